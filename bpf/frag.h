@@ -0,0 +1,64 @@
+#ifndef __FRAG_H
+#define __FRAG_H
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+
+#ifndef IP_MF
+#define IP_MF 0x2000
+#endif
+#ifndef IP_OFFSET
+#define IP_OFFSET 0x1fff
+#endif
+
+// frag_later returns 1 when the packet is a fragment following the first one of its datagram, it
+// holds no l4 header
+static __always_inline int frag_later(struct iphdr *ip) {
+  return (ip->frag_off & __constant_htons(IP_OFFSET)) != 0;
+}
+
+// frag_ports reads the ports of the tcp or udp packet whose l4 header is at l4_off. The first
+// fragment of a datagram records its ports, the following fragments take them from it. It returns
+// -1 when the ports are unknown.
+static __always_inline int frag_ports(struct __sk_buff *skb, struct iphdr *ip, __u32 l4_off,
+                                      __u16 *src_port, __u16 *dst_port) {
+  struct ipFragKey fragKey = {};
+  fragKey.srcIp = htonl(ip->saddr);
+  fragKey.dstIp = htonl(ip->daddr);
+  fragKey.id = ntohs(ip->id);
+  fragKey.protocol = ip->protocol;
+  if (frag_later(ip)) {
+    struct ipFragInfo *frag = bpf_map_lookup_elem(&ip_frags, &fragKey);
+    if (!frag) {
+      return -1;
+    }
+    *src_port = frag->srcPort;
+    *dst_port = frag->dstPort;
+    return 0;
+  }
+
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  __be16 *ports = data + l4_off;
+  if ((void *)(ports + 2) > data_end) {
+    return -1;
+  }
+  *src_port = ntohs(ports[0]);
+  *dst_port = ntohs(ports[1]);
+  if (ip->frag_off & __constant_htons(IP_MF)) {
+    struct ipFragInfo frag = {};
+    frag.srcPort = *src_port;
+    frag.dstPort = *dst_port;
+    bpf_map_update_elem(&ip_frags, &fragKey, &frag, BPF_ANY);
+  }
+  return 0;
+}
+
+#endif
@@ -0,0 +1,39 @@
+#ifndef __GENEVE_H
+#define __GENEVE_H
+
+#include <linux/bpf.h>
+#include <bpf/bpf_helpers.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+
+// The class of the geneve options of fast, in the range of the classes for experimental use
+#define GENEVE_OPT_CLASS 0xff01
+// The option carrying the identity of the source pod
+#define GENEVE_OPT_TYPE_IDENTITY 1
+
+// geneveIdentityOpt is the geneve option carrying the identity of the source pod, the length is
+// the size of the data in 4 bytes
+struct geneveIdentityOpt {
+  __be16 optClass;
+  __u8 type;
+  __u8 length;
+  __be32 identity;
+};
+
+// geneve_identity returns the identity of the source pod of the packet the source node sent in
+// the geneve option, or 0 when the packet has no such option
+static __always_inline __u32 geneve_identity(struct __sk_buff *skb) {
+  struct geneveIdentityOpt opt = {};
+  int ret = bpf_skb_get_tunnel_opt(skb, &opt, sizeof(opt));
+  if (ret != sizeof(opt)) {
+    return 0;
+  }
+  if (opt.optClass != htons(GENEVE_OPT_CLASS) || opt.type != GENEVE_OPT_TYPE_IDENTITY) {
+    return 0;
+  }
+  return ntohl(opt.identity);
+}
+
+#endif
@@ -0,0 +1,60 @@
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "routing.h"
+#include "geneve.h"
+
+// Attached to the egress of the geneve device, the packets redirected to the pods of the other
+// nodes are sent to the node of the pod with the identity of the source pod in a geneve option.
+__section("classifier")
+int cls_main(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    return TC_ACT_UNSPEC;
+  }
+
+  struct ethhdr *eth = data;
+  struct iphdr *ip = (data + sizeof(struct ethhdr));
+  if (eth->h_proto != __constant_htons(ETH_P_IP)) {
+    return TC_ACT_UNSPEC;
+  }
+
+  struct clusterIpsMapKey podNodeKey = {};
+  podNodeKey.ip = htonl(ip->daddr);
+  struct clusterIpsMapInfo *podNode = bpf_map_lookup_elem(&cluster_pod_ips, &podNodeKey);
+  if (!podNode) {
+    return TC_ACT_OK;
+  }
+  struct podIdentityKey idKey = {};
+  idKey.ip = htonl(ip->saddr);
+  struct podIdentityInfo *identity = bpf_map_lookup_elem(&pod_identities, &idKey);
+
+  struct bpf_tunnel_key key = {};
+  key.remote_ipv4 = podNode->ip;
+  key.tunnel_id = route_tunnel_id(htonl(ip->saddr), podNode);
+  key.tunnel_ttl = 64;
+  if (bpf_skb_set_tunnel_key(skb, &key, sizeof(key), BPF_F_ZERO_CSUM_TX) < 0) {
+    return TC_ACT_SHOT;
+  }
+  // the option is sent without identity too so that the size of the packets does not change
+  struct geneveIdentityOpt opt = {};
+  opt.optClass = htons(GENEVE_OPT_CLASS);
+  opt.type = GENEVE_OPT_TYPE_IDENTITY;
+  opt.length = sizeof(opt.identity) / 4;
+  if (identity) {
+    opt.identity = htonl(identity->identity);
+  }
+  if (bpf_skb_set_tunnel_opt(skb, &opt, sizeof(opt)) < 0) {
+    return TC_ACT_SHOT;
+  }
+  return TC_ACT_OK;
+}
+
+char _license[] SEC("license") = "GPL";
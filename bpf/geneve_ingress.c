@@ -0,0 +1,44 @@
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "policy.h"
+#include "routing.h"
+#include "geneve.h"
+
+// Attached to the ingress of the geneve device, the packets of the pods of the other nodes are
+// redirected to the local pods. The ingress policies of the pod are enforced with the identity
+// the source node sent in the geneve option, the identity of the source pod is not looked up.
+// The tunnel id is the tenant of the packet, 0 is the default tenant.
+__section("classifier")
+int cls_main(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    return TC_ACT_UNSPEC;
+  }
+
+  struct serviceCtKey conn = {};
+  if (policy_conn(skb, &conn) < 0) {
+    return TC_ACT_UNSPEC;
+  }
+  if (!policy_allow_from(&conn, geneve_identity(skb))) {
+    return TC_ACT_SHOT;
+  }
+  struct bpf_tunnel_key key = {};
+  if (bpf_skb_get_tunnel_key(skb, &key, sizeof(key), 0) < 0) {
+    return TC_ACT_SHOT;
+  }
+  int ret = route_local(skb, conn.ip, route_tenant(key.tunnel_id));
+  if (ret >= 0) {
+    return ret;
+  }
+  return TC_ACT_OK;
+}
+
+char _license[] SEC("license") = "GPL";
@@ -0,0 +1,125 @@
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "lb.h"
+#include "masq.h"
+#include "routing.h"
+
+// Attached to the ingress of the underlay interface, the node ports and the external ips of the
+// services are translated to their backends and the replies of the remote backends and of the
+// masqueraded connections back to the clients. The host ports of the local pods are translated
+// to the pod address and port and redirected to the pod. The packets routed natively to the local
+// pods by the other nodes are redirected to the pods.
+__section("classifier")
+int cls_main(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    return TC_ACT_UNSPEC;
+  }
+
+  struct ethhdr  *eth  = data;
+  struct iphdr   *ip   = (data + sizeof(struct ethhdr));
+  if (eth->h_proto != __constant_htons(ETH_P_IP)) {
+    return TC_ACT_UNSPEC;
+  }
+
+  // the packets routed natively to the pods of the node are redirected to them in both routing
+  // modes so that the nodes of a cluster may use different modes, the tenant of the packet is
+  // the tenant of the source pod
+  __u8 l4_protocol = ip->protocol;
+  int ret = route_local(skb, htonl(ip->daddr), route_remote_tenant(htonl(ip->saddr)));
+  if (ret >= 0) {
+    return ret;
+  }
+  if (l4_protocol != IPPROTO_TCP && l4_protocol != IPPROTO_UDP) {
+    return TC_ACT_UNSPEC;
+  }
+
+  ret = lb_rev_node_port(skb);
+  if (ret >= 0) {
+    return ret;
+  }
+  ret = masq_rev(skb);
+  if (ret >= 0) {
+    return ret;
+  }
+  ret = lb_node_port(skb);
+  if (ret >= 0) {
+    return ret;
+  }
+
+  // reload the packet pointers, they are invalidated by the helpers writing the packet
+  data = (void *)(long)skb->data;
+  data_end = (void *)(long)skb->data_end;
+  if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    return TC_ACT_UNSPEC;
+  }
+  ip = data + sizeof(struct ethhdr);
+
+  // the ports are the first fields of both the tcp and the udp header
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __be16 *ports = data + l4_off;
+  if ((void *)(ports + 2) > data_end) {
+    return TC_ACT_UNSPEC;
+  }
+
+  __u8 protocol = ip->protocol;
+  __be32 old_ip = ip->daddr;
+  __be16 old_port = ports[1];
+
+  struct hostPortsMapKey hostKey = {};
+  hostKey.ip = htonl(old_ip);
+  hostKey.port = ntohs(old_port);
+  hostKey.protocol = protocol;
+  struct hostPortsMapInfo *hostPort = bpf_map_lookup_elem(&host_ports, &hostKey);
+  if (!hostPort) {
+    hostKey.ip = 0;
+    hostPort = bpf_map_lookup_elem(&host_ports, &hostKey);
+  }
+  if (!hostPort) {
+    return TC_ACT_UNSPEC;
+  }
+
+  struct localIpsMapKey epKey = {};
+  epKey.ip = hostPort->ip;
+  struct localIpsMapInfo *ep = bpf_map_lookup_elem(&local_pod_ips, &epKey);
+  if (!ep) {
+    return TC_ACT_UNSPEC;
+  }
+
+  // remember the host address and port for the replies of the pod
+  struct hostPortsCtKey ctKey = {};
+  ctKey.clientIp = htonl(ip->saddr);
+  ctKey.podIp = hostPort->ip;
+  ctKey.clientPort = ntohs(ports[0]);
+  ctKey.podPort = hostPort->port;
+  ctKey.protocol = protocol;
+  struct hostPortsMapInfo ctValue = {};
+  ctValue.ip = htonl(old_ip);
+  ctValue.port = ntohs(old_port);
+  bpf_map_update_elem(&host_ports_ct, &ctKey, &ctValue, BPF_ANY);
+
+  lb_nat(skb, protocol, l4_off,
+         IP_DST_OFF, old_ip, htonl(hostPort->ip),
+         l4_off + offsetof(struct tcphdr, dest), old_port, htons(hostPort->port));
+
+  __u8 src_mac[ETH_ALEN];
+  __u8 dst_mac[ETH_ALEN];
+  bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
+  bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), dst_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), src_mac, ETH_ALEN, 0);
+
+  return bpf_redirect(ep->lxcIfIndex, 0);
+}
+
+char _license[] SEC("license") = "GPL";
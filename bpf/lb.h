@@ -0,0 +1,513 @@
+#ifndef __LB_H
+#define __LB_H
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "routing.h"
+#include "frag.h"
+
+#ifndef IP_CSUM_OFF
+#define IP_CSUM_OFF (ETH_HLEN + offsetof(struct iphdr, check))
+#endif
+#ifndef IP_SRC_OFF
+#define IP_SRC_OFF (ETH_HLEN + offsetof(struct iphdr, saddr))
+#endif
+#ifndef IP_DST_OFF
+#define IP_DST_OFF (ETH_HLEN + offsetof(struct iphdr, daddr))
+#endif
+
+// lb_nat rewrites the address at ip_off and the port at port_off of a tcp or udp packet and
+// updates the checksums
+static __always_inline void lb_nat(struct __sk_buff *skb, __u8 protocol, __u32 l4_off,
+                                   __u32 ip_off, __be32 old_ip, __be32 new_ip,
+                                   __u32 port_off, __be16 old_port, __be16 new_port) {
+  __u32 l4_csum_off = l4_off + offsetof(struct tcphdr, check);
+  __u64 l4_flags = 0;
+  if (protocol == IPPROTO_UDP) {
+    l4_csum_off = l4_off + offsetof(struct udphdr, check);
+    // a udp checksum 0 means no checksum
+    l4_flags = BPF_F_MARK_MANGLED_0;
+  }
+  bpf_l4_csum_replace(skb, l4_csum_off, old_ip, new_ip, l4_flags | BPF_F_PSEUDO_HDR | sizeof(new_ip));
+  bpf_l4_csum_replace(skb, l4_csum_off, old_port, new_port, l4_flags | sizeof(new_port));
+  bpf_l3_csum_replace(skb, IP_CSUM_OFF, old_ip, new_ip, sizeof(new_ip));
+  bpf_skb_store_bytes(skb, ip_off, &new_ip, sizeof(new_ip), 0);
+  bpf_skb_store_bytes(skb, port_off, &new_port, sizeof(new_port), 0);
+}
+
+// lb_nat_ip rewrites the address at ip_off of a fragment following the first one of its datagram
+// and updates the ip checksum, the l4 checksum of the datagram is updated on its first fragment
+static __always_inline void lb_nat_ip(struct __sk_buff *skb, __u32 ip_off, __be32 old_ip, __be32 new_ip) {
+  bpf_l3_csum_replace(skb, IP_CSUM_OFF, old_ip, new_ip, sizeof(new_ip));
+  bpf_skb_store_bytes(skb, ip_off, &new_ip, sizeof(new_ip), 0);
+}
+
+// lb_pick_backend picks one of the backends of the frontend at random
+static __always_inline int lb_pick_backend(struct serviceKey *frontend, struct serviceInfo *svc,
+                                           struct serviceBackendInfo *backend) {
+  if (svc->count == 0) {
+    return -1;
+  }
+  struct serviceBackendKey backendKey = {};
+  backendKey.ip = frontend->ip;
+  backendKey.port = frontend->port;
+  backendKey.protocol = frontend->protocol;
+  backendKey.slot = bpf_get_prandom_u32() % svc->count + 1;
+  struct serviceBackendInfo *b = bpf_map_lookup_elem(&service_backends, &backendKey);
+  if (!b) {
+    return -1;
+  }
+  *backend = *b;
+  return 0;
+}
+
+// lb_tcp_closing returns 1 when the packet is a tcp FIN or RST, the header is at l4_off
+static __always_inline int lb_tcp_closing(struct __sk_buff *skb, __u8 protocol, __u32 l4_off) {
+  if (protocol != IPPROTO_TCP) {
+    return 0;
+  }
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct tcphdr *tcp = data + l4_off;
+  if ((void *)(tcp + 1) > data_end) {
+    return 0;
+  }
+  return tcp->fin || tcp->rst;
+}
+
+// lb_rev_ct_seen records a packet of the connection of revKey to a service, the address and port
+// the client connected to are remembered for the replies of the backend
+static __always_inline void lb_rev_ct_seen(struct serviceCtKey *revKey, __u32 svc_ip, __u16 svc_port,
+                                           int closing) {
+  struct serviceRevCtInfo *rev = bpf_map_lookup_elem(&service_rev_ct, revKey);
+  if (rev) {
+    rev->lastSeen = bpf_ktime_get_ns();
+    if (closing) {
+      rev->closing = 1;
+    }
+    return;
+  }
+  struct serviceRevCtInfo info = {};
+  info.ip = svc_ip;
+  info.port = svc_port;
+  info.closing = closing;
+  info.lastSeen = bpf_ktime_get_ns();
+  bpf_map_update_elem(&service_rev_ct, revKey, &info, BPF_ANY);
+}
+
+// lb_node_addr returns 1 when the address is one of the addresses of the node
+static __always_inline int lb_node_addr(__u32 ip) {
+  struct nodeAddrKey addrKey = {};
+  addrKey.ip = ip;
+  return bpf_map_lookup_elem(&node_addrs, &addrKey) != NULL;
+}
+
+// lb_lookup_service returns the frontend of the service at ip and port, the node ports are served
+// on every address of the node. svcKey is set to the key of the frontend found.
+static __always_inline struct serviceInfo *lb_lookup_service(struct serviceKey *svcKey, __u32 ip,
+                                                             __u16 port, __u8 protocol) {
+  svcKey->ip = ip;
+  svcKey->port = port;
+  svcKey->protocol = protocol;
+  struct serviceInfo *svc = bpf_map_lookup_elem(&services, svcKey);
+  if (svc || !lb_node_addr(ip)) {
+    return svc;
+  }
+  svcKey->ip = 0;
+  return bpf_map_lookup_elem(&services, svcKey);
+}
+
+// lb_frontend returns 1 when the connection is to a frontend of a service
+static __always_inline int lb_frontend(struct serviceCtKey *conn) {
+  struct serviceKey svcKey = {};
+  return lb_lookup_service(&svcKey, conn->ip, conn->port, conn->protocol) != NULL;
+}
+
+// lb_service translates a connection to a service to one of the backends of the service, the
+// backend is picked at random for a new connection and kept for the following packets. The
+// fragments following the first one of a datagram are sent to the backend of their first
+// fragment. It returns the address of the backend, or 0 when the packet is not sent to a service.
+static __always_inline __u32 lb_service(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return 0;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return 0;
+  }
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __u16 src_port, dst_port;
+  if (frag_ports(skb, ip, l4_off, &src_port, &dst_port) < 0) {
+    return 0;
+  }
+
+  int later = frag_later(ip);
+  __u8 protocol = ip->protocol;
+  __be32 old_ip = ip->daddr;
+  __be16 old_port = htons(dst_port);
+  int closing = later ? 0 : lb_tcp_closing(skb, protocol, l4_off);
+
+  struct serviceCtKey ctKey = {};
+  ctKey.clientIp = htonl(ip->saddr);
+  ctKey.ip = htonl(old_ip);
+  ctKey.clientPort = src_port;
+  ctKey.port = dst_port;
+  ctKey.protocol = protocol;
+
+  struct serviceBackendInfo backend = {};
+  struct serviceBackendInfo *ct = bpf_map_lookup_elem(&service_ct, &ctKey);
+  if (ct) {
+    backend = *ct;
+  } else if (later) {
+    return 0;
+  } else {
+    struct serviceKey svcKey = {};
+    struct serviceInfo *svc = lb_lookup_service(&svcKey, ctKey.ip, ctKey.port, protocol);
+    if (!svc || lb_pick_backend(&svcKey, svc, &backend) < 0) {
+      return 0;
+    }
+    bpf_map_update_elem(&service_ct, &ctKey, &backend, BPF_ANY);
+  }
+
+  // remember the service for the replies of the backend
+  struct serviceCtKey revKey = {};
+  revKey.clientIp = ctKey.clientIp;
+  revKey.ip = backend.ip;
+  revKey.clientPort = ctKey.clientPort;
+  revKey.port = backend.port;
+  revKey.protocol = protocol;
+  lb_rev_ct_seen(&revKey, ctKey.ip, ctKey.port, closing);
+
+  if (later) {
+    lb_nat_ip(skb, IP_DST_OFF, old_ip, htonl(backend.ip));
+    return backend.ip;
+  }
+  lb_nat(skb, protocol, l4_off,
+         IP_DST_OFF, old_ip, htonl(backend.ip),
+         l4_off + offsetof(struct tcphdr, dest), old_port, htons(backend.port));
+  return backend.ip;
+}
+
+// lb_rev_service translates the reply of a backend back to the service the client connected to,
+// it returns 1 when the reply is translated
+static __always_inline int lb_rev_service(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return 0;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return 0;
+  }
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __u16 src_port, dst_port;
+  if (frag_ports(skb, ip, l4_off, &src_port, &dst_port) < 0) {
+    return 0;
+  }
+
+  int later = frag_later(ip);
+  struct serviceCtKey revKey = {};
+  revKey.clientIp = htonl(ip->daddr);
+  revKey.ip = htonl(ip->saddr);
+  revKey.clientPort = dst_port;
+  revKey.port = src_port;
+  revKey.protocol = ip->protocol;
+  struct serviceRevCtInfo *svc = bpf_map_lookup_elem(&service_rev_ct, &revKey);
+  if (!svc) {
+    return 0;
+  }
+  svc->lastSeen = bpf_ktime_get_ns();
+  if (!later && lb_tcp_closing(skb, revKey.protocol, l4_off)) {
+    svc->closing = 1;
+  }
+  __be32 old_ip = ip->saddr;
+  __be16 old_port = htons(src_port);
+  if (later) {
+    lb_nat_ip(skb, IP_SRC_OFF, old_ip, htonl(svc->ip));
+    return 1;
+  }
+  lb_nat(skb, revKey.protocol, l4_off,
+         IP_SRC_OFF, old_ip, htonl(svc->ip),
+         l4_off + offsetof(struct tcphdr, source), old_port, htons(svc->port));
+  return 1;
+}
+
+// The ports the clients of the connections to the remote backends are translated to, the range
+// above the ephemeral ports of linux the agent reserves so that no socket of the node is bound
+// to them. It must be kept in sync with SNATPortMin and SNATPortMax of pkg/bpf/loader.
+#define SNAT_PORT_MIN 61000
+#define SNAT_PORT_RANGE 4536
+#define SNAT_PORT_TRIES 8
+
+// lb_redirect_fib sends the packet out of the interface of the route to its destination, the
+// kernel resolves the neighbour of the route when it is unknown. It returns -1 when there is no
+// route to the destination.
+static __always_inline int lb_redirect_fib(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return -1;
+  }
+
+  struct bpf_fib_lookup fib = {};
+  fib.family = AF_INET;
+  fib.l4_protocol = ip->protocol;
+  fib.tot_len = ntohs(ip->tot_len);
+  fib.ipv4_src = ip->saddr;
+  fib.ipv4_dst = ip->daddr;
+  fib.ifindex = skb->ifindex;
+  int ret = bpf_fib_lookup(skb, &fib, sizeof(fib), 0);
+  if (ret == BPF_FIB_LKUP_RET_NO_NEIGH) {
+    struct bpf_redir_neigh nh = {};
+    nh.nh_family = fib.family;
+    nh.ipv4_nh = fib.ipv4_dst;
+    return bpf_redirect_neigh(fib.ifindex, &nh, sizeof(nh), 0);
+  }
+  if (ret != BPF_FIB_LKUP_RET_SUCCESS) {
+    return -1;
+  }
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), fib.dmac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), fib.smac, ETH_ALEN, 0);
+  return bpf_redirect(fib.ifindex, 0);
+}
+
+// lb_redirect_remote sends the packet to a backend on another node, the pods of the other nodes
+// are reached through the vxlan device or routed to their node
+static __always_inline int lb_redirect_remote(struct __sk_buff *skb, __u32 backend_ip) {
+  struct clusterIpsMapKey podNodeKey = {};
+  podNodeKey.ip = backend_ip;
+  struct clusterIpsMapInfo *podNode = bpf_map_lookup_elem(&cluster_pod_ips, &podNodeKey);
+  if (podNode) {
+    int ret = route_remote(skb, podNode->ip);
+    return ret < 0 ? TC_ACT_SHOT : ret;
+  }
+  int ret = lb_redirect_fib(skb);
+  return ret < 0 ? TC_ACT_SHOT : ret;
+}
+
+// lb_snat_port reserves the port of the node a connection to a remote backend is translated to,
+// a port of the reserved range no translated connection of the node to the backend holds
+static __always_inline int lb_snat_port(struct serviceCtKey *revKey, struct serviceCtKey *conn) {
+#pragma unroll
+  for (int i = 0; i < SNAT_PORT_TRIES; i++) {
+    revKey->clientPort = SNAT_PORT_MIN + bpf_get_prandom_u32() % SNAT_PORT_RANGE;
+    // the masqueraded connections of the pods share the range
+    if (bpf_map_lookup_elem(&masq_ports, revKey)) {
+      continue;
+    }
+    if (bpf_map_update_elem(&nodeport_rev_ct, revKey, conn, BPF_NOEXIST) == 0) {
+      return 0;
+    }
+  }
+  return -1;
+}
+
+// lb_node_port_seen records a packet of the connection to a remote backend, closing is 1 for a tcp
+// FIN or RST
+static __always_inline void lb_node_port_seen(struct nodePortCtInfo *remote, int closing) {
+  remote->lastSeen = bpf_ktime_get_ns();
+  if (closing) {
+    remote->closing = 1;
+  }
+}
+
+// lb_node_port translates a connection coming from outside the node to a node port or an
+// external ip to one of the backends of the service. A local backend gets the connection from
+// the client, the client of a connection to a remote backend is translated to the node so that
+// the replies come back through the node. It returns the verdict for the packet, or -1 when the
+// packet is not sent to a service.
+static __always_inline int lb_node_port(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return -1;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return -1;
+  }
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __be16 *ports = data + l4_off;
+  if ((void *)(ports + 2) > data_end) {
+    return -1;
+  }
+
+  __u8 protocol = ip->protocol;
+  __be32 old_saddr = ip->saddr;
+  __be32 old_daddr = ip->daddr;
+  __be16 old_sport = ports[0];
+  __be16 old_dport = ports[1];
+  int closing = lb_tcp_closing(skb, protocol, l4_off);
+
+  __u32 zero = 0;
+  struct nodeInfo *node = bpf_map_lookup_elem(&node_info, &zero);
+  if (!node || node->ip == 0) {
+    return -1;
+  }
+  __u32 node_ip = node->ip;
+
+  // the external ips are looked up first, the node ports are served on every address of the node
+  struct serviceKey svcKey = {};
+  struct serviceInfo *svc = lb_lookup_service(&svcKey, htonl(old_daddr), ntohs(old_dport), protocol);
+  if (!svc) {
+    return -1;
+  }
+
+  struct serviceCtKey ctKey = {};
+  ctKey.clientIp = htonl(old_saddr);
+  ctKey.ip = svcKey.ip;
+  ctKey.clientPort = ntohs(old_sport);
+  ctKey.port = svcKey.port;
+  ctKey.protocol = protocol;
+
+  struct nodePortCtInfo remote = {};
+  struct nodePortCtInfo *rct = bpf_map_lookup_elem(&nodeport_ct, &ctKey);
+  struct serviceBackendInfo backend = {};
+  struct serviceBackendInfo *ct = NULL;
+  if (rct) {
+    lb_node_port_seen(rct, closing);
+    remote = *rct;
+  } else if ((ct = bpf_map_lookup_elem(&service_ct, &ctKey))) {
+    backend = *ct;
+  } else {
+    // a service without backend refuses the connections
+    if (lb_pick_backend(&svcKey, svc, &backend) < 0) {
+      return TC_ACT_SHOT;
+    }
+    // the backends on the host network of the node are left to the stack
+    if (lb_node_addr(backend.ip)) {
+      return -1;
+    }
+    struct localIpsMapKey epKey = {};
+    epKey.ip = backend.ip;
+    if (bpf_map_lookup_elem(&local_pod_ips, &epKey)) {
+      bpf_map_update_elem(&service_ct, &ctKey, &backend, BPF_ANY);
+    } else {
+      struct serviceCtKey revKey = {};
+      revKey.clientIp = node_ip;
+      revKey.ip = backend.ip;
+      revKey.clientPort = ctKey.clientPort;
+      revKey.port = backend.port;
+      revKey.protocol = protocol;
+      struct serviceCtKey conn = ctKey;
+      conn.ip = htonl(old_daddr);
+      if (lb_snat_port(&revKey, &conn) < 0) {
+        return TC_ACT_SHOT;
+      }
+      remote.ip = backend.ip;
+      remote.port = backend.port;
+      remote.snatPort = revKey.clientPort;
+      remote.closing = closing;
+      remote.lastSeen = bpf_ktime_get_ns();
+      bpf_map_update_elem(&nodeport_ct, &ctKey, &remote, BPF_ANY);
+      rct = &remote;
+    }
+  }
+
+  if (rct) {
+    lb_nat(skb, protocol, l4_off,
+           IP_SRC_OFF, old_saddr, htonl(node_ip),
+           l4_off + offsetof(struct tcphdr, source), old_sport, htons(remote.snatPort));
+    lb_nat(skb, protocol, l4_off,
+           IP_DST_OFF, old_daddr, htonl(remote.ip),
+           l4_off + offsetof(struct tcphdr, dest), old_dport, htons(remote.port));
+    return lb_redirect_remote(skb, remote.ip);
+  }
+
+  // remember the address and port the client connected to for the replies of the backend
+  struct serviceCtKey revKey = {};
+  revKey.clientIp = ctKey.clientIp;
+  revKey.ip = backend.ip;
+  revKey.clientPort = ctKey.clientPort;
+  revKey.port = backend.port;
+  revKey.protocol = protocol;
+  lb_rev_ct_seen(&revKey, htonl(old_daddr), ctKey.port, closing);
+
+  struct localIpsMapKey epKey = {};
+  epKey.ip = backend.ip;
+  struct localIpsMapInfo *ep = bpf_map_lookup_elem(&local_pod_ips, &epKey);
+  if (!ep) {
+    return TC_ACT_SHOT;
+  }
+  __u8 src_mac[ETH_ALEN];
+  __u8 dst_mac[ETH_ALEN];
+  bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
+  bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
+  __u32 lxc_ifindex = ep->lxcIfIndex;
+
+  lb_nat(skb, protocol, l4_off,
+         IP_DST_OFF, old_daddr, htonl(backend.ip),
+         l4_off + offsetof(struct tcphdr, dest), old_dport, htons(backend.port));
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), dst_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), src_mac, ETH_ALEN, 0);
+  return bpf_redirect(lxc_ifindex, 0);
+}
+
+// lb_rev_node_port translates the reply of a remote backend back to the client and the address
+// and port the client connected to, and sends it out of the node
+static __always_inline int lb_rev_node_port(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return -1;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return -1;
+  }
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __be16 *ports = data + l4_off;
+  if ((void *)(ports + 2) > data_end) {
+    return -1;
+  }
+
+  struct serviceCtKey revKey = {};
+  revKey.clientIp = htonl(ip->daddr);
+  revKey.ip = htonl(ip->saddr);
+  revKey.clientPort = ntohs(ports[1]);
+  revKey.port = ntohs(ports[0]);
+  revKey.protocol = ip->protocol;
+  struct serviceCtKey *conn = bpf_map_lookup_elem(&nodeport_rev_ct, &revKey);
+  if (!conn) {
+    return -1;
+  }
+  // the connections to the node ports are keyed by the ip 0
+  struct serviceCtKey ctKey = *conn;
+  struct nodePortCtInfo *remote = bpf_map_lookup_elem(&nodeport_ct, &ctKey);
+  if (!remote) {
+    ctKey.ip = 0;
+    remote = bpf_map_lookup_elem(&nodeport_ct, &ctKey);
+  }
+  if (remote) {
+    lb_node_port_seen(remote, lb_tcp_closing(skb, revKey.protocol, l4_off));
+  }
+
+  __u8 protocol = revKey.protocol;
+  __be32 old_saddr = ip->saddr;
+  __be32 old_daddr = ip->daddr;
+  __be16 old_sport = ports[0];
+  __be16 old_dport = ports[1];
+  lb_nat(skb, protocol, l4_off,
+         IP_SRC_OFF, old_saddr, htonl(conn->ip),
+         l4_off + offsetof(struct tcphdr, source), old_sport, htons(conn->port));
+  lb_nat(skb, protocol, l4_off,
+         IP_DST_OFF, old_daddr, htonl(conn->clientIp),
+         l4_off + offsetof(struct tcphdr, dest), old_dport, htons(conn->clientPort));
+  int ret = lb_redirect_fib(skb);
+  return ret < 0 ? TC_ACT_SHOT : ret;
+}
+
+#endif
@@ -1,3 +1,6 @@
+#ifndef __MAPS_H
+#define __MAPS_H
+
 #include <linux/bpf.h>
 #include <linux/pkt_cls.h>
 #include <bpf/bpf_helpers.h>
@@ -6,9 +9,15 @@
 
 #define LOCAL_DEV_VXLAN 1;
 #define LOCAL_DEV_VETH 2;
+#define LOCAL_DEV_GENEVE 3
+#define LOCAL_DEV_WIREGUARD 4
 
+// the tunnel id of the pods of the default tenant, the ips may not take it as their vni
 #define DEFAULT_TUNNEL_ID 13190
 
+// The max_entries of the maps are the defaults, the agent resizes the maps to its configuration
+// when it loads them
+
 struct localIpsMapKey {
   __u32 ip;
 };
@@ -18,12 +27,14 @@ struct localIpsMapInfo {
   __u32 lxcIfIndex;
   __u8 mac[8];
   __u8 nodeMac[8];
+  // the tenant of the pod, 0 is the default tenant
+  __u32 vni;
 };
 
 // The container IP address of the local node is stored
 struct {
   __uint(type, BPF_MAP_TYPE_HASH);
-  __uint(max_entries, 255);
+  __uint(max_entries, 16384);
   __type(key, struct localIpsMapKey);
   __type(value, struct localIpsMapInfo);
   __uint(pinning, LIBBPF_PIN_BY_NAME);
@@ -36,12 +47,14 @@ struct clusterIpsMapKey {
 
 struct clusterIpsMapInfo {
   __u32 ip;
+  // the tenant of the pod, 0 is the default tenant
+  __u32 vni;
 };
 
 // The container IP addresses of other nodes are stored
 struct {
   __uint(type, BPF_MAP_TYPE_HASH);
-  __uint(max_entries, 255);
+  __uint(max_entries, 65536);
   __type(key, struct clusterIpsMapKey);
   __type(value, struct clusterIpsMapInfo);
   __uint(pinning, LIBBPF_PIN_BY_NAME);
@@ -64,3 +77,421 @@ struct {
   __uint(pinning, LIBBPF_PIN_BY_NAME);
 } local_dev __section_maps_btf;
 
+
+struct hostPortsMapKey {
+  __u32 ip;
+  __u16 port;
+  __u8 protocol;
+  __u8 pad;
+};
+
+struct hostPortsMapInfo {
+  __u32 ip;
+  __u16 port;
+  __u16 pad;
+};
+
+// Stores the host ports of the local pods, an ip 0 matches every address of the node
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 16384);
+  __type(key, struct hostPortsMapKey);
+  __type(value, struct hostPortsMapInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} host_ports __section_maps_btf;
+
+struct hostPortsCtKey {
+  __u32 clientIp;
+  __u32 podIp;
+  __u16 clientPort;
+  __u16 podPort;
+  __u8 protocol;
+  __u8 pad[3];
+};
+
+// Stores the host address and port a connection to a host port was sent to, the replies of the pod are translated back with it
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct hostPortsCtKey);
+  __type(value, struct hostPortsMapInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} host_ports_ct __section_maps_btf;
+
+struct nodeAddrKey {
+  __u32 ip;
+};
+
+struct nodeAddrInfo {
+  __u32 pad;
+};
+
+// Stores the addresses of the node, the host ports without host ip are served on each of them
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 256);
+  __type(key, struct nodeAddrKey);
+  __type(value, struct nodeAddrInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} node_addrs __section_maps_btf;
+
+struct sockRevNatKey {
+  __u64 cookie;
+  __u32 ip;
+  __u16 port;
+  __u16 pad;
+};
+
+struct sockRevNatInfo {
+  __u32 ip;
+  __u16 port;
+  __u16 pad;
+};
+
+// Stores the address and port a udp socket of the node sent to before the socket programs
+// translated it, by the socket and the translated address and port. The replies the socket
+// receives are translated back with it.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct sockRevNatKey);
+  __type(value, struct sockRevNatInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} sock_rev_nat __section_maps_btf;
+
+struct serviceKey {
+  __u32 ip;
+  __u16 port;
+  __u8 protocol;
+  __u8 pad;
+};
+
+struct serviceInfo {
+  __u32 count;
+};
+
+// Stores the frontends of the services and the number of their backends, the frontends are the cluster
+// ips, the external ips and the node ports of the services, an ip 0 is a node port
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 16384);
+  __type(key, struct serviceKey);
+  __type(value, struct serviceInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} services __section_maps_btf;
+
+struct serviceBackendKey {
+  __u32 ip;
+  __u16 port;
+  __u8 protocol;
+  __u8 pad;
+  __u32 slot;
+};
+
+struct serviceBackendInfo {
+  __u32 ip;
+  __u16 port;
+  __u16 pad;
+};
+
+// Stores the backends of the services by slot, the slots of a service go from 1 to its count
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceBackendKey);
+  __type(value, struct serviceBackendInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} service_backends __section_maps_btf;
+
+struct serviceCtKey {
+  __u32 clientIp;
+  __u32 ip;
+  __u16 clientPort;
+  __u16 port;
+  __u8 protocol;
+  __u8 pad[3];
+};
+
+// Stores the backend a connection to a service is sent to, the ip and port of the key are the service
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct serviceBackendInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} service_ct __section_maps_btf;
+
+struct serviceRevCtInfo {
+  __u32 ip;
+  __u16 port;
+  __u8 closing;
+  __u8 pad;
+  __u64 lastSeen;
+};
+
+// Stores the service a connection to a backend was sent to, the ip and port of the key are the backend
+// and the replies of the backend are translated back to the service with it. The packets of both
+// directions set lastSeen, the time since boot in ns, and closing once a tcp FIN or RST is seen, the
+// agent expires the idle connections and their entry in service_ct.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct serviceRevCtInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} service_rev_ct __section_maps_btf;
+
+struct ipFragKey {
+  __u32 srcIp;
+  __u32 dstIp;
+  __u16 id;
+  __u8 protocol;
+  __u8 pad;
+};
+
+struct ipFragInfo {
+  __u16 srcPort;
+  __u16 dstPort;
+};
+
+// Stores the ports of the fragmented datagrams, the first fragment records them for the
+// following fragments which hold no l4 header
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 8192);
+  __type(key, struct ipFragKey);
+  __type(value, struct ipFragInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} ip_frags __section_maps_btf;
+
+#define ROUTING_VXLAN 0
+#define ROUTING_NATIVE 1
+
+#define TUNNEL_VXLAN 0
+#define TUNNEL_GENEVE 1
+
+#define ENCRYPTION_NONE 0
+#define ENCRYPTION_WIREGUARD 1
+
+struct nodeInfo {
+  __u32 ip;
+  __u8 masquerade;
+  __u8 routing;
+  __u8 tunnel;
+  __u8 encryption;
+};
+
+// Stores the address of the node, the node ports are served on it and the connections to the
+// remote backends of the node ports and the external ips are translated to it. The connections
+// of the pods leaving the cluster are translated to it when masquerade is set. The pods of the
+// other nodes are reached through the tunnel device of tunnel or routed to their node as set by
+// routing, or through the wireguard device whatever the routing when encryption is set.
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __uint(max_entries, 1);
+  __type(key, __u32);
+  __type(value, struct nodeInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} node_info __section_maps_btf;
+
+struct nodePortCtInfo {
+  __u32 ip;
+  __u16 port;
+  __u16 snatPort;
+  __u8 closing;
+  __u8 pad[7];
+  __u64 lastSeen;
+};
+
+// Stores the remote backend a connection to a node port or an external ip is sent to and the
+// port of the node the client is translated to, the ip of the key is 0 for a node port. The
+// packets of both directions set lastSeen and closing like in service_rev_ct, the agent expires
+// the idle connections and their entry in nodeport_rev_ct.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct nodePortCtInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} nodeport_ct __section_maps_btf;
+
+// Stores the connection a translated connection to a remote backend belongs to, the key is the
+// node address and port to the backend and the value is the client and the address and port it
+// connected to
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct serviceCtKey);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} nodeport_rev_ct __section_maps_btf;
+
+struct nonMasqCidrKey {
+  __u32 prefixlen;
+  __be32 ip;
+};
+
+struct nonMasqCidrInfo {
+  __u32 pad;
+};
+
+// Stores the destinations the connections of the pods are not masqueraded to, the cidrs of the
+// configuration and the addresses of the nodes
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 4096);
+  __type(key, struct nonMasqCidrKey);
+  __type(value, struct nonMasqCidrInfo);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} non_masq_cidrs __section_maps_btf;
+
+struct masqCtInfo {
+  __u16 snatPort;
+  __u8 closing;
+  __u8 pad[5];
+  __u64 lastSeen;
+};
+
+// Stores the port of the node a connection of a pod leaving the cluster is translated to, the
+// key is the pod address and port to the destination. The packets of both directions set lastSeen
+// and closing like in service_rev_ct, the agent expires the idle connections and their port in
+// masq_ports.
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct masqCtInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} masq_ct __section_maps_btf;
+
+// Stores the ports of the node allocated to the masqueraded connections, the key is the node
+// address and port to the destination and the value is the connection of the pod, the replies
+// are translated back to the pod with it
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct serviceCtKey);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} masq_ports __section_maps_btf;
+
+#define POLICY_INGRESS 1
+#define POLICY_EGRESS 2
+
+struct podIdentityKey {
+  __u32 ip;
+};
+
+struct podIdentityInfo {
+  __u32 identity;
+};
+
+// Stores the identities of the pods of the cluster, the pods of a namespace with the same labels
+// share an identity
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 81920);
+  __type(key, struct podIdentityKey);
+  __type(value, struct podIdentityInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} pod_identities __section_maps_btf;
+
+struct policyEndpointKey {
+  __u32 ip;
+};
+
+struct policyEndpointInfo {
+  __u32 ingressPolicy;
+  __u32 egressPolicy;
+};
+
+// Stores the local pods selected by the network policies, a pod is isolated in a direction when
+// the policy of the direction is set and the connections no rule allows are denied for it
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 16384);
+  __type(key, struct policyEndpointKey);
+  __type(value, struct policyEndpointInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_endpoints __section_maps_btf;
+
+struct policyRuleKey {
+  __u32 ip;
+  __u32 identity;
+  __u16 port;
+  __u8 protocol;
+  __u8 direction;
+  __u8 portPrefix;
+  __u8 pad[3];
+};
+
+struct policyRuleInfo {
+  __u32 policy;
+};
+
+// Stores the pod peers the rules of the policies allow, by the local pod, the identity of the
+// peer, the ports and the direction. A rule matches the ports whose first portPrefix bits are
+// those of its port, the port ranges are split into such blocks. A portPrefix 0 is every port of
+// the protocol and a protocol 0 every protocol.
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct policyRuleKey);
+  __type(value, struct policyRuleInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_rules __section_maps_btf;
+
+struct policyCidrKey {
+  __u32 prefixlen;
+  __u32 ip;
+  __u16 port;
+  __u8 protocol;
+  __u8 direction;
+  __u8 portPrefix;
+  __u8 pad[3];
+  __be32 peer;
+};
+
+// Stores the ip blocks the rules of the policies allow, the prefix covers the local pod, the
+// ports, the protocol and the direction and the prefix of the peer. The ports are matched like
+// those of policy_rules.
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __uint(max_entries, 16384);
+  __type(key, struct policyCidrKey);
+  __type(value, struct policyRuleInfo);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_cidrs __section_maps_btf;
+
+// Stores the connections allowed to or from an isolated pod, the packets of both directions of
+// the connection are allowed with it
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __uint(max_entries, 65536);
+  __type(key, struct serviceCtKey);
+  __type(value, struct policyRuleInfo);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_ct __section_maps_btf;
+
+struct policyStatsKey {
+  __u32 policy;
+};
+
+struct policyStats {
+  __u64 allowed;
+  __u64 denied;
+};
+
+// Stores the counters of the policies, the connections a policy allows and the packets denied
+// for the pods it isolates
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, 16384);
+  __type(key, struct policyStatsKey);
+  __type(value, struct policyStats);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);
+} policy_stats __section_maps_btf;
+
+#endif
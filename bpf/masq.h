@@ -0,0 +1,233 @@
+#ifndef __MASQ_H
+#define __MASQ_H
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "lb.h"
+#include "frag.h"
+
+// Only the tcp and udp packets are masqueraded, ICMP is left to the stack. The fragments are left
+// to the stack too, only the first one holds the ports and the fragments of a packet must leave
+// the node with the same address.
+
+// masq_fragment returns 1 when the packet is a fragment
+static __always_inline int masq_fragment(struct iphdr *ip) {
+  return (ip->frag_off & __constant_htons(IP_MF | IP_OFFSET)) != 0;
+}
+
+// masq_excluded returns 1 when the connections to the address are not masqueraded, the pods of
+// the cluster, the nodes and the non masquerade cidrs are reached with the address of the pod
+static __always_inline int masq_excluded(__u32 ip) {
+  struct localIpsMapKey epKey = {};
+  epKey.ip = ip;
+  if (bpf_map_lookup_elem(&local_pod_ips, &epKey)) {
+    return 1;
+  }
+  struct clusterIpsMapKey podNodeKey = {};
+  podNodeKey.ip = ip;
+  if (bpf_map_lookup_elem(&cluster_pod_ips, &podNodeKey)) {
+    return 1;
+  }
+  struct nonMasqCidrKey cidrKey = {};
+  cidrKey.prefixlen = 32;
+  cidrKey.ip = htonl(ip);
+  if (bpf_map_lookup_elem(&non_masq_cidrs, &cidrKey)) {
+    return 1;
+  }
+  return 0;
+}
+
+// masq_routable returns 1 when the packet is forwarded out of the node, the destinations on the
+// node are left to the stack
+static __always_inline int masq_routable(struct __sk_buff *skb, struct iphdr *ip) {
+  struct bpf_fib_lookup fib = {};
+  fib.family = AF_INET;
+  fib.l4_protocol = ip->protocol;
+  fib.tot_len = ntohs(ip->tot_len);
+  fib.ipv4_src = ip->saddr;
+  fib.ipv4_dst = ip->daddr;
+  fib.ifindex = skb->ifindex;
+  int ret = bpf_fib_lookup(skb, &fib, sizeof(fib), 0);
+  return ret == BPF_FIB_LKUP_RET_SUCCESS || ret == BPF_FIB_LKUP_RET_NO_NEIGH;
+}
+
+// masq_ct_seen records a packet of the masqueraded connection, closing is 1 for a tcp FIN or RST
+static __always_inline void masq_ct_seen(struct masqCtInfo *ct, int closing) {
+  ct->lastSeen = bpf_ktime_get_ns();
+  if (closing) {
+    ct->closing = 1;
+  }
+}
+
+// masq_snat_port allocates the port of the node a connection is translated to, a port of the
+// reserved range no translated connection of the node to the destination holds
+static __always_inline int masq_snat_port(struct serviceCtKey *revKey, struct serviceCtKey *conn) {
+#pragma unroll
+  for (int i = 0; i < SNAT_PORT_TRIES; i++) {
+    revKey->clientPort = SNAT_PORT_MIN + bpf_get_prandom_u32() % SNAT_PORT_RANGE;
+    // the connections to the remote backends of the node ports share the range
+    if (bpf_map_lookup_elem(&nodeport_rev_ct, revKey)) {
+      continue;
+    }
+    if (bpf_map_update_elem(&masq_ports, revKey, conn, BPF_NOEXIST) == 0) {
+      return 0;
+    }
+  }
+  return -1;
+}
+
+// masq_snat translates a connection of a local pod leaving the cluster to the address of the
+// node and sends it out of the node, the stack may have no masquerade rule. It returns the
+// verdict for the packet, or -1 when the packet is not masqueraded.
+static __always_inline int masq_snat(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return -1;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return -1;
+  }
+  if (masq_fragment(ip)) {
+    return -1;
+  }
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __be16 *ports = data + l4_off;
+  if ((void *)(ports + 2) > data_end) {
+    return -1;
+  }
+
+  __u32 zero = 0;
+  struct nodeInfo *node = bpf_map_lookup_elem(&node_info, &zero);
+  if (!node || !node->masquerade || node->ip == 0) {
+    return -1;
+  }
+  __u32 node_ip = node->ip;
+
+  struct serviceCtKey conn = {};
+  conn.clientIp = htonl(ip->saddr);
+  conn.ip = htonl(ip->daddr);
+  conn.clientPort = ntohs(ports[0]);
+  conn.port = ntohs(ports[1]);
+  conn.protocol = ip->protocol;
+  if (conn.ip == node_ip || masq_excluded(conn.ip)) {
+    return -1;
+  }
+  // only the pods of the node are masqueraded
+  struct localIpsMapKey epKey = {};
+  epKey.ip = conn.clientIp;
+  if (!bpf_map_lookup_elem(&local_pod_ips, &epKey)) {
+    return -1;
+  }
+  if (!masq_routable(skb, ip)) {
+    return -1;
+  }
+
+  struct serviceCtKey revKey = {};
+  revKey.clientIp = node_ip;
+  revKey.ip = conn.ip;
+  revKey.port = conn.port;
+  revKey.protocol = conn.protocol;
+  // the port of a connection evicted from masq_ports may be taken by another connection, the
+  // connection is allocated a port again then
+  struct serviceCtKey *owner = NULL;
+  struct masqCtInfo *ct = bpf_map_lookup_elem(&masq_ct, &conn);
+  if (ct) {
+    revKey.clientPort = ct->snatPort;
+    owner = bpf_map_lookup_elem(&masq_ports, &revKey);
+  }
+  int closing = lb_tcp_closing(skb, conn.protocol, l4_off);
+  if (!owner || owner->clientIp != conn.clientIp || owner->clientPort != conn.clientPort) {
+    if (masq_snat_port(&revKey, &conn) < 0) {
+      return TC_ACT_SHOT;
+    }
+    struct masqCtInfo info = {};
+    info.snatPort = revKey.clientPort;
+    info.closing = closing;
+    info.lastSeen = bpf_ktime_get_ns();
+    bpf_map_update_elem(&masq_ct, &conn, &info, BPF_ANY);
+  } else if (ct) {
+    masq_ct_seen(ct, closing);
+  }
+
+  __u8 protocol = conn.protocol;
+  __be32 old_saddr = ip->saddr;
+  __be16 old_sport = ports[0];
+  lb_nat(skb, protocol, l4_off,
+         IP_SRC_OFF, old_saddr, htonl(node_ip),
+         l4_off + offsetof(struct tcphdr, source), old_sport, htons(revKey.clientPort));
+  int ret = lb_redirect_fib(skb);
+  return ret < 0 ? TC_ACT_SHOT : ret;
+}
+
+// masq_rev translates the reply to a masqueraded connection back to the pod and redirects it to
+// the pod. It returns the verdict for the packet, or -1 when the packet is not such a reply.
+static __always_inline int masq_rev(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return -1;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return -1;
+  }
+  if (masq_fragment(ip)) {
+    return -1;
+  }
+  __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+  __be16 *ports = data + l4_off;
+  if ((void *)(ports + 2) > data_end) {
+    return -1;
+  }
+
+  struct serviceCtKey revKey = {};
+  revKey.clientIp = htonl(ip->daddr);
+  revKey.ip = htonl(ip->saddr);
+  revKey.clientPort = ntohs(ports[1]);
+  revKey.port = ntohs(ports[0]);
+  revKey.protocol = ip->protocol;
+  struct serviceCtKey *conn = bpf_map_lookup_elem(&masq_ports, &revKey);
+  if (!conn) {
+    return -1;
+  }
+  struct masqCtInfo *ct = bpf_map_lookup_elem(&masq_ct, conn);
+  if (ct) {
+    masq_ct_seen(ct, lb_tcp_closing(skb, revKey.protocol, l4_off));
+  }
+  __u32 pod_ip = conn->clientIp;
+  __u16 pod_port = conn->clientPort;
+
+  struct localIpsMapKey epKey = {};
+  epKey.ip = pod_ip;
+  struct localIpsMapInfo *ep = bpf_map_lookup_elem(&local_pod_ips, &epKey);
+  if (!ep) {
+    return TC_ACT_SHOT;
+  }
+  __u8 src_mac[ETH_ALEN];
+  __u8 dst_mac[ETH_ALEN];
+  bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
+  bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
+  __u32 lxc_ifindex = ep->lxcIfIndex;
+
+  __be32 old_daddr = ip->daddr;
+  __be16 old_dport = ports[1];
+  lb_nat(skb, revKey.protocol, l4_off,
+         IP_DST_OFF, old_daddr, htonl(pod_ip),
+         l4_off + offsetof(struct tcphdr, dest), old_dport, htons(pod_port));
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), dst_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), src_mac, ETH_ALEN, 0);
+  return bpf_redirect(lxc_ifindex, 0);
+}
+
+#endif
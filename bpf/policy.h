@@ -0,0 +1,217 @@
+#ifndef __POLICY_H
+#define __POLICY_H
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "frag.h"
+
+// The prefix of the local pod, the ports, the protocol and the direction of a policy_cidrs key
+#define POLICY_CIDR_PREFIX 96
+
+// policy_conn reads the connection of the packet, the ports are 0 for the protocols other
+// than tcp and udp. The fragments following the first one of a datagram take the ports of their
+// first fragment, their ports are 0 when the first fragment is unknown so that only the rules
+// allowing every port match them. It returns -1 when the packet is not IPv4 or is truncated.
+static __always_inline int policy_conn(struct __sk_buff *skb, struct serviceCtKey *conn) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct ethhdr *eth = data;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end || eth->h_proto != __constant_htons(ETH_P_IP)) {
+    return -1;
+  }
+  __builtin_memset(conn, 0, sizeof(*conn));
+  conn->clientIp = htonl(ip->saddr);
+  conn->ip = htonl(ip->daddr);
+  conn->protocol = ip->protocol;
+  if (ip->protocol == IPPROTO_TCP || ip->protocol == IPPROTO_UDP) {
+    if (frag_ports(skb, ip, ETH_HLEN + ip->ihl * 4, &conn->clientPort, &conn->port) < 0 &&
+        !frag_later(ip)) {
+      return -1;
+    }
+  }
+  return 0;
+}
+
+// policy_port_block returns the first port of the block of the first bits bits of port
+static __always_inline __u16 policy_port_block(__u16 port, int bits) {
+  if (bits == 0) {
+    return 0;
+  }
+  return port & (__u16)(0xffff << (16 - bits));
+}
+
+// policy_rule_identity looks the rule allowing the identity up for the port, then for the blocks
+// of ports holding it from the smallest to every port of the protocol, and then for every protocol
+static __always_inline __u32 policy_rule_identity(struct policyRuleKey *key) {
+  __u16 port = key->port;
+  struct policyRuleInfo *rule;
+#pragma unroll
+  for (int bits = 16; bits >= 0; bits--) {
+    key->port = policy_port_block(port, bits);
+    key->portPrefix = bits;
+    rule = bpf_map_lookup_elem(&policy_rules, key);
+    if (rule) {
+      return rule->policy;
+    }
+  }
+  key->protocol = 0;
+  rule = bpf_map_lookup_elem(&policy_rules, key);
+  if (rule) {
+    return rule->policy;
+  }
+  return 0;
+}
+
+// policy_rule_cidr looks the rule allowing the address up like policy_rule_identity
+static __always_inline __u32 policy_rule_cidr(struct policyCidrKey *key) {
+  __u16 port = key->port;
+  struct policyRuleInfo *rule;
+#pragma unroll
+  for (int bits = 16; bits >= 0; bits--) {
+    key->port = policy_port_block(port, bits);
+    key->portPrefix = bits;
+    rule = bpf_map_lookup_elem(&policy_cidrs, key);
+    if (rule) {
+      return rule->policy;
+    }
+  }
+  key->protocol = 0;
+  rule = bpf_map_lookup_elem(&policy_cidrs, key);
+  if (rule) {
+    return rule->policy;
+  }
+  return 0;
+}
+
+// policy_rule returns the policy allowing the local pod to reach the peer in the direction, or 0
+// when no rule allows it. The rules of the identity of a pod peer are looked up before the ip
+// blocks, the identity is looked up in pod_identities unless peer_identity gives it.
+static __always_inline __u32 policy_rule(__u32 ip, __u8 direction, __u32 peer, __u32 peer_identity,
+                                         __u16 port, __u8 protocol) {
+  if (!peer_identity) {
+    struct podIdentityKey idKey = {};
+    idKey.ip = peer;
+    struct podIdentityInfo *identity = bpf_map_lookup_elem(&pod_identities, &idKey);
+    if (identity) {
+      peer_identity = identity->identity;
+    }
+  }
+  if (peer_identity) {
+    struct policyRuleKey key = {};
+    key.ip = ip;
+    key.identity = peer_identity;
+    key.port = port;
+    key.protocol = protocol;
+    key.direction = direction;
+    __u32 policy = policy_rule_identity(&key);
+    if (policy) {
+      return policy;
+    }
+  }
+
+  struct policyCidrKey key = {};
+  key.prefixlen = POLICY_CIDR_PREFIX + 32;
+  key.ip = ip;
+  key.port = port;
+  key.protocol = protocol;
+  key.direction = direction;
+  key.peer = htonl(peer);
+  return policy_rule_cidr(&key);
+}
+
+// policy_count counts a connection allowed or a packet denied for the policy
+static __always_inline void policy_count(__u32 policy, int allowed) {
+  struct policyStatsKey key = {};
+  key.policy = policy;
+  struct policyStats *stats = bpf_map_lookup_elem(&policy_stats, &key);
+  if (!stats) {
+    return;
+  }
+  if (allowed) {
+    __sync_fetch_and_add(&stats->allowed, 1);
+  } else {
+    __sync_fetch_and_add(&stats->denied, 1);
+  }
+}
+
+// policy_allow_from returns 1 when the policies of the local pods of the connection allow the
+// packet, the egress of the client and the ingress of the server are checked. The packets of the
+// connections allowed before are allowed in both directions, and the node always reaches its pods
+// for the probes of the kubelet. The identity of the client is looked up unless client_identity
+// gives it.
+static __always_inline int policy_allow_from(struct serviceCtKey *conn, __u32 client_identity) {
+  struct policyEndpointKey epKey = {};
+  epKey.ip = conn->clientIp;
+  struct policyEndpointInfo *client = bpf_map_lookup_elem(&policy_endpoints, &epKey);
+  epKey.ip = conn->ip;
+  struct policyEndpointInfo *server = bpf_map_lookup_elem(&policy_endpoints, &epKey);
+  // the connections of the pods selected by a policy are tracked even when they are not isolated
+  // in the direction, the replies are allowed for the other direction then
+  int selected = 0;
+  __u32 egress_policy = 0;
+  __u32 ingress_policy = 0;
+  if (client) {
+    selected = 1;
+    egress_policy = client->egressPolicy;
+  }
+  if (server) {
+    selected = 1;
+    ingress_policy = server->ingressPolicy;
+  }
+  if (!selected) {
+    return 1;
+  }
+
+  if (bpf_map_lookup_elem(&policy_ct, conn)) {
+    return 1;
+  }
+  struct serviceCtKey rev = {};
+  rev.clientIp = conn->ip;
+  rev.ip = conn->clientIp;
+  rev.clientPort = conn->port;
+  rev.port = conn->clientPort;
+  rev.protocol = conn->protocol;
+  if (bpf_map_lookup_elem(&policy_ct, &rev)) {
+    return 1;
+  }
+
+  struct policyRuleInfo allowed = {};
+  if (egress_policy) {
+    allowed.policy = policy_rule(conn->clientIp, POLICY_EGRESS, conn->ip, 0, conn->port, conn->protocol);
+    if (!allowed.policy) {
+      policy_count(egress_policy, 0);
+      return 0;
+    }
+    policy_count(allowed.policy, 1);
+  }
+  if (ingress_policy) {
+    __u32 zero = 0;
+    struct nodeInfo *node = bpf_map_lookup_elem(&node_info, &zero);
+    if (!node || node->ip != conn->clientIp) {
+      allowed.policy = policy_rule(conn->ip, POLICY_INGRESS, conn->clientIp, client_identity,
+                                   conn->port, conn->protocol);
+      if (!allowed.policy) {
+        policy_count(ingress_policy, 0);
+        return 0;
+      }
+      policy_count(allowed.policy, 1);
+    }
+  }
+  bpf_map_update_elem(&policy_ct, conn, &allowed, BPF_ANY);
+  return 1;
+}
+
+// policy_allow returns 1 when the policies of the local pods of the connection allow the packet
+static __always_inline int policy_allow(struct serviceCtKey *conn) {
+  return policy_allow_from(conn, 0);
+}
+
+#endif
@@ -0,0 +1,148 @@
+#ifndef __ROUTING_H
+#define __ROUTING_H
+
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+
+// ROUTE_ANY_TENANT is the tenant of the packets of the nodes and of the clients outside the
+// cluster, the pods of every tenant accept them
+#define ROUTE_ANY_TENANT 0
+
+// route_tenant is the tunnel id the packets of the pods of the vni are sent with, the pods of
+// the default tenant use the default tunnel id
+static __always_inline __u32 route_tenant(__u32 vni) {
+  return vni ? vni : DEFAULT_TUNNEL_ID;
+}
+
+// route_allow reports whether a packet of the tenant may reach a pod of the vni
+static __always_inline int route_allow(__u32 tenant, __u32 vni) {
+  return tenant == ROUTE_ANY_TENANT || tenant == route_tenant(vni);
+}
+
+// route_local_tenant is the tenant of a pod of the node, ROUTE_ANY_TENANT when the address is
+// not a pod of the node
+static __always_inline __u32 route_local_tenant(__u32 pod_ip) {
+  struct localIpsMapKey epKey = {};
+  epKey.ip = pod_ip;
+  struct localIpsMapInfo *ep = bpf_map_lookup_elem(&local_pod_ips, &epKey);
+  return ep ? route_tenant(ep->vni) : ROUTE_ANY_TENANT;
+}
+
+// route_remote_tenant is the tenant of a pod of another node, ROUTE_ANY_TENANT when the address
+// is not a pod of another node
+static __always_inline __u32 route_remote_tenant(__u32 pod_ip) {
+  struct clusterIpsMapKey podNodeKey = {};
+  podNodeKey.ip = pod_ip;
+  struct clusterIpsMapInfo *podNode = bpf_map_lookup_elem(&cluster_pod_ips, &podNodeKey);
+  return podNode ? route_tenant(podNode->vni) : ROUTE_ANY_TENANT;
+}
+
+// route_tunnel_id is the tunnel id a packet from src_ip to a pod of another node is sent with,
+// the tenant of the source pod or, for the packets of the node, the tenant of the destination
+// pod so that the pod accepts them
+static __always_inline __u32 route_tunnel_id(__u32 src_ip, struct clusterIpsMapInfo *dst) {
+  __u32 tenant = route_local_tenant(src_ip);
+  return tenant != ROUTE_ANY_TENANT ? tenant : route_tenant(dst->vni);
+}
+
+// route_native sends a packet to a pod on another node out of the interface of the route to the
+// node, the node is the next hop of the packet. No route to the pods is programmed in the kernel,
+// it returns -1 when there is no route to the node.
+static __always_inline int route_native(struct __sk_buff *skb, __u32 node_ip) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + sizeof(struct ethhdr);
+  if ((void *)(ip + 1) > data_end) {
+    return -1;
+  }
+
+  struct bpf_fib_lookup fib = {};
+  fib.family = AF_INET;
+  fib.l4_protocol = ip->protocol;
+  fib.tot_len = ntohs(ip->tot_len);
+  fib.ipv4_src = ip->saddr;
+  fib.ipv4_dst = htonl(node_ip);
+  fib.ifindex = skb->ifindex;
+  int ret = bpf_fib_lookup(skb, &fib, sizeof(fib), 0);
+  if (ret == BPF_FIB_LKUP_RET_NO_NEIGH) {
+    struct bpf_redir_neigh nh = {};
+    nh.nh_family = fib.family;
+    nh.ipv4_nh = fib.ipv4_dst;
+    return bpf_redirect_neigh(fib.ifindex, &nh, sizeof(nh), 0);
+  }
+  if (ret != BPF_FIB_LKUP_RET_SUCCESS) {
+    return -1;
+  }
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), fib.dmac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), fib.smac, ETH_ALEN, 0);
+  return bpf_redirect(fib.ifindex, 0);
+}
+
+// route_remote sends a packet to a pod on the node node_ip, the packet is encapsulated by the
+// vxlan or the geneve device or routed to the node in the native routing mode. The packets the
+// native routing mode has no route for are tunneled, the nodes accept both and the devices of the
+// pods are sized for the tunnel so that those packets fit. It returns -1 when there is no tunnel
+// device. The packet is encrypted by the wireguard device when the node encrypts, it is dropped
+// rather than sent in clear when the device is missing.
+static __always_inline int route_remote(struct __sk_buff *skb, __u32 node_ip) {
+  __u32 zero = 0;
+  struct nodeInfo *node = bpf_map_lookup_elem(&node_info, &zero);
+  if (node && node->encryption == ENCRYPTION_WIREGUARD) {
+    // the device sends the packet to the peer of the node by the address of the pod
+    struct localDevMapKey wgKey = {};
+    wgKey.type = LOCAL_DEV_WIREGUARD;
+    struct localDevMapValue *wg = bpf_map_lookup_elem(&local_dev, &wgKey);
+    if (!wg) {
+      return TC_ACT_SHOT;
+    }
+    return bpf_redirect(wg->ifIndex, 0);
+  }
+  if (node && node->routing == ROUTING_NATIVE) {
+    int ret = route_native(skb, node_ip);
+    if (ret >= 0) {
+      return ret;
+    }
+  }
+  struct localDevMapKey localKey = {};
+  localKey.type = LOCAL_DEV_VXLAN;
+  if (node && node->tunnel == TUNNEL_GENEVE) {
+    localKey.type = LOCAL_DEV_GENEVE;
+  }
+  struct localDevMapValue *localValue = bpf_map_lookup_elem(&local_dev, &localKey);
+  if (!localValue) {
+    return -1;
+  }
+  return bpf_redirect(localValue->ifIndex, 0);
+}
+
+// route_local redirects a packet of the tenant from another node to a pod of the node, the
+// packet is dropped when the pod belongs to another tenant. It returns -1 when the destination
+// is not a pod of the node.
+static __always_inline int route_local(struct __sk_buff *skb, __u32 pod_ip, __u32 tenant) {
+  struct localIpsMapKey epKey = {};
+  epKey.ip = pod_ip;
+  struct localIpsMapInfo *ep = bpf_map_lookup_elem(&local_pod_ips, &epKey);
+  if (!ep) {
+    return -1;
+  }
+  if (!route_allow(tenant, ep->vni)) {
+    return TC_ACT_SHOT;
+  }
+  __u8 src_mac[ETH_ALEN];
+  __u8 dst_mac[ETH_ALEN];
+  bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
+  bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
+  __u32 lxc_ifindex = ep->lxcIfIndex;
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), dst_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), src_mac, ETH_ALEN, 0);
+  return bpf_redirect(lxc_ifindex, 0);
+}
+
+#endif
@@ -0,0 +1,105 @@
+#include <linux/bpf.h>
+#include <bpf/bpf_helpers.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "lb.h"
+
+// The programs are attached to the root cgroup, they translate the sockets of the node, on the
+// host and in the pods, connecting or sending to a host port to the pod and to a service to one
+// of its backends before any packet is sent. The connections of the node to its own host ports
+// and to the services never reach an interface the tc programs are attached to.
+
+// sock_host_port returns the pod address and port of the host port, the host ports without host
+// ip are served on every address of the node
+static __always_inline struct hostPortsMapInfo *sock_host_port(__u32 ip, __u16 port, __u8 protocol) {
+  struct hostPortsMapKey key = {};
+  key.ip = ip;
+  key.port = port;
+  key.protocol = protocol;
+  struct hostPortsMapInfo *hostPort = bpf_map_lookup_elem(&host_ports, &key);
+  if (hostPort) {
+    return hostPort;
+  }
+  if (!lb_node_addr(ip)) {
+    return NULL;
+  }
+  key.ip = 0;
+  return bpf_map_lookup_elem(&host_ports, &key);
+}
+
+// sock_translate sets the destination of the socket, the destination a udp socket sent to is
+// remembered for the replies it receives
+static __always_inline void sock_translate(struct bpf_sock_addr *ctx, __u32 ip, __u16 port,
+                                           __u32 new_ip, __u16 new_port) {
+  if (ctx->protocol == IPPROTO_UDP) {
+    struct sockRevNatKey key = {};
+    key.cookie = bpf_get_socket_cookie(ctx);
+    key.ip = new_ip;
+    key.port = new_port;
+    struct sockRevNatInfo info = {};
+    info.ip = ip;
+    info.port = port;
+    bpf_map_update_elem(&sock_rev_nat, &key, &info, BPF_ANY);
+  }
+  ctx->user_ip4 = htonl(new_ip);
+  ctx->user_port = htons(new_port);
+}
+
+static __always_inline int sock_lb(struct bpf_sock_addr *ctx) {
+  __u8 protocol = ctx->protocol;
+  if (protocol != IPPROTO_TCP && protocol != IPPROTO_UDP) {
+    return 1;
+  }
+  __u32 ip = ntohl(ctx->user_ip4);
+  __u16 port = ntohs((__u16)ctx->user_port);
+
+  struct hostPortsMapInfo *hostPort = sock_host_port(ip, port, protocol);
+  if (hostPort) {
+    sock_translate(ctx, ip, port, hostPort->ip, hostPort->port);
+    return 1;
+  }
+
+  // the node ports are served to the node and its pods on every address of the node
+  struct serviceKey svcKey = {};
+  struct serviceInfo *svc = lb_lookup_service(&svcKey, ip, port, protocol);
+  if (!svc) {
+    return 1;
+  }
+  struct serviceBackendInfo backend = {};
+  // a service without backend refuses the connections
+  if (lb_pick_backend(&svcKey, svc, &backend) < 0) {
+    return 0;
+  }
+  sock_translate(ctx, ip, port, backend.ip, backend.port);
+  return 1;
+}
+
+__section("cgroup/connect4")
+int sock_connect4(struct bpf_sock_addr *ctx) {
+  return sock_lb(ctx);
+}
+
+__section("cgroup/sendmsg4")
+int sock_sendmsg4(struct bpf_sock_addr *ctx) {
+  return sock_lb(ctx);
+}
+
+// sock_recvmsg4 translates the source of a reply received by a udp socket back to the address
+// and port the socket sent to
+__section("cgroup/recvmsg4")
+int sock_recvmsg4(struct bpf_sock_addr *ctx) {
+  struct sockRevNatKey key = {};
+  key.cookie = bpf_get_socket_cookie(ctx);
+  key.ip = ntohl(ctx->user_ip4);
+  key.port = ntohs((__u16)ctx->user_port);
+  struct sockRevNatInfo *info = bpf_map_lookup_elem(&sock_rev_nat, &key);
+  if (info) {
+    ctx->user_ip4 = htonl(info->ip);
+    ctx->user_port = htons(info->port);
+  }
+  return 1;
+}
+
+char _license[] SEC("license") = "GPL";
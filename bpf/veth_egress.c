@@ -0,0 +1,38 @@
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "lb.h"
+#include "policy.h"
+
+// Attached to the egress of the host veth, the packets sent to the pod through the host or
+// redirected from the vxlan device pass here. The ingress policies of the pod are enforced and
+// the replies of the service backends are translated back to the service.
+__section("classifier")
+int cls_main(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    return TC_ACT_OK;
+  }
+
+  struct ethhdr *eth = data;
+  if (eth->h_proto != __constant_htons(ETH_P_IP)) {
+    return TC_ACT_OK;
+  }
+
+  // the replies are checked before they are translated back to the service
+  struct serviceCtKey conn = {};
+  if (policy_conn(skb, &conn) == 0 && !policy_allow(&conn)) {
+    return TC_ACT_SHOT;
+  }
+  lb_rev_service(skb);
+  return TC_ACT_OK;
+}
+
+char _license[] SEC("license") = "GPL";
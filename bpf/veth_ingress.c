@@ -4,10 +4,28 @@
 #include <linux/if_ether.h>
 #include <linux/ip.h>
 #include <linux/icmp.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
 #include <netinet/in.h>
 
 #include "common.h"
 #include "maps.h"
+#include "lb.h"
+#include "routing.h"
+#include "policy.h"
+#include "masq.h"
+
+// rev_host_port translates the reply of a pod back to the host address and port the client
+// connected to, the reply is sent out of the node directly since the kernel drops a packet
+// coming from the pod with a local source address.
+static __always_inline int rev_host_port(struct __sk_buff *skb, struct iphdr *ip, __u32 l4_off,
+                                         __be16 old_port, struct hostPortsMapInfo *ct) {
+  lb_nat(skb, ip->protocol, l4_off,
+         IP_SRC_OFF, ip->saddr, htonl(ct->ip),
+         l4_off + offsetof(struct tcphdr, source), old_port, htons(ct->port));
+  int ret = lb_redirect_fib(skb);
+  return ret < 0 ? TC_ACT_SHOT : ret;
+}
 
 __section("classifier")
 int cls_main(struct __sk_buff *skb) {
@@ -25,6 +43,64 @@ int cls_main(struct __sk_buff *skb) {
 
   __u32 src_ip = htonl(ip->saddr);
   __u32 dst_ip = htonl(ip->daddr);
+  // a pod only sends from its own addresses, the tenant of the packet is that of the pod of the
+  // veth so that a pod can not reach another tenant with a spoofed source
+  struct localIpsMapKey srcKey = {};
+  srcKey.ip = src_ip;
+  struct localIpsMapInfo *src = bpf_map_lookup_elem(&local_pod_ips, &srcKey);
+  if (!src || src->lxcIfIndex != skb->ifindex) {
+    return TC_ACT_SHOT;
+  }
+  // the pods of different tenants do not reach each other
+  __u32 tenant = route_tenant(src->vni);
+
+  // the policies are checked on the connection to the backend of a service once it is
+  // translated, the replies are checked before they are translated back
+  struct serviceCtKey conn = {};
+  if (policy_conn(skb, &conn) < 0) {
+    return TC_ACT_UNSPEC;
+  }
+  int to_service = lb_frontend(&conn);
+  if (!to_service && !policy_allow(&conn)) {
+    return TC_ACT_SHOT;
+  }
+
+  int rev_service = 0;
+
+  // the reply of a host port connection
+  if (ip->protocol == IPPROTO_TCP || ip->protocol == IPPROTO_UDP) {
+    __u32 l4_off = ETH_HLEN + ip->ihl * 4;
+    __be16 *ports = data + l4_off;
+    if ((void *)(ports + 2) > data_end) {
+      return TC_ACT_UNSPEC;
+    }
+    struct hostPortsCtKey ctKey = {};
+    ctKey.clientIp = dst_ip;
+    ctKey.podIp = src_ip;
+    ctKey.clientPort = ntohs(ports[1]);
+    ctKey.podPort = ntohs(ports[0]);
+    ctKey.protocol = ip->protocol;
+    struct hostPortsMapInfo *ct = bpf_map_lookup_elem(&host_ports_ct, &ctKey);
+    if (ct) {
+      return rev_host_port(skb, ip, l4_off, ports[0], ct);
+    }
+
+    // the reply of a local backend of a service to a local client, the packet bypasses the
+    // egress of the host veth of the client
+    rev_service = lb_rev_service(skb);
+    // a connection to a service is sent to one of its backends
+    __u32 backend_ip = lb_service(skb);
+    if (backend_ip) {
+      dst_ip = backend_ip;
+      if (policy_conn(skb, &conn) < 0 || !policy_allow(&conn)) {
+        return TC_ACT_SHOT;
+      }
+    } else if (to_service) {
+      // a service without backend refuses the connections
+      return TC_ACT_SHOT;
+    }
+  }
+
   __u8 src_mac[ETH_ALEN];
   __u8 dst_mac[ETH_ALEN];
   struct localIpsMapKey epKey = {};
@@ -32,6 +108,9 @@ int cls_main(struct __sk_buff *skb) {
   struct localIpsMapInfo *ep = bpf_map_lookup_elem(&local_pod_ips, &epKey);
   // If the obtained IP address is the IP address of the local node
   if (ep) {
+    if (!route_allow(tenant, ep->vni)) {
+      return TC_ACT_SHOT;
+    }
     bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
 	bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
     bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), dst_mac, ETH_ALEN, 0);
@@ -42,17 +121,29 @@ int cls_main(struct __sk_buff *skb) {
   struct clusterIpsMapKey podNodeKey = {};
   podNodeKey.ip = dst_ip;
   struct clusterIpsMapInfo *podNode = bpf_map_lookup_elem(&cluster_pod_ips, &podNodeKey);
-  // If it is the IP address of another node container
+  // If it is the IP address of another node container, it is sent through the vxlan device or
+  // routed to the node
   if (podNode) {
-    struct localDevMapKey localKey = {};
-    localKey.type = LOCAL_DEV_VXLAN;
-    struct localDevMapValue *localValue = bpf_map_lookup_elem(&local_dev, &localKey);
-    if (localValue) {
-      // Redirect to vxlan
-      return bpf_redirect(localValue->ifIndex, 0);
-    } 
+    if (!route_allow(tenant, podNode->vni)) {
+      return TC_ACT_SHOT;
+    }
+    int ret = route_remote(skb, podNode->ip);
+    return ret < 0 ? TC_ACT_UNSPEC : ret;
+  }
+  // the reply to a client outside the cluster of a node port or an external ip is sent out of
+  // the node directly, the kernel drops a packet coming from the pod with a local source address
+  if (rev_service) {
+    int ret = lb_redirect_fib(skb);
+    if (ret >= 0) {
+      return ret;
+    }
     return TC_ACT_UNSPEC;
   }
+  // the connections leaving the cluster are translated to the address of the node
+  int ret = masq_snat(skb);
+  if (ret >= 0) {
+    return ret;
+  }
   return TC_ACT_UNSPEC;
 }
 
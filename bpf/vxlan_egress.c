@@ -9,6 +9,7 @@
 
 #include "common.h"
 #include "maps.h"
+#include "routing.h"
 
 __section("classifier")
 int cls_main(struct __sk_buff *skb) {
@@ -37,7 +38,7 @@ int cls_main(struct __sk_buff *skb) {
     int ret;
     __builtin_memset(&key, 0x0, sizeof(key));
     key.remote_ipv4 = podNode->ip;
-    key.tunnel_id = DEFAULT_TUNNEL_ID;
+    key.tunnel_id = route_tunnel_id(src_ip, podNode);
     key.tunnel_tos = 0;
     key.tunnel_ttl = 64;
     ret = bpf_skb_set_tunnel_key(skb, &key, sizeof(key), BPF_F_ZERO_CSUM_TX);
@@ -7,6 +7,7 @@
 
 #include "common.h"
 #include "maps.h"
+#include "routing.h"
 
 __section("classifier")
 int cls_main(struct __sk_buff *skb) {
@@ -33,6 +34,11 @@ int cls_main(struct __sk_buff *skb) {
   if (!ep) {
     return TC_ACT_OK;
   }
+  // the packets of the pods of another tenant are dropped
+  struct bpf_tunnel_key key = {};
+  if (bpf_skb_get_tunnel_key(skb, &key, sizeof(key), 0) < 0 || !route_allow(route_tenant(key.tunnel_id), ep->vni)) {
+    return TC_ACT_SHOT;
+  }
   __u8 src_mac[ETH_ALEN];
   __u8 dst_mac[ETH_ALEN];
   bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
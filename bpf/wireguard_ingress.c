@@ -0,0 +1,51 @@
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <bpf/bpf_helpers.h>
+#include <linux/if_ether.h>
+#include <linux/ip.h>
+#include <netinet/in.h>
+
+#include "common.h"
+#include "maps.h"
+#include "routing.h"
+
+// Attached to the ingress of the wireguard device, the decrypted packets of the pods of the other
+// nodes are redirected to the local pods. The device carries the IP packets without ethernet
+// header, the header is added before the packet is redirected to the host veth of the pod.
+__section("classifier")
+int cls_main(struct __sk_buff *skb) {
+  if (skb->protocol != __constant_htons(ETH_P_IP)) {
+    return TC_ACT_UNSPEC;
+  }
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data;
+  if ((void *)(ip + 1) > data_end) {
+    return TC_ACT_UNSPEC;
+  }
+
+  __u32 src_ip = htonl(ip->saddr);
+  __u32 dst_ip = htonl(ip->daddr);
+  struct localIpsMapKey epKey = {};
+  epKey.ip = dst_ip;
+  if (!bpf_map_lookup_elem(&local_pod_ips, &epKey)) {
+    return TC_ACT_UNSPEC;
+  }
+  __u32 tenant = route_remote_tenant(src_ip);
+
+  if (bpf_skb_change_head(skb, ETH_HLEN, 0) < 0) {
+    return TC_ACT_SHOT;
+  }
+  data = (void *)(long)skb->data;
+  data_end = (void *)(long)skb->data_end;
+  struct ethhdr *eth = data;
+  if ((void *)(eth + 1) > data_end) {
+    return TC_ACT_SHOT;
+  }
+  eth->h_proto = __constant_htons(ETH_P_IP);
+
+  int ret = route_local(skb, dst_ip, tenant);
+  return ret < 0 ? TC_ACT_SHOT : ret;
+}
+
+char _license[] SEC("license") = "GPL";
@@ -20,12 +20,16 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	utilfeature "k8s.io/apiserver/pkg/util/feature"
 	kubeinformers "k8s.io/client-go/informers"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -33,16 +37,26 @@ import (
 	"k8s.io/component-base/cli/globalflag"
 	logsapi "k8s.io/component-base/logs/api/v1"
 	"k8s.io/component-base/metrics/features"
+	"k8s.io/component-base/metrics/legacyregistry"
 	"k8s.io/component-base/term"
 	"k8s.io/klog/v2"
 
 	"github.com/fast-io/fast/cmd/agent/app/config"
 	"github.com/fast-io/fast/cmd/agent/app/options"
 	ipamapiv1 "github.com/fast-io/fast/pkg/api/proto/v1"
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
 	ipamservicev1 "github.com/fast-io/fast/pkg/api/service/v1"
+	ipamservicev2 "github.com/fast-io/fast/pkg/api/service/v2"
+	"github.com/fast-io/fast/pkg/bpf/loader"
 	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
 	clientbuilder "github.com/fast-io/fast/pkg/builder"
 	clusterpodctrl "github.com/fast-io/fast/pkg/controllers/clusterpod"
+	masqueradectrl "github.com/fast-io/fast/pkg/controllers/masquerade"
+	policyctrl "github.com/fast-io/fast/pkg/controllers/policy"
+	servicectrl "github.com/fast-io/fast/pkg/controllers/service"
+	wireguardctrl "github.com/fast-io/fast/pkg/controllers/wireguard"
+	ipsinformers "github.com/fast-io/fast/pkg/generated/informers/externalversions"
+	"github.com/fast-io/fast/pkg/ipamcache"
 	grpclogger "github.com/fast-io/fast/pkg/logger"
 	"github.com/fast-io/fast/pkg/version"
 )
@@ -60,10 +74,6 @@ func NewAgentCommand() *cobra.Command {
 		Use:  "fast-agent",
 		Long: `The fast-agent is an agent component`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// load bpf map
-			if err := bpfmap.LoadBpfMap(); err != nil {
-				return fmt.Errorf("failed to load ebpf map: %v", err)
-			}
 			// Activate logging as soon as possible, after that
 			// show flags with the final logging configuration.
 			if err := logsapi.ValidateAndApply(o.Logs, utilfeature.DefaultFeatureGate); err != nil {
@@ -121,25 +131,138 @@ func Run(ctx context.Context, c *config.CompletedConfig) error {
 
 	clientBuilder := clientbuilder.NewSimpleIpsControllerClientBuilder(c.Kubeconfig)
 
-	// 1.create map and attach eBPF programs
+	// 1.create map and attach eBPF programs, the maps full while they are migrated are counted
+	bpfmap.RegisterMetrics()
+	if err := loader.Load(ctx, c.BPFMapMaxEntries); err != nil {
+		return fmt.Errorf("failed to load ebpf programs: %v", err)
+	}
 	if err := bpfmap.InitLoadPinnedMap(); err != nil {
 		return err
 	}
+	// serve the node ports and the external ips of the services on the underlay interface, the
+	// connections of the pods leaving the cluster are masqueraded to its address
+	node := bpfmap.NodeInfoValue{Routing: c.RoutingMode, Tunnel: c.TunnelType}
+	if c.EnableMasquerade {
+		// the nodes and the non masquerade cidrs are in the map before the first connection of a pod
+		// is masqueraded, the masquerade controller keeps them in sync afterwards
+		if err := masqueradectrl.SyncCidrs(ctx, c.Client, c.NonMasqueradeCIDRs); err != nil {
+			return fmt.Errorf("failed to program the non masquerade cidrs: %v", err)
+		}
+		node.Masquerade = 1
+	}
+	// the packets to the pods of the other nodes are encrypted by the wireguard device, its key and
+	// its peers are configured by the wireguard controller
+	if c.EnableWireguard {
+		if err := loader.AttachWireguard(); err != nil {
+			return fmt.Errorf("failed to attach the wireguard device: %v", err)
+		}
+		node.Encryption = bpfmap.EncryptionWireguard
+	} else if err := wireguardctrl.Cleanup(ctx, c.Client); err != nil {
+		logger.Error(err, "Failed to delete the wireguard device of a previous configuration")
+	}
+	// the clients of the connections to remote backends are translated to the reserved ports so
+	// that the replies of the backends are never taken for the replies to a socket of the node
+	if err := loader.ReserveSNATPorts(); err != nil {
+		logger.Error(err, "Failed to reserve the SNAT ports, they may be given to the sockets of the node")
+	}
+	if err := loader.AttachUnderlay(node); err != nil {
+		// the datapath would send the packets of the pods in clear
+		if c.EnableWireguard {
+			return fmt.Errorf("failed to attach the underlay interface: %v", err)
+		}
+		logger.Error(err, "Failed to attach the underlay interface, the node ports and external ips are not served, the pods are not masqueraded and the pods of the other nodes are reached through vxlan")
+	}
+	// the tunnel device is also created in the native routing mode, the nodes tunneling reach the
+	// pods of the node through it
+	if err := loader.AttachTunnel(c.TunnelType, c.TunnelPort); err != nil {
+		return fmt.Errorf("failed to attach the tunnel device: %v", err)
+	}
+	// the connections of the node itself and of its pods to the host ports of the node are translated
+	// by the socket programs, they do not cross the interfaces the tc programs are attached to
+	if err := loader.AttachCgroup(c.CgroupRoot); err != nil {
+		logger.Error(err, "Failed to attach the socket programs, the host ports and the services are not served to the node itself")
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := loader.SyncNodeAddrs(); err != nil {
+			logger.Error(err, "Failed to sync the addresses of the node")
+		}
+	}, time.Second*30)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) { bpfmap.UpdateMapMetrics() }, time.Second*30)
 
 	// new normal informer factory
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(c.Client, time.Second*30)
+	ipsInformerFactory := ipsinformers.NewSharedInformerFactory(clientBuilder.IpsClientOrDie("fast-agent"), time.Second*30)
 
 	// 2.Obtain the cluster pod IP and store the information to the cluster eBPF map
 	controller, err := clusterpodctrl.NewController(
 		ctx,
 		clientBuilder.ClientOrDie("fast-agent"),
 		kubeInformerFactory.Core().V1().Pods(),
+		ipsInformerFactory.Sample().V1alpha1().IpEndpoints(),
+		ipsInformerFactory.Sample().V1alpha1().Ipses(),
 	)
 	if err != nil {
 		return err
 	}
 	go controller.Run(ctx)
 
+	// load balance the connections to the services
+	serviceController, err := servicectrl.NewController(
+		ctx,
+		clientBuilder.ClientOrDie("fast-agent"),
+		kubeInformerFactory.Core().V1().Services(),
+		kubeInformerFactory.Discovery().V1().EndpointSlices(),
+	)
+	if err != nil {
+		return err
+	}
+	go serviceController.Run(ctx)
+
+	// keep the connections to the nodes and the non masquerade cidrs from being masqueraded
+	if c.EnableMasquerade {
+		masqueradeController, err := masqueradectrl.NewController(
+			ctx,
+			clientBuilder.ClientOrDie("fast-agent"),
+			c.NonMasqueradeCIDRs,
+			kubeInformerFactory.Core().V1().Nodes(),
+		)
+		if err != nil {
+			return err
+		}
+		go masqueradeController.Run(ctx)
+	}
+
+	// encrypt the packets to the pods of the other nodes
+	if c.EnableWireguard {
+		wireguardController, err := wireguardctrl.NewController(
+			ctx,
+			clientBuilder.ClientOrDie("fast-agent"),
+			c.WireguardPort,
+			c.WireguardKeyRotationPeriod,
+			kubeInformerFactory.Core().V1().Nodes(),
+			kubeInformerFactory.Core().V1().Pods(),
+			ipsInformerFactory.Sample().V1alpha1().IpEndpoints(),
+		)
+		if err != nil {
+			return err
+		}
+		go wireguardController.Run(ctx)
+	}
+
+	// enforce the network policies of the local pods
+	policyController, err := policyctrl.NewController(
+		ctx,
+		clientBuilder.ClientOrDie("fast-agent"),
+		c.PolicyStateFile,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Core().V1().Namespaces(),
+		kubeInformerFactory.Networking().V1().NetworkPolicies(),
+	)
+	if err != nil {
+		return err
+	}
+	go policyController.Run(ctx)
+
 	// 3.start grpc server
 	var opts []grpc.ServerOption
 	grpclogger.AddLogging(opts)
@@ -149,13 +272,37 @@ func Run(ctx context.Context, c *config.CompletedConfig) error {
 		logger.Error(err, "gRPC listen error")
 		return err
 	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	ipamCache, err := ipamcache.NewFileCache(c.IpamCacheFile)
+	if err != nil {
+		return err
+	}
 	ipamSvc := ipamservicev1.NewIPAMService(
 		ctx,
+		strings.ToLower(hostname),
 		clientBuilder.ClientOrDie("fast-agent"),
 		clientBuilder.IpsClientOrDie("fast-agent"),
+		kubeInformerFactory.Core().V1().Pods(),
+		ipsInformerFactory.Sample().V1alpha1().IpEndpoints(),
+		ipamCache,
+		c.PendingReleaseDir,
+		c.AllocateConcurrency,
+		c.MaxPendingAllocations,
 		grpclogger.Log,
 	)
 	ipamapiv1.RegisterIpServiceServer(server, ipamSvc)
+	ipamapiv2.RegisterIpServiceServer(server, ipamservicev2.NewIPAMService(
+		ctx,
+		clientBuilder.IpsClientOrDie("fast-agent"),
+		ipsInformerFactory.Sample().V1alpha1().Ipses(),
+		ipamSvc,
+		grpclogger.Log,
+	))
+	ipamSvc.EnableWarmPool(ctx, c.WarmPoolSize, c.WarmPools)
+	go wait.UntilWithContext(ctx, ipamSvc.Reconcile, time.Second*30)
 
 	go func() {
 		logger.Info("starting gRPC server...")
@@ -164,8 +311,41 @@ func Run(ctx context.Context, c *config.CompletedConfig) error {
 			logger.Error(err, "start gRPC server error")
 		}
 	}()
+	if len(c.GRPCSocket) > 0 {
+		// the socket of a previous agent is stale
+		if err := os.RemoveAll(c.GRPCSocket); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(c.GRPCSocket), 0755); err != nil {
+			return err
+		}
+		socket, err := net.Listen("unix", c.GRPCSocket)
+		if err != nil {
+			logger.Error(err, "gRPC listen error", "socket", c.GRPCSocket)
+			return err
+		}
+		go func() {
+			logger.Info("starting gRPC server on unix socket...", "socket", c.GRPCSocket)
+			if err := server.Serve(socket); err != nil {
+				logger.Error(err, "start gRPC server error")
+			}
+		}()
+	}
+
+	// 4.serve the metrics
+	if len(c.MetricsBindAddress) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", legacyregistry.Handler())
+		go func() {
+			logger.Info("starting metrics server...", "address", c.MetricsBindAddress)
+			if err := http.ListenAndServe(c.MetricsBindAddress, mux); err != nil {
+				logger.Error(err, "start metrics server error")
+			}
+		}()
+	}
 
 	kubeInformerFactory.Start(stopCh)
+	ipsInformerFactory.Start(stopCh)
 
 	<-stopCh
 	return nil
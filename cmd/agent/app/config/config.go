@@ -17,9 +17,14 @@ limitations under the License.
 package config
 
 import (
+	"net"
+	"time"
+
 	clientset "k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
 )
 
 // Config define global options and sub controller configuration
@@ -35,6 +40,54 @@ type Config struct {
 
 	// the GRPCPort define the server port
 	GRPCPort string
+	// the GRPCSocket define the unix socket the server also listens on
+	GRPCSocket string
+
+	// the IpamCacheFile define the file persisting the allocations of the node
+	IpamCacheFile string
+
+	// the PendingReleaseDir define the directory where the CNI plugin records the deferred releases
+	PendingReleaseDir string
+
+	// the PolicyStateFile define the file where the names of the programmed policies are written
+	PolicyStateFile string
+
+	// the CgroupRoot define the dir the cgroup2 hierarchy the socket programs are attached to is mounted at
+	CgroupRoot string
+
+	// the AllocateConcurrency define the max number of ips updated at the same time
+	AllocateConcurrency int
+	// the MaxPendingAllocations define the max number of allocations waiting on the node
+	MaxPendingAllocations int
+
+	// the MetricsBindAddress define the address serving the metrics
+	MetricsBindAddress string
+
+	// the WarmPoolSize define the number of addresses pre-claimed by the node for every ips
+	WarmPoolSize int
+	// the WarmPools define the ips warmed when the agent starts
+	WarmPools []string
+
+	// the EnableMasquerade define whether the connections of the pods leaving the cluster are
+	// translated to the address of the node
+	EnableMasquerade bool
+	// the NonMasqueradeCIDRs define the destinations the connections of the pods are not masqueraded to
+	NonMasqueradeCIDRs []*net.IPNet
+
+	// the RoutingMode define how the pods of the other nodes are reached
+	RoutingMode bpfmap.RoutingMode
+	// the TunnelType and the TunnelPort define the tunnel the pods of the other nodes are reached through
+	TunnelType bpfmap.TunnelType
+	TunnelPort int
+
+	// the EnableWireguard define whether the packets to the pods of the other nodes are encrypted, the
+	// WireguardPort and the WireguardKeyRotationPeriod define the port and the key rotation of the device
+	EnableWireguard            bool
+	WireguardPort              int
+	WireguardKeyRotationPeriod time.Duration
+
+	// the BPFMapMaxEntries define the capacities of the eBPF maps
+	BPFMapMaxEntries bpfmap.MaxEntries
 }
 
 type completedConfig struct {
@@ -17,6 +17,10 @@ limitations under the License.
 package options
 
 import (
+	"fmt"
+	"net"
+	"time"
+
 	v1 "k8s.io/api/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	clientgokubescheme "k8s.io/client-go/kubernetes/scheme"
@@ -29,6 +33,9 @@ import (
 	"k8s.io/component-base/metrics"
 
 	"github.com/fast-io/fast/cmd/agent/app/config"
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	policyctrl "github.com/fast-io/fast/pkg/controllers/policy"
+	"github.com/fast-io/fast/pkg/ipamcache"
 )
 
 const (
@@ -44,24 +51,92 @@ type AgentOptions struct {
 	Kubeconfig string
 
 	GRPCPort          string
+	GRPCSocket        string
 	GRPCLogLevel      int
 	GRPCLogTimeFormat string
+
+	IpamCacheFile     string
+	PendingReleaseDir string
+	PolicyStateFile   string
+	CgroupRoot        string
+
+	KubeAPIQPS            float32
+	KubeAPIBurst          int
+	AllocateConcurrency   int
+	MaxPendingAllocations int
+	MetricsBindAddress    string
+
+	WarmPoolSize int
+	WarmPools    []string
+
+	EnableMasquerade   bool
+	NonMasqueradeCIDRs []string
+
+	RoutingMode string
+	TunnelType  string
+	TunnelPort  int
+
+	EnableWireguard            bool
+	WireguardPort              int
+	WireguardKeyRotationPeriod time.Duration
+
+	BPFMapMaxEntries bpfmap.MaxEntries
 }
 
 // NewAgentOptions return all options of controller
 func NewAgentOptions() *AgentOptions {
 	return &AgentOptions{
-		Metrics: metrics.NewOptions(),
-		Logs:    logs.NewOptions(),
+		Metrics:          metrics.NewOptions(),
+		Logs:             logs.NewOptions(),
+		BPFMapMaxEntries: bpfmap.DefaultMaxEntries(),
 	}
 }
 
 // Config return a controller config objective
 func (o *AgentOptions) Config() (*config.Config, error) {
+	for name, n := range o.BPFMapMaxEntries.ByName() {
+		if n == 0 {
+			return nil, fmt.Errorf("the max entries of the eBPF map %s must be positive", name)
+		}
+	}
+
+	var nonMasqueradeCIDRs []*net.IPNet
+	for _, s := range o.NonMasqueradeCIDRs {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid non masquerade cidr %s: %w", s, err)
+		}
+		if cidr.IP.To4() == nil {
+			return nil, fmt.Errorf("the non masquerade cidr %s is not IPv4", s)
+		}
+		nonMasqueradeCIDRs = append(nonMasqueradeCIDRs, cidr)
+	}
+
+	routingMode, err := bpfmap.ParseRoutingMode(o.RoutingMode)
+	if err != nil {
+		return nil, err
+	}
+	tunnelType, err := bpfmap.ParseTunnelType(o.TunnelType)
+	if err != nil {
+		return nil, err
+	}
+	if o.TunnelPort < 0 || o.TunnelPort > 65535 {
+		return nil, fmt.Errorf("invalid tunnel port %d", o.TunnelPort)
+	}
+	if o.WireguardPort <= 0 || o.WireguardPort > 65535 {
+		return nil, fmt.Errorf("invalid wireguard port %d", o.WireguardPort)
+	}
+	if o.WireguardKeyRotationPeriod < 0 {
+		return nil, fmt.Errorf("invalid wireguard key rotation period %s", o.WireguardKeyRotationPeriod)
+	}
+
 	kubeconfig, err := clientcmd.BuildConfigFromFlags(o.Master, o.Kubeconfig)
 	if err != nil {
 		return nil, err
 	}
+	// the clients built by the client builder share the rate limit of the kubeconfig
+	kubeconfig.QPS = o.KubeAPIQPS
+	kubeconfig.Burst = o.KubeAPIBurst
 	client, err := clientset.NewForConfig(restclient.AddUserAgent(kubeconfig, ControllerUserAgent))
 	if err != nil {
 		return nil, err
@@ -76,6 +151,32 @@ func (o *AgentOptions) Config() (*config.Config, error) {
 		EventBroadcaster: eventBroadcaster,
 		EventRecorder:    eventRecorder,
 		GRPCPort:         o.GRPCPort,
+		GRPCSocket:       o.GRPCSocket,
+		IpamCacheFile:    o.IpamCacheFile,
+
+		PendingReleaseDir: o.PendingReleaseDir,
+		PolicyStateFile:   o.PolicyStateFile,
+		CgroupRoot:        o.CgroupRoot,
+
+		AllocateConcurrency:   o.AllocateConcurrency,
+		MaxPendingAllocations: o.MaxPendingAllocations,
+		MetricsBindAddress:    o.MetricsBindAddress,
+
+		WarmPoolSize: o.WarmPoolSize,
+		WarmPools:    o.WarmPools,
+
+		EnableMasquerade:   o.EnableMasquerade,
+		NonMasqueradeCIDRs: nonMasqueradeCIDRs,
+
+		RoutingMode: routingMode,
+		TunnelType:  tunnelType,
+		TunnelPort:  o.TunnelPort,
+
+		EnableWireguard:            o.EnableWireguard,
+		WireguardPort:              o.WireguardPort,
+		WireguardKeyRotationPeriod: o.WireguardKeyRotationPeriod,
+
+		BPFMapMaxEntries: o.BPFMapMaxEntries,
 	}
 
 	o.Metrics.Apply()
@@ -94,8 +195,43 @@ func (o *AgentOptions) Flags() cliflag.NamedFlagSets {
 	fs.StringVar(&o.Master, "master", o.Master, "The address of the Kubernetes API server (overrides any value in kubeconfig).")
 	fs.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, "Path to kubeconfig file with authorization and master location information.")
 	fs.StringVar(&o.GRPCPort, "grpc-port", "50051", "The grpc-port define the grpc server port")
+	fs.StringVar(&o.GRPCSocket, "grpc-socket", "", "The grpc-socket define the unix socket the grpc server also listens on, the CNI plugin reaches it with the agentEndpoint of its config, empty disables it")
 	fs.IntVar(&o.GRPCLogLevel, "grpc-log-level", -1, "The grpc-log-level define the grpc server log level")
 	fs.StringVar(&o.GRPCLogTimeFormat, "grpc-log-time-format", "2006-01-02 15:04:05", "The grpc-log-time-format define the grpc server log time format")
+	fs.StringVar(&o.IpamCacheFile, "ipam-cache-file", "/var/lib/fast/ipam-cache.json", "The ipam-cache-file define the file persisting the allocations of the node, they are served while the apiserver is unreachable")
+	fs.StringVar(&o.PendingReleaseDir, "pending-release-dir", ipamcache.DefaultPendingReleaseDir, "The pending-release-dir define the directory where the CNI plugin records the releases it could not send to the agent")
+	fs.StringVar(&o.PolicyStateFile, "policy-state-file", policyctrl.DefaultStateFile, "The policy-state-file define the file where the names of the network policies and the pod identities programmed in the eBPF maps are written for fastctl")
+	fs.StringVar(&o.CgroupRoot, "cgroup-root", "/sys/fs/cgroup", "The cgroup-root define the dir the cgroup2 hierarchy of the node is mounted at, or the cgroup dir holding it as unified, the socket programs serving the host ports and the services to the node itself are attached to it")
+	fs.Float32Var(&o.KubeAPIQPS, "kube-api-qps", 20, "The kube-api-qps define the QPS to use while talking with kubernetes apiserver")
+	fs.IntVar(&o.KubeAPIBurst, "kube-api-burst", 30, "The kube-api-burst define the burst to use while talking with kubernetes apiserver")
+	fs.IntVar(&o.AllocateConcurrency, "allocate-concurrency", 4, "The allocate-concurrency define the max number of ips updated at the same time by the node allocations")
+	fs.IntVar(&o.MaxPendingAllocations, "max-pending-allocations", 256, "The max-pending-allocations define the max number of allocations waiting on the node, the others are rejected to be retried by the CNI, 0 means no limit")
+	fs.StringVar(&o.MetricsBindAddress, "metrics-bind-address", ":9090", "The metrics-bind-address define the address serving the /metrics endpoint, empty disables it")
+	fs.IntVar(&o.WarmPoolSize, "warm-pool-size", 0, "The warm-pool-size define the number of addresses pre-claimed by the node for every ips it uses, 0 disables the warm pool")
+	fs.StringSliceVar(&o.WarmPools, "warm-pools", []string{"default-ips"}, "The warm-pools define the ips warmed when the agent starts, the other ips are warmed once used by the node")
+
+	fs.BoolVar(&o.EnableMasquerade, "enable-masquerade", false, "The enable-masquerade define whether the tcp and udp connections of the pods leaving the cluster are translated to the address of the node in eBPF, the stack masquerades them otherwise. ICMP and the fragmented packets are always left to the stack")
+	fs.StringSliceVar(&o.NonMasqueradeCIDRs, "non-masquerade-cidrs", nil, "The non-masquerade-cidrs define the IPv4 destinations the connections of the pods are not masqueraded to besides the pods and the nodes of the cluster")
+	fs.StringVar(&o.RoutingMode, "routing-mode", "vxlan", "The routing-mode define how the pods of the other nodes are reached, vxlan encapsulates the packets and native sends them to the node of the pod as the next hop when the nodes share an L2 segment, no route to the pods is programmed in the kernel. The packets to a node native has no route to are tunneled, the nodes accept the packets of both modes and the MTU of the pods leaves room for the tunnel")
+	fs.StringVar(&o.TunnelType, "tunnel-type", "vxlan", "The tunnel-type define the tunnel the pods of the other nodes are reached through, vxlan or geneve which carries the identity of the source pod in an option for the policies of the receiving node, all the nodes of the cluster must use the same tunnel type")
+	fs.IntVar(&o.TunnelPort, "tunnel-port", 0, "The tunnel-port define the udp port of the tunnel device, 0 is the default port of the kernel, 8472 for vxlan and 6081 for geneve")
+	fs.BoolVar(&o.EnableWireguard, "enable-wireguard", false, "The enable-wireguard define whether the packets to the pods of the other nodes are encrypted by wireguard whatever the routing mode, the public key of the node is published on the node and the packets to the nodes without key are dropped")
+	fs.IntVar(&o.WireguardPort, "wireguard-port", 51871, "The wireguard-port define the udp port of the wireguard device, all the nodes of the cluster must use the same port")
+	fs.DurationVar(&o.WireguardKeyRotationPeriod, "wireguard-key-rotation-period", 0, "The wireguard-key-rotation-period define how often the key of the wireguard device is replaced, jittered by up to 20% across the nodes. The packets between a node and its peers are dropped from the rotation until the peers see the new public key, 0 keeps the key until the device is recreated")
+
+	fs = fss.FlagSet("bpf")
+	fs.Uint32Var(&o.BPFMapMaxEntries.LocalPodIps, "bpf-map-local-pod-ips-max-entries", o.BPFMapMaxEntries.LocalPodIps, "The bpf-map-local-pod-ips-max-entries define the capacity of the local_pod_ips eBPF map, it bounds the number of pods of the node")
+	fs.Uint32Var(&o.BPFMapMaxEntries.ClusterPodIps, "bpf-map-cluster-pod-ips-max-entries", o.BPFMapMaxEntries.ClusterPodIps, "The bpf-map-cluster-pod-ips-max-entries define the capacity of the cluster_pod_ips eBPF map, it bounds the number of pods of the other nodes")
+	fs.Uint32Var(&o.BPFMapMaxEntries.HostPorts, "bpf-map-host-ports-max-entries", o.BPFMapMaxEntries.HostPorts, "The bpf-map-host-ports-max-entries define the capacity of the host_ports eBPF map, it bounds the number of host ports of the node")
+	fs.Uint32Var(&o.BPFMapMaxEntries.HostPortsCt, "bpf-map-host-ports-ct-max-entries", o.BPFMapMaxEntries.HostPortsCt, "The bpf-map-host-ports-ct-max-entries define the capacity of the host_ports_ct eBPF map, the least recently used connections to host ports are evicted beyond it")
+	fs.Uint32Var(&o.BPFMapMaxEntries.Services, "bpf-map-services-max-entries", o.BPFMapMaxEntries.Services, "The bpf-map-services-max-entries define the capacity of the services eBPF map, it bounds the number of service ports of the cluster")
+	fs.Uint32Var(&o.BPFMapMaxEntries.ServiceBackends, "bpf-map-service-backends-max-entries", o.BPFMapMaxEntries.ServiceBackends, "The bpf-map-service-backends-max-entries define the capacity of the service_backends eBPF map, it bounds the number of backends of all the service ports")
+	fs.Uint32Var(&o.BPFMapMaxEntries.ServiceCt, "bpf-map-service-ct-max-entries", o.BPFMapMaxEntries.ServiceCt, "The bpf-map-service-ct-max-entries define the capacity of the service_ct and service_rev_ct eBPF maps, the least recently used connections to services are evicted beyond it")
+	fs.Uint32Var(&o.BPFMapMaxEntries.NodePortCt, "bpf-map-node-port-ct-max-entries", o.BPFMapMaxEntries.NodePortCt, "The bpf-map-node-port-ct-max-entries define the capacity of the nodeport_ct and nodeport_rev_ct eBPF maps, the least recently used connections to the remote backends of the node ports and external ips are evicted beyond it")
+	fs.Uint32Var(&o.BPFMapMaxEntries.MasqCt, "bpf-map-masq-ct-max-entries", o.BPFMapMaxEntries.MasqCt, "The bpf-map-masq-ct-max-entries define the capacity of the masq_ct and masq_ports eBPF maps, the least recently used masqueraded connections of the pods are evicted beyond it")
+	fs.Uint32Var(&o.BPFMapMaxEntries.PolicyRules, "bpf-map-policy-rules-max-entries", o.BPFMapMaxEntries.PolicyRules, "The bpf-map-policy-rules-max-entries define the capacity of the policy_rules eBPF map, it bounds the number of pod peers, ports and directions the network policies allow the local pods")
+	fs.Uint32Var(&o.BPFMapMaxEntries.PolicyCidrs, "bpf-map-policy-cidrs-max-entries", o.BPFMapMaxEntries.PolicyCidrs, "The bpf-map-policy-cidrs-max-entries define the capacity of the policy_cidrs eBPF map, it bounds the number of ip blocks, ports and directions the network policies allow the local pods")
+	fs.Uint32Var(&o.BPFMapMaxEntries.PolicyCt, "bpf-map-policy-ct-max-entries", o.BPFMapMaxEntries.PolicyCt, "The bpf-map-policy-ct-max-entries define the capacity of the policy_ct eBPF map, the least recently used connections of the pods selected by network policies are evicted beyond it")
 
 	return fss
 }
@@ -546,6 +546,8 @@ func startGcManagerController(ctx context.Context, controllerContext ControllerC
 		controllerContext.ClientBuilder.ClientOrDie("fast-controller-manager"),
 		controllerContext.ClientBuilder.IpsClientOrDie("fast-controller-manager"),
 		controllerContext.InformerFactory.Core().V1().Pods(),
+		controllerContext.InformerFactory.Core().V1().Nodes(),
+		controllerContext.IpsInformerFactory.Sample().V1alpha1().Ipses(),
 	)
 	if err != nil {
 		return nil, false, err
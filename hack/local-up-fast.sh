@@ -13,10 +13,10 @@ kind create cluster --name "${KIND_CLUSTER_NAME}" --config "${REPO_ROOT}"/artifa
 
 # step2: build cni plugins
 make fast GOOS="linux"
-docker cp "${REPO_ROOT}"/artifacts/cni/node-99-fast.conf "${KIND_CLUSTER_NAME}"-worker:/etc/cni/net.d/99-fast.conf
+docker cp "${REPO_ROOT}"/artifacts/cni/node-99-fast.conflist "${KIND_CLUSTER_NAME}"-worker:/etc/cni/net.d/99-fast.conflist
 docker cp "${REPO_ROOT}"/_output/bin/linux/"${GOARCH}"/fast "${KIND_CLUSTER_NAME}"-worker:/opt/cni/bin/fast
 
-docker cp "${REPO_ROOT}"/artifacts/cni/master-99-fast.conf "${KIND_CLUSTER_NAME}"-control-plane:/etc/cni/net.d/99-fast.conf
+docker cp "${REPO_ROOT}"/artifacts/cni/master-99-fast.conflist "${KIND_CLUSTER_NAME}"-control-plane:/etc/cni/net.d/99-fast.conflist
 docker cp "${REPO_ROOT}"/_output/bin/linux/"${GOARCH}"/fast "${KIND_CLUSTER_NAME}"-control-plane:/opt/cni/bin/fast
 
 # step3: build image
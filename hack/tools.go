@@ -4,5 +4,6 @@
 package tools
 
 import (
+	_ "github.com/cilium/ebpf/cmd/bpf2go"
 	_ "k8s.io/code-generator"
 )
@@ -0,0 +1,87 @@
+package v1
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+
+	"github.com/fast-io/fast/pkg/ipsmanager"
+)
+
+// ErrorDomain is the domain set on the ErrorInfo details of every status returned by the service
+const ErrorDomain = "fast.io"
+
+// The reasons set on the ErrorInfo details, they let the client tell failures apart
+// without parsing the status message.
+const (
+	ReasonInvalidArgument      = "INVALID_ARGUMENT"
+	ReasonPodNotFound          = "POD_NOT_FOUND"
+	ReasonPodNotAlive          = "POD_NOT_ALIVE"
+	ReasonIpsNotFound          = "IPS_NOT_FOUND"
+	ReasonIpsExhausted         = "IPS_EXHAUSTED"
+	ReasonIPUnavailable        = "IP_UNAVAILABLE"
+	ReasonIpEndpointNotFound   = "IP_ENDPOINT_NOT_FOUND"
+	ReasonIpEndpointMismatch   = "IP_ENDPOINT_MISMATCH"
+	ReasonApiserverUnavailable = "APISERVER_UNAVAILABLE"
+	ReasonAllocateQueueFull    = "ALLOCATE_QUEUE_FULL"
+	ReasonInternal             = "INTERNAL"
+)
+
+// NewStatusError returns a gRPC status error with the given code and an ErrorInfo detail
+// carrying the reason and metadata.
+func NewStatusError(code codes.Code, reason, msg string, metadata map[string]string) error {
+	st := status.New(code, msg)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   ErrorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// ToStatusError maps an error returned while allocating or releasing to a gRPC status error.
+func ToStatusError(err error, metadata map[string]string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, ipsmanager.ErrIpsExhausted):
+		return NewStatusError(codes.ResourceExhausted, ReasonIpsExhausted, err.Error(), metadata)
+	case errors.Is(err, ipsmanager.ErrIPUnavailable):
+		return NewStatusError(codes.FailedPrecondition, ReasonIPUnavailable, err.Error(), metadata)
+	case errors.Is(err, ipsmanager.ErrAllocateQueueFull):
+		return NewStatusError(codes.Unavailable, ReasonAllocateQueueFull, err.Error(), metadata)
+	case isTransientError(err):
+		return NewStatusError(codes.Unavailable, ReasonApiserverUnavailable, err.Error(), metadata)
+	}
+	return NewStatusError(codes.Internal, ReasonInternal, err.Error(), metadata)
+}
+
+// isTransientError returns true if the error is caused by an apiserver that is
+// temporarily unreachable or overloaded, retrying the request later may succeed.
+func isTransientError(err error) bool {
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsUnexpectedServerError(err) ||
+		apierrors.IsConflict(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsProbableEOF(err) ||
+		utilnet.IsTimeout(err) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
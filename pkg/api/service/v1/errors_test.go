@@ -0,0 +1,79 @@
+package v1
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/fast-io/fast/pkg/ipsmanager"
+)
+
+func TestToStatusError(t *testing.T) {
+	ipsResource := schema.GroupResource{Group: "sample.fast.io", Resource: "ipses"}
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   codes.Code
+		wantReason string
+	}{
+		{
+			name:       "ips exhausted",
+			err:        fmt.Errorf("failed to allocate IP from ips default-ips: %w", fmt.Errorf("ips default-ips: %w", ipsmanager.ErrIpsExhausted)),
+			wantCode:   codes.ResourceExhausted,
+			wantReason: ReasonIpsExhausted,
+		},
+		{
+			name:       "requested ip unavailable",
+			err:        fmt.Errorf("failed to allocate IP 10.244.100.1 from ips default-ips: %w", ipsmanager.ErrIPUnavailable),
+			wantCode:   codes.FailedPrecondition,
+			wantReason: ReasonIPUnavailable,
+		},
+		{
+			name:       "apiserver timeout",
+			err:        apierrors.NewServerTimeout(ipsResource, "get", 1),
+			wantCode:   codes.Unavailable,
+			wantReason: ReasonApiserverUnavailable,
+		},
+		{
+			name:       "conflict retries exhausted",
+			err:        fmt.Errorf("failed to allocate IP from ips default-ips: %w", apierrors.NewConflict(ipsResource, "default-ips", fmt.Errorf("conflict"))),
+			wantCode:   codes.Unavailable,
+			wantReason: ReasonApiserverUnavailable,
+		},
+		{
+			name:       "allocate queue full",
+			err:        ipsmanager.ErrAllocateQueueFull,
+			wantCode:   codes.Unavailable,
+			wantReason: ReasonAllocateQueueFull,
+		},
+		{
+			name:       "unknown error",
+			err:        fmt.Errorf("unknown"),
+			wantCode:   codes.Internal,
+			wantReason: ReasonInternal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(ToStatusError(tt.err, map[string]string{"namespace": "default", "name": "test"}))
+			if st.Code() != tt.wantCode {
+				t.Errorf("ToStatusError() code = %v, want %v", st.Code(), tt.wantCode)
+			}
+			if len(st.Details()) != 1 {
+				t.Fatalf("ToStatusError() details = %v, want one ErrorInfo", st.Details())
+			}
+			info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			if !ok {
+				t.Fatalf("ToStatusError() detail = %T, want ErrorInfo", st.Details()[0])
+			}
+			if info.Reason != tt.wantReason || info.Domain != ErrorDomain {
+				t.Errorf("ToStatusError() reason = %v/%v, want %v/%v", info.Domain, info.Reason, ErrorDomain, tt.wantReason)
+			}
+		})
+	}
+}
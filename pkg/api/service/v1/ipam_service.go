@@ -3,14 +3,27 @@ package v1
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
 	ipamapiv1 "github.com/fast-io/fast/pkg/api/proto/v1"
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
 	ipsversioned "github.com/fast-io/fast/pkg/generated/clientset/versioned"
+	ipsinformers "github.com/fast-io/fast/pkg/generated/informers/externalversions/ips/v1alpha1"
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
+	"github.com/fast-io/fast/pkg/ipamcache"
 	"github.com/fast-io/fast/pkg/ipsmanager"
 	"github.com/fast-io/fast/pkg/util"
 )
@@ -19,22 +32,64 @@ type IPAMService struct {
 	client     ipsversioned.Interface
 	kubeClient kubernetes.Interface
 	logger     *zap.Logger
+	nodeName   string
+
+	podLister  corelisters.PodLister
+	ipepLister ipslisters.IpEndpointLister
+	ipepSynced cache.InformerSynced
+
+	// cache keeps the allocations of the node, it serves the allocation while the apiserver is unreachable
+	cache ipamcache.Cache
+	// pendingReleaseDir is where the CNI plugin records the releases it could not send
+	pendingReleaseDir string
 
 	ipsManager ipsmanager.IpsManager
+	// allocator queues and coalesces the allocations of the node per ips
+	allocator *ipsmanager.Allocator
 
 	ipamapiv1.UnimplementedIpServiceServer
 }
 
+// Interface is the interface of the pod an address is allocated for
+type Interface struct {
+	// IfName is the name of the interface in the pod netns, it is the default interface when empty
+	IfName string
+	// Network is the name of the network the interface is attached to
+	Network string
+	// Ips is the ips the address is allocated from, the ips of the pod is used when it is empty
+	Ips string
+	// IP is the address asked for by the runtime, a free address of the ips is allocated when it is empty
+	IP string
+	// ContainerID is the sandbox the interface is set up for
+	ContainerID string
+}
+
 func NewIPAMService(
 	ctx context.Context,
+	nodeName string,
 	kubeClient kubernetes.Interface,
 	client ipsversioned.Interface,
-	logger *zap.Logger) ipamapiv1.IpServiceServer {
+	podInformer coreinformers.PodInformer,
+	ipepInformer ipsinformers.IpEndpointInformer,
+	cache ipamcache.Cache,
+	pendingReleaseDir string,
+	allocateConcurrency int,
+	maxPendingAllocations int,
+	logger *zap.Logger) *IPAMService {
+	ipsManager := ipsmanager.NewIpsManager(client)
 	return &IPAMService{
 		client:     client,
 		kubeClient: kubeClient,
 		logger:     logger,
-		ipsManager: ipsmanager.NewIpsManager(client),
+		nodeName:   nodeName,
+		podLister:  podInformer.Lister(),
+		ipepLister: ipepInformer.Lister(),
+		ipepSynced: ipepInformer.Informer().HasSynced,
+		cache:      cache,
+		ipsManager: ipsManager,
+		allocator:  ipsmanager.NewAllocator(ipsManager, allocateConcurrency, maxPendingAllocations),
+
+		pendingReleaseDir: pendingReleaseDir,
 	}
 }
 
@@ -43,56 +98,341 @@ func (s *IPAMService) Health(context.Context, *ipamapiv1.HealthRequest) (*ipamap
 }
 
 func (s *IPAMService) Allocate(ctx context.Context, req *ipamapiv1.AllocateRequest) (*ipamapiv1.AllocateResponse, error) {
-	if len(req.Namespace) == 0 || len(req.Name) == 0 {
-		return nil, fmt.Errorf("namespace or name can not be none")
+	ipep, err := s.AllocateIpEndpoint(ctx, req.Namespace, req.Name, req.Uid, Interface{IfName: req.IfName, ContainerID: req.Id})
+	if err != nil {
+		return nil, err
+	}
+	return &ipamapiv1.AllocateResponse{Ip: ipep.Status.Allocation(ifName(req.IfName), "").IPv4}, nil
+}
+
+// AllocateIpEndpoint allocates an ip for the interface of the pod and returns the ip endpoint of
+// the pod, the ip endpoint is returned directly if the interface already got an ip on the network.
+// The allocation moves to the sandbox of the request when it was set up for another one, and the
+// ip of the interface on another network is released. The returned error is a gRPC status error.
+func (s *IPAMService) AllocateIpEndpoint(ctx context.Context, namespace, name, uid string, iface Interface) (*ipsv1alpha1.IpEndpoint, error) {
+	if len(namespace) == 0 || len(name) == 0 {
+		return nil, NewStatusError(codes.InvalidArgument, ReasonInvalidArgument, "namespace or name can not be none", nil)
+	}
+	nic := ifName(iface.IfName)
+	s.logger.Info("allocate ip", zap.String("namespace", namespace), zap.String("name", name), zap.String("interface", nic))
+	metadata := map[string]string{"namespace": namespace, "name": name, "interface": nic}
+
+	// the re-ADD of a pod which already got an ip is served by the local cache without the apiserver
+	if entry, ok := s.cache.Get(namespace, name); ok && !entry.Releasing(nic) {
+		if detail := entry.Status.Allocation(nic, iface.Network); detail != nil && len(detail.IPv4) > 0 && (len(uid) == 0 || entry.Status.UID == uid) &&
+			sameSandbox(detail, iface.ContainerID) {
+			s.logger.Info("ip endpoint exist in cache", zap.String("ip", detail.IPv4))
+			if err := requestedIP(iface.IP, detail, metadata); err != nil {
+				return nil, err
+			}
+			return entry.IpEndpoint(), nil
+		}
 	}
-	s.logger.Info("allocate ip", zap.String("namespace", req.Namespace), zap.String("name", req.Name))
 
-	pod, err := s.kubeClient.CoreV1().Pods(req.Namespace).Get(ctx, req.Name, metav1.GetOptions{})
+	pod, err := s.getPod(ctx, namespace, name)
 	if err != nil {
 		s.logger.Error("get pod from lister error", zap.Error(err))
-		return nil, err
+		if apierrors.IsNotFound(err) {
+			return nil, NewStatusError(codes.NotFound, ReasonPodNotFound, err.Error(), metadata)
+		}
+		return nil, ToStatusError(err, metadata)
 	}
 	if !util.IsPodAlive(pod) {
-		return nil, fmt.Errorf("pod is not alive")
+		return nil, NewStatusError(codes.FailedPrecondition, ReasonPodNotAlive, fmt.Sprintf("pod %s/%s is not alive", pod.Namespace, pod.Name), metadata)
 	}
 
-	ipep, err := s.client.SampleV1alpha1().IpEndpoints(req.Namespace).Get(ctx, req.Name, metav1.GetOptions{})
+	ipep, err := s.getIpEndpoint(ctx, namespace, name)
 	if err != nil && !apierrors.IsNotFound(err) {
 		s.logger.Error("get ip endpoint error", zap.Error(err))
-		return nil, err
+		return nil, ToStatusError(err, metadata)
 	}
-	if ipep != nil && len(ipep.Status.IPs.IPv4) > 0 {
-		s.logger.Info("ip endpoint exist", zap.String("ip", ipep.Status.IPs.IPv4))
-		return &ipamapiv1.AllocateResponse{Ip: ipep.Status.IPs.IPv4}, nil
+	if err == nil {
+		if detail := ipep.Status.Allocation(nic, iface.Network); detail != nil && len(detail.IPv4) > 0 {
+			s.logger.Info("ip endpoint exist", zap.String("ip", detail.IPv4))
+			if err := requestedIP(iface.IP, detail, metadata); err != nil {
+				return nil, err
+			}
+			if !sameSandbox(detail, iface.ContainerID) {
+				detail.ContainerID = iface.ContainerID
+				ipep = ipep.DeepCopy()
+				ipep.Status.SetAllocation(*detail)
+				if err := s.ipsManager.CreateIpEndpoint(ctx, ipep); err != nil {
+					s.logger.Error("failed to move ip endpoint to sandbox", zap.Error(err))
+					return nil, ToStatusError(err, metadata)
+				}
+			}
+			s.setCache(ipep)
+			return ipep, nil
+		}
+		if detail := ipep.Status.Allocation(nic, ""); detail != nil {
+			s.logger.Info("release ip of interface on another network", zap.String("ip", detail.IPv4), zap.String("network", detail.Network))
+			if err := s.ipsManager.ReleaseIP(ctx, namespace, name, ipsmanager.Release{Interface: nic, Network: detail.Network}); err != nil {
+				s.logger.Error("failed to release ip of interface on another network", zap.Error(err))
+				return nil, ToStatusError(err, metadata)
+			}
+			s.forgetCache(namespace, name, ipsmanager.Release{Interface: nic, Network: detail.Network})
+		}
 	}
 
-	allocateResult, err := s.ipsManager.AllocateIP(ctx, pod)
+	ipsName := iface.Ips
+	if len(ipsName) == 0 {
+		ipsName = ipsmanager.IpsNameByPod(pod)
+	}
+	allocateResult, err := s.allocator.Allocate(ctx, ipsName, &ipsmanager.PodInterface{Pod: pod, Interface: nic, IP: iface.IP})
 	if err != nil {
 		s.logger.Error("failed to allocate ip", zap.Error(err))
-		return nil, err
+		if apierrors.IsNotFound(err) {
+			return nil, NewStatusError(codes.FailedPrecondition, ReasonIpsNotFound, err.Error(), metadata)
+		}
+		return nil, ToStatusError(err, metadata)
 	}
+	metadata["ips"] = allocateResult.IPsName
 
-	ipep, err = s.ipsManager.NewIpEndpoint(allocateResult.IPsName, pod, allocateResult.IP)
+	ipep, err = s.ipsManager.NewIpEndpoint(pod, ipsv1alpha1.IPAllocationDetail{
+		NIC:         nic,
+		Network:     iface.Network,
+		IPv4:        allocateResult.IP,
+		IPv4Pool:    allocateResult.IPsName,
+		ContainerID: iface.ContainerID,
+	})
 	if err != nil {
 		s.logger.Error("failed to new ip endpoint")
-		return nil, err
+		return nil, ToStatusError(err, metadata)
 	}
 
 	if err := s.ipsManager.CreateIpEndpoint(ctx, ipep); err != nil {
 		s.logger.Error("failed to create or update ip endpoint", zap.Error(err))
-		return nil, err
+		return nil, ToStatusError(err, metadata)
 	}
 	s.logger.Info("allocate ip successfully", zap.String("ip", allocateResult.IP))
+	s.setCache(ipep)
 
-	return &ipamapiv1.AllocateResponse{Ip: allocateResult.IP}, nil
+	return ipep, nil
+}
+
+// sameSandbox returns true if the allocation was set up for the sandbox
+func sameSandbox(detail *ipsv1alpha1.IPAllocationDetail, containerID string) bool {
+	return len(containerID) == 0 || detail.ContainerID == containerID
+}
+
+// requestedIP returns an error if the interface already holds an address other than the one asked for
+func requestedIP(ip string, detail *ipsv1alpha1.IPAllocationDetail, metadata map[string]string) error {
+	if len(ip) == 0 || ip == detail.IPv4 {
+		return nil
+	}
+	return NewStatusError(codes.FailedPrecondition, ReasonIPUnavailable,
+		fmt.Sprintf("interface %s already has ip %s, ip %s is requested", detail.NIC, detail.IPv4, ip), metadata)
+}
+
+// CheckIpEndpoint returns the ip endpoint of the pod without allocating, it returns an error
+// if the ip endpoint does not exist, has no address for the interface on the network or does
+// not belong to the pod on this node.
+func (s *IPAMService) CheckIpEndpoint(ctx context.Context, namespace, name, uid, nic, network string) (*ipsv1alpha1.IpEndpoint, error) {
+	if len(namespace) == 0 || len(name) == 0 {
+		return nil, NewStatusError(codes.InvalidArgument, ReasonInvalidArgument, "namespace or name can not be none", nil)
+	}
+	nic = ifName(nic)
+	metadata := map[string]string{"namespace": namespace, "name": name, "interface": nic}
+
+	pod, err := s.getPod(ctx, namespace, name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, NewStatusError(codes.NotFound, ReasonPodNotFound, err.Error(), metadata)
+		}
+		return nil, ToStatusError(err, metadata)
+	}
+	ipep, err := s.getIpEndpoint(ctx, namespace, name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, NewStatusError(codes.NotFound, ReasonIpEndpointNotFound, err.Error(), metadata)
+		}
+		return nil, ToStatusError(err, metadata)
+	}
+
+	mismatch := func(format string, a ...interface{}) error {
+		return NewStatusError(codes.FailedPrecondition, ReasonIpEndpointMismatch, fmt.Sprintf(format, a...), metadata)
+	}
+	detail := ipep.Status.Allocation(nic, network)
+	switch {
+	case detail == nil || len(detail.IPv4) == 0:
+		return nil, mismatch("ip endpoint %s/%s has no ipv4 address for interface %s on network %q", namespace, name, nic, network)
+	case len(uid) > 0 && ipep.Status.UID != uid:
+		return nil, mismatch("ip endpoint %s/%s belongs to pod uid %s, want %s", namespace, name, ipep.Status.UID, uid)
+	case ipep.Status.UID != string(pod.UID):
+		return nil, mismatch("ip endpoint %s/%s belongs to pod uid %s, the pod uid is %s", namespace, name, ipep.Status.UID, pod.UID)
+	case ipep.Status.Node != s.nodeName:
+		return nil, mismatch("ip endpoint %s/%s is on node %s, want %s", namespace, name, ipep.Status.Node, s.nodeName)
+	// the pod ip is the ip of the default interface
+	case nic == ipsmanager.DefaultInterface && len(pod.Status.PodIP) > 0 && pod.Status.PodIP != detail.IPv4:
+		return nil, mismatch("ip endpoint %s/%s has ip %s, the pod ip is %s", namespace, name, detail.IPv4, pod.Status.PodIP)
+	}
+	return ipep, nil
 }
 
 func (s *IPAMService) Release(ctx context.Context, req *ipamapiv1.AllocateRequest) (*ipamapiv1.ReleaseResponse, error) {
-	if len(req.Namespace) == 0 || len(req.Name) == 0 {
-		return nil, fmt.Errorf("namespace or name can not be none")
+	if err := s.ReleaseInterface(ctx, req.Namespace, req.Name, ipsmanager.Release{Interface: ifName(req.IfName), ContainerID: req.Id}); err != nil {
+		return nil, err
 	}
-	s.logger.Info("release ip", zap.String("namespace", req.Namespace), zap.String("name", req.Name))
+	return &ipamapiv1.ReleaseResponse{}, nil
+}
+
+// ReleaseInterface releases the ip of the interface of the pod, the release is deferred to the
+// reconciliation when the apiserver is unreachable. The returned error is a gRPC status error.
+func (s *IPAMService) ReleaseInterface(ctx context.Context, namespace, name string, release ipsmanager.Release) error {
+	if len(namespace) == 0 || len(name) == 0 {
+		return NewStatusError(codes.InvalidArgument, ReasonInvalidArgument, "namespace or name can not be none", nil)
+	}
+	release.Interface = ifName(release.Interface)
+	nic := release.Interface
+	s.logger.Info("release ip", zap.String("namespace", namespace), zap.String("name", name), zap.String("interface", nic))
+	// a late release of an old sandbox of the pod keeps the allocation of the new one
+	if ipep, err := s.getIpEndpoint(ctx, namespace, name); err == nil {
+		if detail := ipep.Status.Allocation(nic, release.Network); detail != nil && !detail.HeldBy(release.ContainerID) {
+			s.logger.Info("skip release of another sandbox", zap.String("containerID", release.ContainerID), zap.String("holder", detail.ContainerID))
+			return nil
+		}
+	}
+	s.allocator.Forget(namespace, name, nic)
+
+	if err := s.ipsManager.ReleaseIP(ctx, namespace, name, release); err != nil {
+		if !isTransientError(err) {
+			return ToStatusError(err, map[string]string{"namespace": namespace, "name": name})
+		}
+		// the apiserver is unreachable, the release of the interface is deferred to the reconciliation
+		s.logger.Warn("failed to release ip, defer it", zap.String("namespace", namespace), zap.String("name", name), zap.Error(err))
+		entry, ok := s.cache.Get(namespace, name)
+		if !ok {
+			entry = &ipamcache.Entry{Namespace: namespace, Name: name}
+		}
+		entry.AddPendingRelease(ipamcache.Release{IfName: nic, Network: release.Network, ContainerID: release.ContainerID})
+		if err := s.cache.Set(entry); err != nil {
+			return ToStatusError(err, map[string]string{"namespace": namespace, "name": name})
+		}
+		return nil
+	}
+	s.forgetCache(namespace, name, release)
+	return nil
+}
+
+// warmPoolRetryPeriod is how often the warm pool is retried while the apiserver is unreachable
+const warmPoolRetryPeriod = 10 * time.Second
+
+// EnableWarmPool keeps size warm addresses of every ips used by the node, so that
+// an allocation is served without waiting for the ips update. The warm pool is enabled in the
+// background once the ip endpoints are synced and retried while the apiserver is unreachable,
+// the allocations are served from the cache meanwhile.
+func (s *IPAMService) EnableWarmPool(ctx context.Context, size int, ipsNames []string) {
+	if size <= 0 {
+		return
+	}
+	go func() {
+		if !cache.WaitForCacheSync(ctx.Done(), s.ipepSynced) {
+			return
+		}
+		_ = wait.PollUntilContextCancel(ctx, warmPoolRetryPeriod, true, func(ctx context.Context) (bool, error) {
+			if err := s.enableWarmPool(ctx, size, ipsNames); err != nil {
+				s.logger.Warn("failed to enable warm pool, retry it", zap.Error(err))
+				return false, nil
+			}
+			return true, nil
+		})
+	}()
+}
+
+// enableWarmPool enables the warm pool, the addresses held by the allocations of the node in
+// the cache and on the synced ip endpoints are never adopted as warm, their binds may not have
+// landed before the agent restarted.
+func (s *IPAMService) enableWarmPool(ctx context.Context, size int, ipsNames []string) error {
+	held := make(map[string]*ipsmanager.WarmBind)
+	hold := func(namespace, name string, status ipsv1alpha1.IpEndpointStatus) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(status.UID)},
+			Spec:       corev1.PodSpec{NodeName: s.nodeName},
+		}
+		for _, detail := range status.Details() {
+			if len(detail.IPv4) > 0 {
+				held[detail.IPv4] = &ipsmanager.WarmBind{IP: detail.IPv4, Pod: pod, Interface: detail.NIC}
+			}
+		}
+	}
+	for _, entry := range s.cache.List() {
+		status := entry.Status.DeepCopy()
+		for _, detail := range entry.Status.Details() {
+			if entry.Releasing(detail.NIC) {
+				status.RemoveAllocation(detail.NIC)
+			}
+		}
+		hold(entry.Namespace, entry.Name, *status)
+	}
+	ipeps, err := s.ipepLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list ip endpoints: %w", err)
+	}
+	for _, ipep := range ipeps {
+		if ipep.Status.Node == s.nodeName && ipep.DeletionTimestamp.IsZero() {
+			hold(ipep.Namespace, ipep.Name, ipep.Status)
+		}
+	}
+	return s.allocator.EnableWarmPool(ctx, s.nodeName, size, ipsNames, held)
+}
 
-	return &ipamapiv1.ReleaseResponse{}, s.ipsManager.ReleaseIP(ctx, req.Namespace, req.Name)
+// getPod gets the pod from the lister, the apiserver is only requested when
+// the pod is not yet in the lister.
+func (s *IPAMService) getPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	pod, err := s.podLister.Pods(namespace).Get(name)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return pod, err
+	}
+	return s.kubeClient.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// getIpEndpoint gets the ip endpoint from the lister, the apiserver is requested
+// until the lister is synced to avoid allocating twice.
+func (s *IPAMService) getIpEndpoint(ctx context.Context, namespace, name string) (*ipsv1alpha1.IpEndpoint, error) {
+	if s.ipepSynced() {
+		return s.ipepLister.IpEndpoints(namespace).Get(name)
+	}
+	return s.client.SampleV1alpha1().IpEndpoints(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (s *IPAMService) setCache(ipep *ipsv1alpha1.IpEndpoint) {
+	if err := s.cache.Set(&ipamcache.Entry{
+		Namespace: ipep.Namespace,
+		Name:      ipep.Name,
+		Status:    ipep.Status,
+	}); err != nil {
+		s.logger.Error("failed to save ip endpoint to cache", zap.Error(err))
+	}
+}
+
+// forgetCache removes the allocations released from the cache, the entry is deleted once the
+// pod has no allocation and no deferred release left.
+func (s *IPAMService) forgetCache(namespace, name string, release ipsmanager.Release) {
+	entry, ok := s.cache.Get(namespace, name)
+	if !ok {
+		return
+	}
+	for _, detail := range entry.Status.Details() {
+		if release.Matches(detail) {
+			entry.Status.RemoveAllocation(detail.NIC)
+		}
+	}
+	var err error
+	if len(entry.Status.Details()) == 0 && len(entry.PendingReleases) == 0 {
+		err = s.cache.Delete(namespace, name)
+	} else {
+		err = s.cache.Set(entry)
+	}
+	if err != nil {
+		s.logger.Error("failed to delete ip endpoint from cache", zap.Error(err))
+	}
+}
+
+// ifName returns the name of the interface, the default interface is used by the clients
+// which do not send one.
+func ifName(nic string) string {
+	if len(nic) == 0 {
+		return ipsmanager.DefaultInterface
+	}
+	return nic
 }
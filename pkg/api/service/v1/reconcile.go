@@ -0,0 +1,113 @@
+package v1
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/fast-io/fast/pkg/ipamcache"
+	"github.com/fast-io/fast/pkg/ipsmanager"
+)
+
+// Reconcile catches up the local cache with the apiserver. It retries the deferred releases,
+// drops the allocations released by others, adds the allocations of the node and refills
+// the warm pool.
+func (s *IPAMService) Reconcile(ctx context.Context) {
+	s.allocator.RefillWarmPools(ctx)
+	s.addPendingReleases()
+	if !s.ipepSynced() {
+		return
+	}
+
+	for _, entry := range s.cache.List() {
+		if len(entry.PendingReleases) > 0 {
+			s.releasePending(ctx, entry)
+			continue
+		}
+
+		if _, err := s.ipepLister.IpEndpoints(entry.Namespace).Get(entry.Name); apierrors.IsNotFound(err) {
+			if err := s.cache.Delete(entry.Namespace, entry.Name); err != nil {
+				s.logger.Error("failed to delete ip endpoint from cache", zap.Error(err))
+			}
+		}
+	}
+
+	ipeps, err := s.ipepLister.List(labels.Everything())
+	if err != nil {
+		s.logger.Error("failed to list ip endpoints", zap.Error(err))
+		return
+	}
+	for _, ipep := range ipeps {
+		if ipep.Status.Node != s.nodeName || len(ipep.Status.Details()) == 0 || !ipep.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if _, ok := s.cache.Get(ipep.Namespace, ipep.Name); ok {
+			continue
+		}
+		s.setCache(ipep)
+	}
+}
+
+// releasePending retries the deferred releases of the pod, the releases which fail again are
+// kept for the next reconciliation.
+func (s *IPAMService) releasePending(ctx context.Context, entry *ipamcache.Entry) {
+	var failed []ipamcache.Release
+	for _, pending := range entry.PendingReleases {
+		release := ipsmanager.Release{Interface: pending.IfName, Network: pending.Network, ContainerID: pending.ContainerID}
+		if err := s.ipsManager.ReleaseIP(ctx, entry.Namespace, entry.Name, release); err != nil {
+			s.logger.Warn("failed to release deferred ip", zap.String("namespace", entry.Namespace), zap.String("name", entry.Name),
+				zap.String("interface", pending.IfName), zap.Error(err))
+			failed = append(failed, pending)
+			continue
+		}
+		s.logger.Info("release deferred ip successfully", zap.String("namespace", entry.Namespace), zap.String("name", entry.Name),
+			zap.String("interface", pending.IfName))
+		for _, detail := range entry.Status.Details() {
+			if release.Matches(detail) {
+				entry.Status.RemoveAllocation(detail.NIC)
+			}
+		}
+	}
+	entry.PendingReleases = failed
+
+	var err error
+	if len(entry.Status.Details()) == 0 && len(entry.PendingReleases) == 0 {
+		err = s.cache.Delete(entry.Namespace, entry.Name)
+	} else {
+		err = s.cache.Set(entry)
+	}
+	if err != nil {
+		s.logger.Error("failed to update ip endpoint in cache", zap.Error(err))
+	}
+}
+
+// addPendingReleases moves the releases recorded by the CNI plugin into the cache, a release
+// of a pod which was created again since then is dropped.
+func (s *IPAMService) addPendingReleases() {
+	releases, err := ipamcache.ListPendingReleases(s.pendingReleaseDir)
+	if err != nil {
+		s.logger.Error("failed to list pending releases", zap.Error(err))
+		return
+	}
+	for _, release := range releases {
+		entry, ok := s.cache.Get(release.Namespace, release.Name)
+		if !ok {
+			entry = &ipamcache.Entry{Namespace: release.Namespace, Name: release.Name}
+		}
+		if ok && len(release.UID) > 0 && len(entry.Status.UID) > 0 && entry.Status.UID != release.UID {
+			s.logger.Info("drop pending release of old pod", zap.String("namespace", release.Namespace), zap.String("name", release.Name))
+		} else {
+			s.allocator.Forget(release.Namespace, release.Name, release.IfName)
+			entry.AddPendingRelease(release.Release)
+			if err := s.cache.Set(entry); err != nil {
+				s.logger.Error("failed to add pending release to cache", zap.Error(err))
+				continue
+			}
+		}
+		if err := ipamcache.RemovePendingRelease(s.pendingReleaseDir, release); err != nil {
+			s.logger.Error("failed to remove pending release", zap.Error(err))
+		}
+	}
+}
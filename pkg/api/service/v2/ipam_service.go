@@ -0,0 +1,176 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ipamapiv1 "github.com/fast-io/fast/pkg/api/proto/v1"
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+	ipamservicev1 "github.com/fast-io/fast/pkg/api/service/v1"
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+	ipsversioned "github.com/fast-io/fast/pkg/generated/clientset/versioned"
+	ipsinformers "github.com/fast-io/fast/pkg/generated/informers/externalversions/ips/v1alpha1"
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
+	"github.com/fast-io/fast/pkg/ipsmanager"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// IPAMService serves the v2 ip service, it allocates through the v1 service and
+// completes the response with the interface configuration of the selected ips.
+type IPAMService struct {
+	client ipsversioned.Interface
+	logger *zap.Logger
+
+	ipsLister ipslisters.IpsLister
+
+	v1 *ipamservicev1.IPAMService
+
+	ipamapiv2.UnimplementedIpServiceServer
+}
+
+// NewIPAMService returns the v2 service, it shares the allocation with the given v1 service
+func NewIPAMService(
+	ctx context.Context,
+	client ipsversioned.Interface,
+	ipsInformer ipsinformers.IpsInformer,
+	v1 *ipamservicev1.IPAMService,
+	logger *zap.Logger) *IPAMService {
+	return &IPAMService{
+		client:    client,
+		logger:    logger,
+		ipsLister: ipsInformer.Lister(),
+		v1:        v1,
+	}
+}
+
+func (s *IPAMService) Health(ctx context.Context, _ *ipamapiv2.HealthRequest) (*ipamapiv2.HealthResponse, error) {
+	resp, err := s.v1.Health(ctx, &ipamapiv1.HealthRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &ipamapiv2.HealthResponse{Health: ipamapiv2.HealthyType(resp.Health)}, nil
+}
+
+func (s *IPAMService) Allocate(ctx context.Context, req *ipamapiv2.AllocateRequest) (*ipamapiv2.AllocateResponse, error) {
+	ipep, err := s.v1.AllocateIpEndpoint(ctx, req.Namespace, req.Name, req.Uid, ipamservicev1.Interface{
+		IfName:      req.IfName,
+		Network:     req.Network,
+		Ips:         req.Ips,
+		IP:          req.Ip,
+		ContainerID: req.Id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.response(ctx, ipep, req.IfName, req.Network)
+}
+
+// Check returns the interface configuration of the ip endpoint of the pod without allocating,
+// an error is returned if the ip endpoint does not match the pod.
+func (s *IPAMService) Check(ctx context.Context, req *ipamapiv2.AllocateRequest) (*ipamapiv2.AllocateResponse, error) {
+	ipep, err := s.v1.CheckIpEndpoint(ctx, req.Namespace, req.Name, req.Uid, req.IfName, req.Network)
+	if err != nil {
+		return nil, err
+	}
+	return s.response(ctx, ipep, req.IfName, req.Network)
+}
+
+// response builds the configuration of the interface from its allocation on the network in the ip endpoint
+func (s *IPAMService) response(ctx context.Context, ipep *ipsv1alpha1.IpEndpoint, nic, network string) (*ipamapiv2.AllocateResponse, error) {
+	if len(nic) == 0 {
+		nic = ipsmanager.DefaultInterface
+	}
+	metadata := map[string]string{"namespace": ipep.Namespace, "name": ipep.Name, "interface": nic}
+	detail := ipep.Status.Allocation(nic, network)
+	if detail == nil {
+		return nil, ipamservicev1.ToStatusError(fmt.Errorf("ip endpoint %s/%s has no allocation for interface %s on network %q",
+			ipep.Namespace, ipep.Name, nic, network), metadata)
+	}
+
+	resp := &ipamapiv2.AllocateResponse{}
+	if len(detail.IPv4) > 0 {
+		ips, err := s.getIps(ctx, detail.IPv4Pool)
+		if err != nil {
+			s.logger.Error("failed to get ips", zap.String("ips", detail.IPv4Pool), zap.Error(err))
+			return nil, ipamservicev1.ToStatusError(err, metadata)
+		}
+		if err := completeResponse(resp, ipamapiv2.IPFamily_IPv4, detail.IPv4, ips); err != nil {
+			return nil, ipamservicev1.ToStatusError(err, metadata)
+		}
+		resp.Mac = util.GenerateMacByIP(net.ParseIP(detail.IPv4)).String()
+	}
+	if len(detail.IPv6) > 0 {
+		ips, err := s.getIps(ctx, detail.IPv6Pool)
+		if err != nil {
+			s.logger.Error("failed to get ips", zap.String("ips", detail.IPv6Pool), zap.Error(err))
+			return nil, ipamservicev1.ToStatusError(err, metadata)
+		}
+		if err := completeResponse(resp, ipamapiv2.IPFamily_IPv6, detail.IPv6, ips); err != nil {
+			return nil, ipamservicev1.ToStatusError(err, metadata)
+		}
+	}
+	return resp, nil
+}
+
+func (s *IPAMService) Release(ctx context.Context, req *ipamapiv2.AllocateRequest) (*ipamapiv2.ReleaseResponse, error) {
+	if err := s.v1.ReleaseInterface(ctx, req.Namespace, req.Name, ipsmanager.Release{
+		Interface:   req.IfName,
+		Network:     req.Network,
+		ContainerID: req.Id,
+	}); err != nil {
+		return nil, err
+	}
+	return &ipamapiv2.ReleaseResponse{}, nil
+}
+
+// getIps gets the ips from the lister, the apiserver is only requested when the ips is not yet in the lister
+func (s *IPAMService) getIps(ctx context.Context, name string) (*ipsv1alpha1.Ips, error) {
+	ips, err := s.ipsLister.Get(name)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return ips, err
+	}
+	return s.client.SampleV1alpha1().Ipses().Get(ctx, name, metav1.GetOptions{})
+}
+
+// completeResponse adds the ip of the family and the interface configuration of the ips to the response,
+// the MTU, VLAN and DNS of the first family win when both families are set. The VNI is the one of the
+// IPv4 ips, the eBPF datapath isolates the tenants by their IPv4 addresses.
+func completeResponse(resp *ipamapiv2.AllocateResponse, family ipamapiv2.IPFamily, ip string, ips *ipsv1alpha1.Ips) error {
+	_, subnet, err := net.ParseCIDR(ips.Spec.Subnet)
+	if err != nil {
+		return fmt.Errorf("failed to parse subnet %q of ips %s: %w", ips.Spec.Subnet, ips.Name, err)
+	}
+	ones, _ := subnet.Mask.Size()
+	resp.Ips = append(resp.Ips, &ipamapiv2.IPConfig{
+		Family:  family,
+		Address: fmt.Sprintf("%s/%d", ip, ones),
+		Gateway: ips.Spec.Gateway,
+	})
+
+	for _, route := range ips.Spec.Routes {
+		resp.Routes = append(resp.Routes, &ipamapiv2.Route{Dst: route.Dst, Gateway: route.Gateway})
+	}
+	if resp.Mtu == 0 {
+		resp.Mtu = int32(ips.Spec.MTU)
+	}
+	if resp.Vlan == 0 {
+		resp.Vlan = int32(ips.Spec.Vlan)
+	}
+	if family == ipamapiv2.IPFamily_IPv4 {
+		resp.Vni = uint32(ips.Spec.Vni)
+	}
+	if resp.Dns == nil && ips.Spec.DNS != nil {
+		resp.Dns = &ipamapiv2.DNS{
+			Nameservers: ips.Spec.DNS.Nameservers,
+			Domain:      ips.Spec.DNS.Domain,
+			Search:      ips.Spec.DNS.Search,
+			Options:     ips.Spec.DNS.Options,
+		}
+	}
+	return nil
+}
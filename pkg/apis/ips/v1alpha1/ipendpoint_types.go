@@ -25,6 +25,9 @@ type IpEndpointList struct {
 	Items           []IpEndpoint `json:"items"`
 }
 
+// DefaultInterface is the interface of the pod on the default network of the cluster
+const DefaultInterface = "eth0"
+
 // IpEndpointStatus defines the observed state of Ips
 type IpEndpointStatus struct {
 	// +kubebuilder:validation:Required
@@ -33,14 +36,31 @@ type IpEndpointStatus struct {
 	// +kubebuilder:validation:Required
 	Node string `json:"node"`
 
-	// +kubebuilder:validation:Required
+	// IPs is the allocation of the default interface of the pod. It is the only allocation of the
+	// ip endpoints written before Allocations, and it is kept in sync with Allocations for the
+	// clients reading it.
+	// +kubebuilder:validation:Optional
 	IPs IPAllocationDetail `json:"ips"`
+
+	// Allocations are the allocations of the interfaces of the pod, one per interface
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=interface
+	// +listMapKey=network
+	Allocations []IPAllocationDetail `json:"allocations,omitempty"`
 }
 
 type IPAllocationDetail struct {
+	// NIC is the name of the interface in the pod netns
 	// +kubebuilder:validation:Required
 	NIC string `json:"interface"`
 
+	// Network is the name of the network the interface is attached to, the allocations written
+	// before the networks have none
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default=""
+	Network string `json:"network"`
+
 	// +kubebuilder:validation:Optional
 	IPv4 string `json:"ipv4,omitempty"`
 
@@ -52,4 +72,73 @@ type IPAllocationDetail struct {
 
 	// +kubebuilder:validation:Optional
 	IPv6Pool string `json:"ipv6Pool,omitempty"`
+
+	// ContainerID is the sandbox the interface was last set up for, only the release of this
+	// sandbox releases the allocation
+	// +kubebuilder:validation:Optional
+	ContainerID string `json:"containerID,omitempty"`
+}
+
+// HeldBy returns true if the allocation may be released by the sandbox, the allocations recorded
+// without a sandbox and the releases without one are not checked
+func (d *IPAllocationDetail) HeldBy(containerID string) bool {
+	return len(containerID) == 0 || len(d.ContainerID) == 0 || d.ContainerID == containerID
+}
+
+// Details returns the allocations of the interfaces, an ip endpoint written before Allocations
+// has the allocation of the default interface only
+func (s *IpEndpointStatus) Details() []IPAllocationDetail {
+	if len(s.Allocations) == 0 && len(s.IPs.NIC) > 0 {
+		return []IPAllocationDetail{s.IPs}
+	}
+	return s.Allocations
+}
+
+// Allocation returns the allocation of the interface on the network, an empty network matches any
+// network. It returns nil if the interface has none.
+func (s *IpEndpointStatus) Allocation(nic, network string) *IPAllocationDetail {
+	details := s.Allocations
+	if len(details) == 0 {
+		details = []IPAllocationDetail{s.IPs}
+	}
+	for i := range details {
+		if details[i].NIC == nic && (len(network) == 0 || len(details[i].Network) == 0 || details[i].Network == network) {
+			detail := details[i]
+			return &detail
+		}
+	}
+	return nil
+}
+
+// SetAllocation adds the allocation of its interface or replaces the one the interface has
+func (s *IpEndpointStatus) SetAllocation(detail IPAllocationDetail) {
+	details := make([]IPAllocationDetail, 0, len(s.Details())+1)
+	for _, existing := range s.Details() {
+		if existing.NIC != detail.NIC {
+			details = append(details, existing)
+		}
+	}
+	s.setDetails(append(details, detail))
+}
+
+// RemoveAllocation removes the allocation of the interface
+func (s *IpEndpointStatus) RemoveAllocation(nic string) {
+	details := make([]IPAllocationDetail, 0, len(s.Details()))
+	for _, existing := range s.Details() {
+		if existing.NIC != nic {
+			details = append(details, existing)
+		}
+	}
+	s.setDetails(details)
+}
+
+// setDetails sets the allocations and the allocation of the default interface
+func (s *IpEndpointStatus) setDetails(details []IPAllocationDetail) {
+	s.Allocations = details
+	s.IPs = IPAllocationDetail{}
+	for _, detail := range details {
+		if detail.NIC == DefaultInterface {
+			s.IPs = detail
+		}
+	}
 }
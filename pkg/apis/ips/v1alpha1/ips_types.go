@@ -4,6 +4,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// ReservedVni is the tunnel id the datapath sends the pods of the default tenant with, no ips
+// may take it as its vni
+const ReservedVni = 13190
+
 // +genclient
 // +genclient:nonNamespaced
 // +kubebuilder:resource:scope="Cluster",singular="ips",path="ipses"
@@ -29,6 +33,7 @@ type IpsList struct {
 }
 
 // IpsSpec defines the desired state of Ips
+// +kubebuilder:validation:XValidation:rule="(has(self.vni) ? self.vni : 0) == (has(oldSelf.vni) ? oldSelf.vni : 0)",message="vni is immutable"
 type IpsSpec struct {
 	// +kubebuilder:validation:Required
 	Subnet string `json:"subnet"`
@@ -44,6 +49,52 @@ type IpsSpec struct {
 
 	// +kubebuilder:validation:Optional
 	NodeAffinity *metav1.LabelSelector `json:"nodeAffinity,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	Routes []Route `json:"routes,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Optional
+	MTU int `json:"mtu,omitempty"`
+
+	// Vlan is returned by the v2 Allocate API for the plugins tagging the interface of the pod,
+	// the fast plugin does not tag its veth and rejects the ips with a vlan.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4094
+	// +kubebuilder:validation:Optional
+	Vlan int `json:"vlan,omitempty"`
+
+	// Vni is the tenant of the pods of the ips, the pods of different tenants do not reach each
+	// other. 0 is the default tenant, 13190 is the tunnel id of the default tenant.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=16777215
+	// +kubebuilder:validation:XValidation:rule="self != 13190",message="vni 13190 is reserved for the default tenant"
+	// +kubebuilder:validation:Optional
+	Vni int `json:"vni,omitempty"`
+
+	// +kubebuilder:validation:Optional
+	DNS *DNS `json:"dns,omitempty"`
+}
+
+type Route struct {
+	// +kubebuilder:validation:Required
+	Dst string `json:"dst"`
+	// +kubebuilder:validation:Optional
+	Gateway string `json:"gateway,omitempty"`
+}
+
+type DNS struct {
+	// +kubebuilder:validation:Optional
+	Nameservers []string `json:"nameservers,omitempty"`
+	// +kubebuilder:validation:Optional
+	Domain string `json:"domain,omitempty"`
+	// +kubebuilder:validation:Optional
+	Search []string `json:"search,omitempty"`
+	// +kubebuilder:validation:Optional
+	Options []string `json:"options,omitempty"`
 }
 
 // IpsStatus defines the observed state of Ips
@@ -66,4 +117,14 @@ type AllocatedPod struct {
 
 	// +kubebuilder:validation:Optional
 	PodUid string `json:"poduid,omitempty"`
+
+	// Node is the node holding the address. An address with a node but without a pod
+	// is pre-claimed by the warm pool of the node.
+	// +kubebuilder:validation:Optional
+	Node string `json:"node,omitempty"`
+
+	// Interface is the interface of the pod holding the address, a pod may hold an address
+	// of the ips for each of its interfaces.
+	// +kubebuilder:validation:Optional
+	Interface string `json:"interface,omitempty"`
 }
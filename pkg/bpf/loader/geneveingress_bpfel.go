@@ -0,0 +1,189 @@
+// Code generated by bpf2go; DO NOT EDIT.
+//go:build 386 || amd64 || amd64p32 || arm || arm64 || mips64le || mips64p32le || mipsle || ppc64le || riscv64
+// +build 386 amd64 amd64p32 arm arm64 mips64le mips64p32le mipsle ppc64le riscv64
+
+package loader
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+
+	"github.com/cilium/ebpf"
+)
+
+// loadGeneveIngress returns the embedded CollectionSpec for geneveIngress.
+func loadGeneveIngress() (*ebpf.CollectionSpec, error) {
+	reader := bytes.NewReader(_GeneveIngressBytes)
+	spec, err := ebpf.LoadCollectionSpecFromReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't load geneveIngress: %w", err)
+	}
+
+	return spec, err
+}
+
+// loadGeneveIngressObjects loads geneveIngress and converts it into a struct.
+//
+// The following types are suitable as obj argument:
+//
+//	*geneveIngressObjects
+//	*geneveIngressPrograms
+//	*geneveIngressMaps
+//
+// See ebpf.CollectionSpec.LoadAndAssign documentation for details.
+func loadGeneveIngressObjects(obj interface{}, opts *ebpf.CollectionOptions) error {
+	spec, err := loadGeneveIngress()
+	if err != nil {
+		return err
+	}
+
+	return spec.LoadAndAssign(obj, opts)
+}
+
+// geneveIngressSpecs contains maps and programs before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type geneveIngressSpecs struct {
+	geneveIngressProgramSpecs
+	geneveIngressMapSpecs
+}
+
+// geneveIngressSpecs contains programs before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type geneveIngressProgramSpecs struct {
+	ClsMain *ebpf.ProgramSpec `ebpf:"cls_main"`
+}
+
+// geneveIngressMapSpecs contains maps before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type geneveIngressMapSpecs struct {
+	ClusterPodIps   *ebpf.MapSpec `ebpf:"cluster_pod_ips"`
+	HostPorts       *ebpf.MapSpec `ebpf:"host_ports"`
+	HostPortsCt     *ebpf.MapSpec `ebpf:"host_ports_ct"`
+	IpFrags         *ebpf.MapSpec `ebpf:"ip_frags"`
+	LocalDev        *ebpf.MapSpec `ebpf:"local_dev"`
+	LocalPodIps     *ebpf.MapSpec `ebpf:"local_pod_ips"`
+	MasqCt          *ebpf.MapSpec `ebpf:"masq_ct"`
+	MasqPorts       *ebpf.MapSpec `ebpf:"masq_ports"`
+	NodeAddrs       *ebpf.MapSpec `ebpf:"node_addrs"`
+	NodeInfo        *ebpf.MapSpec `ebpf:"node_info"`
+	NodeportCt      *ebpf.MapSpec `ebpf:"nodeport_ct"`
+	NodeportRevCt   *ebpf.MapSpec `ebpf:"nodeport_rev_ct"`
+	NonMasqCidrs    *ebpf.MapSpec `ebpf:"non_masq_cidrs"`
+	PodIdentities   *ebpf.MapSpec `ebpf:"pod_identities"`
+	PolicyCidrs     *ebpf.MapSpec `ebpf:"policy_cidrs"`
+	PolicyCt        *ebpf.MapSpec `ebpf:"policy_ct"`
+	PolicyEndpoints *ebpf.MapSpec `ebpf:"policy_endpoints"`
+	PolicyRules     *ebpf.MapSpec `ebpf:"policy_rules"`
+	PolicyStats     *ebpf.MapSpec `ebpf:"policy_stats"`
+	ServiceBackends *ebpf.MapSpec `ebpf:"service_backends"`
+	ServiceCt       *ebpf.MapSpec `ebpf:"service_ct"`
+	ServiceRevCt    *ebpf.MapSpec `ebpf:"service_rev_ct"`
+	Services        *ebpf.MapSpec `ebpf:"services"`
+	SockRevNat      *ebpf.MapSpec `ebpf:"sock_rev_nat"`
+}
+
+// geneveIngressObjects contains all objects after they have been loaded into the kernel.
+//
+// It can be passed to loadGeneveIngressObjects or ebpf.CollectionSpec.LoadAndAssign.
+type geneveIngressObjects struct {
+	geneveIngressPrograms
+	geneveIngressMaps
+}
+
+func (o *geneveIngressObjects) Close() error {
+	return _GeneveIngressClose(
+		&o.geneveIngressPrograms,
+		&o.geneveIngressMaps,
+	)
+}
+
+// geneveIngressMaps contains all maps after they have been loaded into the kernel.
+//
+// It can be passed to loadGeneveIngressObjects or ebpf.CollectionSpec.LoadAndAssign.
+type geneveIngressMaps struct {
+	ClusterPodIps   *ebpf.Map `ebpf:"cluster_pod_ips"`
+	HostPorts       *ebpf.Map `ebpf:"host_ports"`
+	HostPortsCt     *ebpf.Map `ebpf:"host_ports_ct"`
+	IpFrags         *ebpf.Map `ebpf:"ip_frags"`
+	LocalDev        *ebpf.Map `ebpf:"local_dev"`
+	LocalPodIps     *ebpf.Map `ebpf:"local_pod_ips"`
+	MasqCt          *ebpf.Map `ebpf:"masq_ct"`
+	MasqPorts       *ebpf.Map `ebpf:"masq_ports"`
+	NodeAddrs       *ebpf.Map `ebpf:"node_addrs"`
+	NodeInfo        *ebpf.Map `ebpf:"node_info"`
+	NodeportCt      *ebpf.Map `ebpf:"nodeport_ct"`
+	NodeportRevCt   *ebpf.Map `ebpf:"nodeport_rev_ct"`
+	NonMasqCidrs    *ebpf.Map `ebpf:"non_masq_cidrs"`
+	PodIdentities   *ebpf.Map `ebpf:"pod_identities"`
+	PolicyCidrs     *ebpf.Map `ebpf:"policy_cidrs"`
+	PolicyCt        *ebpf.Map `ebpf:"policy_ct"`
+	PolicyEndpoints *ebpf.Map `ebpf:"policy_endpoints"`
+	PolicyRules     *ebpf.Map `ebpf:"policy_rules"`
+	PolicyStats     *ebpf.Map `ebpf:"policy_stats"`
+	ServiceBackends *ebpf.Map `ebpf:"service_backends"`
+	ServiceCt       *ebpf.Map `ebpf:"service_ct"`
+	ServiceRevCt    *ebpf.Map `ebpf:"service_rev_ct"`
+	Services        *ebpf.Map `ebpf:"services"`
+	SockRevNat      *ebpf.Map `ebpf:"sock_rev_nat"`
+}
+
+func (m *geneveIngressMaps) Close() error {
+	return _GeneveIngressClose(
+		m.ClusterPodIps,
+		m.HostPorts,
+		m.HostPortsCt,
+		m.IpFrags,
+		m.LocalDev,
+		m.LocalPodIps,
+		m.MasqCt,
+		m.MasqPorts,
+		m.NodeAddrs,
+		m.NodeInfo,
+		m.NodeportCt,
+		m.NodeportRevCt,
+		m.NonMasqCidrs,
+		m.PodIdentities,
+		m.PolicyCidrs,
+		m.PolicyCt,
+		m.PolicyEndpoints,
+		m.PolicyRules,
+		m.PolicyStats,
+		m.ServiceBackends,
+		m.ServiceCt,
+		m.ServiceRevCt,
+		m.Services,
+		m.SockRevNat,
+	)
+}
+
+// geneveIngressPrograms contains all programs after they have been loaded into the kernel.
+//
+// It can be passed to loadGeneveIngressObjects or ebpf.CollectionSpec.LoadAndAssign.
+type geneveIngressPrograms struct {
+	ClsMain *ebpf.Program `ebpf:"cls_main"`
+}
+
+func (p *geneveIngressPrograms) Close() error {
+	return _GeneveIngressClose(
+		p.ClsMain,
+	)
+}
+
+func _GeneveIngressClose(closers ...io.Closer) error {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Do not access this directly.
+//
+//go:embed geneveingress_bpfel.o
+var _GeneveIngressBytes []byte
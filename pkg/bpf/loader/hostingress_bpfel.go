@@ -0,0 +1,189 @@
+// Code generated by bpf2go; DO NOT EDIT.
+//go:build 386 || amd64 || amd64p32 || arm || arm64 || mips64le || mips64p32le || mipsle || ppc64le || riscv64
+// +build 386 amd64 amd64p32 arm arm64 mips64le mips64p32le mipsle ppc64le riscv64
+
+package loader
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+
+	"github.com/cilium/ebpf"
+)
+
+// loadHostIngress returns the embedded CollectionSpec for hostIngress.
+func loadHostIngress() (*ebpf.CollectionSpec, error) {
+	reader := bytes.NewReader(_HostIngressBytes)
+	spec, err := ebpf.LoadCollectionSpecFromReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't load hostIngress: %w", err)
+	}
+
+	return spec, err
+}
+
+// loadHostIngressObjects loads hostIngress and converts it into a struct.
+//
+// The following types are suitable as obj argument:
+//
+//	*hostIngressObjects
+//	*hostIngressPrograms
+//	*hostIngressMaps
+//
+// See ebpf.CollectionSpec.LoadAndAssign documentation for details.
+func loadHostIngressObjects(obj interface{}, opts *ebpf.CollectionOptions) error {
+	spec, err := loadHostIngress()
+	if err != nil {
+		return err
+	}
+
+	return spec.LoadAndAssign(obj, opts)
+}
+
+// hostIngressSpecs contains maps and programs before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type hostIngressSpecs struct {
+	hostIngressProgramSpecs
+	hostIngressMapSpecs
+}
+
+// hostIngressSpecs contains programs before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type hostIngressProgramSpecs struct {
+	ClsMain *ebpf.ProgramSpec `ebpf:"cls_main"`
+}
+
+// hostIngressMapSpecs contains maps before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type hostIngressMapSpecs struct {
+	ClusterPodIps   *ebpf.MapSpec `ebpf:"cluster_pod_ips"`
+	HostPorts       *ebpf.MapSpec `ebpf:"host_ports"`
+	HostPortsCt     *ebpf.MapSpec `ebpf:"host_ports_ct"`
+	IpFrags         *ebpf.MapSpec `ebpf:"ip_frags"`
+	LocalDev        *ebpf.MapSpec `ebpf:"local_dev"`
+	LocalPodIps     *ebpf.MapSpec `ebpf:"local_pod_ips"`
+	MasqCt          *ebpf.MapSpec `ebpf:"masq_ct"`
+	MasqPorts       *ebpf.MapSpec `ebpf:"masq_ports"`
+	NodeAddrs       *ebpf.MapSpec `ebpf:"node_addrs"`
+	NodeInfo        *ebpf.MapSpec `ebpf:"node_info"`
+	NodeportCt      *ebpf.MapSpec `ebpf:"nodeport_ct"`
+	NodeportRevCt   *ebpf.MapSpec `ebpf:"nodeport_rev_ct"`
+	NonMasqCidrs    *ebpf.MapSpec `ebpf:"non_masq_cidrs"`
+	PodIdentities   *ebpf.MapSpec `ebpf:"pod_identities"`
+	PolicyCidrs     *ebpf.MapSpec `ebpf:"policy_cidrs"`
+	PolicyCt        *ebpf.MapSpec `ebpf:"policy_ct"`
+	PolicyEndpoints *ebpf.MapSpec `ebpf:"policy_endpoints"`
+	PolicyRules     *ebpf.MapSpec `ebpf:"policy_rules"`
+	PolicyStats     *ebpf.MapSpec `ebpf:"policy_stats"`
+	ServiceBackends *ebpf.MapSpec `ebpf:"service_backends"`
+	ServiceCt       *ebpf.MapSpec `ebpf:"service_ct"`
+	ServiceRevCt    *ebpf.MapSpec `ebpf:"service_rev_ct"`
+	Services        *ebpf.MapSpec `ebpf:"services"`
+	SockRevNat      *ebpf.MapSpec `ebpf:"sock_rev_nat"`
+}
+
+// hostIngressObjects contains all objects after they have been loaded into the kernel.
+//
+// It can be passed to loadHostIngressObjects or ebpf.CollectionSpec.LoadAndAssign.
+type hostIngressObjects struct {
+	hostIngressPrograms
+	hostIngressMaps
+}
+
+func (o *hostIngressObjects) Close() error {
+	return _HostIngressClose(
+		&o.hostIngressPrograms,
+		&o.hostIngressMaps,
+	)
+}
+
+// hostIngressMaps contains all maps after they have been loaded into the kernel.
+//
+// It can be passed to loadHostIngressObjects or ebpf.CollectionSpec.LoadAndAssign.
+type hostIngressMaps struct {
+	ClusterPodIps   *ebpf.Map `ebpf:"cluster_pod_ips"`
+	HostPorts       *ebpf.Map `ebpf:"host_ports"`
+	HostPortsCt     *ebpf.Map `ebpf:"host_ports_ct"`
+	IpFrags         *ebpf.Map `ebpf:"ip_frags"`
+	LocalDev        *ebpf.Map `ebpf:"local_dev"`
+	LocalPodIps     *ebpf.Map `ebpf:"local_pod_ips"`
+	MasqCt          *ebpf.Map `ebpf:"masq_ct"`
+	MasqPorts       *ebpf.Map `ebpf:"masq_ports"`
+	NodeAddrs       *ebpf.Map `ebpf:"node_addrs"`
+	NodeInfo        *ebpf.Map `ebpf:"node_info"`
+	NodeportCt      *ebpf.Map `ebpf:"nodeport_ct"`
+	NodeportRevCt   *ebpf.Map `ebpf:"nodeport_rev_ct"`
+	NonMasqCidrs    *ebpf.Map `ebpf:"non_masq_cidrs"`
+	PodIdentities   *ebpf.Map `ebpf:"pod_identities"`
+	PolicyCidrs     *ebpf.Map `ebpf:"policy_cidrs"`
+	PolicyCt        *ebpf.Map `ebpf:"policy_ct"`
+	PolicyEndpoints *ebpf.Map `ebpf:"policy_endpoints"`
+	PolicyRules     *ebpf.Map `ebpf:"policy_rules"`
+	PolicyStats     *ebpf.Map `ebpf:"policy_stats"`
+	ServiceBackends *ebpf.Map `ebpf:"service_backends"`
+	ServiceCt       *ebpf.Map `ebpf:"service_ct"`
+	ServiceRevCt    *ebpf.Map `ebpf:"service_rev_ct"`
+	Services        *ebpf.Map `ebpf:"services"`
+	SockRevNat      *ebpf.Map `ebpf:"sock_rev_nat"`
+}
+
+func (m *hostIngressMaps) Close() error {
+	return _HostIngressClose(
+		m.ClusterPodIps,
+		m.HostPorts,
+		m.HostPortsCt,
+		m.IpFrags,
+		m.LocalDev,
+		m.LocalPodIps,
+		m.MasqCt,
+		m.MasqPorts,
+		m.NodeAddrs,
+		m.NodeInfo,
+		m.NodeportCt,
+		m.NodeportRevCt,
+		m.NonMasqCidrs,
+		m.PodIdentities,
+		m.PolicyCidrs,
+		m.PolicyCt,
+		m.PolicyEndpoints,
+		m.PolicyRules,
+		m.PolicyStats,
+		m.ServiceBackends,
+		m.ServiceCt,
+		m.ServiceRevCt,
+		m.Services,
+		m.SockRevNat,
+	)
+}
+
+// hostIngressPrograms contains all programs after they have been loaded into the kernel.
+//
+// It can be passed to loadHostIngressObjects or ebpf.CollectionSpec.LoadAndAssign.
+type hostIngressPrograms struct {
+	ClsMain *ebpf.Program `ebpf:"cls_main"`
+}
+
+func (p *hostIngressPrograms) Close() error {
+	return _HostIngressClose(
+		p.ClsMain,
+	)
+}
+
+func _HostIngressClose(closers ...io.Closer) error {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Do not access this directly.
+//
+//go:embed hostingress_bpfel.o
+var _HostIngressBytes []byte
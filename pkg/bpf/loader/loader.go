@@ -0,0 +1,577 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/bpf/tc"
+	"github.com/fast-io/fast/pkg/nettools"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" vethIngress ../../../bpf/veth_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" vethEgress ../../../bpf/veth_egress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" vxlanIngress ../../../bpf/vxlan_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" vxlanEgress ../../../bpf/vxlan_egress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" hostIngress ../../../bpf/host_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" geneveIngress ../../../bpf/geneve_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" geneveEgress ../../../bpf/geneve_egress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" wireguardIngress ../../../bpf/wireguard_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel -no-global-types -cflags "-O2 -g -Wall" sock ../../../bpf/sock.c
+
+// BPFFSPath is where the bpf filesystem is mounted
+const BPFFSPath = "/sys/fs/bpf"
+
+// program is a tc program embedded in the agent and the path it is pinned at
+type program struct {
+	path string
+	load func() (*ebpf.CollectionSpec, error)
+}
+
+var programs = []program{
+	{path: tc.GetVethIngressPath(), load: loadVethIngress},
+	{path: tc.GetVethEgressPath(), load: loadVethEgress},
+	{path: tc.GetVxlanIngressPath(), load: loadVxlanIngress},
+	{path: tc.GetVxlanEgressPath(), load: loadVxlanEgress},
+	{path: tc.GetHostIngressPath(), load: loadHostIngress},
+	{path: tc.GetGeneveIngressPath(), load: loadGeneveIngress},
+	{path: tc.GetGeneveEgressPath(), load: loadGeneveEgress},
+	{path: tc.GetWireguardIngressPath(), load: loadWireguardIngress},
+}
+
+// sockProgram holds the socket programs, they are pinned in the dir at its path by their name and
+// attached to the root cgroup through links pinned next to them
+var sockProgram = program{path: tc.ProgramDefaultPath, load: loadSock}
+
+// sockAttachTypes are the cgroup hooks of the socket programs by program
+var sockAttachTypes = map[string]ebpf.AttachType{
+	"sock_connect4": ebpf.AttachCGroupInet4Connect,
+	"sock_sendmsg4": ebpf.AttachCGroupUDP4Sendmsg,
+	"sock_recvmsg4": ebpf.AttachCGroupUDP4Recvmsg,
+}
+
+// Load mounts the bpf filesystem, creates and pins the maps and pins the tc programs for the
+// CNI plugin and the socket programs. The maps are sized with maxEntries, the maps already pinned
+// are reused so that their entries survive a restart of the agent, or migrated to a new map when
+// their size or layout changed, under the lock of the maps. The pinned programs are replaced by the
+// embedded ones and attached again wherever the previous ones are attached.
+func Load(ctx context.Context, maxEntries bpfmap.MaxEntries) error {
+	logger := klog.FromContext(ctx)
+
+	if os.Getuid() != 0 {
+		return fmt.Errorf("root user in required for this process or container")
+	}
+	if err := MountBPFFS(); err != nil {
+		return fmt.Errorf("failed to mount bpf filesystem: %w", err)
+	}
+	for _, dir := range []string{bpfmap.PinPath, tc.ProgramDefaultPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	all := append(programs, sockProgram)
+	specs := make([]*ebpf.CollectionSpec, len(all))
+	for i, p := range all {
+		spec, err := p.load()
+		if err != nil {
+			return err
+		}
+		resize(spec, maxEntries)
+		specs[i] = spec
+	}
+	// the CNI plugin does not write the maps while they are replaced, the datapath keeps writing
+	// the replaced maps until its programs are replaced
+	unlock, err := bpfmap.LockMaps()
+	if err != nil {
+		return fmt.Errorf("failed to lock the eBPF maps: %w", err)
+	}
+	defer unlock()
+	migrations, err := migrateMaps(logger, specs)
+	if err != nil {
+		return err
+	}
+	defer closeMigrations(migrations)
+	for i, p := range programs {
+		if err := loadAndPin(p.path, specs[i]); err != nil {
+			return err
+		}
+	}
+	if err := loadAndPinSock(specs[len(programs)]); err != nil {
+		return err
+	}
+	for _, p := range programs {
+		// a failure leaves the previous program attached, the dev may be deleted meanwhile
+		if err := tc.ReattachBPF(p.path); err != nil {
+			logger.Error(err, "Failed to attach the program again", "program", p.path)
+		}
+	}
+	for name := range sockAttachTypes {
+		if err := reattachCgroup(name); err != nil {
+			logger.Error(err, "Failed to attach the program again", "program", name)
+		}
+	}
+	for _, mig := range migrations {
+		if err := mig.finish(logger); err != nil {
+			return fmt.Errorf("failed to migrate map %s: %w", mig.name, err)
+		}
+	}
+	return nil
+}
+
+// AttachCgroup attaches the socket programs to the root of the cgroup2 hierarchy mounted at
+// root, or at root/unified on the hosts mounting cgroup v1 at root. The hooks of the root
+// cgroup run for the sockets of every process of the node, the links are pinned so that the
+// programs stay attached when the agent exits. The programs must be loaded.
+func AttachCgroup(root string) error {
+	root, err := cgroup2Root(root)
+	if err != nil {
+		return err
+	}
+	for name, attachType := range sockAttachTypes {
+		linkPath := sockLinkPath(name)
+		if _, err := os.Stat(linkPath); err == nil {
+			continue
+		}
+		prog, err := ebpf.LoadPinnedProgram(filepath.Join(tc.ProgramDefaultPath, name), nil)
+		if err != nil {
+			return err
+		}
+		l, err := link.AttachCgroup(link.CgroupOptions{Path: root, Attach: attachType, Program: prog})
+		prog.Close()
+		if err != nil {
+			return fmt.Errorf("failed to attach %s to cgroup %s: %w", name, root, err)
+		}
+		err = l.Pin(linkPath)
+		// the link of a kernel without cgroup links can not be pinned, it is detached on close
+		l.Close()
+		if err != nil {
+			return fmt.Errorf("failed to pin the link of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// cgroup2Root returns the dir the cgroup2 hierarchy is mounted at
+func cgroup2Root(root string) (string, error) {
+	for _, dir := range []string{root, filepath.Join(root, "unified")} {
+		var statfs unix.Statfs_t
+		if err := unix.Statfs(dir, &statfs); err == nil && int64(statfs.Type) == unix.CGROUP2_SUPER_MAGIC {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup2 hierarchy is mounted at %s", root)
+}
+
+// sockLinkPath returns the path the cgroup link of the socket program is pinned at
+func sockLinkPath(name string) string {
+	return filepath.Join(tc.ProgramDefaultPath, name+"_link")
+}
+
+// reattachCgroup updates the cgroup link of the socket program to the program pinned, the
+// program is not attached when it has no link yet
+func reattachCgroup(name string) error {
+	l, err := link.LoadPinnedLink(sockLinkPath(name), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	prog, err := ebpf.LoadPinnedProgram(filepath.Join(tc.ProgramDefaultPath, name), nil)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return l.Update(prog)
+}
+
+// SyncNodeAddrs records the IPv4 addresses of the node in node_addrs, the host ports without host
+// ip and the node ports are served on them. The loopback addresses are left out, they are the addresses of the pods
+// themselves in their netns. The maps must be loaded.
+func SyncNodeAddrs() error {
+	nodeAddrsMap := bpfmap.GetNodeAddrsMap()
+	if nodeAddrsMap == nil {
+		return errors.New("failed to load eBPF map node_addrs")
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	want := make(map[bpfmap.NodeAddrKey]bool, len(addrs))
+	for _, addr := range addrs {
+		if addr.IP.IsLoopback() {
+			continue
+		}
+		key := bpfmap.NodeAddrKey{IP: util.InetIpToUInt32(addr.IP.String())}
+		want[key] = true
+		if err := nodeAddrsMap.Put(key, bpfmap.NodeAddrInfo{}); err != nil {
+			if bpfmap.IsMapFull(err) {
+				bpfmap.RecordMapFull(bpfmap.NodeAddrs)
+			}
+			return err
+		}
+	}
+
+	var (
+		key   bpfmap.NodeAddrKey
+		info  bpfmap.NodeAddrInfo
+		stale []bpfmap.NodeAddrKey
+	)
+	iter := nodeAddrsMap.Iterate()
+	for iter.Next(&key, &info) {
+		if !want[key] {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := nodeAddrsMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// SNATPortMin and SNATPortMax bound the ports of the node the datapath translates the clients of
+	// the connections to remote backends to, the range above the ephemeral ports of linux
+	SNATPortMin = 61000
+	SNATPortMax = 65535
+)
+
+// reservedPortsPath is the sysctl of the ports the kernel never picks for a socket of the node
+var reservedPortsPath = "/proc/sys/net/ipv4/ip_local_reserved_ports"
+
+// ReserveSNATPorts adds the SNAT ports to the reserved ports of the node, the sockets of the node
+// are not given one of them even when the range of the ephemeral ports is widened over them
+func ReserveSNATPorts() error {
+	return reservePorts(reservedPortsPath, fmt.Sprintf("%d-%d", SNATPortMin, SNATPortMax))
+}
+
+// reservePorts adds the range of ports to the reserved ports in the sysctl at path, the ports
+// reserved by others are kept
+func reservePorts(path, ports string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	reserved := strings.TrimSpace(string(b))
+	if reserved != "" {
+		for _, r := range strings.Split(reserved, ",") {
+			if r == ports {
+				return nil
+			}
+		}
+		ports = reserved + "," + ports
+	}
+	return os.WriteFile(path, []byte(ports), 0644)
+}
+
+// AttachUnderlay records node with the address of the underlay interface in node_info and
+// attaches host_ingress to the interface, the node ports and the external ips of the services
+// are served on it and the connections of the pods leaving the cluster are masqueraded to it
+// when the node masquerades. The maps must be loaded.
+func AttachUnderlay(node bpfmap.NodeInfoValue) error {
+	link, err := nettools.UnderlayLink()
+	if err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("the underlay interface %s has no IPv4 address", link.Attrs().Name)
+	}
+	nodeInfoMap := bpfmap.GetNodeInfoMap()
+	if nodeInfoMap == nil {
+		return errors.New("failed to load eBPF map node_info")
+	}
+	node.IP = util.InetIpToUInt32(addrs[0].IP.String())
+	if err := nodeInfoMap.Put(bpfmap.NodeInfoKey, node); err != nil {
+		return err
+	}
+	return tc.TryAttachBPF(link.Attrs().Name, tc.IngressType, tc.GetHostIngressPath())
+}
+
+// AttachTunnel creates the device of the tunnel listening on port, records it in local_dev and
+// attaches the programs of the tunnel to it, the CNI plugin sets its MTU. The maps must be loaded.
+func AttachTunnel(tunnel bpfmap.TunnelType, port int) error {
+	var (
+		link            netlink.Link
+		devType         bpfmap.LocalDevType
+		ingress, egress string
+		err             error
+	)
+	switch tunnel {
+	case bpfmap.TunnelGeneve:
+		link, err = nettools.CreateGeneveAndUp(nettools.GeneveDevName, port)
+		devType, ingress, egress = bpfmap.GeneveDevType, tc.GetGeneveIngressPath(), tc.GetGeneveEgressPath()
+	default:
+		link, err = nettools.CreateVxlanAndUp(nettools.VxlanDevName, port)
+		devType, ingress, egress = bpfmap.VxlanDevType, tc.GetVxlanIngressPath(), tc.GetVxlanEgressPath()
+	}
+	if err != nil {
+		return err
+	}
+	localDevMap := bpfmap.GetLocalDevMap()
+	if localDevMap == nil {
+		return errors.New("failed to load eBPF map local_dev")
+	}
+	if err := localDevMap.Put(bpfmap.LocalDevMapKey{Type: devType}, bpfmap.LocalDevMapValue{IfIndex: uint32(link.Attrs().Index)}); err != nil {
+		return err
+	}
+	if err := tc.TryAttachBPF(link.Attrs().Name, tc.IngressType, ingress); err != nil {
+		return err
+	}
+	return tc.TryAttachBPF(link.Attrs().Name, tc.EgressType, egress)
+}
+
+// AttachWireguard creates the wireguard device, records it in local_dev and attaches
+// wireguard_ingress to it, the agent configures its key and peers and the CNI plugin sets its
+// MTU. The maps must be loaded.
+func AttachWireguard() error {
+	link, err := nettools.CreateWireguardAndUp(nettools.WireguardDevName)
+	if err != nil {
+		return err
+	}
+	localDevMap := bpfmap.GetLocalDevMap()
+	if localDevMap == nil {
+		return errors.New("failed to load eBPF map local_dev")
+	}
+	if err := localDevMap.Put(bpfmap.LocalDevMapKey{Type: bpfmap.WireguardDevType}, bpfmap.LocalDevMapValue{IfIndex: uint32(link.Attrs().Index)}); err != nil {
+		return err
+	}
+	return tc.TryAttachBPF(link.Attrs().Name, tc.IngressType, tc.GetWireguardIngressPath())
+}
+
+// resize sets the capacities of the maps of the spec
+func resize(spec *ebpf.CollectionSpec, maxEntries bpfmap.MaxEntries) {
+	for name, n := range maxEntries.ByName() {
+		if m, ok := spec.Maps[name]; ok && n > 0 {
+			m.MaxEntries = n
+		}
+	}
+}
+
+// migration is a pinned map replaced by a new map, the old map is kept open until the programs
+// using it are replaced
+type migration struct {
+	name     string
+	old, new *ebpf.Map
+	// copyable is true when the entries of the old map fit the new map
+	copyable bool
+}
+
+// migrateMaps replaces the pinned maps that do not match their spec anymore, the returned
+// migrations must be finished once the programs are replaced.
+func migrateMaps(logger klog.Logger, specs []*ebpf.CollectionSpec) ([]*migration, error) {
+	var migrations []*migration
+	migrated := make(map[string]bool)
+	for _, spec := range specs {
+		for name, m := range spec.Maps {
+			if m.Pinning != ebpf.PinByName || migrated[name] {
+				continue
+			}
+			mig, err := migrateMap(logger, m)
+			if err != nil {
+				closeMigrations(migrations)
+				return nil, fmt.Errorf("failed to migrate map %s: %w", name, err)
+			}
+			if mig != nil {
+				migrations = append(migrations, mig)
+			}
+			migrated[name] = true
+		}
+	}
+	return migrations, nil
+}
+
+// migrateMap replaces the pinned map by a new map of the spec when they differ, the entries
+// are copied when the layout of the map is unchanged or fields were appended to the values,
+// the appended fields are zero, and the new map has room for them. It returns nil when the
+// pinned map is kept.
+func migrateMap(logger klog.Logger, spec *ebpf.MapSpec) (*migration, error) {
+	path := filepath.Join(bpfmap.PinPath, spec.Name)
+	pinned, err := ebpf.LoadPinnedMap(path, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pinned.Type() == spec.Type && pinned.KeySize() == spec.KeySize && pinned.ValueSize() == spec.ValueSize &&
+		pinned.MaxEntries() == spec.MaxEntries && pinned.Flags() == spec.Flags {
+		pinned.Close()
+		return nil, nil
+	}
+
+	unpinned := spec.Copy()
+	unpinned.Pinning = ebpf.PinNone
+	m, err := ebpf.NewMap(unpinned)
+	if err != nil {
+		pinned.Close()
+		return nil, err
+	}
+	mig := &migration{
+		name:     spec.Name,
+		old:      pinned,
+		new:      m,
+		copyable: pinned.KeySize() == spec.KeySize && pinned.ValueSize() <= spec.ValueSize,
+	}
+
+	var copied, dropped int
+	if mig.copyable {
+		copied, dropped, err = copyEntries(spec.Name, pinned, m, ebpf.UpdateAny)
+	} else {
+		dropped = bpfmap.CountEntries(pinned)
+	}
+	if err == nil {
+		logger.Info("Migrating eBPF map", "map", spec.Name,
+			"maxEntries", pinned.MaxEntries(), "newMaxEntries", spec.MaxEntries, "copied", copied, "dropped", dropped)
+		err = replacePin(m, path)
+	}
+	if err != nil {
+		mig.close()
+		return nil, err
+	}
+	return mig, nil
+}
+
+// finish copies the entries the replaced programs added to the old map after it was copied, the
+// entries they updated or deleted meanwhile are not carried over.
+func (mig *migration) finish(logger klog.Logger) error {
+	if !mig.copyable {
+		return nil
+	}
+	copied, dropped, err := copyEntries(mig.name, mig.old, mig.new, ebpf.UpdateNoExist)
+	if err != nil {
+		return err
+	}
+	if copied > 0 || dropped > 0 {
+		logger.Info("Copied the entries added to the migrated eBPF map", "map", mig.name, "copied", copied, "dropped", dropped)
+	}
+	return nil
+}
+
+func (mig *migration) close() {
+	mig.old.Close()
+	mig.new.Close()
+}
+
+func closeMigrations(migrations []*migration) {
+	for _, mig := range migrations {
+		mig.close()
+	}
+}
+
+// copyEntries copies the entries of from into the map name to, the values are extended with zeros
+// to the value size of to. The entries to already has with UpdateNoExist are skipped, the entries
+// to has no room for are dropped and counted as rejected by a full map.
+func copyEntries(name string, from, to *ebpf.Map, flags ebpf.MapUpdateFlags) (copied, dropped int, err error) {
+	var key, value []byte
+	full := false
+	iter := from.Iterate()
+	for iter.Next(&key, &value) {
+		extended := make([]byte, to.ValueSize())
+		copy(extended, value)
+		if err := to.Update(key, extended, flags); err != nil {
+			if errors.Is(err, ebpf.ErrKeyExist) {
+				continue
+			}
+			full = full || bpfmap.IsMapFull(err)
+			dropped++
+			continue
+		}
+		copied++
+	}
+	if full {
+		bpfmap.RecordMapFull(name)
+	}
+	return copied, dropped, iter.Err()
+}
+
+// loadAndPin loads the program into the kernel and pins it, the maps of the program are
+// created and pinned by name unless they are pinned already.
+func loadAndPin(path string, spec *ebpf.CollectionSpec) error {
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{PinPath: bpfmap.PinPath},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load %s into the kernel: %w", filepath.Base(path), err)
+	}
+	defer coll.Close()
+
+	prog, ok := coll.Programs[tc.ProgramName]
+	if !ok {
+		return fmt.Errorf("%s has no %s program", filepath.Base(path), tc.ProgramName)
+	}
+	if err := replacePin(prog, path); err != nil {
+		return fmt.Errorf("failed to pin %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// loadAndPinSock loads the socket programs into the kernel and pins them by their name, the maps
+// of the programs are created and pinned by name unless they are pinned already.
+func loadAndPinSock(spec *ebpf.CollectionSpec) error {
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{PinPath: bpfmap.PinPath},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load the socket programs into the kernel: %w", err)
+	}
+	defer coll.Close()
+
+	for name := range sockAttachTypes {
+		prog, ok := coll.Programs[name]
+		if !ok {
+			return fmt.Errorf("the socket programs have no %s program", name)
+		}
+		if err := replacePin(prog, filepath.Join(tc.ProgramDefaultPath, name)); err != nil {
+			return fmt.Errorf("failed to pin %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// replacePin pins the object aside and renames it over the object pinned at the path, the
+// users of the old object keep it until they load the new one. bpffs does not allow dots in
+// the names.
+func replacePin(obj interface{ Pin(string) error }, path string) error {
+	tmp := path + "_new"
+	if err := unix.Unlink(tmp); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	if err := obj.Pin(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// MountBPFFS mounts the bpf filesystem unless it is mounted already
+func MountBPFFS() error {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(BPFFSPath, &statfs); err == nil && int64(statfs.Type) == unix.BPF_FS_MAGIC {
+		return nil
+	}
+	if err := os.MkdirAll(BPFFSPath, 0755); err != nil {
+		return err
+	}
+	return unix.Mount("bpffs", BPFFSPath, "bpf", 0, "")
+}
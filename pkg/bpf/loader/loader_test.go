@@ -0,0 +1,963 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/bpf/tc"
+	"github.com/fast-io/fast/pkg/nettools"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+func TestMapSpecs(t *testing.T) {
+	tests := []struct {
+		name      string
+		keySize   uintptr
+		valueSize uintptr
+	}{
+		{
+			name:      "local_dev",
+			keySize:   unsafe.Sizeof(bpfmap.LocalDevMapKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.LocalDevMapValue{}),
+		},
+		{
+			name:      "local_pod_ips",
+			keySize:   unsafe.Sizeof(bpfmap.LocalIpsMapKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.LocalIpsMapInfo{}),
+		},
+		{
+			name:      "cluster_pod_ips",
+			keySize:   unsafe.Sizeof(bpfmap.ClusterIpsMapKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ClusterIpsMapInfo{}),
+		},
+		{
+			name:      "host_ports",
+			keySize:   unsafe.Sizeof(bpfmap.HostPortsMapKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.HostPortsMapInfo{}),
+		},
+		{
+			name:      "host_ports_ct",
+			keySize:   unsafe.Sizeof(bpfmap.HostPortsCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.HostPortsMapInfo{}),
+		},
+		{
+			name:      "node_addrs",
+			keySize:   unsafe.Sizeof(bpfmap.NodeAddrKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.NodeAddrInfo{}),
+		},
+		{
+			name:      "sock_rev_nat",
+			keySize:   unsafe.Sizeof(bpfmap.SockRevNatKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.SockRevNatInfo{}),
+		},
+		{
+			name:      "services",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ServiceInfo{}),
+		},
+		{
+			name:      "service_backends",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceBackendKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ServiceBackendInfo{}),
+		},
+		{
+			name:      "service_ct",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ServiceBackendInfo{}),
+		},
+		{
+			name:      "service_rev_ct",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ServiceRevCtInfo{}),
+		},
+		{
+			name:      "ip_frags",
+			keySize:   unsafe.Sizeof(bpfmap.IPFragKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.IPFragInfo{}),
+		},
+		{
+			name:      "node_info",
+			keySize:   unsafe.Sizeof(bpfmap.NodeInfoKey),
+			valueSize: unsafe.Sizeof(bpfmap.NodeInfoValue{}),
+		},
+		{
+			name:      "nodeport_ct",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.NodePortCtInfo{}),
+		},
+		{
+			name:      "nodeport_rev_ct",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+		},
+		{
+			name:      "non_masq_cidrs",
+			keySize:   unsafe.Sizeof(bpfmap.NonMasqCidrKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.NonMasqCidrInfo{}),
+		},
+		{
+			name:      "masq_ct",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.MasqCtInfo{}),
+		},
+		{
+			name:      "masq_ports",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+		},
+		{
+			name:      "pod_identities",
+			keySize:   unsafe.Sizeof(bpfmap.PodIdentityKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.PodIdentityInfo{}),
+		},
+		{
+			name:      "policy_endpoints",
+			keySize:   unsafe.Sizeof(bpfmap.PolicyEndpointKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.PolicyEndpointInfo{}),
+		},
+		{
+			name:      "policy_rules",
+			keySize:   unsafe.Sizeof(bpfmap.PolicyRuleKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.PolicyRuleInfo{}),
+		},
+		{
+			name:      "policy_cidrs",
+			keySize:   unsafe.Sizeof(bpfmap.PolicyCidrKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.PolicyRuleInfo{}),
+		},
+		{
+			name:      "policy_ct",
+			keySize:   unsafe.Sizeof(bpfmap.ServiceCtKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.PolicyRuleInfo{}),
+		},
+		{
+			name:      "policy_stats",
+			keySize:   unsafe.Sizeof(bpfmap.PolicyStatsKey{}),
+			valueSize: unsafe.Sizeof(bpfmap.PolicyStatsInfo{}),
+		},
+	}
+	// every program declares the maps, the declarations must match the go types
+	for i, p := range append(programs, sockProgram) {
+		spec, err := p.load()
+		if err != nil {
+			t.Fatalf("load %s error = %v", p.path, err)
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("case %d %s", i+1, tt.name), func(t *testing.T) {
+				m, ok := spec.Maps[tt.name]
+				if !ok {
+					t.Skipf("%s has no map %s", p.path, tt.name)
+				}
+				if uintptr(m.KeySize) != tt.keySize || uintptr(m.ValueSize) != tt.valueSize {
+					t.Errorf("map %s key %d value %d, want key %d value %d", tt.name, m.KeySize, m.ValueSize, tt.keySize, tt.valueSize)
+				}
+			})
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		maxEntries bpfmap.MaxEntries
+		want       map[string]uint32
+	}{
+		{
+			maxEntries: bpfmap.DefaultMaxEntries(),
+			want:       map[string]uint32{"local_dev": 255, "local_pod_ips": 16384, "cluster_pod_ips": 65536},
+		},
+		{
+			maxEntries: bpfmap.MaxEntries{LocalPodIps: 1024, ClusterPodIps: 200000},
+			want:       map[string]uint32{"local_dev": 255, "local_pod_ips": 1024, "cluster_pod_ips": 200000},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			spec, err := loadVethIngress()
+			if err != nil {
+				t.Fatalf("loadVethIngress() error = %v", err)
+			}
+			resize(spec, tt.maxEntries)
+			for name, want := range tt.want {
+				if got := spec.Maps[name].MaxEntries; got != want {
+					t.Errorf("map %s max entries = %d, want %d", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyEntries(t *testing.T) {
+	tests := []struct {
+		from        map[uint32]uint32
+		to          map[uint32]uint64
+		maxEntries  uint32
+		flags       ebpf.MapUpdateFlags
+		want        map[uint32]uint64
+		wantCopied  int
+		wantDropped int
+	}{
+		{
+			from:       map[uint32]uint32{1: 10, 2: 20},
+			maxEntries: 4,
+			flags:      ebpf.UpdateAny,
+			want:       map[uint32]uint64{1: 10, 2: 20},
+			wantCopied: 2,
+		},
+		{
+			// the entries updated in the new map are kept
+			from:       map[uint32]uint32{1: 10, 2: 20},
+			to:         map[uint32]uint64{1: 11},
+			maxEntries: 4,
+			flags:      ebpf.UpdateNoExist,
+			want:       map[uint32]uint64{1: 11, 2: 20},
+			wantCopied: 1,
+		},
+		{
+			from:        map[uint32]uint32{1: 10, 2: 20, 3: 30},
+			to:          map[uint32]uint64{1: 11},
+			maxEntries:  2,
+			flags:       ebpf.UpdateNoExist,
+			wantCopied:  1,
+			wantDropped: 1,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			from, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 4, MaxEntries: 4})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer from.Close()
+			to, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 8, MaxEntries: tt.maxEntries})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer to.Close()
+			for k, v := range tt.from {
+				if err := from.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k, v := range tt.to {
+				if err := to.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			copied, dropped, err := copyEntries("test", from, to, tt.flags)
+			if err != nil {
+				t.Fatalf("copyEntries() error = %v", err)
+			}
+			if copied != tt.wantCopied || dropped != tt.wantDropped {
+				t.Errorf("copyEntries() = %d, %d, want %d, %d", copied, dropped, tt.wantCopied, tt.wantDropped)
+			}
+			for k, want := range tt.want {
+				var got uint64
+				if err := to.Lookup(k, &got); err != nil || got != want {
+					t.Errorf("entry %d = %d, %v, want %d", k, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReservePorts(t *testing.T) {
+	tests := []struct {
+		reserved string
+		want     string
+	}{
+		{reserved: "\n", want: "61000-65535"},
+		{reserved: "8080,9000-9010\n", want: "8080,9000-9010,61000-65535"},
+		{reserved: "8080,61000-65535\n", want: "8080,61000-65535\n"},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ip_local_reserved_ports")
+			if err := os.WriteFile(path, []byte(tt.reserved), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := reservePorts(path, "61000-65535"); err != nil {
+				t.Fatalf("reservePorts() error = %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("reservePorts() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// skBuff is the start of the struct __sk_buff a program is tested with, up to its ifindex
+type skBuff struct {
+	_       [10]uint32
+	Ifindex uint32
+}
+
+// newVethIngress loads the program of the host veths with maps of its own, the test is skipped
+// without the privileges to load it
+func newVethIngress(t *testing.T) *ebpf.Collection {
+	t.Helper()
+	spec, err := loadVethIngress()
+	if err != nil {
+		t.Fatalf("loadVethIngress() error = %v", err)
+	}
+	for _, m := range spec.Maps {
+		m.Pinning = ebpf.PinNone
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		t.Skipf("failed to load the program: %v", err)
+	}
+	t.Cleanup(coll.Close)
+	return coll
+}
+
+func TestVethIngressSource(t *testing.T) {
+	const (
+		tcActShot = 2
+		// the ifindex of lo, the packets are received on it
+		loIfIndex = 1
+	)
+	tests := []struct {
+		src        string
+		lxcIfIndex uint32
+		wantShot   bool
+	}{
+		{src: "10.244.0.2", lxcIfIndex: loIfIndex, wantShot: false},
+		// the source is a pod of another veth
+		{src: "10.244.0.2", lxcIfIndex: 1000, wantShot: true},
+		// the source is not a pod of the node
+		{src: "10.244.9.9", lxcIfIndex: loIfIndex, wantShot: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			coll := newVethIngress(t)
+			key := bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32("10.244.0.2")}
+			if err := coll.Maps["local_pod_ips"].Put(key, bpfmap.LocalIpsMapInfo{LxcIfIndex: tt.lxcIfIndex}); err != nil {
+				t.Fatal(err)
+			}
+
+			ret, err := coll.Programs["cls_main"].Run(&ebpf.RunOptions{
+				Data:    udpPacket(tt.src, "10.244.0.3"),
+				Context: skBuff{Ifindex: loIfIndex},
+			})
+			if err != nil {
+				t.Skipf("failed to run the program: %v", err)
+			}
+			if gotShot := ret == tcActShot; gotShot != tt.wantShot {
+				t.Errorf("cls_main() = %d, dropped %v, want %v", ret, gotShot, tt.wantShot)
+			}
+		})
+	}
+}
+
+// udpPacket returns an ethernet frame of an udp packet from src to dst
+func udpPacket(src, dst string) []byte {
+	pkt := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(pkt[12:], 0x0800)
+	ip := pkt[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], 20+8)
+	ip[8] = 64
+	ip[9] = 17
+	binary.BigEndian.PutUint32(ip[12:], util.InetIpToUInt32(src))
+	binary.BigEndian.PutUint32(ip[16:], util.InetIpToUInt32(dst))
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], 8)
+	return pkt
+}
+
+func TestVethIngressFragments(t *testing.T) {
+	const (
+		loIfIndex = 1
+		clusterIP = "10.96.0.10"
+		backendIP = "10.244.0.3"
+	)
+	tests := []struct {
+		offsets  []uint16
+		wantDsts []string
+	}{
+		// the fragments following the first one are sent to the backend of the first fragment
+		{offsets: []uint16{0, 1, 2}, wantDsts: []string{backendIP, backendIP, backendIP}},
+		// a fragment whose first fragment is unknown is not translated
+		{offsets: []uint16{1}, wantDsts: []string{clusterIP}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			coll := newVethIngress(t)
+			for _, ip := range []string{"10.244.0.2", backendIP} {
+				key := bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(ip)}
+				if err := coll.Maps["local_pod_ips"].Put(key, bpfmap.LocalIpsMapInfo{LxcIfIndex: loIfIndex}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			svcKey := bpfmap.ServiceKey{IP: util.InetIpToUInt32(clusterIP), Port: 53, Protocol: 17}
+			if err := coll.Maps["services"].Put(svcKey, bpfmap.ServiceInfo{Count: 1}); err != nil {
+				t.Fatal(err)
+			}
+			backendKey := bpfmap.ServiceBackendKey{IP: svcKey.IP, Port: svcKey.Port, Protocol: svcKey.Protocol, Slot: 1}
+			backend := bpfmap.ServiceBackendInfo{IP: util.InetIpToUInt32(backendIP), Port: 5353}
+			if err := coll.Maps["service_backends"].Put(backendKey, backend); err != nil {
+				t.Fatal(err)
+			}
+
+			for j, offset := range tt.offsets {
+				pkt := udpFragment("10.244.0.2", clusterIP, 7, offset, j < len(tt.offsets)-1)
+				out := make([]byte, len(pkt))
+				_, err := coll.Programs["cls_main"].Run(&ebpf.RunOptions{
+					Data:    pkt,
+					DataOut: out,
+					Context: skBuff{Ifindex: loIfIndex},
+				})
+				if err != nil {
+					t.Skipf("failed to run the program: %v", err)
+				}
+				if got := util.InetUint32ToIp(binary.BigEndian.Uint32(out[14+16:])); got != tt.wantDsts[j] {
+					t.Errorf("fragment %d sent to %s, want %s", offset, got, tt.wantDsts[j])
+				}
+				if offset == 0 {
+					if got := binary.BigEndian.Uint16(out[14+20+2:]); got != backend.Port {
+						t.Errorf("first fragment sent to port %d, want %d", got, backend.Port)
+					}
+				}
+			}
+		})
+	}
+}
+
+// udpFragment returns an ethernet frame of a fragment of the udp datagram id from src to dst at
+// offset in units of 8 bytes, the fragments following the first one hold no udp header
+func udpFragment(src, dst string, id, offset uint16, more bool) []byte {
+	pkt := udpPacket(src, dst)
+	ip := pkt[14:]
+	binary.BigEndian.PutUint16(ip[4:], id)
+	fragOff := offset
+	if more {
+		fragOff |= 0x2000
+	}
+	binary.BigEndian.PutUint16(ip[6:], fragOff)
+	if offset != 0 {
+		// the payload of the datagram, it would be read as other ports
+		copy(ip[20:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+	return pkt
+}
+
+func TestVethIngressPolicy(t *testing.T) {
+	const (
+		tcActShot = 2
+		loIfIndex = 1
+		client    = "10.244.0.2"
+		server    = "10.244.0.3"
+		identity  = 10
+	)
+	tests := []struct {
+		rule     bpfmap.PolicyRuleKey
+		offsets  []uint16
+		wantShot []bool
+	}{
+		{rule: bpfmap.PolicyRuleKey{Port: 80, PortPrefix: 16}, offsets: []uint16{0}, wantShot: []bool{true}},
+		{rule: bpfmap.PolicyRuleKey{Port: 53, PortPrefix: 16}, offsets: []uint16{0}, wantShot: []bool{false}},
+		// the fragments following the first one are checked on the ports of the first fragment
+		{rule: bpfmap.PolicyRuleKey{Port: 53, PortPrefix: 16}, offsets: []uint16{0, 1}, wantShot: []bool{false, false}},
+		{rule: bpfmap.PolicyRuleKey{Port: 65535, PortPrefix: 16}, offsets: []uint16{0, 1}, wantShot: []bool{true, true}},
+		// a fragment whose first fragment is unknown is only allowed by the rules of every port
+		{rule: bpfmap.PolicyRuleKey{Port: 53, PortPrefix: 16}, offsets: []uint16{1}, wantShot: []bool{true}},
+		{rule: bpfmap.PolicyRuleKey{}, offsets: []uint16{1}, wantShot: []bool{false}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			coll := newVethIngress(t)
+			for _, ip := range []string{client, server} {
+				key := bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(ip)}
+				if err := coll.Maps["local_pod_ips"].Put(key, bpfmap.LocalIpsMapInfo{LxcIfIndex: loIfIndex}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			idKey := bpfmap.PodIdentityKey{IP: util.InetIpToUInt32(client)}
+			if err := coll.Maps["pod_identities"].Put(idKey, bpfmap.PodIdentityInfo{Identity: identity}); err != nil {
+				t.Fatal(err)
+			}
+			epKey := bpfmap.PolicyEndpointKey{IP: util.InetIpToUInt32(server)}
+			if err := coll.Maps["policy_endpoints"].Put(epKey, bpfmap.PolicyEndpointInfo{IngressPolicy: 1}); err != nil {
+				t.Fatal(err)
+			}
+			rule := tt.rule
+			rule.IP = util.InetIpToUInt32(server)
+			rule.Identity = identity
+			rule.Protocol = 17
+			rule.Direction = bpfmap.PolicyIngress
+			if err := coll.Maps["policy_rules"].Put(rule, bpfmap.PolicyRuleInfo{Policy: 1}); err != nil {
+				t.Fatal(err)
+			}
+
+			for j, offset := range tt.offsets {
+				ret, err := coll.Programs["cls_main"].Run(&ebpf.RunOptions{
+					Data:    udpFragment(client, server, 7, offset, j < len(tt.offsets)-1),
+					Context: skBuff{Ifindex: loIfIndex},
+				})
+				if err != nil {
+					t.Skipf("failed to run the program: %v", err)
+				}
+				if gotShot := ret == tcActShot; gotShot != tt.wantShot[j] {
+					t.Errorf("cls_main() of fragment %d = %d, dropped %v, want %v", offset, ret, gotShot, tt.wantShot[j])
+				}
+			}
+		})
+	}
+}
+
+func TestVethIngressMasqPorts(t *testing.T) {
+	const (
+		tcActShot = 2
+		loIfIndex = 1
+		client    = "10.244.0.2"
+		dst       = "203.0.113.1"
+		nodeIP    = "192.0.2.10"
+	)
+	tests := []struct {
+		held     int
+		wantPort bool
+	}{
+		{held: 0, wantPort: true},
+		{held: 100, wantPort: true},
+		// every port of the range is held by a connection to the destination
+		{held: SNATPortMax - SNATPortMin + 1, wantPort: false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			coll := newVethIngress(t)
+			key := bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(client)}
+			if err := coll.Maps["local_pod_ips"].Put(key, bpfmap.LocalIpsMapInfo{LxcIfIndex: loIfIndex}); err != nil {
+				t.Fatal(err)
+			}
+			node := bpfmap.NodeInfoValue{IP: util.InetIpToUInt32(nodeIP), Masquerade: 1}
+			if err := coll.Maps["node_info"].Put(bpfmap.NodeInfoKey, node); err != nil {
+				t.Fatal(err)
+			}
+			for port := SNATPortMin; port < SNATPortMin+tt.held; port++ {
+				portKey := bpfmap.ServiceCtKey{ClientIP: node.IP, IP: util.InetIpToUInt32(dst), ClientPort: uint16(port), Port: 53, Protocol: 17}
+				owner := bpfmap.ServiceCtKey{ClientIP: util.InetIpToUInt32("10.244.0.9"), IP: portKey.IP, ClientPort: uint16(port), Port: 53, Protocol: 17}
+				if err := coll.Maps["masq_ports"].Put(portKey, owner); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ret, err := coll.Programs["cls_main"].Run(&ebpf.RunOptions{
+				Data:    udpPacket(client, dst),
+				Context: skBuff{Ifindex: loIfIndex},
+			})
+			if err != nil {
+				t.Skipf("failed to run the program: %v", err)
+			}
+			conn := bpfmap.ServiceCtKey{ClientIP: key.IP, IP: util.InetIpToUInt32(dst), ClientPort: 40000, Port: 53, Protocol: 17}
+			var ct bpfmap.MasqCtInfo
+			gotPort := coll.Maps["masq_ct"].Lookup(conn, &ct) == nil
+			if !gotPort && ret != tcActShot {
+				t.Skipf("the destination is not routed, cls_main() = %d", ret)
+			}
+			if gotPort != tt.wantPort {
+				t.Fatalf("port allocated = %v, want %v", gotPort, tt.wantPort)
+			}
+			if !gotPort {
+				return
+			}
+			if ct.SnatPort < SNATPortMin+uint16(tt.held) || ct.SnatPort > SNATPortMax || ct.LastSeen == 0 {
+				t.Errorf("masq_ct = %+v, want a free port of the range and the time of the packet", ct)
+			}
+		})
+	}
+}
+
+// withUnderlay runs f in a new netns whose veth0 is on 192.168.0.0/24 and knows the mac of the node
+// 192.168.0.2, the test is skipped without the privileges to create them
+func withUnderlay(t *testing.T, nodeMAC net.HardwareAddr, f func() error) {
+	t.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	err = netns.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth0-peer"}); err != nil {
+			return err
+		}
+		for _, name := range []string{"lo", "veth0", "veth0-peer"} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+		}
+		link, err := netlink.LinkByName("veth0")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("192.168.0.1/24")
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		if err := netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           net.ParseIP("192.168.0.2"),
+			HardwareAddr: nodeMAC,
+		}); err != nil {
+			return err
+		}
+		return f()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVethIngressRouteRemote(t *testing.T) {
+	const (
+		tcActRedirect = 7
+		tcActUnspec   = 0xffffffff
+		loIfIndex     = 1
+		client        = "10.244.0.2"
+		server        = "10.244.1.2"
+	)
+	nodeMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	tests := []struct {
+		routing    bpfmap.RoutingMode
+		node       string
+		tunnel     bool
+		want       uint32
+		wantNative bool
+	}{
+		{routing: bpfmap.RoutingNative, node: "192.168.0.2", tunnel: true, want: tcActRedirect, wantNative: true},
+		// the node native has no route to is reached through the tunnel
+		{routing: bpfmap.RoutingNative, node: "10.9.9.9", tunnel: true, want: tcActRedirect},
+		{routing: bpfmap.RoutingNative, node: "10.9.9.9", want: tcActUnspec},
+		{routing: bpfmap.RoutingVxlan, node: "192.168.0.2", tunnel: true, want: tcActRedirect},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			// the program is loaded outside of the netns, a test is skipped from its goroutine only
+			coll := newVethIngress(t)
+			var runErr error
+			withUnderlay(t, nodeMAC, func() error {
+				key := bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(client)}
+				if err := coll.Maps["local_pod_ips"].Put(key, bpfmap.LocalIpsMapInfo{LxcIfIndex: loIfIndex}); err != nil {
+					return err
+				}
+				podKey := bpfmap.ClusterIpsMapKey{IP: util.InetIpToUInt32(server)}
+				if err := coll.Maps["cluster_pod_ips"].Put(podKey, bpfmap.ClusterIpsMapInfo{IP: util.InetIpToUInt32(tt.node)}); err != nil {
+					return err
+				}
+				if err := coll.Maps["node_info"].Put(bpfmap.NodeInfoKey, bpfmap.NodeInfoValue{Routing: tt.routing}); err != nil {
+					return err
+				}
+				if tt.tunnel {
+					devKey := bpfmap.LocalDevMapKey{Type: bpfmap.VxlanDevType}
+					if err := coll.Maps["local_dev"].Put(devKey, bpfmap.LocalDevMapValue{IfIndex: 1000}); err != nil {
+						return err
+					}
+				}
+
+				pkt := udpPacket(client, server)
+				out := make([]byte, len(pkt))
+				ret, err := coll.Programs["cls_main"].Run(&ebpf.RunOptions{
+					Data:    pkt,
+					DataOut: out,
+					Context: skBuff{Ifindex: loIfIndex},
+				})
+				if err != nil {
+					runErr = err
+					return nil
+				}
+				if ret != tt.want {
+					return fmt.Errorf("cls_main() = %d, want %d", ret, tt.want)
+				}
+				// the packet routed natively is sent to the mac of the node, the tunnel encapsulates it
+				if gotNative := bytes.Equal(out[:6], nodeMAC); gotNative != tt.wantNative {
+					return fmt.Errorf("packet sent to %s, routed natively %v, want %v", net.HardwareAddr(out[:6]), gotNative, tt.wantNative)
+				}
+				return nil
+			})
+			if runErr != nil {
+				t.Skipf("failed to run the program: %v", runErr)
+			}
+		})
+	}
+}
+
+// newGeneve loads the program of the geneve device in the direction with maps of its own and pins
+// it for tc, the test is skipped without the privileges to load it
+func newGeneve(t *testing.T, load func() (*ebpf.CollectionSpec, error), direct tc.BpfTcDirectType) (*ebpf.Collection, string) {
+	t.Helper()
+	spec, err := load()
+	if err != nil {
+		t.Fatalf("load the geneve program error = %v", err)
+	}
+	for _, m := range spec.Maps {
+		m.Pinning = ebpf.PinNone
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		t.Skipf("failed to load the program: %v", err)
+	}
+	t.Cleanup(coll.Close)
+	path := filepath.Join("/sys/fs/bpf", fmt.Sprintf("fast_geneve_test_%d_%s", os.Getpid(), direct))
+	if err := coll.Programs["cls_main"].Pin(path); err != nil {
+		t.Skipf("failed to pin the program: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(path) })
+	return coll, path
+}
+
+// withGeneveNodes runs the node 192.168.0.1 and the node 192.168.0.2 in netns of their own joined
+// by a veth, under0 and under1, with a geneve device each. The egress program of the geneve device
+// of the first node is attached, and the ingress program of the second one. The test is skipped
+// when the kernel has no geneve.
+func withGeneveNodes(t *testing.T, egress, ingress string, first, second func() error) {
+	t.Helper()
+	nodes := make([]ns.NetNS, 2)
+	for i := range nodes {
+		netns, err := testutils.NewNS()
+		if err != nil {
+			t.Skipf("failed to create netns: %v", err)
+		}
+		defer func() {
+			netns.Close()
+			_ = testutils.UnmountNS(netns)
+		}()
+		nodes[i] = netns
+	}
+	setup := func(dev, addr, program string, direct tc.BpfTcDirectType) error {
+		link, err := netlink.LinkByName(dev)
+		if err != nil {
+			return err
+		}
+		ip, _ := netlink.ParseAddr(addr)
+		if err := netlink.AddrAdd(link, ip); err != nil {
+			return err
+		}
+		for _, l := range []netlink.Link{link, &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo"}}} {
+			if err := netlink.LinkSetUp(l); err != nil {
+				return err
+			}
+		}
+		if _, err := nettools.CreateGeneveAndUp(nettools.GeneveDevName, 0); err != nil {
+			return err
+		}
+		if err := tc.AddClsactQdiscIntoDev(nettools.GeneveDevName); err != nil {
+			return err
+		}
+		return tc.AttachBPFIntoDev(nettools.GeneveDevName, direct, program)
+	}
+
+	err := nodes[0].Do(func(ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "under0"}, PeerName: "under1"})
+	})
+	if err == nil {
+		err = nodes[0].Do(func(ns.NetNS) error {
+			peer, err := netlink.LinkByName("under1")
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetNsFd(peer, int(nodes[1].Fd()))
+		})
+	}
+	if err == nil {
+		err = nodes[1].Do(func(ns.NetNS) error { return setup("under1", "192.168.0.2/24", ingress, tc.IngressType) })
+	}
+	if err == nil {
+		err = nodes[0].Do(func(ns.NetNS) error { return setup("under0", "192.168.0.1/24", egress, tc.EgressType) })
+	}
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skipf("the kernel has no geneve: %v", err)
+	}
+	if err == nil {
+		err = nodes[1].Do(func(ns.NetNS) error { return second() })
+	}
+	if err == nil {
+		err = nodes[0].Do(func(ns.NetNS) error { return first() })
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// geneveOption returns the first option of the geneve packet received on the socket, its class,
+// type, length in 4 bytes and data
+func geneveOption(fd int) (uint16, uint8, uint8, []byte, error) {
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return 0, 0, 0, nil, fmt.Errorf("no geneve packet received: %w", err)
+		}
+		pkt := buf[:n]
+		// the outer ethernet, IPv4 and UDP headers to the geneve port
+		if n < 14+20+8+8 || binary.BigEndian.Uint16(pkt[12:]) != 0x0800 || pkt[14+9] != 17 {
+			continue
+		}
+		udp := pkt[14+int(pkt[14]&0x0f)*4:]
+		if binary.BigEndian.Uint16(udp[2:]) != 6081 {
+			continue
+		}
+		geneve := udp[8:]
+		optLen := int(geneve[0]&0x3f) * 4
+		if optLen < 4 || len(geneve) < 8+optLen {
+			return 0, 0, 0, nil, fmt.Errorf("geneve packet without option: % x", geneve)
+		}
+		opt := geneve[8 : 8+optLen]
+		length := opt[3] & 0x1f
+		if len(opt) < 4+int(length)*4 {
+			return 0, 0, 0, nil, fmt.Errorf("geneve option longer than the options: % x", opt)
+		}
+		return binary.BigEndian.Uint16(opt), opt[2], length, opt[4 : 4+int(length)*4], nil
+	}
+}
+
+func TestGeneveIdentity(t *testing.T) {
+	const (
+		client   = "10.244.0.1"
+		server   = "10.244.1.2"
+		identity = 42
+	)
+	tests := []struct {
+		identity    uint32
+		wantAllowed bool
+	}{
+		{identity: identity, wantAllowed: true},
+		// the option is sent without identity, the identity is not allowed
+		{identity: 0, wantAllowed: false},
+		{identity: 7, wantAllowed: false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			egress, egressPath := newGeneve(t, loadGeneveEgress, tc.EgressType)
+			ingress, ingressPath := newGeneve(t, loadGeneveIngress, tc.IngressType)
+			podKey := bpfmap.ClusterIpsMapKey{IP: util.InetIpToUInt32(server)}
+			if err := egress.Maps["cluster_pod_ips"].Put(podKey, bpfmap.ClusterIpsMapInfo{IP: util.InetIpToUInt32("192.168.0.2")}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.identity != 0 {
+				idKey := bpfmap.PodIdentityKey{IP: util.InetIpToUInt32(client)}
+				if err := egress.Maps["pod_identities"].Put(idKey, bpfmap.PodIdentityInfo{Identity: tt.identity}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			epKey := bpfmap.PolicyEndpointKey{IP: util.InetIpToUInt32(server)}
+			if err := ingress.Maps["policy_endpoints"].Put(epKey, bpfmap.PolicyEndpointInfo{IngressPolicy: 1}); err != nil {
+				t.Fatal(err)
+			}
+			rule := bpfmap.PolicyRuleKey{IP: epKey.IP, Identity: identity, Protocol: 17, Direction: bpfmap.PolicyIngress}
+			if err := ingress.Maps["policy_rules"].Put(rule, bpfmap.PolicyRuleInfo{Policy: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := ingress.Maps["policy_stats"].Put(bpfmap.PolicyStatsKey{Policy: 1}, bpfmap.PolicyStatsInfo{}); err != nil {
+				t.Fatal(err)
+			}
+
+			var sock int
+			withGeneveNodes(t, egressPath, ingressPath, func() error {
+				defer unix.Close(sock)
+				link, err := netlink.LinkByName(nettools.GeneveDevName)
+				if err != nil {
+					return err
+				}
+				addr, _ := netlink.ParseAddr(client + "/32")
+				if err := netlink.AddrAdd(link, addr); err != nil {
+					return err
+				}
+				_, dst, _ := net.ParseCIDR(server + "/32")
+				if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Src: net.ParseIP(client)}); err != nil {
+					return err
+				}
+				if err := netlink.NeighSet(&netlink.Neigh{
+					LinkIndex:    link.Attrs().Index,
+					Family:       netlink.FAMILY_V4,
+					State:        netlink.NUD_PERMANENT,
+					IP:           net.ParseIP(server),
+					HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+				}); err != nil {
+					return err
+				}
+				conn, err := net.Dial("udp4", server+":53")
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				if _, err := conn.Write([]byte("fast")); err != nil {
+					return err
+				}
+
+				class, typ, length, data, err := geneveOption(sock)
+				if err != nil {
+					return err
+				}
+				if class != 0xff01 || typ != 1 || length != 1 || binary.BigEndian.Uint32(data) != tt.identity {
+					return fmt.Errorf("geneve option class %#x type %d length %d data % x, want class 0xff01 type 1 length 1 identity %d",
+						class, typ, length, data, tt.identity)
+				}
+				return nil
+			}, func() error {
+				// the packets of the node are captured on the veth before the geneve device gets them
+				var err error
+				if sock, err = unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL))); err != nil {
+					return err
+				}
+				link, err := netlink.LinkByName("under1")
+				if err != nil {
+					return err
+				}
+				if err := unix.Bind(sock, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: link.Attrs().Index}); err != nil {
+					return err
+				}
+				return unix.SetsockoptTimeval(sock, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 2})
+			})
+
+			// the ingress program of the second node checks the policy with the identity of the option
+			var stats bpfmap.PolicyStatsInfo
+			for j := 0; j < 20; j++ {
+				if err := ingress.Maps["policy_stats"].Lookup(bpfmap.PolicyStatsKey{Policy: 1}, &stats); err != nil {
+					t.Fatal(err)
+				}
+				if stats.Allowed+stats.Denied > 0 {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if gotAllowed := stats.Allowed > 0; gotAllowed != tt.wantAllowed || stats.Allowed+stats.Denied == 0 {
+				t.Errorf("policy stats = %+v, allowed %v, want %v", stats, gotAllowed, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+// htons returns the short in network byte order
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,195 @@
+// Code generated by bpf2go; DO NOT EDIT.
+//go:build 386 || amd64 || amd64p32 || arm || arm64 || mips64le || mips64p32le || mipsle || ppc64le || riscv64
+// +build 386 amd64 amd64p32 arm arm64 mips64le mips64p32le mipsle ppc64le riscv64
+
+package loader
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+
+	"github.com/cilium/ebpf"
+)
+
+// loadSock returns the embedded CollectionSpec for sock.
+func loadSock() (*ebpf.CollectionSpec, error) {
+	reader := bytes.NewReader(_SockBytes)
+	spec, err := ebpf.LoadCollectionSpecFromReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't load sock: %w", err)
+	}
+
+	return spec, err
+}
+
+// loadSockObjects loads sock and converts it into a struct.
+//
+// The following types are suitable as obj argument:
+//
+//	*sockObjects
+//	*sockPrograms
+//	*sockMaps
+//
+// See ebpf.CollectionSpec.LoadAndAssign documentation for details.
+func loadSockObjects(obj interface{}, opts *ebpf.CollectionOptions) error {
+	spec, err := loadSock()
+	if err != nil {
+		return err
+	}
+
+	return spec.LoadAndAssign(obj, opts)
+}
+
+// sockSpecs contains maps and programs before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type sockSpecs struct {
+	sockProgramSpecs
+	sockMapSpecs
+}
+
+// sockSpecs contains programs before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type sockProgramSpecs struct {
+	SockConnect4 *ebpf.ProgramSpec `ebpf:"sock_connect4"`
+	SockRecvmsg4 *ebpf.ProgramSpec `ebpf:"sock_recvmsg4"`
+	SockSendmsg4 *ebpf.ProgramSpec `ebpf:"sock_sendmsg4"`
+}
+
+// sockMapSpecs contains maps before they are loaded into the kernel.
+//
+// It can be passed ebpf.CollectionSpec.Assign.
+type sockMapSpecs struct {
+	ClusterPodIps   *ebpf.MapSpec `ebpf:"cluster_pod_ips"`
+	HostPorts       *ebpf.MapSpec `ebpf:"host_ports"`
+	HostPortsCt     *ebpf.MapSpec `ebpf:"host_ports_ct"`
+	IpFrags         *ebpf.MapSpec `ebpf:"ip_frags"`
+	LocalDev        *ebpf.MapSpec `ebpf:"local_dev"`
+	LocalPodIps     *ebpf.MapSpec `ebpf:"local_pod_ips"`
+	MasqCt          *ebpf.MapSpec `ebpf:"masq_ct"`
+	MasqPorts       *ebpf.MapSpec `ebpf:"masq_ports"`
+	NodeAddrs       *ebpf.MapSpec `ebpf:"node_addrs"`
+	NodeInfo        *ebpf.MapSpec `ebpf:"node_info"`
+	NodeportCt      *ebpf.MapSpec `ebpf:"nodeport_ct"`
+	NodeportRevCt   *ebpf.MapSpec `ebpf:"nodeport_rev_ct"`
+	NonMasqCidrs    *ebpf.MapSpec `ebpf:"non_masq_cidrs"`
+	PodIdentities   *ebpf.MapSpec `ebpf:"pod_identities"`
+	PolicyCidrs     *ebpf.MapSpec `ebpf:"policy_cidrs"`
+	PolicyCt        *ebpf.MapSpec `ebpf:"policy_ct"`
+	PolicyEndpoints *ebpf.MapSpec `ebpf:"policy_endpoints"`
+	PolicyRules     *ebpf.MapSpec `ebpf:"policy_rules"`
+	PolicyStats     *ebpf.MapSpec `ebpf:"policy_stats"`
+	ServiceBackends *ebpf.MapSpec `ebpf:"service_backends"`
+	ServiceCt       *ebpf.MapSpec `ebpf:"service_ct"`
+	ServiceRevCt    *ebpf.MapSpec `ebpf:"service_rev_ct"`
+	Services        *ebpf.MapSpec `ebpf:"services"`
+	SockRevNat      *ebpf.MapSpec `ebpf:"sock_rev_nat"`
+}
+
+// sockObjects contains all objects after they have been loaded into the kernel.
+//
+// It can be passed to loadSockObjects or ebpf.CollectionSpec.LoadAndAssign.
+type sockObjects struct {
+	sockPrograms
+	sockMaps
+}
+
+func (o *sockObjects) Close() error {
+	return _SockClose(
+		&o.sockPrograms,
+		&o.sockMaps,
+	)
+}
+
+// sockMaps contains all maps after they have been loaded into the kernel.
+//
+// It can be passed to loadSockObjects or ebpf.CollectionSpec.LoadAndAssign.
+type sockMaps struct {
+	ClusterPodIps   *ebpf.Map `ebpf:"cluster_pod_ips"`
+	HostPorts       *ebpf.Map `ebpf:"host_ports"`
+	HostPortsCt     *ebpf.Map `ebpf:"host_ports_ct"`
+	IpFrags         *ebpf.Map `ebpf:"ip_frags"`
+	LocalDev        *ebpf.Map `ebpf:"local_dev"`
+	LocalPodIps     *ebpf.Map `ebpf:"local_pod_ips"`
+	MasqCt          *ebpf.Map `ebpf:"masq_ct"`
+	MasqPorts       *ebpf.Map `ebpf:"masq_ports"`
+	NodeAddrs       *ebpf.Map `ebpf:"node_addrs"`
+	NodeInfo        *ebpf.Map `ebpf:"node_info"`
+	NodeportCt      *ebpf.Map `ebpf:"nodeport_ct"`
+	NodeportRevCt   *ebpf.Map `ebpf:"nodeport_rev_ct"`
+	NonMasqCidrs    *ebpf.Map `ebpf:"non_masq_cidrs"`
+	PodIdentities   *ebpf.Map `ebpf:"pod_identities"`
+	PolicyCidrs     *ebpf.Map `ebpf:"policy_cidrs"`
+	PolicyCt        *ebpf.Map `ebpf:"policy_ct"`
+	PolicyEndpoints *ebpf.Map `ebpf:"policy_endpoints"`
+	PolicyRules     *ebpf.Map `ebpf:"policy_rules"`
+	PolicyStats     *ebpf.Map `ebpf:"policy_stats"`
+	ServiceBackends *ebpf.Map `ebpf:"service_backends"`
+	ServiceCt       *ebpf.Map `ebpf:"service_ct"`
+	ServiceRevCt    *ebpf.Map `ebpf:"service_rev_ct"`
+	Services        *ebpf.Map `ebpf:"services"`
+	SockRevNat      *ebpf.Map `ebpf:"sock_rev_nat"`
+}
+
+func (m *sockMaps) Close() error {
+	return _SockClose(
+		m.ClusterPodIps,
+		m.HostPorts,
+		m.HostPortsCt,
+		m.IpFrags,
+		m.LocalDev,
+		m.LocalPodIps,
+		m.MasqCt,
+		m.MasqPorts,
+		m.NodeAddrs,
+		m.NodeInfo,
+		m.NodeportCt,
+		m.NodeportRevCt,
+		m.NonMasqCidrs,
+		m.PodIdentities,
+		m.PolicyCidrs,
+		m.PolicyCt,
+		m.PolicyEndpoints,
+		m.PolicyRules,
+		m.PolicyStats,
+		m.ServiceBackends,
+		m.ServiceCt,
+		m.ServiceRevCt,
+		m.Services,
+		m.SockRevNat,
+	)
+}
+
+// sockPrograms contains all programs after they have been loaded into the kernel.
+//
+// It can be passed to loadSockObjects or ebpf.CollectionSpec.LoadAndAssign.
+type sockPrograms struct {
+	SockConnect4 *ebpf.Program `ebpf:"sock_connect4"`
+	SockRecvmsg4 *ebpf.Program `ebpf:"sock_recvmsg4"`
+	SockSendmsg4 *ebpf.Program `ebpf:"sock_sendmsg4"`
+}
+
+func (p *sockPrograms) Close() error {
+	return _SockClose(
+		p.SockConnect4,
+		p.SockRecvmsg4,
+		p.SockSendmsg4,
+	)
+}
+
+func _SockClose(closers ...io.Closer) error {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Do not access this directly.
+//
+//go:embed sock_bpfel.o
+var _SockBytes []byte
@@ -8,15 +8,68 @@ import (
 )
 
 const (
+	// PinPath is where the maps are pinned, the tc programs share them by name
+	PinPath = "/sys/fs/bpf/tc/globals"
+
 	LocalDev      = "/sys/fs/bpf/tc/globals/local_dev"
 	LocalPodIps   = "/sys/fs/bpf/tc/globals/local_pod_ips"
 	ClusterPodIps = "/sys/fs/bpf/tc/globals/cluster_pod_ips"
+	HostPorts     = "/sys/fs/bpf/tc/globals/host_ports"
+	HostPortsCt   = "/sys/fs/bpf/tc/globals/host_ports_ct"
+	NodeAddrs     = "/sys/fs/bpf/tc/globals/node_addrs"
+	SockRevNat    = "/sys/fs/bpf/tc/globals/sock_rev_nat"
+
+	Services        = "/sys/fs/bpf/tc/globals/services"
+	ServiceBackends = "/sys/fs/bpf/tc/globals/service_backends"
+	ServiceCt       = "/sys/fs/bpf/tc/globals/service_ct"
+	ServiceRevCt    = "/sys/fs/bpf/tc/globals/service_rev_ct"
+	IPFrags         = "/sys/fs/bpf/tc/globals/ip_frags"
+
+	NodeInfo      = "/sys/fs/bpf/tc/globals/node_info"
+	NodePortCt    = "/sys/fs/bpf/tc/globals/nodeport_ct"
+	NodePortRevCt = "/sys/fs/bpf/tc/globals/nodeport_rev_ct"
+
+	NonMasqCidrs = "/sys/fs/bpf/tc/globals/non_masq_cidrs"
+	MasqCt       = "/sys/fs/bpf/tc/globals/masq_ct"
+	MasqPorts    = "/sys/fs/bpf/tc/globals/masq_ports"
+
+	PodIdentities   = "/sys/fs/bpf/tc/globals/pod_identities"
+	PolicyEndpoints = "/sys/fs/bpf/tc/globals/policy_endpoints"
+	PolicyRules     = "/sys/fs/bpf/tc/globals/policy_rules"
+	PolicyCidrs     = "/sys/fs/bpf/tc/globals/policy_cidrs"
+	PolicyCt        = "/sys/fs/bpf/tc/globals/policy_ct"
+	PolicyStats     = "/sys/fs/bpf/tc/globals/policy_stats"
 )
 
 var (
 	localPodIpsMap   *ebpf.Map
 	clusterPodIpsMap *ebpf.Map
 	localDevMap      *ebpf.Map
+	hostPortsMap     *ebpf.Map
+	hostPortsCtMap   *ebpf.Map
+	nodeAddrsMap     *ebpf.Map
+	sockRevNatMap    *ebpf.Map
+
+	servicesMap        *ebpf.Map
+	serviceBackendsMap *ebpf.Map
+	serviceCtMap       *ebpf.Map
+	serviceRevCtMap    *ebpf.Map
+	ipFragsMap         *ebpf.Map
+
+	nodeInfoMap      *ebpf.Map
+	nodePortCtMap    *ebpf.Map
+	nodePortRevCtMap *ebpf.Map
+
+	nonMasqCidrsMap *ebpf.Map
+	masqCtMap       *ebpf.Map
+	masqPortsMap    *ebpf.Map
+
+	podIdentitiesMap   *ebpf.Map
+	policyEndpointsMap *ebpf.Map
+	policyRulesMap     *ebpf.Map
+	policyCidrsMap     *ebpf.Map
+	policyCtMap        *ebpf.Map
+	policyStatsMap     *ebpf.Map
 )
 
 func InitLoadPinnedMap() error {
@@ -33,6 +86,90 @@ func InitLoadPinnedMap() error {
 	if err != nil {
 		return fmt.Errorf("load map error: %w", err)
 	}
+	hostPortsMap, err = ebpf.LoadPinnedMap(HostPorts, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	hostPortsCtMap, err = ebpf.LoadPinnedMap(HostPortsCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	nodeAddrsMap, err = ebpf.LoadPinnedMap(NodeAddrs, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	sockRevNatMap, err = ebpf.LoadPinnedMap(SockRevNat, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	servicesMap, err = ebpf.LoadPinnedMap(Services, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	serviceBackendsMap, err = ebpf.LoadPinnedMap(ServiceBackends, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	serviceCtMap, err = ebpf.LoadPinnedMap(ServiceCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	serviceRevCtMap, err = ebpf.LoadPinnedMap(ServiceRevCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	ipFragsMap, err = ebpf.LoadPinnedMap(IPFrags, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	nodeInfoMap, err = ebpf.LoadPinnedMap(NodeInfo, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	nodePortCtMap, err = ebpf.LoadPinnedMap(NodePortCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	nodePortRevCtMap, err = ebpf.LoadPinnedMap(NodePortRevCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	nonMasqCidrsMap, err = ebpf.LoadPinnedMap(NonMasqCidrs, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	masqCtMap, err = ebpf.LoadPinnedMap(MasqCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	masqPortsMap, err = ebpf.LoadPinnedMap(MasqPorts, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	podIdentitiesMap, err = ebpf.LoadPinnedMap(PodIdentities, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	policyEndpointsMap, err = ebpf.LoadPinnedMap(PolicyEndpoints, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	policyRulesMap, err = ebpf.LoadPinnedMap(PolicyRules, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	policyCidrsMap, err = ebpf.LoadPinnedMap(PolicyCidrs, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	policyCtMap, err = ebpf.LoadPinnedMap(PolicyCt, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
+	policyStatsMap, err = ebpf.LoadPinnedMap(PolicyStats, &ebpf.LoadPinOptions{})
+	if err != nil {
+		return fmt.Errorf("load map error: %w", err)
+	}
 	return nil
 }
 
@@ -57,6 +194,153 @@ func GetLocalDevMap() *ebpf.Map {
 	return localDevMap
 }
 
+func GetHostPortsMap() *ebpf.Map {
+	if hostPortsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return hostPortsMap
+}
+
+func GetHostPortsCtMap() *ebpf.Map {
+	if hostPortsCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return hostPortsCtMap
+}
+
+func GetNodeAddrsMap() *ebpf.Map {
+	if nodeAddrsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return nodeAddrsMap
+}
+
+func GetSockRevNatMap() *ebpf.Map {
+	if sockRevNatMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return sockRevNatMap
+}
+
+func GetServicesMap() *ebpf.Map {
+	if servicesMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return servicesMap
+}
+
+func GetServiceBackendsMap() *ebpf.Map {
+	if serviceBackendsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return serviceBackendsMap
+}
+
+func GetServiceCtMap() *ebpf.Map {
+	if serviceCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return serviceCtMap
+}
+
+func GetServiceRevCtMap() *ebpf.Map {
+	if serviceRevCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return serviceRevCtMap
+}
+
+func GetIPFragsMap() *ebpf.Map {
+	if ipFragsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return ipFragsMap
+}
+
+func GetNodeInfoMap() *ebpf.Map {
+	if nodeInfoMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return nodeInfoMap
+}
+
+func GetNodePortCtMap() *ebpf.Map {
+	if nodePortCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return nodePortCtMap
+}
+
+func GetNodePortRevCtMap() *ebpf.Map {
+	if nodePortRevCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return nodePortRevCtMap
+}
+
+func GetNonMasqCidrsMap() *ebpf.Map {
+	if nonMasqCidrsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return nonMasqCidrsMap
+}
+
+func GetMasqCtMap() *ebpf.Map {
+	if masqCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return masqCtMap
+}
+
+func GetMasqPortsMap() *ebpf.Map {
+	if masqPortsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return masqPortsMap
+}
+
+func GetPodIdentitiesMap() *ebpf.Map {
+	if podIdentitiesMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return podIdentitiesMap
+}
+
+func GetPolicyEndpointsMap() *ebpf.Map {
+	if policyEndpointsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return policyEndpointsMap
+}
+
+func GetPolicyRulesMap() *ebpf.Map {
+	if policyRulesMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return policyRulesMap
+}
+
+func GetPolicyCidrsMap() *ebpf.Map {
+	if policyCidrsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return policyCidrsMap
+}
+
+func GetPolicyCtMap() *ebpf.Map {
+	if policyCtMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return policyCtMap
+}
+
+func GetPolicyStatsMap() *ebpf.Map {
+	if policyStatsMap == nil {
+		_ = InitLoadPinnedMap()
+	}
+	return policyStatsMap
+}
+
 func PrintMapSize() {
 	fmt.Println(uint32(unsafe.Sizeof(LocalDevMapKey{})))
 	fmt.Println(uint32(unsafe.Sizeof(LocalDevMapValue{})))
@@ -64,4 +348,33 @@ func PrintMapSize() {
 	fmt.Println(uint32(unsafe.Sizeof(LocalIpsMapInfo{})))
 	fmt.Println(uint32(unsafe.Sizeof(ClusterIpsMapKey{})))
 	fmt.Println(uint32(unsafe.Sizeof(ClusterIpsMapInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(HostPortsMapKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(HostPortsMapInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(HostPortsCtKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(NodeAddrKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(NodeAddrInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(SockRevNatKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(SockRevNatInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(ServiceKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(ServiceInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(ServiceBackendKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(ServiceBackendInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(ServiceCtKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(ServiceRevCtInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(IPFragKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(IPFragInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(NodeInfoValue{})))
+	fmt.Println(uint32(unsafe.Sizeof(NodePortCtInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(NonMasqCidrKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(NonMasqCidrInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(MasqCtInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(PodIdentityKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(PodIdentityInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyEndpointKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyEndpointInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyRuleKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyRuleInfo{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyCidrKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyStatsKey{})))
+	fmt.Println(uint32(unsafe.Sizeof(PolicyStatsInfo{})))
 }
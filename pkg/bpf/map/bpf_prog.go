@@ -1,21 +0,0 @@
-package bpf_map
-
-import (
-	"fmt"
-	"os"
-	"os/exec"
-)
-
-func LoadBpfMap() error {
-	if os.Getuid() != 0 {
-		return fmt.Errorf("root user in required for this process or container")
-	}
-	cmd := exec.Command("make", "load")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if code := cmd.ProcessState.ExitCode(); code != 0 || err != nil {
-		return fmt.Errorf("unexpected exit code: %d, err: %v", code, err)
-	}
-	return nil
-}
@@ -0,0 +1,37 @@
+package bpf_map
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// the connections tracked by the datapath idle for longer than the timeout of their protocol
+	// are expired, the tcp connections a FIN or a RST was seen for once idle for ClosingTimeout
+	TCPTimeout     = 6 * time.Hour
+	UDPTimeout     = 2 * time.Minute
+	ClosingTimeout = 10 * time.Second
+)
+
+// SinceBoot returns the time since boot in ns, the clock of the datapath
+func SinceBoot() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// Expired returns true when the connection whose last packet was seen at lastSeen is idle for
+// longer than its timeout at now, a connection without time is never expired
+func Expired(protocol uint8, closing uint8, lastSeen, now uint64) bool {
+	timeout := UDPTimeout
+	if protocol == unix.IPPROTO_TCP {
+		timeout = TCPTimeout
+		if closing != 0 {
+			timeout = ClosingTimeout
+		}
+	}
+	return lastSeen > 0 && now > lastSeen && time.Duration(now-lastSeen) > timeout
+}
@@ -0,0 +1,38 @@
+package bpf_map
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockFile is the file locked while the pinned maps are written by the CNI plugin or replaced by
+// the agent, it is on the host dir the agent persists its state in.
+const LockFile = "/var/lib/fast/bpf-maps.lock"
+
+// LockMaps blocks until the lock of the pinned maps is taken, the returned func releases it. The
+// agent holds it while it migrates the maps so that the entries the CNI plugin writes meanwhile
+// are not left in the replaced maps.
+func LockMaps() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(LockFile), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(LockFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// closing the file releases the lock
+	return func() { f.Close() }, nil
+}
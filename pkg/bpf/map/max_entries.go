@@ -0,0 +1,88 @@
+package bpf_map
+
+import (
+	"errors"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxEntries is the capacity of the maps, the agent sizes the maps declared in maps.h with it
+// when it loads them. local_dev holds an entry per device type, node_info a single entry,
+// node_addrs an entry per address of the node, non_masq_cidrs an entry per non masquerade cidr
+// and node, policy_stats an entry per policy and ip_frags is a cache of the datagrams being
+// fragmented, they keep their declared size.
+type MaxEntries struct {
+	LocalPodIps   uint32
+	ClusterPodIps uint32
+	HostPorts     uint32
+	// HostPortsCt is the capacity of both the connections to the host ports and the udp sockets
+	// of the node translated by the socket programs
+	HostPortsCt uint32
+
+	Services        uint32
+	ServiceBackends uint32
+	// ServiceCt is the capacity of both the connections to the services and their reverse
+	ServiceCt uint32
+	// NodePortCt is the capacity of both the connections to the remote backends of the node ports
+	// and the external ips and their reverse
+	NodePortCt uint32
+	// MasqCt is the capacity of both the masqueraded connections and the ports they are allocated
+	MasqCt uint32
+
+	PolicyRules uint32
+	PolicyCidrs uint32
+	PolicyCt    uint32
+}
+
+// DefaultMaxEntries returns the capacities declared in maps.h
+func DefaultMaxEntries() MaxEntries {
+	return MaxEntries{
+		LocalPodIps:   16384,
+		ClusterPodIps: 65536,
+		HostPorts:     16384,
+		HostPortsCt:   65536,
+
+		Services:        16384,
+		ServiceBackends: 65536,
+		ServiceCt:       65536,
+		NodePortCt:      65536,
+		MasqCt:          65536,
+
+		PolicyRules: 65536,
+		PolicyCidrs: 16384,
+		PolicyCt:    65536,
+	}
+}
+
+// ByName returns the capacities by the name the maps are pinned with
+func (m MaxEntries) ByName() map[string]uint32 {
+	return map[string]uint32{
+		filepath.Base(LocalPodIps):   m.LocalPodIps,
+		filepath.Base(ClusterPodIps): m.ClusterPodIps,
+		filepath.Base(HostPorts):     m.HostPorts,
+		filepath.Base(HostPortsCt):   m.HostPortsCt,
+		filepath.Base(SockRevNat):    m.HostPortsCt,
+
+		filepath.Base(Services):        m.Services,
+		filepath.Base(ServiceBackends): m.ServiceBackends,
+		filepath.Base(ServiceCt):       m.ServiceCt,
+		filepath.Base(ServiceRevCt):    m.ServiceCt,
+		filepath.Base(NodePortCt):      m.NodePortCt,
+		filepath.Base(NodePortRevCt):   m.NodePortCt,
+		filepath.Base(MasqCt):          m.MasqCt,
+		filepath.Base(MasqPorts):       m.MasqCt,
+
+		// the identities are those of every pod of the cluster and the endpoints the local pods
+		filepath.Base(PodIdentities):   m.LocalPodIps + m.ClusterPodIps,
+		filepath.Base(PolicyEndpoints): m.LocalPodIps,
+		filepath.Base(PolicyRules):     m.PolicyRules,
+		filepath.Base(PolicyCidrs):     m.PolicyCidrs,
+		filepath.Base(PolicyCt):        m.PolicyCt,
+	}
+}
+
+// IsMapFull returns true if the update of a map failed because the map has no room left
+func IsMapFull(err error) bool {
+	return errors.Is(err, unix.E2BIG)
+}
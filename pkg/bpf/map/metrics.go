@@ -0,0 +1,127 @@
+package bpf_map
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "fast_agent"
+
+var (
+	// mapEntries is the number of entries of a map
+	mapEntries = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "bpf_map_entries",
+			Help:           "Number of entries of an eBPF map.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"map"},
+	)
+
+	// mapMaxEntries is the capacity of a map
+	mapMaxEntries = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "bpf_map_max_entries",
+			Help:           "Capacity of an eBPF map.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"map"},
+	)
+
+	// mapFull is the number of updates of a map rejected because the map was full
+	mapFull = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "bpf_map_full_total",
+			Help:           "Number of updates of an eBPF map rejected because the map was full.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"map"},
+	)
+)
+
+var registerMetrics sync.Once
+
+// RegisterMetrics registers the map metrics
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(mapEntries)
+		legacyregistry.MustRegister(mapMaxEntries)
+		legacyregistry.MustRegister(mapFull)
+	})
+}
+
+// RecordMapFull counts an update of the map rejected because the map was full
+func RecordMapFull(path string) {
+	mapFull.WithLabelValues(filepath.Base(path)).Inc()
+}
+
+// pluginMaps are the maps written by the CNI plugin, the updates it fails to make fail ADD and are
+// reported in the events of the pod rather than counted by the agent
+var pluginMaps = map[string]bool{
+	LocalPodIps: true,
+	HostPorts:   true,
+}
+
+// UpdateMapMetrics counts the entries of the maps, the maps are also written by the CNI plugin
+// so they are counted rather than tracked. A map written by the CNI plugin is counted as full at
+// every update it is found full, the ADD of the next pod would be rejected.
+func UpdateMapMetrics() {
+	for path, m := range map[string]*ebpf.Map{
+		LocalDev:      GetLocalDevMap(),
+		LocalPodIps:   GetLocalPodIpsMap(),
+		ClusterPodIps: GetClusterPodIpsMap(),
+		HostPorts:     GetHostPortsMap(),
+		HostPortsCt:   GetHostPortsCtMap(),
+		NodeAddrs:     GetNodeAddrsMap(),
+		SockRevNat:    GetSockRevNatMap(),
+
+		Services:        GetServicesMap(),
+		ServiceBackends: GetServiceBackendsMap(),
+		ServiceCt:       GetServiceCtMap(),
+		ServiceRevCt:    GetServiceRevCtMap(),
+		IPFrags:         GetIPFragsMap(),
+		NodePortCt:      GetNodePortCtMap(),
+		NodePortRevCt:   GetNodePortRevCtMap(),
+		NonMasqCidrs:    GetNonMasqCidrsMap(),
+		MasqCt:          GetMasqCtMap(),
+		MasqPorts:       GetMasqPortsMap(),
+
+		PodIdentities:   GetPodIdentitiesMap(),
+		PolicyEndpoints: GetPolicyEndpointsMap(),
+		PolicyRules:     GetPolicyRulesMap(),
+		PolicyCidrs:     GetPolicyCidrsMap(),
+		PolicyCt:        GetPolicyCtMap(),
+		PolicyStats:     GetPolicyStatsMap(),
+	} {
+		if m == nil {
+			continue
+		}
+		name := filepath.Base(path)
+		entries := CountEntries(m)
+		mapEntries.WithLabelValues(name).Set(float64(entries))
+		mapMaxEntries.WithLabelValues(name).Set(float64(m.MaxEntries()))
+		if pluginMaps[path] && entries >= int(m.MaxEntries()) {
+			RecordMapFull(path)
+		}
+	}
+}
+
+// CountEntries returns the number of entries of the map
+func CountEntries(m *ebpf.Map) int {
+	var (
+		key, value []byte
+		count      int
+	)
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		count++
+	}
+	return count
+}
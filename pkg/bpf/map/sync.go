@@ -0,0 +1,53 @@
+package bpf_map
+
+import (
+	"errors"
+
+	"github.com/cilium/ebpf"
+)
+
+// SyncMap updates the map to the desired entries and deletes the others, the map full errors are
+// counted against the map pinned at path
+func SyncMap[K comparable, V comparable](m *ebpf.Map, path string, desired map[K]V) error {
+	_, err := SyncMapChanges(m, path, desired)
+	return err
+}
+
+// SyncMapChanges is SyncMap returning the keys of the entries it added, updated or deleted
+func SyncMapChanges[K comparable, V comparable](m *ebpf.Map, path string, desired map[K]V) ([]K, error) {
+	var (
+		key     K
+		value   V
+		changed []K
+	)
+	existing := make(map[K]V)
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		existing[key] = value
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	for key, value := range desired {
+		if old, ok := existing[key]; ok && old == value {
+			continue
+		}
+		if err := m.Put(key, value); err != nil {
+			if IsMapFull(err) {
+				RecordMapFull(path)
+			}
+			return changed, err
+		}
+		changed = append(changed, key)
+	}
+	for key := range existing {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return changed, err
+		}
+		changed = append(changed, key)
+	}
+	return changed, nil
+}
@@ -1,10 +1,20 @@
 package bpf_map
 
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/fast-io/fast/pkg/util"
+)
+
 type LocalDevType uint32
 
 const (
-	VxlanDevType LocalDevType = 1
-	VethDevType  LocalDevType = 2
+	VxlanDevType     LocalDevType = 1
+	VethDevType      LocalDevType = 2
+	GeneveDevType    LocalDevType = 3
+	WireguardDevType LocalDevType = 4
 )
 
 type LocalDevMapKey struct {
@@ -25,6 +35,9 @@ type LocalIpsMapInfo struct {
 
 	MAC     [8]byte
 	NodeMAC [8]byte
+
+	// Vni is the tenant of the pod, 0 is the default tenant
+	Vni uint32
 }
 
 type ClusterIpsMapKey struct {
@@ -33,4 +46,313 @@ type ClusterIpsMapKey struct {
 
 type ClusterIpsMapInfo struct {
 	IP uint32
+	// Vni is the tenant of the pod, 0 is the default tenant
+	Vni uint32
+}
+
+// HostPortsMapKey is the host address and port of a host port, an IP 0 matches every address of the node
+type HostPortsMapKey struct {
+	IP       uint32
+	Port     uint16
+	Protocol uint8
+	Pad      uint8
+}
+
+// HostPortsMapInfo is the address and port a host port is translated to
+type HostPortsMapInfo struct {
+	IP   uint32
+	Port uint16
+	Pad  uint16
+}
+
+// HostPortsCtKey is a connection of a client to a host port of a pod
+type HostPortsCtKey struct {
+	ClientIP   uint32
+	PodIP      uint32
+	ClientPort uint16
+	PodPort    uint16
+	Protocol   uint8
+	Pad        [3]uint8
+}
+
+// NodeAddrKey is an address of the node
+type NodeAddrKey struct {
+	IP uint32
+}
+
+type NodeAddrInfo struct {
+	Pad uint32
+}
+
+// SockRevNatKey is a udp socket of the node and the address and port its destination was translated to
+type SockRevNatKey struct {
+	Cookie uint64
+	IP     uint32
+	Port   uint16
+	Pad    uint16
+}
+
+// SockRevNatInfo is the address and port the udp socket sent to
+type SockRevNatInfo struct {
+	IP   uint32
+	Port uint16
+	Pad  uint16
+}
+
+// ServiceKey is the cluster ip and port of a service
+type ServiceKey struct {
+	IP       uint32
+	Port     uint16
+	Protocol uint8
+	Pad      uint8
+}
+
+func (k ServiceKey) String() string {
+	return fmt.Sprintf("%s:%d/%s", util.InetUint32ToIp(k.IP), k.Port, ProtocolName(k.Protocol))
+}
+
+// ServiceInfo is the number of backends of a service
+type ServiceInfo struct {
+	Count uint32
+}
+
+// ServiceBackendKey is a slot of the backends of a service, the slots go from 1 to the count of the service
+type ServiceBackendKey struct {
+	IP       uint32
+	Port     uint16
+	Protocol uint8
+	Pad      uint8
+	Slot     uint32
+}
+
+// ServiceBackendInfo is the address and port of a backend
+type ServiceBackendInfo struct {
+	IP   uint32
+	Port uint16
+	Pad  uint16
+}
+
+func (b ServiceBackendInfo) String() string {
+	return fmt.Sprintf("%s:%d", util.InetUint32ToIp(b.IP), b.Port)
+}
+
+// ServiceCtKey is a connection of a client to a service, or to a backend for a reverse connection
+type ServiceCtKey struct {
+	ClientIP   uint32
+	IP         uint32
+	ClientPort uint16
+	Port       uint16
+	Protocol   uint8
+	Pad        [3]uint8
+}
+
+// ServiceRevCtInfo is the address and port of the service of a reverse connection, LastSeen is the
+// time since boot of its last packet in ns and Closing is 1 once a tcp FIN or RST is seen
+type ServiceRevCtInfo struct {
+	IP       uint32
+	Port     uint16
+	Closing  uint8
+	Pad      uint8
+	LastSeen uint64
+}
+
+// IPFragKey is a fragmented datagram, ID is the identification of its ip header
+type IPFragKey struct {
+	SrcIP    uint32
+	DstIP    uint32
+	ID       uint16
+	Protocol uint8
+	Pad      uint8
+}
+
+// IPFragInfo is the ports of a fragmented datagram recorded by its first fragment
+type IPFragInfo struct {
+	SrcPort uint16
+	DstPort uint16
+}
+
+// NodeInfoKey is the key of the single entry of node_info
+const NodeInfoKey uint32 = 0
+
+// NodeInfoValue is the address of the node the node ports are served on, the connections of the
+// pods leaving the cluster are translated to it when Masquerade is 1. Routing is the way the pods
+// of the other nodes are reached, Tunnel is the tunnel they are reached through unless routed.
+// The packets to the pods of the other nodes are encrypted whatever the routing when Encryption is set.
+type NodeInfoValue struct {
+	IP         uint32
+	Masquerade uint8
+	Routing    RoutingMode
+	Tunnel     TunnelType
+	Encryption EncryptionType
+}
+
+// RoutingMode is the way the packets of the pods reach the pods of the other nodes
+type RoutingMode uint8
+
+const (
+	// RoutingVxlan encapsulates the packets in vxlan to the node of the pod
+	RoutingVxlan RoutingMode = 0
+	// RoutingNative sends the packets to the node of the pod as they are, the nodes share an L2
+	// segment or the fabric routes the pods
+	RoutingNative RoutingMode = 1
+)
+
+// ParseRoutingMode returns the routing mode of the name, vxlan or native
+func ParseRoutingMode(name string) (RoutingMode, error) {
+	switch name {
+	case "vxlan":
+		return RoutingVxlan, nil
+	case "native":
+		return RoutingNative, nil
+	}
+	return RoutingVxlan, fmt.Errorf("unknown routing mode %q, it is vxlan or native", name)
+}
+
+// TunnelType is the encapsulation of the packets to the pods of the other nodes
+type TunnelType uint8
+
+const (
+	// TunnelVxlan encapsulates the packets in vxlan
+	TunnelVxlan TunnelType = 0
+	// TunnelGeneve encapsulates the packets in geneve, the identity of the source pod is sent in
+	// a geneve option
+	TunnelGeneve TunnelType = 1
+)
+
+// ParseTunnelType returns the tunnel type of the name, vxlan or geneve
+func ParseTunnelType(name string) (TunnelType, error) {
+	switch name {
+	case "vxlan":
+		return TunnelVxlan, nil
+	case "geneve":
+		return TunnelGeneve, nil
+	}
+	return TunnelVxlan, fmt.Errorf("unknown tunnel type %q, it is vxlan or geneve", name)
+}
+
+// EncryptionType is the encryption of the packets to the pods of the other nodes
+type EncryptionType uint8
+
+const (
+	// EncryptionNone sends the packets in clear
+	EncryptionNone EncryptionType = 0
+	// EncryptionWireguard sends the packets through the wireguard device to the peer of the node
+	EncryptionWireguard EncryptionType = 1
+)
+
+// NodePortCtInfo is the remote backend a connection to a node port or an external ip is sent to
+// and the port of the node the client is translated to, LastSeen and Closing are those of
+// ServiceRevCtInfo
+type NodePortCtInfo struct {
+	IP       uint32
+	Port     uint16
+	SnatPort uint16
+	Closing  uint8
+	Pad      [7]uint8
+	LastSeen uint64
+}
+
+// NonMasqCidrKey is a destination the connections of the pods are not masqueraded to, the ip is
+// in network byte order
+type NonMasqCidrKey struct {
+	Prefixlen uint32
+	IP        [4]byte
+}
+
+// NonMasqCidrInfo is the value of a non masquerade cidr
+type NonMasqCidrInfo struct {
+	Pad uint32
+}
+
+// MasqCtInfo is the port of the node a masqueraded connection is translated to, LastSeen and
+// Closing are those of ServiceRevCtInfo
+type MasqCtInfo struct {
+	SnatPort uint16
+	Closing  uint8
+	Pad      [5]uint8
+	LastSeen uint64
+}
+
+// The directions of the rules of the policies
+const (
+	PolicyIngress uint8 = 1
+	PolicyEgress  uint8 = 2
+)
+
+// PolicyCidrPrefix is the prefix of the local pod, the ports, the protocol and the direction of a
+// PolicyCidrKey, the prefix of the peer follows it
+const PolicyCidrPrefix = 96
+
+// PodIdentityKey is the address of a pod of the cluster
+type PodIdentityKey struct {
+	IP uint32
+}
+
+// PodIdentityInfo is the identity of a pod, the pods of a namespace with the same labels share it
+type PodIdentityInfo struct {
+	Identity uint32
+}
+
+// PolicyEndpointKey is the address of a local pod selected by the policies
+type PolicyEndpointKey struct {
+	IP uint32
+}
+
+// PolicyEndpointInfo is the policy isolating the pod in each direction, 0 when it is not isolated
+type PolicyEndpointInfo struct {
+	IngressPolicy uint32
+	EgressPolicy  uint32
+}
+
+// PolicyRuleKey is a pod peer a local pod is allowed to reach in a direction, the ports are those
+// whose first PortPrefix bits are those of Port. A PortPrefix 0 is every port of the protocol and
+// a protocol 0 every protocol.
+type PolicyRuleKey struct {
+	IP         uint32
+	Identity   uint32
+	Port       uint16
+	Protocol   uint8
+	Direction  uint8
+	PortPrefix uint8
+	Pad        [3]uint8
+}
+
+// PolicyRuleInfo is the policy of a rule
+type PolicyRuleInfo struct {
+	Policy uint32
+}
+
+// PolicyCidrKey is an ip block a local pod is allowed to reach in a direction, the peer is in
+// network byte order
+type PolicyCidrKey struct {
+	Prefixlen  uint32
+	IP         uint32
+	Port       uint16
+	Protocol   uint8
+	Direction  uint8
+	PortPrefix uint8
+	Pad        [3]uint8
+	Peer       [4]byte
+}
+
+// PolicyStatsKey is the policy of the counters
+type PolicyStatsKey struct {
+	Policy uint32
+}
+
+// PolicyStatsInfo are the connections a policy allowed and the packets denied for the pods it isolates
+type PolicyStatsInfo struct {
+	Allowed uint64
+	Denied  uint64
+}
+
+// ProtocolName returns the name of the ip protocol of a key
+func ProtocolName(protocol uint8) string {
+	switch protocol {
+	case unix.IPPROTO_TCP:
+		return "TCP"
+	case unix.IPPROTO_UDP:
+		return "UDP"
+	}
+	return fmt.Sprintf("%d", protocol)
 }
@@ -2,26 +2,55 @@ package tc
 
 import (
 	"fmt"
+
+	"github.com/vishvananda/netlink"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 type BpfTcDirectType string
 
 const (
-	ProgramDefaultPath                 = "/opt/fast"
+	// ProgramDefaultPath is where the agent pins the tc programs, the CNI plugin attaches them from there
+	ProgramDefaultPath                 = "/sys/fs/bpf/fast"
 	IngressType        BpfTcDirectType = "ingress"
 	EgressType         BpfTcDirectType = "egress"
 )
 
 func GetVethIngressPath() string {
-	return ProgramDefaultPath + "/veth_ingress.o"
+	return ProgramDefaultPath + "/veth_ingress"
+}
+
+// GetVethEgressPath returns the program attached to the egress of the host veth
+func GetVethEgressPath() string {
+	return ProgramDefaultPath + "/veth_egress"
 }
 
 func GetVxlanIngressPath() string {
-	return ProgramDefaultPath + "/vxlan_ingress.o"
+	return ProgramDefaultPath + "/vxlan_ingress"
 }
 
 func GetVxlanEgressPath() string {
-	return ProgramDefaultPath + "/vxlan_egress.o"
+	return ProgramDefaultPath + "/vxlan_egress"
+}
+
+// GetGeneveIngressPath returns the program attached to the ingress of the geneve device
+func GetGeneveIngressPath() string {
+	return ProgramDefaultPath + "/geneve_ingress"
+}
+
+// GetGeneveEgressPath returns the program attached to the egress of the geneve device
+func GetGeneveEgressPath() string {
+	return ProgramDefaultPath + "/geneve_egress"
+}
+
+// GetWireguardIngressPath returns the program attached to the ingress of the wireguard device
+func GetWireguardIngressPath() string {
+	return ProgramDefaultPath + "/wireguard_ingress"
+}
+
+// GetHostIngressPath returns the program attached to the ingress of the underlay interface
+func GetHostIngressPath() string {
+	return ProgramDefaultPath + "/host_ingress"
 }
 
 func TryAttachBPF(dev string, direct BpfTcDirectType, program string) error {
@@ -32,21 +61,34 @@ func TryAttachBPF(dev string, direct BpfTcDirectType, program string) error {
 		}
 	}
 
-	switch direct {
-	case IngressType:
-		if ExistIngress(dev) {
-			return nil
-		}
-		return AttachIngressBPFIntoDev(dev, program)
-	case EgressType:
-		if ExistEgress(dev) {
-			return nil
-		}
-		return AttachEgressBPFIntoDev(dev, program)
+	if ExistBPF(dev, direct, program) {
+		return nil
 	}
-	return fmt.Errorf("unknow error occurred in TryAttachBPF")
+	return AttachBPFIntoDev(dev, direct, program)
 }
 
 func DetachBPF(dev string) error {
 	return DelClsactQdiscIntoDev(dev)
 }
+
+// ReattachBPF attaches the program again wherever it is attached, a filter keeps the program
+// loaded when it was attached until it is replaced.
+func ReattachBPF(program string) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, link := range links {
+		dev := link.Attrs().Name
+		for _, direct := range []BpfTcDirectType{IngressType, EgressType} {
+			if !ExistBPF(dev, direct, program) {
+				continue
+			}
+			if err := AttachBPFIntoDev(dev, direct, program); err != nil {
+				errs = append(errs, fmt.Errorf("failed to attach %s to %s %s: %w", program, dev, direct, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -1,76 +1,199 @@
 package tc
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ProgramName is the function of the tc program in every object, the filters are named after
+// the pinned program and its section.
+const (
+	ProgramName    = "cls_main"
+	programSection = "classifier"
 )
 
-func _exec(command string) error {
-	processInfo := exec.Command("/bin/sh", "-c", command)
-	_, err := processInfo.Output()
-	return err
+func clsact(link netlink.Link) *netlink.GenericQdisc {
+	return &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+}
+
+func parent(direct BpfTcDirectType) (uint32, error) {
+	switch direct {
+	case IngressType:
+		return netlink.HANDLE_MIN_INGRESS, nil
+	case EgressType:
+		return netlink.HANDLE_MIN_EGRESS, nil
+	}
+	return 0, fmt.Errorf("unknown tc direction %q", direct)
+}
+
+// filterName is the name of the filter of a program, it is the name given by iproute2
+func filterName(program string) string {
+	return fmt.Sprintf("%s:[%s]", filepath.Base(program), programSection)
+}
+
+// loadProgram loads the program pinned by the agent
+func loadProgram(program string) (*ebpf.Program, error) {
+	prog, err := ebpf.LoadPinnedProgram(program, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pinned program %s, the agent may not be running: %w", program, err)
+	}
+	return prog, nil
 }
 
 func AddClsactQdiscIntoDev(dev string) error {
-	return _exec(
-		fmt.Sprintf("tc qdisc add dev %s clsact", dev),
-	)
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return err
+	}
+	return netlink.QdiscReplace(clsact(link))
 }
 
 func DelClsactQdiscIntoDev(dev string) error {
-	return _exec(
-		fmt.Sprintf("tc qdisc del dev %s clsact", dev),
-	)
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscDel(clsact(link)); err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EINVAL) {
+		return err
+	}
+	return nil
+}
+
+// AttachBPFIntoDev attaches the program object to the direction of the dev, it replaces the
+// program attached before.
+func AttachBPFIntoDev(dev string, direct BpfTcDirectType, program string) error {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return err
+	}
+	p, err := parent(direct)
+	if err != nil {
+		return err
+	}
+	prog, err := loadProgram(program)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	return netlink.FilterReplace(&netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    p,
+			Handle:    1,
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  1,
+		},
+		Fd:           prog.FD(),
+		Name:         filterName(program),
+		DirectAction: true,
+	})
 }
 
 func AttachIngressBPFIntoDev(dev string, filepath string) error {
-	return _exec(
-		fmt.Sprintf("tc filter add dev %s ingress bpf direct-action obj %s", dev, filepath),
-	)
+	return AttachBPFIntoDev(dev, IngressType, filepath)
 }
 
 func AttachEgressBPFIntoDev(dev string, filepath string) error {
-	return _exec(
-		fmt.Sprintf("tc filter add dev %s egress bpf direct-action obj %s", dev, filepath),
-	)
+	return AttachBPFIntoDev(dev, EgressType, filepath)
 }
 
 func ExistClsact(dev string) bool {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc qdisc show dev %s", dev),
-	)
-	out, _ := processInfo.Output()
-	return strings.Contains(string(out), "clsact")
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return false
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return false
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			return true
+		}
+	}
+	return false
 }
 
 func ExistIngress(dev string) bool {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc filter show dev %s ingress", dev),
-	)
-	out, _ := processInfo.Output()
-	return strings.Contains(string(out), "direct-action")
+	filters, err := ListBPF(dev, IngressType)
+	return err == nil && len(filters) > 0
+}
+
+// ExistIngressBPF returns true if the program object is attached to the ingress of the dev
+func ExistIngressBPF(dev string, program string) bool {
+	return ExistBPF(dev, IngressType, program)
 }
 
 func ExistEgress(dev string) bool {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc filter show dev %s egress", dev),
-	)
-	out, _ := processInfo.Output()
-	return strings.Contains(string(out), "direct-action")
+	filters, err := ListBPF(dev, EgressType)
+	return err == nil && len(filters) > 0
+}
+
+// ExistBPF returns true if the program object is attached to the direction of the dev
+func ExistBPF(dev string, direct BpfTcDirectType, program string) bool {
+	filters, err := ListBPF(dev, direct)
+	if err != nil {
+		return false
+	}
+	for _, filter := range filters {
+		if filter.Name == filterName(program) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListBPF returns the direct-action bpf filters of the direction of the dev
+func ListBPF(dev string, direct BpfTcDirectType) ([]*netlink.BpfFilter, error) {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parent(direct)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := netlink.FilterList(link, p)
+	if err != nil {
+		// the dev has no clsact qdisc
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var bpfFilters []*netlink.BpfFilter
+	for _, filter := range filters {
+		if bpfFilter, ok := filter.(*netlink.BpfFilter); ok && bpfFilter.DirectAction {
+			bpfFilters = append(bpfFilters, bpfFilter)
+		}
+	}
+	return bpfFilters, nil
 }
 
+// ShowBPF returns the names of the bpf filters of the direction of the dev
 func ShowBPF(dev string, direct string) (string, error) {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc filter show dev %s %s", dev, direct),
-	)
-	out, err := processInfo.Output()
+	filters, err := ListBPF(dev, BpfTcDirectType(direct))
 	if err != nil {
 		return "", err
 	}
-	return string(out), nil
+	names := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		names = append(names, filter.Name)
+	}
+	return strings.Join(names, "\n"), nil
 }
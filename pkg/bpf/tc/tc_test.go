@@ -0,0 +1,114 @@
+package tc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+)
+
+// withVeth runs f in a new netns with the veth dev, the test is skipped without the privileges
+// to create them
+func withVeth(t *testing.T, dev string, f func() error) {
+	t.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	err = netns.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: dev}, PeerName: dev + "-peer"}); err != nil {
+			return err
+		}
+		return f()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pinProgram pins a tc program accepting every packet on the bpf filesystem
+func pinProgram(t *testing.T) string {
+	t.Helper()
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.SchedCLS,
+		License:      "GPL",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 0), asm.Return()},
+	})
+	if err != nil {
+		t.Skipf("failed to load program: %v", err)
+	}
+	defer prog.Close()
+	path := filepath.Join("/sys/fs/bpf", fmt.Sprintf("fast_tc_test_%d", os.Getpid()))
+	if err := prog.Pin(path); err != nil {
+		t.Skipf("failed to pin program: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(path) })
+	return path
+}
+
+func TestAttachBPFIntoDev(t *testing.T) {
+	program := pinProgram(t)
+	tests := []struct {
+		direct BpfTcDirectType
+		other  BpfTcDirectType
+	}{
+		{direct: IngressType, other: EgressType},
+		{direct: EgressType, other: IngressType},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			withVeth(t, "veth0", func() error {
+				if filters, err := ListBPF("veth0", tt.direct); err != nil || len(filters) != 0 {
+					return fmt.Errorf("ListBPF() without clsact = %v, %v, want none", filters, err)
+				}
+				if err := AddClsactQdiscIntoDev("veth0"); err != nil {
+					return err
+				}
+				if !ExistClsact("veth0") {
+					return fmt.Errorf("ExistClsact() = false, want true")
+				}
+				// the program attached again replaces the filter
+				for j := 0; j < 2; j++ {
+					if err := AttachBPFIntoDev("veth0", tt.direct, program); err != nil {
+						return fmt.Errorf("AttachBPFIntoDev() error = %w", err)
+					}
+				}
+				filters, err := ListBPF("veth0", tt.direct)
+				if err != nil {
+					return err
+				}
+				if len(filters) != 1 || filters[0].Name != filterName(program) {
+					return fmt.Errorf("ListBPF() = %v, want the filter %s", filters, filterName(program))
+				}
+				if !ExistBPF("veth0", tt.direct, program) {
+					return fmt.Errorf("ExistBPF(%s) = false, want true", tt.direct)
+				}
+				if ExistBPF("veth0", tt.other, program) {
+					return fmt.Errorf("ExistBPF(%s) = true, want false", tt.other)
+				}
+				if ExistBPF("veth0", tt.direct, "/sys/fs/bpf/fast/other") {
+					return fmt.Errorf("ExistBPF() of another program = true, want false")
+				}
+
+				if err := DelClsactQdiscIntoDev("veth0"); err != nil {
+					return err
+				}
+				if ExistClsact("veth0") || ExistBPF("veth0", tt.direct, program) {
+					return fmt.Errorf("the filter is attached after the clsact is deleted")
+				}
+				// the clsact deleted twice is not an error
+				return DelClsactQdiscIntoDev("veth0")
+			})
+		})
+	}
+}
@@ -2,11 +2,15 @@ package clusterpod
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/cilium/ebpf"
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -24,6 +28,8 @@ import (
 	"k8s.io/klog/v2"
 
 	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	ipsinformers "github.com/fast-io/fast/pkg/generated/informers/externalversions/ips/v1alpha1"
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
 	"github.com/fast-io/fast/pkg/util"
 )
 
@@ -45,14 +51,23 @@ type Controller struct {
 	nodeName   types.NodeName
 
 	// lister define the cache object
-	podLister corelisters.PodLister
+	podLister  corelisters.PodLister
+	ipepLister ipslisters.IpEndpointLister
+	ipsLister  ipslisters.IpsLister
 
 	// synced define the sync for relist
-	podSynced cache.InformerSynced
+	podSynced  cache.InformerSynced
+	ipepSynced cache.InformerSynced
+	ipsSynced  cache.InformerSynced
 
 	// Access that need to be synced
 	queue workqueue.RateLimitingInterface
 
+	// programmed are the addresses of the pods of the other nodes put into cluster_pod_ips, the
+	// addresses a pod no longer has are deleted
+	lock       sync.Mutex
+	programmed map[string]map[bpfmap.ClusterIpsMapKey]struct{}
+
 	eventBroadcaster record.EventBroadcaster
 	eventRecorder    record.EventRecorder
 }
@@ -61,7 +76,9 @@ type Controller struct {
 func NewController(
 	ctx context.Context,
 	kubeClient kubernetes.Interface,
-	podInformer coreinformers.PodInformer) (*Controller, error) {
+	podInformer coreinformers.PodInformer,
+	ipepInformer ipsinformers.IpEndpointInformer,
+	ipsInformer ipsinformers.IpsInformer) (*Controller, error) {
 	logger := klog.FromContext(ctx)
 
 	hostname, err := os.Hostname()
@@ -74,8 +91,13 @@ func NewController(
 	controller := &Controller{
 		kubeClient:       kubeClient,
 		podLister:        podInformer.Lister(),
+		ipepLister:       ipepInformer.Lister(),
+		ipsLister:        ipsInformer.Lister(),
 		podSynced:        podInformer.Informer().HasSynced,
+		ipepSynced:       ipepInformer.Informer().HasSynced,
+		ipsSynced:        ipsInformer.Informer().HasSynced,
 		nodeName:         types.NodeName(strings.ToLower(hostname)),
+		programmed:       make(map[string]map[bpfmap.ClusterIpsMapKey]struct{}),
 		eventBroadcaster: eventBroadcaster,
 		eventRecorder:    eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName}),
 		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), ControllerName),
@@ -97,6 +119,23 @@ func NewController(
 		logger.Error(err, "Failed to setting up event handlers")
 		return nil, err
 	}
+	// the ip endpoint of a pod holds the addresses of its interfaces and names the ips their
+	// tenant is defined by
+	_, err = ipepInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.enqueueIpEndpoint(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.enqueueIpEndpoint(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.enqueueIpEndpoint(obj)
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
 
 	return controller, nil
 }
@@ -119,7 +158,7 @@ func (c *Controller) Run(ctx context.Context) {
 
 	// Wait for the caches to be synced before starting worker
 	logger.Info("Waiting for informer caches to sync")
-	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced, c.ipepSynced, c.ipsSynced) {
 		logger.Error(fmt.Errorf("failed to sync informer"), "Informer caches to sync bad")
 		return
 	}
@@ -187,20 +226,20 @@ func (c *Controller) syncHandler(ctx context.Context, key string) error {
 		logger.V(4).Info("Finished syncing cluster pod", "pod", name, "duration", time.Since(startTime))
 	}()
 
+	clusterIpsMap := bpfmap.GetClusterPodIpsMap()
+	if clusterIpsMap == nil {
+		return fmt.Errorf("failed to load eBPF map")
+	}
 	pod, err := c.podLister.Pods(ns).Get(name)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
-			return nil
+			// the pod was deleted before its deletion was seen
+			return c.syncAddresses(clusterIpsMap, key, nil)
 		}
 		logger.Error(err, "failed to get pod")
 		return err
 	}
-	if len(pod.Status.PodIP) == 0 {
-		return nil
-	}
 
-	podIp := util.InetIpToUInt32(pod.Status.PodIP)
-	nodeIP := util.InetIpToUInt32(pod.Status.HostIP)
 	if types.NodeName(pod.Spec.NodeName) == c.nodeName {
 		if pod.DeletionTimestamp.IsZero() {
 			return nil
@@ -210,31 +249,136 @@ func (c *Controller) syncHandler(ctx context.Context, key string) error {
 		if localIpsMap == nil {
 			return fmt.Errorf("failed to load eBPF map")
 		}
-		return localIpsMap.Delete(bpfmap.LocalIpsMapKey{IP: podIp})
-	} else {
-		clusterIpsMap := bpfmap.GetClusterPodIpsMap()
-		if clusterIpsMap == nil {
-			return fmt.Errorf("failed to load eBPF map")
+		addrs, err := c.podAddresses(pod)
+		if err != nil {
+			return err
 		}
+		for ip := range addrs {
+			if err := localIpsMap.Delete(bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(ip)}); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
 
-		if !pod.DeletionTimestamp.IsZero() {
-			return clusterIpsMap.Delete(bpfmap.ClusterIpsMapKey{IP: podIp})
+	if !pod.DeletionTimestamp.IsZero() || len(pod.Status.HostIP) == 0 {
+		return c.syncAddresses(clusterIpsMap, key, nil)
+	}
+	addrs, err := c.podAddresses(pod)
+	if err != nil {
+		return err
+	}
+	nodeIP := util.InetIpToUInt32(pod.Status.HostIP)
+	desired := make(map[bpfmap.ClusterIpsMapKey]bpfmap.ClusterIpsMapInfo, len(addrs))
+	for ip, pool := range addrs {
+		vni, err := c.vni(pool)
+		if err != nil {
+			return fmt.Errorf("failed to get the tenant of pod %s/%s: %w", pod.Namespace, pod.Name, err)
 		}
-		return clusterIpsMap.Put(bpfmap.ClusterIpsMapKey{IP: podIp}, bpfmap.ClusterIpsMapInfo{IP: nodeIP})
+		desired[bpfmap.ClusterIpsMapKey{IP: util.InetIpToUInt32(ip)}] = bpfmap.ClusterIpsMapInfo{IP: nodeIP, Vni: vni}
+	}
+	err = c.syncAddresses(clusterIpsMap, key, desired)
+	if bpfmap.IsMapFull(err) {
+		bpfmap.RecordMapFull(bpfmap.ClusterPodIps)
+		c.eventRecorder.Eventf(pod, v1.EventTypeWarning, "BPFMapFull",
+			"cluster_pod_ips is full, the pod is unreachable from node %s, raise --bpf-map-cluster-pod-ips-max-entries of fast-agent", c.nodeName)
 	}
+	return err
+}
+
+// syncAddresses puts the desired addresses of the pod of another node into cluster_pod_ips and
+// deletes the addresses put before which are not desired anymore
+func (c *Controller) syncAddresses(clusterIpsMap *ebpf.Map, key string, desired map[bpfmap.ClusterIpsMapKey]bpfmap.ClusterIpsMapInfo) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	programmed := c.programmed[key]
+	for ipKey := range programmed {
+		if _, ok := desired[ipKey]; ok {
+			continue
+		}
+		if err := clusterIpsMap.Delete(ipKey); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+		delete(programmed, ipKey)
+	}
+	if len(desired) == 0 {
+		delete(c.programmed, key)
+		return nil
+	}
+	if programmed == nil {
+		programmed = make(map[bpfmap.ClusterIpsMapKey]struct{}, len(desired))
+		c.programmed[key] = programmed
+	}
+	for ipKey, info := range desired {
+		if err := clusterIpsMap.Put(ipKey, info); err != nil {
+			return err
+		}
+		programmed[ipKey] = struct{}{}
+	}
+	return nil
+}
+
+// podAddresses returns the IPv4 addresses of the pod with the ips each one is allocated from: the
+// address of its status and the addresses its ip endpoint allocates to its interfaces. The pods
+// whose address is not allocated by fast have no ips.
+func (c *Controller) podAddresses(pod *v1.Pod) (map[string]string, error) {
+	addrs := make(map[string]string)
+	if net.ParseIP(pod.Status.PodIP).To4() != nil {
+		addrs[pod.Status.PodIP] = ""
+	}
+	ipep, err := c.ipepLister.IpEndpoints(pod.Namespace).Get(pod.Name)
+	if apierrors.IsNotFound(err) {
+		return addrs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the ip endpoint of a previous pod of the same name
+	if len(ipep.Status.UID) > 0 && ipep.Status.UID != string(pod.UID) {
+		return addrs, nil
+	}
+	for _, detail := range ipep.Status.Details() {
+		if net.ParseIP(detail.IPv4).To4() != nil {
+			addrs[detail.IPv4] = detail.IPv4Pool
+		}
+	}
+	return addrs, nil
+}
+
+// vni returns the tenant of the addresses allocated from the ips, the addresses allocated from no
+// ips are in the default tenant
+func (c *Controller) vni(ipsName string) (uint32, error) {
+	if len(ipsName) == 0 {
+		return 0, nil
+	}
+	ips, err := c.ipsLister.Get(ipsName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get ips %s: %w", ipsName, err)
+	}
+	return uint32(ips.Spec.Vni), nil
+}
+
+// enqueueIpEndpoint queues the pod of the ip endpoint, they share their namespace and name
+func (c *Controller) enqueueIpEndpoint(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %#v: %w", obj, err))
+		return
+	}
+	c.queue.Add(key)
 }
 
 // If nodeName is used, it is not queued if there is no match
 func (c *Controller) enqueue(logger klog.Logger, obj interface{}) {
-	pod := obj.(*v1.Pod)
-	if len(pod.Spec.NodeName) == 0 {
+	if pod, ok := obj.(*v1.Pod); ok && len(pod.Spec.NodeName) == 0 {
 		logger.V(10).Info("pod not scheduled, skip it")
 		return
 	}
 
-	key, err := cache.MetaNamespaceKeyFunc(obj)
+	// the addresses of a deleted pod whose final state is unknown are deleted once it is not found
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 	if err != nil {
-		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %#v: %w", pod, err))
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %#v: %w", obj, err))
 		return
 	}
 
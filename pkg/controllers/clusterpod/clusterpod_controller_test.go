@@ -0,0 +1,166 @@
+package clusterpod
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
+)
+
+func TestPodAddresses(t *testing.T) {
+	ipepIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, details := range map[string][]ipsv1alpha1.IPAllocationDetail{
+		"default": {{NIC: "eth0", IPv4: "10.244.0.10", IPv4Pool: "default-ips"}},
+		"secondary": {
+			{NIC: "eth0", IPv4: "10.244.0.11", IPv4Pool: "default-ips"},
+			{NIC: "net1", IPv4: "10.246.10.1", IPv4Pool: "mgmt-ips"},
+		},
+		"previous": {{NIC: "eth0", IPv4: "10.244.0.12", IPv4Pool: "default-ips"}},
+	} {
+		_ = ipepIndexer.Add(&ipsv1alpha1.IpEndpoint{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Status:     ipsv1alpha1.IpEndpointStatus{UID: name, Allocations: details},
+		})
+	}
+	c := &Controller{ipepLister: ipslisters.NewIpEndpointLister(ipepIndexer)}
+
+	tests := []struct {
+		name  string
+		uid   string
+		podIP string
+		want  map[string]string
+	}{
+		{name: "default", uid: "default", podIP: "10.244.0.10", want: map[string]string{"10.244.0.10": "default-ips"}},
+		// the addresses of the secondary interfaces are allocated before the pod has an address
+		{name: "secondary", uid: "secondary", want: map[string]string{"10.244.0.11": "default-ips", "10.246.10.1": "mgmt-ips"}},
+		{name: "unallocated", uid: "unallocated", podIP: "10.244.0.13", want: map[string]string{"10.244.0.13": ""}},
+		// the ip endpoint of a previous pod of the same name
+		{name: "previous", uid: "new", podIP: "10.244.0.14", want: map[string]string{"10.244.0.14": ""}},
+		{name: "unallocated", uid: "unallocated", podIP: "fd00::13", want: map[string]string{}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: tt.name, UID: types.UID(tt.uid)},
+				Status:     v1.PodStatus{PodIP: tt.podIP},
+			}
+			got, err := c.podAddresses(pod)
+			if err != nil {
+				t.Fatalf("podAddresses() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVni(t *testing.T) {
+	ipsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ips := range []*ipsv1alpha1.Ips{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default-ips"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "tenant-ips"}, Spec: ipsv1alpha1.IpsSpec{Vni: 100}},
+	} {
+		_ = ipsIndexer.Add(ips)
+	}
+	c := &Controller{ipsLister: ipslisters.NewIpsLister(ipsIndexer)}
+
+	tests := []struct {
+		ips     string
+		want    uint32
+		wantErr bool
+	}{
+		{ips: "default-ips", want: 0},
+		{ips: "tenant-ips", want: 100},
+		{ips: "", want: 0},
+		{ips: "deleted-ips", wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			got, err := c.vni(tt.ips)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("vni() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("vni() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncAddresses(t *testing.T) {
+	addr := func(ip uint32, vni uint32) (bpfmap.ClusterIpsMapKey, bpfmap.ClusterIpsMapInfo) {
+		return bpfmap.ClusterIpsMapKey{IP: ip}, bpfmap.ClusterIpsMapInfo{IP: 200, Vni: vni}
+	}
+	desired := func(ips ...uint32) map[bpfmap.ClusterIpsMapKey]bpfmap.ClusterIpsMapInfo {
+		m := make(map[bpfmap.ClusterIpsMapKey]bpfmap.ClusterIpsMapInfo)
+		for _, ip := range ips {
+			key, info := addr(ip, ip)
+			m[key] = info
+		}
+		return m
+	}
+
+	tests := []struct {
+		syncs [][]uint32
+		want  []uint32
+	}{
+		{syncs: [][]uint32{{1, 2}}, want: []uint32{1, 2}},
+		// the address of a released interface is deleted
+		{syncs: [][]uint32{{1, 2}, {1}}, want: []uint32{1}},
+		// the addresses of a deleted pod are deleted
+		{syncs: [][]uint32{{1, 2}, nil}, want: nil},
+		{syncs: [][]uint32{nil}, want: nil},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, MaxEntries: 16,
+				KeySize: uint32(unsafe.Sizeof(bpfmap.ClusterIpsMapKey{})), ValueSize: uint32(unsafe.Sizeof(bpfmap.ClusterIpsMapInfo{}))})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer m.Close()
+			// the address of another pod
+			if err := m.Put(addr(9, 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			c := &Controller{programmed: make(map[string]map[bpfmap.ClusterIpsMapKey]struct{})}
+			for _, ips := range tt.syncs {
+				if err := c.syncAddresses(m, "default/pod", desired(ips...)); err != nil {
+					t.Fatalf("syncAddresses() error = %v", err)
+				}
+			}
+			want := desired(append(tt.want, 9)...)
+			want[bpfmap.ClusterIpsMapKey{IP: 9}] = bpfmap.ClusterIpsMapInfo{IP: 200}
+			got := make(map[bpfmap.ClusterIpsMapKey]bpfmap.ClusterIpsMapInfo)
+			var (
+				key  bpfmap.ClusterIpsMapKey
+				info bpfmap.ClusterIpsMapInfo
+			)
+			iter := m.Iterate()
+			for iter.Next(&key, &info) {
+				got[key] = info
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("cluster_pod_ips = %v, want %v", got, want)
+			}
+			if len(tt.want) == 0 && len(c.programmed) != 0 {
+				t.Errorf("programmed = %v, want none", c.programmed)
+			}
+		})
+	}
+}
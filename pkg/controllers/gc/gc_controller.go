@@ -8,7 +8,9 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
@@ -21,6 +23,8 @@ import (
 
 	ipsversioned "github.com/fast-io/fast/pkg/generated/clientset/versioned"
 	"github.com/fast-io/fast/pkg/generated/clientset/versioned/scheme"
+	ipsinformers "github.com/fast-io/fast/pkg/generated/informers/externalversions/ips/v1alpha1"
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
 	"github.com/fast-io/fast/pkg/ipsmanager"
 )
 
@@ -46,6 +50,11 @@ type Controller struct {
 	// synced define the sync for relist
 	podSynced cache.InformerSynced
 
+	nodeLister corelisters.NodeLister
+	nodeSynced cache.InformerSynced
+	ipsLister  ipslisters.IpsLister
+	ipsSynced  cache.InformerSynced
+
 	ipsManager ipsmanager.IpsManager
 
 	// Ips that need to be synced
@@ -64,7 +73,9 @@ func NewController(
 	ctx context.Context,
 	kubeClient kubernetes.Interface,
 	client ipsversioned.Interface,
-	podInformer coreinformers.PodInformer) (*Controller, error) {
+	podInformer coreinformers.PodInformer,
+	nodeInformer coreinformers.NodeInformer,
+	ipsInformer ipsinformers.IpsInformer) (*Controller, error) {
 	logger := klog.FromContext(ctx)
 
 	logger.V(4).Info("Creating event broadcaster")
@@ -74,6 +85,10 @@ func NewController(
 		kubeClient:       kubeClient,
 		podLister:        podInformer.Lister(),
 		podSynced:        podInformer.Informer().HasSynced,
+		nodeLister:       nodeInformer.Lister(),
+		nodeSynced:       nodeInformer.Informer().HasSynced,
+		ipsLister:        ipsInformer.Lister(),
+		ipsSynced:        ipsInformer.Informer().HasSynced,
 		ipsManager:       ipsmanager.NewIpsManager(client),
 		eventBroadcaster: eventBroadcaster,
 		eventRecorder:    eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName}),
@@ -114,13 +129,14 @@ func (c *Controller) Run(ctx context.Context) {
 
 	// Wait for the caches to be synced before starting worker
 	logger.Info("Waiting for informer caches to sync")
-	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced, c.nodeSynced, c.ipsSynced) {
 		logger.Error(fmt.Errorf("failed to sync informer"), "Informer caches to sync bad")
 		return
 	}
 
 	logger.Info("Starting worker")
 	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	go wait.UntilWithContext(ctx, c.reclaimWarmIPs, time.Minute)
 
 	<-ctx.Done()
 }
@@ -182,7 +198,36 @@ func (c *Controller) syncHandler(ctx context.Context, key string) error {
 		logger.V(4).Info("Finished syncing pod", "pod", name, "duration", time.Since(startTime))
 	}()
 
-	return c.ipsManager.ReleaseIP(ctx, ns, name)
+	return c.ipsManager.ReleaseIP(ctx, ns, name, ipsmanager.Release{})
+}
+
+// reclaimWarmIPs releases the warm addresses held by the nodes which no longer exist
+func (c *Controller) reclaimWarmIPs(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	ipses, err := c.ipsLister.List(labels.Everything())
+	if err != nil {
+		logger.Error(err, "Failed to list ips")
+		return
+	}
+	for _, ips := range ipses {
+		deadNodes := sets.NewString()
+		for _, allocated := range ips.Status.AllocatedIPs {
+			if !ipsmanager.IsWarm(allocated) || deadNodes.Has(allocated.Node) {
+				continue
+			}
+			if _, err := c.nodeLister.Get(allocated.Node); apierrors.IsNotFound(err) {
+				deadNodes.Insert(allocated.Node)
+			}
+		}
+		for _, node := range deadNodes.List() {
+			if err := c.ipsManager.ReleaseWarmIPs(ctx, ips.Name, node); err != nil {
+				logger.Error(err, "Failed to reclaim warm ips", "ips", ips.Name, "node", node)
+				continue
+			}
+			logger.Info("Reclaimed warm ips of dead node", "ips", ips.Name, "node", node)
+		}
+	}
 }
 
 // If nodeName is used, it is not queued if there is no match
@@ -0,0 +1,40 @@
+package masquerade
+
+import (
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+// nonMasqCidrs returns the destinations the connections of the pods are not masqueraded to, the
+// cidrs of the configuration and the addresses of the nodes. The pods of the cluster are looked
+// up in the pod maps by the datapath.
+func nonMasqCidrs(cidrs []*net.IPNet, nodes []*v1.Node) map[bpfmap.NonMasqCidrKey]bpfmap.NonMasqCidrInfo {
+	result := make(map[bpfmap.NonMasqCidrKey]bpfmap.NonMasqCidrInfo)
+	add := func(cidr *net.IPNet) {
+		ip := cidr.IP.Mask(cidr.Mask).To4()
+		if ip == nil {
+			return
+		}
+		ones, _ := cidr.Mask.Size()
+		key := bpfmap.NonMasqCidrKey{Prefixlen: uint32(ones)}
+		copy(key.IP[:], ip)
+		result[key] = bpfmap.NonMasqCidrInfo{}
+	}
+	for _, cidr := range cidrs {
+		add(cidr)
+	}
+	for _, node := range nodes {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != v1.NodeInternalIP && addr.Type != v1.NodeExternalIP {
+				continue
+			}
+			if ip := net.ParseIP(addr.Address); ip != nil && ip.To4() != nil {
+				add(&net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package masquerade
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+func TestNonMasqCidrs(t *testing.T) {
+	parse := func(s string) *net.IPNet {
+		_, cidr, _ := net.ParseCIDR(s)
+		return cidr
+	}
+	key := func(ip string, ones uint32) bpfmap.NonMasqCidrKey {
+		k := bpfmap.NonMasqCidrKey{Prefixlen: ones}
+		copy(k.IP[:], net.ParseIP(ip).To4())
+		return k
+	}
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: "192.168.1.10"},
+			{Type: v1.NodeInternalIP, Address: "fd00::10"},
+			{Type: v1.NodeExternalIP, Address: "203.0.113.10"},
+			{Type: v1.NodeHostName, Address: "node1"},
+		}},
+	}
+
+	tests := []struct {
+		cidrs []*net.IPNet
+		nodes []*v1.Node
+		want  map[bpfmap.NonMasqCidrKey]bpfmap.NonMasqCidrInfo
+	}{
+		{
+			want: map[bpfmap.NonMasqCidrKey]bpfmap.NonMasqCidrInfo{},
+		},
+		{
+			cidrs: []*net.IPNet{parse("10.0.0.0/8"), parse("fd00::/8")},
+			nodes: []*v1.Node{node},
+			want: map[bpfmap.NonMasqCidrKey]bpfmap.NonMasqCidrInfo{
+				key("10.0.0.0", 8):      {},
+				key("192.168.1.10", 32): {},
+				key("203.0.113.10", 32): {},
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			if got := nonMasqCidrs(tt.cidrs, tt.nodes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nonMasqCidrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package masquerade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"k8s.io/klog/v2"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+// expirePeriod is how often the idle connections are expired
+const expirePeriod = 10 * time.Second
+
+// expireConnections deletes the idle masqueraded connections so that their port of the node is
+// allocated again
+func (c *Controller) expireConnections(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	maps, err := loadMaps()
+	if err != nil {
+		logger.Error(err, "Failed to load the masquerade maps")
+		return
+	}
+	now, err := bpfmap.SinceBoot()
+	if err != nil {
+		logger.Error(err, "Failed to get the time since boot")
+		return
+	}
+	expired, err := maps.expireConnections(now)
+	if err != nil {
+		logger.Error(err, "Failed to expire the masqueraded connections")
+		return
+	}
+	if expired > 0 {
+		logger.V(4).Info("Expired the idle masqueraded connections", "count", expired)
+	}
+}
+
+// masqMaps are the eBPF maps of the masqueraded connections
+type masqMaps struct {
+	ct       *ebpf.Map
+	ports    *ebpf.Map
+	nodeInfo *ebpf.Map
+}
+
+func loadMaps() (*masqMaps, error) {
+	maps := &masqMaps{
+		ct:       bpfmap.GetMasqCtMap(),
+		ports:    bpfmap.GetMasqPortsMap(),
+		nodeInfo: bpfmap.GetNodeInfoMap(),
+	}
+	if maps.ct == nil || maps.ports == nil || maps.nodeInfo == nil {
+		return nil, fmt.Errorf("failed to load eBPF map")
+	}
+	return maps, nil
+}
+
+// expireConnections deletes the connections idle for longer than their timeout at now and frees
+// their port, it returns the number of connections deleted. The connections of a datapath which
+// did not record their last packet are stamped with now.
+func (m *masqMaps) expireConnections(now uint64) (int, error) {
+	var node bpfmap.NodeInfoValue
+	if err := m.nodeInfo.Lookup(bpfmap.NodeInfoKey, &node); err != nil {
+		return 0, err
+	}
+
+	var (
+		key       bpfmap.ServiceCtKey
+		ct        bpfmap.MasqCtInfo
+		stale     []bpfmap.ServiceCtKey
+		unstamped []bpfmap.ServiceCtKey
+	)
+	iter := m.ct.Iterate()
+	for iter.Next(&key, &ct) {
+		if ct.LastSeen == 0 {
+			unstamped = append(unstamped, key)
+		} else if bpfmap.Expired(key.Protocol, ct.Closing, ct.LastSeen, now) {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range unstamped {
+		if err := m.ct.Lookup(key, &ct); err != nil || ct.LastSeen != 0 {
+			continue
+		}
+		ct.LastSeen = now
+		// the entry may be evicted or seen meanwhile
+		_ = m.ct.Update(key, ct, ebpf.UpdateExist)
+	}
+
+	count := 0
+	for _, key := range stale {
+		// the connection may have resumed meanwhile
+		if err := m.ct.Lookup(key, &ct); err != nil || !bpfmap.Expired(key.Protocol, ct.Closing, ct.LastSeen, now) {
+			continue
+		}
+		if err := m.ct.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return count, err
+		}
+		// the port is freed unless it was allocated to another connection since
+		portKey := bpfmap.ServiceCtKey{
+			ClientIP:   node.IP,
+			IP:         key.IP,
+			ClientPort: ct.SnatPort,
+			Port:       key.Port,
+			Protocol:   key.Protocol,
+		}
+		var owner bpfmap.ServiceCtKey
+		if err := m.ports.Lookup(portKey, &owner); err == nil && owner == key {
+			if err := m.ports.Delete(portKey); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return count, err
+			}
+		}
+		count++
+	}
+	return count, nil
+}
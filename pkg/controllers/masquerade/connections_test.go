@@ -0,0 +1,110 @@
+package masquerade
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+func TestExpireConnections(t *testing.T) {
+	const nodeIP = 200
+	now := uint64(10 * time.Hour)
+	conn := bpfmap.ServiceCtKey{ClientIP: 1, IP: 100, ClientPort: 40000, Port: 443, Protocol: unix.IPPROTO_TCP}
+	other := conn
+	other.ClientPort = 40001
+	tests := []struct {
+		ct        bpfmap.MasqCtInfo
+		owner     bpfmap.ServiceCtKey
+		want      int
+		wantCt    bool
+		wantPort  bool
+		wantStamp bool
+	}{
+		{
+			ct:       bpfmap.MasqCtInfo{SnatPort: 61000, LastSeen: now - uint64(time.Hour)},
+			owner:    conn,
+			want:     0,
+			wantCt:   true,
+			wantPort: true,
+		},
+		{
+			ct:    bpfmap.MasqCtInfo{SnatPort: 61000, LastSeen: now - uint64(time.Minute), Closing: 1},
+			owner: conn,
+			want:  1,
+		},
+		{
+			// the port was allocated to another connection once the connection was evicted
+			ct:       bpfmap.MasqCtInfo{SnatPort: 61000, LastSeen: now - uint64(7*time.Hour)},
+			owner:    other,
+			want:     1,
+			wantPort: true,
+		},
+		{
+			ct:        bpfmap.MasqCtInfo{SnatPort: 61000},
+			owner:     conn,
+			want:      0,
+			wantCt:    true,
+			wantPort:  true,
+			wantStamp: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			ct, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, MaxEntries: 16,
+				KeySize: uint32(unsafe.Sizeof(bpfmap.ServiceCtKey{})), ValueSize: uint32(unsafe.Sizeof(bpfmap.MasqCtInfo{}))})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer ct.Close()
+			ports, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, MaxEntries: 16,
+				KeySize: uint32(unsafe.Sizeof(bpfmap.ServiceCtKey{})), ValueSize: uint32(unsafe.Sizeof(bpfmap.ServiceCtKey{}))})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer ports.Close()
+			nodeInfo, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Array, MaxEntries: 1,
+				KeySize: uint32(unsafe.Sizeof(bpfmap.NodeInfoKey)), ValueSize: uint32(unsafe.Sizeof(bpfmap.NodeInfoValue{}))})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer nodeInfo.Close()
+
+			if err := nodeInfo.Put(bpfmap.NodeInfoKey, bpfmap.NodeInfoValue{IP: nodeIP, Masquerade: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := ct.Put(conn, tt.ct); err != nil {
+				t.Fatal(err)
+			}
+			portKey := bpfmap.ServiceCtKey{ClientIP: nodeIP, IP: conn.IP, ClientPort: tt.ct.SnatPort, Port: conn.Port, Protocol: conn.Protocol}
+			if err := ports.Put(portKey, tt.owner); err != nil {
+				t.Fatal(err)
+			}
+
+			m := &masqMaps{ct: ct, ports: ports, nodeInfo: nodeInfo}
+			got, err := m.expireConnections(now)
+			if err != nil {
+				t.Fatalf("expireConnections() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expireConnections() = %d, want %d", got, tt.want)
+			}
+			var info bpfmap.MasqCtInfo
+			if gotCt := ct.Lookup(conn, &info) == nil; gotCt != tt.wantCt {
+				t.Errorf("connection kept = %v, want %v", gotCt, tt.wantCt)
+			}
+			if tt.wantStamp && info.LastSeen != now {
+				t.Errorf("connection last seen = %d, want %d", info.LastSeen, now)
+			}
+			var owner bpfmap.ServiceCtKey
+			if gotPort := ports.Lookup(portKey, &owner) == nil; gotPort != tt.wantPort {
+				t.Errorf("port kept = %v, want %v", gotPort, tt.wantPort)
+			}
+		})
+	}
+}
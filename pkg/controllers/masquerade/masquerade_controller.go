@@ -0,0 +1,202 @@
+package masquerade
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+const (
+	// maxRetries is the number of times the cidrs will be retried before they are dropped out of the queue.
+	maxRetries     = 15
+	ControllerName = "masquerade-controller"
+
+	// syncKey is the single key of the queue, every change of the nodes syncs all the cidrs
+	syncKey = "non-masquerade-cidrs"
+)
+
+// Controller programs the destinations the connections of the pods are not masqueraded to, the
+// configured cidrs and the addresses of the nodes, into the non_masq_cidrs eBPF map and expires
+// the idle masqueraded connections
+type Controller struct {
+	kubeClient kubernetes.Interface
+	cidrs      []*net.IPNet
+
+	// lister define the cache object
+	nodeLister corelisters.NodeLister
+
+	// synced define the sync for relist
+	nodeSynced cache.InformerSynced
+
+	// Access that need to be synced
+	queue workqueue.RateLimitingInterface
+
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+}
+
+// NewController return a controller and add event handler
+func NewController(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	cidrs []*net.IPNet,
+	nodeInformer coreinformers.NodeInformer) (*Controller, error) {
+	logger := klog.FromContext(ctx)
+
+	logger.V(4).Info("Creating event broadcaster")
+	eventBroadcaster := record.NewBroadcaster()
+	controller := &Controller{
+		kubeClient:       kubeClient,
+		cidrs:            cidrs,
+		nodeLister:       nodeInformer.Lister(),
+		nodeSynced:       nodeInformer.Informer().HasSynced,
+		eventBroadcaster: eventBroadcaster,
+		eventRecorder:    eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName}),
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), ControllerName),
+	}
+
+	logger.Info("Setting up event handlers")
+	_, err := nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+// Run worker and sync the queue obj to self logic
+func (c *Controller) Run(ctx context.Context) {
+	defer utilruntime.HandleCrash()
+
+	// Start events processing pipeline.
+	c.eventBroadcaster.StartStructuredLogging(0)
+	c.eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: c.kubeClient.CoreV1().Events(metav1.NamespaceAll)})
+	defer c.eventBroadcaster.Shutdown()
+
+	defer c.queue.ShutDown()
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Starting controller", "controller", ControllerName)
+	defer logger.Info("Shutting down controller", "controller", ControllerName)
+
+	// Wait for the caches to be synced before starting worker
+	logger.Info("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.nodeSynced) {
+		logger.Error(fmt.Errorf("failed to sync informer"), "Informer caches to sync bad")
+		return
+	}
+
+	// the cidrs of a previous configuration are still in the map
+	c.queue.Add(syncKey)
+
+	logger.Info("Starting worker")
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	go wait.UntilWithContext(ctx, c.expireConnections, expirePeriod)
+
+	<-ctx.Done()
+}
+
+// runWorker wait obj by queue
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncHandler(ctx)
+	c.handleErr(ctx, err, key)
+
+	return true
+}
+
+func (c *Controller) handleErr(ctx context.Context, err error, key interface{}) {
+	logger := klog.FromContext(ctx)
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		logger.V(2).Info("Error syncing non masquerade cidrs", "err", err)
+		c.queue.AddRateLimited(key)
+		return
+	}
+
+	utilruntime.HandleError(err)
+	logger.V(2).Info("Dropping non masquerade cidrs out of the queue", "err", err)
+	c.queue.Forget(key)
+}
+
+// syncHandler updates the non masquerade cidrs to the configuration and the nodes
+func (c *Controller) syncHandler(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+
+	startTime := time.Now()
+	logger.V(4).Info("Started syncing non masquerade cidrs", "startTime", startTime)
+	defer func() {
+		logger.V(4).Info("Finished syncing non masquerade cidrs", "duration", time.Since(startTime))
+	}()
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	return syncCidrs(c.cidrs, nodes)
+}
+
+// SyncCidrs programs the non masquerade cidrs with the nodes listed from the API server, the agent
+// calls it before the pods are masqueraded so that the nodes are never reached masqueraded
+func SyncCidrs(ctx context.Context, kubeClient kubernetes.Interface, cidrs []*net.IPNet) error {
+	list, err := kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	nodes := make([]*v1.Node, 0, len(list.Items))
+	for i := range list.Items {
+		nodes = append(nodes, &list.Items[i])
+	}
+	return syncCidrs(cidrs, nodes)
+}
+
+func syncCidrs(cidrs []*net.IPNet, nodes []*v1.Node) error {
+	m := bpfmap.GetNonMasqCidrsMap()
+	if m == nil {
+		return fmt.Errorf("failed to load eBPF map")
+	}
+	return bpfmap.SyncMap(m, bpfmap.NonMasqCidrs, nonMasqCidrs(cidrs, nodes))
+}
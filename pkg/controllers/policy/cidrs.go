@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sort"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// ipRange is an inclusive range of IPv4 addresses
+type ipRange struct {
+	first, last uint32
+}
+
+// ipBlockCidrs returns the cidrs of the ip block without its excepts, the IPv6 blocks are ignored
+func ipBlockCidrs(block *networkingv1.IPBlock) []*net.IPNet {
+	_, cidr, err := net.ParseCIDR(block.CIDR)
+	if err != nil || cidr.IP.To4() == nil {
+		return nil
+	}
+	ranges := []ipRange{cidrRange(cidr)}
+	for _, except := range block.Except {
+		_, e, err := net.ParseCIDR(except)
+		if err != nil || e.IP.To4() == nil {
+			continue
+		}
+		ranges = subtract(ranges, cidrRange(e))
+	}
+
+	var result []*net.IPNet
+	for _, r := range ranges {
+		result = append(result, rangeCidrs(r)...)
+	}
+	return result
+}
+
+func cidrRange(cidr *net.IPNet) ipRange {
+	first := binary.BigEndian.Uint32(cidr.IP.To4())
+	ones, _ := cidr.Mask.Size()
+	return ipRange{first: first, last: first | uint32(uint64(1)<<(32-ones)-1)}
+}
+
+// subtract removes the range r from the sorted ranges
+func subtract(ranges []ipRange, r ipRange) []ipRange {
+	var result []ipRange
+	for _, c := range ranges {
+		if r.last < c.first || r.first > c.last {
+			result = append(result, c)
+			continue
+		}
+		if r.first > c.first {
+			result = append(result, ipRange{first: c.first, last: r.first - 1})
+		}
+		if r.last < c.last {
+			result = append(result, ipRange{first: r.last + 1, last: c.last})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].first < result[j].first })
+	return result
+}
+
+// rangeCidrs returns the fewest cidrs covering the range
+func rangeCidrs(r ipRange) []*net.IPNet {
+	var result []*net.IPNet
+	first := uint64(r.first)
+	last := uint64(r.last)
+	for first <= last {
+		// the largest block aligned on first and not beyond last
+		size := 32
+		if first != 0 {
+			size = bits.TrailingZeros64(first)
+			if size > 32 {
+				size = 32
+			}
+		}
+		for size > 0 && first+(uint64(1)<<size)-1 > last {
+			size--
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(first))
+		result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(32-size, 32)})
+		first += uint64(1) << size
+	}
+	return result
+}
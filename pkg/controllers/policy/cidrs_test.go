@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+func TestIPBlockCidrs(t *testing.T) {
+	tests := []struct {
+		block *networkingv1.IPBlock
+		want  []string
+	}{
+		{
+			block: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"},
+			want:  []string{"10.0.0.0/8"},
+		},
+		{
+			block: &networkingv1.IPBlock{CIDR: "10.0.0.0/14", Except: []string{"10.1.0.0/16"}},
+			want:  []string{"10.0.0.0/16", "10.2.0.0/15"},
+		},
+		{
+			block: &networkingv1.IPBlock{CIDR: "0.0.0.0/0", Except: []string{"128.0.0.0/1", "0.0.0.0/2"}},
+			want:  []string{"64.0.0.0/2"},
+		},
+		{
+			block: &networkingv1.IPBlock{CIDR: "192.168.0.0/30", Except: []string{"192.168.0.1/32"}},
+			want:  []string{"192.168.0.0/32", "192.168.0.2/31"},
+		},
+		{
+			block: &networkingv1.IPBlock{CIDR: "192.168.0.0/24", Except: []string{"192.168.0.0/16"}},
+			want:  nil,
+		},
+		{
+			block: &networkingv1.IPBlock{CIDR: "fd00::/64"},
+			want:  nil,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			var got []string
+			for _, cidr := range ipBlockCidrs(tt.block) {
+				got = append(got, cidr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ipBlockCidrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
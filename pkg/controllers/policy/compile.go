@@ -0,0 +1,395 @@
+package policy
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+
+	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// compiled is the content of the policy maps for the local pods
+type compiled struct {
+	identities map[bpfmap.PodIdentityKey]bpfmap.PodIdentityInfo
+	endpoints  map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo
+	rules      map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo
+	cidrs      map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo
+	state      *State
+}
+
+// identity is the pods of a namespace with the same labels, the peers of the rules select them
+// together
+type identity struct {
+	id        uint32
+	namespace string
+	labels    labels.Set
+	pods      []*v1.Pod
+}
+
+// port is a block of ports of a rule, the ports whose first prefix bits are those of port. A
+// prefix 0 is every port of the protocol and a protocol 0 every protocol.
+type port struct {
+	port     uint16
+	prefix   uint8
+	protocol uint8
+}
+
+type compiler struct {
+	namespaces map[string]labels.Set
+	identities []*identity
+	result     *compiled
+}
+
+// compile compiles the policies of the local pods into the policy maps. The pods selected by a
+// policy are isolated in the directions of the policy, the rules of the policies selecting a pod
+// are merged and the first policy allowing a peer is the policy of the rule.
+func compile(nodeName types.NodeName, pods []*v1.Pod, namespaces []*v1.Namespace, policies []*networkingv1.NetworkPolicy) *compiled {
+	c := &compiler{
+		namespaces: make(map[string]labels.Set, len(namespaces)),
+		result: &compiled{
+			identities: make(map[bpfmap.PodIdentityKey]bpfmap.PodIdentityInfo),
+			endpoints:  make(map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo),
+			rules:      make(map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo),
+			cidrs:      make(map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo),
+			state: &State{
+				Policies:   make(map[uint32]string),
+				Identities: make(map[uint32]IdentityState),
+				Pods:       make(map[string]string),
+			},
+		},
+	}
+	for _, ns := range namespaces {
+		c.namespaces[ns.Name] = labels.Set(ns.Labels)
+	}
+
+	byKey := make(map[string]*identity)
+	var local []*v1.Pod
+	for _, pod := range pods {
+		ip := podIPv4(pod)
+		if len(ip) == 0 {
+			continue
+		}
+		key := identityKey(pod)
+		id, ok := byKey[key]
+		if !ok {
+			id = &identity{namespace: pod.Namespace, labels: labels.Set(pod.Labels)}
+			byKey[key] = id
+		}
+		id.pods = append(id.pods, pod)
+		if types.NodeName(pod.Spec.NodeName) == nodeName {
+			local = append(local, pod)
+			c.result.state.Pods[ip] = pod.Namespace + "/" + pod.Name
+		}
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	for key, id := range allocateIDs(keys) {
+		identity := byKey[key]
+		identity.id = id
+		c.identities = append(c.identities, identity)
+		for _, pod := range identity.pods {
+			c.result.identities[bpfmap.PodIdentityKey{IP: util.InetIpToUInt32(podIPv4(pod))}] = bpfmap.PodIdentityInfo{Identity: id}
+		}
+		c.result.state.Identities[id] = IdentityState{Namespace: identity.namespace, Labels: identity.labels}
+	}
+	sort.Slice(c.identities, func(i, j int) bool { return c.identities[i].id < c.identities[j].id })
+
+	policies = append([]*networkingv1.NetworkPolicy(nil), policies...)
+	sort.Slice(policies, func(i, j int) bool { return policyName(policies[i]) < policyName(policies[j]) })
+	names := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		names = append(names, policyName(policy))
+	}
+	ids := allocateIDs(names)
+
+	for _, pod := range local {
+		for _, policy := range policies {
+			if policy.Namespace != pod.Namespace {
+				continue
+			}
+			selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+			if err != nil || !selector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			c.compilePolicy(pod, policy, ids[policyName(policy)])
+		}
+	}
+	return c.result
+}
+
+// compilePolicy isolates the pod in the directions of the policy and adds the rules of the policy
+func (c *compiler) compilePolicy(pod *v1.Pod, policy *networkingv1.NetworkPolicy, id uint32) {
+	ip := util.InetIpToUInt32(podIPv4(pod))
+	key := bpfmap.PolicyEndpointKey{IP: ip}
+	endpoint := c.result.endpoints[key]
+	ingress, egress := policyTypes(policy)
+	if ingress {
+		if endpoint.IngressPolicy == 0 {
+			endpoint.IngressPolicy = id
+		}
+		for _, rule := range policy.Spec.Ingress {
+			c.compileRule(pod, ip, bpfmap.PolicyIngress, id, policy.Namespace, rule.From, rule.Ports)
+		}
+	}
+	if egress {
+		if endpoint.EgressPolicy == 0 {
+			endpoint.EgressPolicy = id
+		}
+		for _, rule := range policy.Spec.Egress {
+			c.compileRule(pod, ip, bpfmap.PolicyEgress, id, policy.Namespace, rule.To, rule.Ports)
+		}
+	}
+	c.result.endpoints[key] = endpoint
+	c.result.state.Policies[id] = policyName(policy)
+}
+
+// compileRule adds the peers of a rule, a rule without peer allows every address. The named
+// ports are those of the pod for an ingress rule and of the peers for an egress rule, they do not
+// apply to the ip blocks of an egress rule.
+func (c *compiler) compileRule(pod *v1.Pod, ip uint32, direction uint8, id uint32, namespace string,
+	peers []networkingv1.NetworkPolicyPeer, policyPorts []networkingv1.NetworkPolicyPort) {
+	portPods := func(peerPods []*v1.Pod) []*v1.Pod {
+		if direction == bpfmap.PolicyIngress {
+			return []*v1.Pod{pod}
+		}
+		return peerPods
+	}
+
+	if len(peers) == 0 {
+		for _, p := range rulePorts(policyPorts, portPods(nil)) {
+			c.addCidr(ip, direction, p, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, id)
+		}
+		return
+	}
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			for _, p := range rulePorts(policyPorts, portPods(nil)) {
+				for _, cidr := range ipBlockCidrs(peer.IPBlock) {
+					c.addCidr(ip, direction, p, cidr, id)
+				}
+			}
+			continue
+		}
+		for _, identity := range c.selectIdentities(namespace, peer) {
+			for _, p := range rulePorts(policyPorts, portPods(identity.pods)) {
+				key := bpfmap.PolicyRuleKey{IP: ip, Identity: identity.id, Port: p.port, Protocol: p.protocol, Direction: direction, PortPrefix: p.prefix}
+				if _, ok := c.result.rules[key]; !ok {
+					c.result.rules[key] = bpfmap.PolicyRuleInfo{Policy: id}
+				}
+			}
+		}
+	}
+}
+
+func (c *compiler) addCidr(ip uint32, direction uint8, p port, cidr *net.IPNet, id uint32) {
+	ones, _ := cidr.Mask.Size()
+	key := bpfmap.PolicyCidrKey{
+		Prefixlen:  uint32(bpfmap.PolicyCidrPrefix + ones),
+		IP:         ip,
+		Port:       p.port,
+		Protocol:   p.protocol,
+		Direction:  direction,
+		PortPrefix: p.prefix,
+	}
+	copy(key.Peer[:], cidr.IP.Mask(cidr.Mask).To4())
+	if _, ok := c.result.cidrs[key]; !ok {
+		c.result.cidrs[key] = bpfmap.PolicyRuleInfo{Policy: id}
+	}
+}
+
+// selectIdentities returns the identities a pod or namespace selector peer selects, a peer
+// without namespace selector selects the pods of the namespace of the policy
+func (c *compiler) selectIdentities(namespace string, peer networkingv1.NetworkPolicyPeer) []*identity {
+	var nsSelector, podSelector labels.Selector
+	var err error
+	if peer.NamespaceSelector != nil {
+		if nsSelector, err = metav1.LabelSelectorAsSelector(peer.NamespaceSelector); err != nil {
+			return nil
+		}
+	}
+	if peer.PodSelector != nil {
+		if podSelector, err = metav1.LabelSelectorAsSelector(peer.PodSelector); err != nil {
+			return nil
+		}
+	}
+
+	var result []*identity
+	for _, identity := range c.identities {
+		if nsSelector == nil {
+			if identity.namespace != namespace {
+				continue
+			}
+		} else if !nsSelector.Matches(c.namespaces[identity.namespace]) {
+			continue
+		}
+		if podSelector != nil && !podSelector.Matches(identity.labels) {
+			continue
+		}
+		result = append(result, identity)
+	}
+	return result
+}
+
+// rulePorts returns the ports of a rule, a rule without port allows every port. The port ranges
+// are split into blocks, the named ports are resolved against the containers of the pods. SCTP is
+// not supported.
+func rulePorts(policyPorts []networkingv1.NetworkPolicyPort, pods []*v1.Pod) []port {
+	if len(policyPorts) == 0 {
+		return []port{{}}
+	}
+	seen := make(map[port]bool)
+	var result []port
+	add := func(p port) {
+		if !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	for _, pp := range policyPorts {
+		protocol := v1.ProtocolTCP
+		if pp.Protocol != nil {
+			protocol = *pp.Protocol
+		}
+		number, ok := protocolNumber(protocol)
+		if !ok {
+			continue
+		}
+		if pp.Port == nil {
+			add(port{protocol: number})
+			continue
+		}
+		if pp.Port.Type == intstr.Int {
+			end := pp.Port.IntVal
+			if pp.EndPort != nil && *pp.EndPort > end {
+				end = *pp.EndPort
+			}
+			for _, p := range portBlocks(pp.Port.IntVal, end) {
+				p.protocol = number
+				add(p)
+			}
+			continue
+		}
+		for _, pod := range pods {
+			for _, container := range pod.Spec.Containers {
+				for _, cp := range container.Ports {
+					cpProtocol := cp.Protocol
+					if len(cpProtocol) == 0 {
+						cpProtocol = v1.ProtocolTCP
+					}
+					if cp.Name == pp.Port.StrVal && cpProtocol == protocol {
+						add(port{port: uint16(cp.ContainerPort), prefix: 16, protocol: number})
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
+// portBlocks splits the ports from start to end into the fewest blocks of a prefix of the port
+func portBlocks(start, end int32) []port {
+	if start < 1 {
+		start = 1
+	}
+	if end > 65535 {
+		end = 65535
+	}
+	var result []port
+	for start <= end {
+		// the block grows while it starts at start and ends before end
+		prefix := 16
+		for prefix > 0 {
+			size := int32(1) << (16 - (prefix - 1))
+			if start%size != 0 || start+size-1 > end {
+				break
+			}
+			prefix--
+		}
+		result = append(result, port{port: uint16(start), prefix: uint8(prefix)})
+		start += int32(1) << (16 - prefix)
+	}
+	return result
+}
+
+// policyTypes returns the directions the policy isolates, a policy without types isolates the
+// ingress and the egress when it has egress rules
+func policyTypes(policy *networkingv1.NetworkPolicy) (ingress, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+
+// allocateIDs gives every key an id, the id is the hash of the key so that it is kept across the
+// restarts of the agent and the changes of the other keys. A collision takes the next free id.
+func allocateIDs(keys []string) map[string]uint32 {
+	sort.Strings(keys)
+	ids := make(map[string]uint32, len(keys))
+	used := make(map[uint32]bool, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		id := h.Sum32()
+		for id == 0 || used[id] {
+			id++
+		}
+		used[id] = true
+		ids[key] = id
+	}
+	return ids
+}
+
+func identityKey(pod *v1.Pod) string {
+	return pod.Namespace + "/" + labels.Set(pod.Labels).String()
+}
+
+func policyName(policy *networkingv1.NetworkPolicy) string {
+	return policy.Namespace + "/" + policy.Name
+}
+
+// podIPv4 returns the IPv4 address of a running pod on the pod network, or an empty string
+func podIPv4(pod *v1.Pod) string {
+	if pod.Spec.HostNetwork || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return ""
+	}
+	ips := []string{pod.Status.PodIP}
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// protocolNumber returns the ip protocol of a policy port, only tcp and udp are supported
+func protocolNumber(protocol v1.Protocol) (uint8, bool) {
+	switch protocol {
+	case v1.ProtocolTCP:
+		return unix.IPPROTO_TCP, true
+	case v1.ProtocolUDP:
+		return unix.IPPROTO_UDP, true
+	}
+	return 0, false
+}
@@ -0,0 +1,238 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+func TestCompile(t *testing.T) {
+	pod := func(ns, name, app, node, ip string, ports ...v1.ContainerPort) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: map[string]string{"app": app}},
+			Spec:       v1.PodSpec{NodeName: node, Containers: []v1.Container{{Name: name, Ports: ports}}},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: ip},
+		}
+	}
+	pods := []*v1.Pod{
+		pod("default", "web", "web", "node1", "10.244.0.3", v1.ContainerPort{Name: "http", ContainerPort: 8080}),
+		pod("default", "client", "client", "node1", "10.244.0.4"),
+		pod("prod", "db", "db", "node2", "10.244.1.5", v1.ContainerPort{Name: "sql", ContainerPort: 5432}),
+	}
+	namespaces := []*v1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "prod", Labels: map[string]string{"team": "db"}}},
+	}
+	identities := allocateIDs([]string{"default/app=web", "default/app=client", "prod/app=db"})
+	web := util.InetIpToUInt32("10.244.0.3")
+	client := util.InetIpToUInt32("10.244.0.4")
+	policy := func(name string, selector map[string]string, spec networkingv1.NetworkPolicySpec) *networkingv1.NetworkPolicy {
+		spec.PodSelector = metav1.LabelSelector{MatchLabels: selector}
+		return &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}, Spec: spec}
+	}
+	named := func(name string) *intstr.IntOrString {
+		port := intstr.FromString(name)
+		return &port
+	}
+	numbered := func(n int) *intstr.IntOrString {
+		port := intstr.FromInt(n)
+		return &port
+	}
+	udp := v1.ProtocolUDP
+	cidr := func(ip uint32, peer string, ones int, port uint16, prefix, protocol, direction uint8) bpfmap.PolicyCidrKey {
+		key := bpfmap.PolicyCidrKey{
+			Prefixlen: uint32(bpfmap.PolicyCidrPrefix + ones), IP: ip, Port: port, Protocol: protocol, Direction: direction,
+			PortPrefix: prefix,
+		}
+		copy(key.Peer[:], net.ParseIP(peer).To4())
+		return key
+	}
+
+	tests := []struct {
+		policies  []*networkingv1.NetworkPolicy
+		endpoints func(ids map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo
+		rules     func(ids map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo
+		cidrs     func(ids map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo
+	}{
+		{
+			endpoints: func(map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo {
+				return map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo{}
+			},
+			rules: func(map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo{}
+			},
+			cidrs: func(map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo{}
+			},
+		},
+		{
+			policies: []*networkingv1.NetworkPolicy{
+				policy("web", map[string]string{"app": "web"}, networkingv1.NetworkPolicySpec{
+					Ingress: []networkingv1.NetworkPolicyIngressRule{{
+						From:  []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}}},
+						Ports: []networkingv1.NetworkPolicyPort{{Port: named("http")}},
+					}},
+				}),
+			},
+			endpoints: func(ids map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo {
+				return map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo{
+					{IP: web}: {IngressPolicy: ids["default/web"]},
+				}
+			},
+			rules: func(ids map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo{
+					{IP: web, Identity: identities["default/app=client"], Port: 8080, Protocol: 6, Direction: bpfmap.PolicyIngress, PortPrefix: 16}: {Policy: ids["default/web"]},
+				}
+			},
+			cidrs: func(map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo{}
+			},
+		},
+		{
+			policies: []*networkingv1.NetworkPolicy{
+				policy("client", map[string]string{"app": "client"}, networkingv1.NetworkPolicySpec{
+					Egress: []networkingv1.NetworkPolicyEgressRule{{
+						To: []networkingv1.NetworkPolicyPeer{
+							{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "db"}}},
+							{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.0/24"}},
+						},
+						Ports: []networkingv1.NetworkPolicyPort{{Port: named("sql")}, {Protocol: &udp, Port: numbered(53)}},
+					}},
+				}),
+			},
+			endpoints: func(ids map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo {
+				return map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo{
+					{IP: client}: {IngressPolicy: ids["default/client"], EgressPolicy: ids["default/client"]},
+				}
+			},
+			rules: func(ids map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo{
+					{IP: client, Identity: identities["prod/app=db"], Port: 5432, Protocol: 6, Direction: bpfmap.PolicyEgress, PortPrefix: 16}: {Policy: ids["default/client"]},
+					{IP: client, Identity: identities["prod/app=db"], Port: 53, Protocol: 17, Direction: bpfmap.PolicyEgress, PortPrefix: 16}:  {Policy: ids["default/client"]},
+				}
+			},
+			cidrs: func(ids map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo{
+					cidr(client, "192.168.0.0", 24, 53, 16, 17, bpfmap.PolicyEgress): {Policy: ids["default/client"]},
+				}
+			},
+		},
+		{
+			policies: []*networkingv1.NetworkPolicy{
+				policy("deny", nil, networkingv1.NetworkPolicySpec{
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				}),
+			},
+			endpoints: func(ids map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo {
+				return map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo{
+					{IP: web}:    {IngressPolicy: ids["default/deny"]},
+					{IP: client}: {IngressPolicy: ids["default/deny"]},
+				}
+			},
+			rules: func(map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo{}
+			},
+			cidrs: func(map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo{}
+			},
+		},
+		{
+			policies: []*networkingv1.NetworkPolicy{
+				policy("b-deny", map[string]string{"app": "web"}, networkingv1.NetworkPolicySpec{}),
+				policy("a-allow", map[string]string{"app": "web"}, networkingv1.NetworkPolicySpec{
+					Ingress: []networkingv1.NetworkPolicyIngressRule{{}},
+				}),
+			},
+			endpoints: func(ids map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo {
+				return map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo{
+					{IP: web}: {IngressPolicy: ids["default/a-allow"]},
+				}
+			},
+			rules: func(map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo{}
+			},
+			cidrs: func(ids map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo{
+					cidr(web, "0.0.0.0", 0, 0, 0, 0, bpfmap.PolicyIngress): {Policy: ids["default/a-allow"]},
+				}
+			},
+		},
+		{
+			// the port ranges are split into the blocks of a prefix of the port
+			policies: []*networkingv1.NetworkPolicy{
+				policy("range", map[string]string{"app": "web"}, networkingv1.NetworkPolicySpec{
+					Ingress: []networkingv1.NetworkPolicyIngressRule{{
+						From:  []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.0/24"}}},
+						Ports: []networkingv1.NetworkPolicyPort{{Port: numbered(8000), EndPort: pointer.Int32(8011)}},
+					}},
+				}),
+			},
+			endpoints: func(ids map[string]uint32) map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo {
+				return map[bpfmap.PolicyEndpointKey]bpfmap.PolicyEndpointInfo{
+					{IP: web}: {IngressPolicy: ids["default/range"]},
+				}
+			},
+			rules: func(map[string]uint32) map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyRuleKey]bpfmap.PolicyRuleInfo{}
+			},
+			cidrs: func(ids map[string]uint32) map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo {
+				return map[bpfmap.PolicyCidrKey]bpfmap.PolicyRuleInfo{
+					cidr(web, "192.168.0.0", 24, 8000, 13, 6, bpfmap.PolicyIngress): {Policy: ids["default/range"]},
+					cidr(web, "192.168.0.0", 24, 8008, 14, 6, bpfmap.PolicyIngress): {Policy: ids["default/range"]},
+				}
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			var names []string
+			for _, p := range tt.policies {
+				names = append(names, policyName(p))
+			}
+			ids := allocateIDs(names)
+			got := compile("node1", pods, namespaces, tt.policies)
+			if want := tt.endpoints(ids); !reflect.DeepEqual(got.endpoints, want) {
+				t.Errorf("compile() endpoints = %v, want %v", got.endpoints, want)
+			}
+			if want := tt.rules(ids); !reflect.DeepEqual(got.rules, want) {
+				t.Errorf("compile() rules = %v, want %v", got.rules, want)
+			}
+			if want := tt.cidrs(ids); !reflect.DeepEqual(got.cidrs, want) {
+				t.Errorf("compile() cidrs = %v, want %v", got.cidrs, want)
+			}
+			if len(got.identities) != len(pods) {
+				t.Errorf("compile() identities = %v, want one per pod", got.identities)
+			}
+		})
+	}
+}
+
+func TestPortBlocks(t *testing.T) {
+	tests := []struct {
+		start, end int32
+		want       []port
+	}{
+		{start: 80, end: 80, want: []port{{port: 80, prefix: 16}}},
+		{start: 8000, end: 8011, want: []port{{port: 8000, prefix: 13}, {port: 8008, prefix: 14}}},
+		{start: 32768, end: 65535, want: []port{{port: 32768, prefix: 1}}},
+		{start: 0, end: 3, want: []port{{port: 1, prefix: 16}, {port: 2, prefix: 15}}},
+		{start: 65535, end: 70000, want: []port{{port: 65535, prefix: 16}}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			if got := portBlocks(tt.start, tt.end); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("portBlocks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
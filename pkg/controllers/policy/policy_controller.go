@@ -0,0 +1,358 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	networkinginformers "k8s.io/client-go/informers/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+const (
+	// maxRetries is the number of times the policies will be retried before they are dropped out of the queue.
+	maxRetries     = 15
+	ControllerName = "policy-controller"
+
+	// syncKey is the single key of the queue, every change compiles all the policies of the node
+	// again so that the identities and the rules stay consistent
+	syncKey = "policies"
+)
+
+// Controller compiles the network policies of the local pods into the eBPF maps, the datapath
+// allows or denies the connections of the pods with them
+type Controller struct {
+	kubeClient kubernetes.Interface
+	nodeName   types.NodeName
+	stateFile  string
+
+	// lister define the cache object
+	podLister       corelisters.PodLister
+	namespaceLister corelisters.NamespaceLister
+	policyLister    networkinglisters.NetworkPolicyLister
+
+	// synced define the sync for relist
+	podSynced       cache.InformerSynced
+	namespaceSynced cache.InformerSynced
+	policySynced    cache.InformerSynced
+
+	// Access that need to be synced
+	queue workqueue.RateLimitingInterface
+
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+}
+
+// NewController return a controller and add event handler
+func NewController(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	stateFile string,
+	podInformer coreinformers.PodInformer,
+	namespaceInformer coreinformers.NamespaceInformer,
+	policyInformer networkinginformers.NetworkPolicyInformer) (*Controller, error) {
+	logger := klog.FromContext(ctx)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.V(4).Info("Creating event broadcaster")
+	eventBroadcaster := record.NewBroadcaster()
+	controller := &Controller{
+		kubeClient:       kubeClient,
+		nodeName:         types.NodeName(strings.ToLower(hostname)),
+		stateFile:        stateFile,
+		podLister:        podInformer.Lister(),
+		namespaceLister:  namespaceInformer.Lister(),
+		policyLister:     policyInformer.Lister(),
+		podSynced:        podInformer.Informer().HasSynced,
+		namespaceSynced:  namespaceInformer.Informer().HasSynced,
+		policySynced:     policyInformer.Informer().HasSynced,
+		eventBroadcaster: eventBroadcaster,
+		eventRecorder:    eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName}),
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), ControllerName),
+	}
+
+	logger.Info("Setting up event handlers")
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+	}
+	for _, informer := range []cache.SharedIndexInformer{podInformer.Informer(), namespaceInformer.Informer(), policyInformer.Informer()} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			logger.Error(err, "Failed to setting up event handlers")
+			return nil, err
+		}
+	}
+
+	return controller, nil
+}
+
+// Run worker and sync the queue obj to self logic
+func (c *Controller) Run(ctx context.Context) {
+	defer utilruntime.HandleCrash()
+
+	// Start events processing pipeline.
+	c.eventBroadcaster.StartStructuredLogging(0)
+	c.eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: c.kubeClient.CoreV1().Events(metav1.NamespaceAll)})
+	defer c.eventBroadcaster.Shutdown()
+
+	defer c.queue.ShutDown()
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Starting controller", "controller", ControllerName)
+	defer logger.Info("Shutting down controller", "controller", ControllerName)
+
+	// Wait for the caches to be synced before starting worker
+	logger.Info("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.podSynced, c.namespaceSynced, c.policySynced) {
+		logger.Error(fmt.Errorf("failed to sync informer"), "Informer caches to sync bad")
+		return
+	}
+
+	// the policies deleted while the agent was down are still in the maps
+	c.queue.Add(syncKey)
+
+	logger.Info("Starting worker")
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+
+	<-ctx.Done()
+}
+
+// runWorker wait obj by queue
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncHandler(ctx)
+	c.handleErr(ctx, err, key)
+
+	return true
+}
+
+func (c *Controller) handleErr(ctx context.Context, err error, key interface{}) {
+	logger := klog.FromContext(ctx)
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		logger.V(2).Info("Error syncing policies", "err", err)
+		c.queue.AddRateLimited(key)
+		return
+	}
+
+	utilruntime.HandleError(err)
+	logger.V(2).Info("Dropping policies out of the queue", "err", err)
+	c.queue.Forget(key)
+}
+
+// syncHandler compiles the policies of the local pods and updates the maps to them, the pods are
+// isolated once the rules allowing their peers are in the maps
+func (c *Controller) syncHandler(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+
+	startTime := time.Now()
+	logger.V(4).Info("Started syncing policies", "startTime", startTime)
+	defer func() {
+		logger.V(4).Info("Finished syncing policies", "duration", time.Since(startTime))
+	}()
+
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	namespaces, err := c.namespaceLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	policies, err := c.policyLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	result := compile(c.nodeName, pods, namespaces, policies)
+
+	maps, err := loadMaps()
+	if err != nil {
+		return err
+	}
+	// the pods whose identity, isolation or rules change
+	affected := make(map[uint32]bool)
+	identities, err := bpfmap.SyncMapChanges(maps.identities, bpfmap.PodIdentities, result.identities)
+	for _, key := range identities {
+		affected[key.IP] = true
+	}
+	if err != nil {
+		return err
+	}
+	rules, err := bpfmap.SyncMapChanges(maps.rules, bpfmap.PolicyRules, result.rules)
+	for _, key := range rules {
+		affected[key.IP] = true
+	}
+	if err != nil {
+		return err
+	}
+	cidrs, err := bpfmap.SyncMapChanges(maps.cidrs, bpfmap.PolicyCidrs, result.cidrs)
+	for _, key := range cidrs {
+		affected[key.IP] = true
+	}
+	if err != nil {
+		return err
+	}
+	if err := maps.syncStats(result.state.Policies); err != nil {
+		return err
+	}
+	endpoints, err := bpfmap.SyncMapChanges(maps.endpoints, bpfmap.PolicyEndpoints, result.endpoints)
+	for _, key := range endpoints {
+		affected[key.IP] = true
+	}
+	if err != nil {
+		return err
+	}
+	// the connections allowed by the previous policies are checked again on their next packet
+	purged, err := maps.purgeConnections(affected)
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		logger.V(4).Info("Purged the connections of the pods whose policies changed", "count", purged)
+	}
+	return WriteState(c.stateFile, result.state)
+}
+
+// policyMaps are the eBPF maps of the policies
+type policyMaps struct {
+	identities *ebpf.Map
+	endpoints  *ebpf.Map
+	rules      *ebpf.Map
+	cidrs      *ebpf.Map
+	stats      *ebpf.Map
+	ct         *ebpf.Map
+}
+
+func loadMaps() (*policyMaps, error) {
+	maps := &policyMaps{
+		identities: bpfmap.GetPodIdentitiesMap(),
+		endpoints:  bpfmap.GetPolicyEndpointsMap(),
+		rules:      bpfmap.GetPolicyRulesMap(),
+		cidrs:      bpfmap.GetPolicyCidrsMap(),
+		stats:      bpfmap.GetPolicyStatsMap(),
+		ct:         bpfmap.GetPolicyCtMap(),
+	}
+	if maps.identities == nil || maps.endpoints == nil || maps.rules == nil || maps.cidrs == nil || maps.stats == nil ||
+		maps.ct == nil {
+		return nil, fmt.Errorf("failed to load eBPF map")
+	}
+	return maps, nil
+}
+
+// syncStats adds the counters of the policies and deletes the counters of the policies that do not
+// select a local pod anymore, the counters of the other policies are kept
+func (m *policyMaps) syncStats(policies map[uint32]string) error {
+	var (
+		key   bpfmap.PolicyStatsKey
+		stats bpfmap.PolicyStatsInfo
+		stale []bpfmap.PolicyStatsKey
+	)
+	existing := make(map[uint32]bool)
+	iter := m.stats.Iterate()
+	for iter.Next(&key, &stats) {
+		existing[key.Policy] = true
+		if _, ok := policies[key.Policy]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := m.stats.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	for id := range policies {
+		if existing[id] {
+			continue
+		}
+		if err := m.stats.Update(bpfmap.PolicyStatsKey{Policy: id}, bpfmap.PolicyStatsInfo{}, ebpf.UpdateNoExist); err != nil &&
+			!errors.Is(err, ebpf.ErrKeyExist) {
+			if bpfmap.IsMapFull(err) {
+				bpfmap.RecordMapFull(bpfmap.PolicyStats)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeConnections deletes the connections from or to the pods, it returns the number of
+// connections deleted
+func (m *policyMaps) purgeConnections(pods map[uint32]bool) (int, error) {
+	if len(pods) == 0 {
+		return 0, nil
+	}
+	var (
+		key   bpfmap.ServiceCtKey
+		rule  bpfmap.PolicyRuleInfo
+		stale []bpfmap.ServiceCtKey
+	)
+	iter := m.ct.Iterate()
+	for iter.Next(&key, &rule) {
+		if pods[key.ClientIP] || pods[key.IP] {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, key := range stale {
+		if err := m.ct.Delete(key); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
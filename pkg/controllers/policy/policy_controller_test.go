@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+func TestPurgeConnections(t *testing.T) {
+	conns := []bpfmap.ServiceCtKey{
+		{ClientIP: 1, IP: 2, ClientPort: 40000, Port: 80, Protocol: unix.IPPROTO_TCP},
+		{ClientIP: 3, IP: 1, ClientPort: 40001, Port: 53, Protocol: unix.IPPROTO_UDP},
+		{ClientIP: 3, IP: 4, ClientPort: 40002, Port: 443, Protocol: unix.IPPROTO_TCP},
+	}
+	tests := []struct {
+		pods map[uint32]bool
+		want int
+		kept []bpfmap.ServiceCtKey
+	}{
+		{pods: nil, want: 0, kept: conns},
+		{pods: map[uint32]bool{1: true}, want: 2, kept: conns[2:]},
+		{pods: map[uint32]bool{4: true, 5: true}, want: 1, kept: conns[:2]},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			ct, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, MaxEntries: 16,
+				KeySize: uint32(unsafe.Sizeof(bpfmap.ServiceCtKey{})), ValueSize: uint32(unsafe.Sizeof(bpfmap.PolicyRuleInfo{}))})
+			if err != nil {
+				t.Skipf("failed to create map: %v", err)
+			}
+			defer ct.Close()
+			for _, conn := range conns {
+				if err := ct.Put(conn, bpfmap.PolicyRuleInfo{Policy: 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := &policyMaps{ct: ct}
+			got, err := m.purgeConnections(tt.pods)
+			if err != nil {
+				t.Fatalf("purgeConnections() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("purgeConnections() = %d, want %d", got, tt.want)
+			}
+			var rule bpfmap.PolicyRuleInfo
+			for _, conn := range tt.kept {
+				if err := ct.Lookup(conn, &rule); err != nil {
+					t.Errorf("connection %v purged, want kept", conn)
+				}
+			}
+		})
+	}
+}
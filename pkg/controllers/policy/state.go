@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// DefaultStateFile is where the agent writes the state of the policies of the node
+const DefaultStateFile = "/var/lib/fast/policy-state.json"
+
+// State is the names of what the policy maps hold, fastctl shows the policies of a pod with it
+type State struct {
+	// Policies are the policies selecting the local pods by their id
+	Policies map[uint32]string `json:"policies"`
+	// Identities are the identities of the pods of the cluster by their id
+	Identities map[uint32]IdentityState `json:"identities"`
+	// Pods are the namespace/name of the local pods by their address
+	Pods map[string]string `json:"pods"`
+}
+
+// IdentityState is the namespace and labels of the pods of an identity
+type IdentityState struct {
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// WriteState persists the state, the file is replaced at once
+func WriteState(path string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, data, 0644)
+}
+
+// ReadState reads the state written by the agent
+func ReadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
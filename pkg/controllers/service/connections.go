@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"k8s.io/klog/v2"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+// expirePeriod is how often the idle connections are expired
+const expirePeriod = 10 * time.Second
+
+// expireConnections deletes the idle connections to the services and to the remote backends of
+// the node ports and the external ips
+func (c *Controller) expireConnections(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+
+	maps, err := loadMaps()
+	if err != nil {
+		logger.Error(err, "Failed to load the service maps")
+		return
+	}
+	now, err := bpfmap.SinceBoot()
+	if err != nil {
+		logger.Error(err, "Failed to get the time since boot")
+		return
+	}
+	expired, err := maps.expireConnections(now)
+	if err != nil {
+		logger.Error(err, "Failed to expire the connections to the services")
+		return
+	}
+	if expired > 0 {
+		logger.V(4).Info("Expired the idle connections to the services", "count", expired)
+	}
+}
+
+// expired returns true when the reverse connection is idle for longer than its timeout at now
+func expired(protocol uint8, rev bpfmap.ServiceRevCtInfo, now uint64) bool {
+	return bpfmap.Expired(protocol, rev.Closing, rev.LastSeen, now)
+}
+
+// expireConnections deletes the reverse connections idle for longer than their timeout at now and
+// their connection, then the idle connections to the remote backends. It returns the number of
+// connections deleted. The connections of a datapath which did not record their last packet are
+// stamped with now.
+func (m *serviceMaps) expireConnections(now uint64) (int, error) {
+	var (
+		revKey    bpfmap.ServiceCtKey
+		rev       bpfmap.ServiceRevCtInfo
+		stale     []bpfmap.ServiceCtKey
+		unstamped []bpfmap.ServiceCtKey
+	)
+	iter := m.revCt.Iterate()
+	for iter.Next(&revKey, &rev) {
+		if rev.LastSeen == 0 {
+			unstamped = append(unstamped, revKey)
+		} else if expired(revKey.Protocol, rev, now) {
+			stale = append(stale, revKey)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range unstamped {
+		if err := m.revCt.Lookup(key, &rev); err != nil || rev.LastSeen != 0 {
+			continue
+		}
+		rev.LastSeen = now
+		// the entry may be evicted or seen meanwhile
+		_ = m.revCt.Update(key, rev, ebpf.UpdateExist)
+	}
+
+	count := 0
+	for _, key := range stale {
+		// the connection may have resumed meanwhile
+		if err := m.revCt.Lookup(key, &rev); err != nil || !expired(key.Protocol, rev, now) {
+			continue
+		}
+		if err := m.revCt.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return count, err
+		}
+		ctKey := bpfmap.ServiceCtKey{
+			ClientIP:   key.ClientIP,
+			IP:         rev.IP,
+			ClientPort: key.ClientPort,
+			Port:       rev.Port,
+			Protocol:   key.Protocol,
+		}
+		err := m.ct.Delete(ctKey)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			// the connections to the node ports are keyed by the ip 0
+			ctKey.IP = 0
+			err = m.ct.Delete(ctKey)
+		}
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return count, err
+		}
+		count++
+	}
+	expired, err := m.expireNodePortConnections(now)
+	return count + expired, err
+}
+
+// expireNodePortConnections deletes the connections to the remote backends idle for longer than
+// their timeout at now and frees their port of the node, it returns the number of connections
+// deleted
+func (m *serviceMaps) expireNodePortConnections(now uint64) (int, error) {
+	var node bpfmap.NodeInfoValue
+	if err := m.nodeInfo.Lookup(bpfmap.NodeInfoKey, &node); err != nil {
+		return 0, err
+	}
+
+	var (
+		ctKey     bpfmap.ServiceCtKey
+		remote    bpfmap.NodePortCtInfo
+		stale     []bpfmap.ServiceCtKey
+		unstamped []bpfmap.ServiceCtKey
+	)
+	iter := m.nodePortCt.Iterate()
+	for iter.Next(&ctKey, &remote) {
+		if remote.LastSeen == 0 {
+			unstamped = append(unstamped, ctKey)
+		} else if bpfmap.Expired(ctKey.Protocol, remote.Closing, remote.LastSeen, now) {
+			stale = append(stale, ctKey)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range unstamped {
+		if err := m.nodePortCt.Lookup(key, &remote); err != nil || remote.LastSeen != 0 {
+			continue
+		}
+		remote.LastSeen = now
+		// the entry may be evicted or seen meanwhile
+		_ = m.nodePortCt.Update(key, remote, ebpf.UpdateExist)
+	}
+
+	count := 0
+	for _, key := range stale {
+		// the connection may have resumed meanwhile
+		if err := m.nodePortCt.Lookup(key, &remote); err != nil || !bpfmap.Expired(key.Protocol, remote.Closing, remote.LastSeen, now) {
+			continue
+		}
+		if err := m.nodePortCt.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return count, err
+		}
+		// the port is freed unless it was reserved for another connection since, the reverse
+		// connection holds the address the client connected to rather than the ip 0 of a node port
+		revKey := bpfmap.ServiceCtKey{
+			ClientIP:   node.IP,
+			IP:         remote.IP,
+			ClientPort: remote.SnatPort,
+			Port:       remote.Port,
+			Protocol:   key.Protocol,
+		}
+		var conn bpfmap.ServiceCtKey
+		if err := m.nodePortRevCt.Lookup(revKey, &conn); err == nil &&
+			conn.ClientIP == key.ClientIP && conn.ClientPort == key.ClientPort {
+			if err := m.nodePortRevCt.Delete(revKey); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return count, err
+			}
+		}
+		count++
+	}
+	return count, nil
+}
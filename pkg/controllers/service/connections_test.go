@@ -0,0 +1,224 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+func TestExpired(t *testing.T) {
+	now := uint64(10 * time.Hour)
+	ago := func(d time.Duration) uint64 { return now - uint64(d) }
+	tests := []struct {
+		protocol uint8
+		rev      bpfmap.ServiceRevCtInfo
+		want     bool
+	}{
+		{protocol: unix.IPPROTO_TCP, rev: bpfmap.ServiceRevCtInfo{LastSeen: ago(time.Hour)}, want: false},
+		{protocol: unix.IPPROTO_TCP, rev: bpfmap.ServiceRevCtInfo{LastSeen: ago(7 * time.Hour)}, want: true},
+		{protocol: unix.IPPROTO_TCP, rev: bpfmap.ServiceRevCtInfo{LastSeen: ago(5 * time.Second), Closing: 1}, want: false},
+		{protocol: unix.IPPROTO_TCP, rev: bpfmap.ServiceRevCtInfo{LastSeen: ago(time.Minute), Closing: 1}, want: true},
+		{protocol: unix.IPPROTO_UDP, rev: bpfmap.ServiceRevCtInfo{LastSeen: ago(time.Minute)}, want: false},
+		{protocol: unix.IPPROTO_UDP, rev: bpfmap.ServiceRevCtInfo{LastSeen: ago(time.Hour)}, want: true},
+		// a reverse connection without time is never expired
+		{protocol: unix.IPPROTO_UDP, rev: bpfmap.ServiceRevCtInfo{}, want: false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			if got := expired(tt.protocol, tt.rev, now); got != tt.want {
+				t.Errorf("expired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newConnectionMaps creates the maps of the connections and the node of address 200, the test is
+// skipped without the privileges to create them
+func newConnectionMaps(t *testing.T) *serviceMaps {
+	t.Helper()
+	newMap := func(typ ebpf.MapType, keySize, valueSize uintptr) *ebpf.Map {
+		m, err := ebpf.NewMap(&ebpf.MapSpec{Type: typ, MaxEntries: 16, KeySize: uint32(keySize), ValueSize: uint32(valueSize)})
+		if err != nil {
+			t.Skipf("failed to create map: %v", err)
+		}
+		t.Cleanup(func() { m.Close() })
+		return m
+	}
+	m := &serviceMaps{
+		ct:            newMap(ebpf.Hash, unsafe.Sizeof(bpfmap.ServiceCtKey{}), unsafe.Sizeof(bpfmap.ServiceBackendInfo{})),
+		revCt:         newMap(ebpf.Hash, unsafe.Sizeof(bpfmap.ServiceCtKey{}), unsafe.Sizeof(bpfmap.ServiceRevCtInfo{})),
+		nodeInfo:      newMap(ebpf.Array, unsafe.Sizeof(bpfmap.NodeInfoKey), unsafe.Sizeof(bpfmap.NodeInfoValue{})),
+		nodePortCt:    newMap(ebpf.Hash, unsafe.Sizeof(bpfmap.ServiceCtKey{}), unsafe.Sizeof(bpfmap.NodePortCtInfo{})),
+		nodePortRevCt: newMap(ebpf.Hash, unsafe.Sizeof(bpfmap.ServiceCtKey{}), unsafe.Sizeof(bpfmap.ServiceCtKey{})),
+	}
+	if err := m.nodeInfo.Put(bpfmap.NodeInfoKey, bpfmap.NodeInfoValue{IP: 200}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestExpireConnections(t *testing.T) {
+	now := uint64(10 * time.Hour)
+	client := bpfmap.ServiceCtKey{ClientIP: 1, ClientPort: 40000, Protocol: unix.IPPROTO_TCP}
+	tests := []struct {
+		svc       bpfmap.ServiceCtKey
+		rev       bpfmap.ServiceRevCtInfo
+		want      int
+		wantCt    bool
+		wantStamp bool
+	}{
+		{
+			svc:    bpfmap.ServiceCtKey{IP: 100, Port: 80},
+			rev:    bpfmap.ServiceRevCtInfo{IP: 100, Port: 80, LastSeen: now - uint64(time.Second)},
+			want:   0,
+			wantCt: true,
+		},
+		{
+			svc:  bpfmap.ServiceCtKey{IP: 100, Port: 80},
+			rev:  bpfmap.ServiceRevCtInfo{IP: 100, Port: 80, LastSeen: now - uint64(time.Minute), Closing: 1},
+			want: 1,
+		},
+		{
+			// a node port connection is keyed by the ip 0 and reversed to the node address
+			svc:  bpfmap.ServiceCtKey{IP: 0, Port: 30080},
+			rev:  bpfmap.ServiceRevCtInfo{IP: 200, Port: 30080, LastSeen: now - uint64(7*time.Hour)},
+			want: 1,
+		},
+		{
+			svc:       bpfmap.ServiceCtKey{IP: 100, Port: 80},
+			rev:       bpfmap.ServiceRevCtInfo{IP: 100, Port: 80},
+			want:      0,
+			wantCt:    true,
+			wantStamp: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			m := newConnectionMaps(t)
+			ct, revCt := m.ct, m.revCt
+
+			ctKey := client
+			ctKey.IP, ctKey.Port = tt.svc.IP, tt.svc.Port
+			backend := bpfmap.ServiceBackendInfo{IP: 10, Port: 8080}
+			revKey := client
+			revKey.IP, revKey.Port = backend.IP, backend.Port
+			if err := ct.Put(ctKey, backend); err != nil {
+				t.Fatal(err)
+			}
+			if err := revCt.Put(revKey, tt.rev); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := m.expireConnections(now)
+			if err != nil {
+				t.Fatalf("expireConnections() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expireConnections() = %d, want %d", got, tt.want)
+			}
+			var b bpfmap.ServiceBackendInfo
+			if gotCt := ct.Lookup(ctKey, &b) == nil; gotCt != tt.wantCt {
+				t.Errorf("connection kept = %v, want %v", gotCt, tt.wantCt)
+			}
+			var rev bpfmap.ServiceRevCtInfo
+			if err := revCt.Lookup(revKey, &rev); err == nil && tt.wantStamp && rev.LastSeen != now {
+				t.Errorf("reverse connection last seen = %d, want %d", rev.LastSeen, now)
+			}
+		})
+	}
+}
+
+func TestExpireNodePortConnections(t *testing.T) {
+	const nodeIP = 200
+	now := uint64(10 * time.Hour)
+	client := bpfmap.ServiceCtKey{ClientIP: 1, ClientPort: 40000, Protocol: unix.IPPROTO_UDP}
+	tests := []struct {
+		svc       bpfmap.ServiceCtKey
+		remote    bpfmap.NodePortCtInfo
+		owner     uint16
+		want      int
+		wantCt    bool
+		wantRev   bool
+		wantStamp bool
+	}{
+		{
+			svc:     bpfmap.ServiceCtKey{IP: 0, Port: 30053},
+			remote:  bpfmap.NodePortCtInfo{IP: 10, Port: 53, SnatPort: 61000, LastSeen: now - uint64(time.Second)},
+			owner:   40000,
+			want:    0,
+			wantCt:  true,
+			wantRev: true,
+		},
+		{
+			// a node port connection is keyed by the ip 0 and reversed to the node address
+			svc:    bpfmap.ServiceCtKey{IP: 0, Port: 30053},
+			remote: bpfmap.NodePortCtInfo{IP: 10, Port: 53, SnatPort: 61000, LastSeen: now - uint64(time.Hour)},
+			owner:  40000,
+			want:   1,
+		},
+		{
+			svc:    bpfmap.ServiceCtKey{IP: 100, Port: 53},
+			remote: bpfmap.NodePortCtInfo{IP: 10, Port: 53, SnatPort: 61000, LastSeen: now - uint64(time.Hour)},
+			owner:  40000,
+			want:   1,
+		},
+		{
+			// the port was reserved for another connection once the reverse connection was evicted
+			svc:     bpfmap.ServiceCtKey{IP: 100, Port: 53},
+			remote:  bpfmap.NodePortCtInfo{IP: 10, Port: 53, SnatPort: 61000, LastSeen: now - uint64(time.Hour)},
+			owner:   40001,
+			want:    1,
+			wantRev: true,
+		},
+		{
+			svc:       bpfmap.ServiceCtKey{IP: 0, Port: 30053},
+			remote:    bpfmap.NodePortCtInfo{IP: 10, Port: 53, SnatPort: 61000},
+			owner:     40000,
+			want:      0,
+			wantCt:    true,
+			wantRev:   true,
+			wantStamp: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			m := newConnectionMaps(t)
+
+			ctKey := client
+			ctKey.IP, ctKey.Port = tt.svc.IP, tt.svc.Port
+			revKey := bpfmap.ServiceCtKey{ClientIP: nodeIP, IP: tt.remote.IP, ClientPort: tt.remote.SnatPort, Port: tt.remote.Port, Protocol: client.Protocol}
+			conn := client
+			conn.IP, conn.Port, conn.ClientPort = 300, tt.svc.Port, tt.owner
+			if err := m.nodePortCt.Put(ctKey, tt.remote); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.nodePortRevCt.Put(revKey, conn); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := m.expireConnections(now)
+			if err != nil {
+				t.Fatalf("expireConnections() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expireConnections() = %d, want %d", got, tt.want)
+			}
+			var remote bpfmap.NodePortCtInfo
+			if gotCt := m.nodePortCt.Lookup(ctKey, &remote) == nil; gotCt != tt.wantCt {
+				t.Errorf("connection kept = %v, want %v", gotCt, tt.wantCt)
+			}
+			if tt.wantStamp && remote.LastSeen != now {
+				t.Errorf("connection last seen = %d, want %d", remote.LastSeen, now)
+			}
+			if gotRev := m.nodePortRevCt.Lookup(revKey, &conn) == nil; gotRev != tt.wantRev {
+				t.Errorf("reverse connection kept = %v, want %v", gotRev, tt.wantRev)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"net"
+	"sort"
+
+	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// frontends returns the backends of every frontend of the service, the frontends are the cluster
+// ips, the external ips and the node ports of the service. The backends are the ready endpoints
+// of the slices of the service, the external ips and the node ports of a service with the Local
+// external traffic policy only have the endpoints of the node.
+func frontends(svc *v1.Service, slices []*discoveryv1.EndpointSlice, nodeName types.NodeName) map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return nil
+	}
+	clusterIPs := svc.Spec.ClusterIPs
+	if len(clusterIPs) == 0 && len(svc.Spec.ClusterIP) > 0 {
+		clusterIPs = []string{svc.Spec.ClusterIP}
+	}
+	clusterIPs = ipv4s(clusterIPs)
+
+	result := make(map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo)
+	// a service without cluster ip is not load balanced
+	if len(clusterIPs) == 0 {
+		return result
+	}
+	externalIPs := ipv4s(svc.Spec.ExternalIPs)
+	nodePorts := svc.Spec.Type == v1.ServiceTypeNodePort || svc.Spec.Type == v1.ServiceTypeLoadBalancer
+	externalNode := types.NodeName("")
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyLocal {
+		externalNode = nodeName
+	}
+
+	for _, port := range svc.Spec.Ports {
+		protocol, ok := protocolNumber(port.Protocol)
+		if !ok {
+			continue
+		}
+		all := backends(port, slices, "")
+		for _, clusterIP := range clusterIPs {
+			result[frontendKey(clusterIP, port.Port, protocol)] = all
+		}
+
+		external := all
+		if len(externalNode) > 0 {
+			external = backends(port, slices, externalNode)
+		}
+		for _, externalIP := range externalIPs {
+			result[frontendKey(externalIP, port.Port, protocol)] = external
+		}
+		// the node ports are served on the address of every node, their ip is 0
+		if nodePorts && port.NodePort > 0 {
+			result[bpfmap.ServiceKey{Port: uint16(port.NodePort), Protocol: protocol}] = external
+		}
+	}
+	return result
+}
+
+// backends returns the ready endpoints of the slices serving the port, only the endpoints of the
+// node when nodeName is set. They are sorted so that an unchanged service keeps its slots.
+func backends(port v1.ServicePort, slices []*discoveryv1.EndpointSlice, nodeName types.NodeName) []bpfmap.ServiceBackendInfo {
+	seen := make(map[bpfmap.ServiceBackendInfo]bool)
+	var result []bpfmap.ServiceBackendInfo
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+			continue
+		}
+		for _, p := range slice.Ports {
+			if p.Port == nil || stringValue(p.Name) != port.Name || protocolValue(p.Protocol) != port.Protocol {
+				continue
+			}
+			for _, ep := range slice.Endpoints {
+				if len(ep.Addresses) == 0 || (ep.Conditions.Ready != nil && !*ep.Conditions.Ready) {
+					continue
+				}
+				if len(nodeName) > 0 && types.NodeName(stringValue(ep.NodeName)) != nodeName {
+					continue
+				}
+				backend := bpfmap.ServiceBackendInfo{
+					IP:   util.InetIpToUInt32(ep.Addresses[0]),
+					Port: uint16(*p.Port),
+				}
+				if !seen[backend] {
+					seen[backend] = true
+					result = append(result, backend)
+				}
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].IP != result[j].IP {
+			return result[i].IP < result[j].IP
+		}
+		return result[i].Port < result[j].Port
+	})
+	return result
+}
+
+func frontendKey(ip string, port int32, protocol uint8) bpfmap.ServiceKey {
+	return bpfmap.ServiceKey{
+		IP:       util.InetIpToUInt32(ip),
+		Port:     uint16(port),
+		Protocol: protocol,
+	}
+}
+
+// ipv4s returns the IPv4 addresses of the list
+func ipv4s(ips []string) []string {
+	var result []string
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// protocolNumber returns the ip protocol of a service port, only tcp and udp are load balanced
+func protocolNumber(protocol v1.Protocol) (uint8, bool) {
+	switch protocol {
+	case v1.ProtocolTCP, "":
+		return unix.IPPROTO_TCP, true
+	case v1.ProtocolUDP:
+		return unix.IPPROTO_UDP, true
+	}
+	return 0, false
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func protocolValue(p *v1.Protocol) v1.Protocol {
+	if p == nil {
+		return v1.ProtocolTCP
+	}
+	return *p
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+func TestFrontends(t *testing.T) {
+	udp := v1.ProtocolUDP
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Namespace: "default", Name: "test-abc"},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: pointer.String("http"), Port: pointer.Int32(8080)},
+			{Name: pointer.String("dns"), Port: pointer.Int32(5353), Protocol: &udp},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.244.1.2"}, NodeName: pointer.String("node2")},
+			{Addresses: []string{"10.244.0.3"}, NodeName: pointer.String("node1"), Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(true)}},
+			{Addresses: []string{"10.244.2.4"}, Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(false)}},
+		},
+	}
+	frontend := func(ip string, port uint16, protocol uint8) bpfmap.ServiceKey {
+		return bpfmap.ServiceKey{IP: util.InetIpToUInt32(ip), Port: port, Protocol: protocol}
+	}
+	backend := func(ip string, port uint16) bpfmap.ServiceBackendInfo {
+		return bpfmap.ServiceBackendInfo{IP: util.InetIpToUInt32(ip), Port: port}
+	}
+
+	tests := []struct {
+		svc  *v1.Service
+		node types.NodeName
+		want map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo
+	}{
+		{
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				ClusterIPs: []string{"10.96.0.10"},
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+					{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+				},
+			}},
+			want: map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo{
+				frontend("10.96.0.10", 80, 6):  {backend("10.244.0.3", 8080), backend("10.244.1.2", 8080)},
+				frontend("10.96.0.10", 53, 17): {backend("10.244.0.3", 5353), backend("10.244.1.2", 5353)},
+			},
+		},
+		{
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				ClusterIPs: []string{"10.96.0.11", "fd00::11"},
+				Ports:      []v1.ServicePort{{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP}},
+			}},
+			want: map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo{
+				frontend("10.96.0.11", 9090, 6): nil,
+			},
+		},
+		{
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				ClusterIP:  v1.ClusterIPNone,
+				ClusterIPs: []string{v1.ClusterIPNone},
+				Ports:      []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			}},
+			want: map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo{},
+		},
+		{
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				Type:        v1.ServiceTypeNodePort,
+				ClusterIPs:  []string{"10.96.0.12"},
+				ExternalIPs: []string{"192.168.1.100", "fd00::100"},
+				Ports:       []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+			}},
+			want: map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo{
+				frontend("10.96.0.12", 80, 6):    {backend("10.244.0.3", 8080), backend("10.244.1.2", 8080)},
+				frontend("192.168.1.100", 80, 6): {backend("10.244.0.3", 8080), backend("10.244.1.2", 8080)},
+				frontend("0.0.0.0", 30080, 6):    {backend("10.244.0.3", 8080), backend("10.244.1.2", 8080)},
+			},
+		},
+		{
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				Type:                  v1.ServiceTypeLoadBalancer,
+				ClusterIPs:            []string{"10.96.0.13"},
+				ExternalIPs:           []string{"192.168.1.101"},
+				ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyLocal,
+				Ports:                 []v1.ServicePort{{Name: "dns", Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP}},
+			}},
+			want: map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo{
+				frontend("10.96.0.13", 53, 17):    {backend("10.244.0.3", 5353), backend("10.244.1.2", 5353)},
+				frontend("192.168.1.101", 53, 17): {backend("10.244.0.3", 5353)},
+				frontend("0.0.0.0", 30053, 17):    {backend("10.244.0.3", 5353)},
+			},
+		},
+		{
+			// the external frontends of a service without endpoint on the node have no backend, the
+			// datapath drops their connections
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				Type:                  v1.ServiceTypeNodePort,
+				ClusterIPs:            []string{"10.96.0.14"},
+				ExternalIPs:           []string{"192.168.1.102"},
+				ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyLocal,
+				Ports:                 []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30081, Protocol: v1.ProtocolTCP}},
+			}},
+			node: "node3",
+			want: map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo{
+				frontend("10.96.0.14", 80, 6):    {backend("10.244.0.3", 8080), backend("10.244.1.2", 8080)},
+				frontend("192.168.1.102", 80, 6): nil,
+				frontend("0.0.0.0", 30081, 6):    nil,
+			},
+		},
+		{
+			svc: &v1.Service{Spec: v1.ServiceSpec{
+				Type:         v1.ServiceTypeExternalName,
+				ExternalName: "example.com",
+			}},
+			want: nil,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			node := tt.node
+			if node == "" {
+				node = "node1"
+			}
+			if got := frontends(tt.svc, []*discoveryv1.EndpointSlice{slice}, node); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("frontends() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+const (
+	// maxRetries is the number of times a service will be retried before it is dropped out of the queue.
+	// With the current rate-limiter in use (5ms*2^(maxRetries-1)) the following numbers represent the times
+	// a service is going to be requeued:
+	//
+	// 5ms, 10ms, 20ms, 40ms, 80ms, 160ms, 320ms, 640ms, 1.3s, 2.6s, 5.1s, 10.2s, 20.4s, 41s, 82s
+	maxRetries     = 15
+	ControllerName = "service-controller"
+)
+
+// Controller programs the frontends of the services and their backends into the eBPF maps, the
+// datapath load balances the connections of the pods to the cluster ips and the connections coming
+// from outside the node to the external ips and the node ports
+type Controller struct {
+	kubeClient kubernetes.Interface
+	nodeName   types.NodeName
+
+	// lister define the cache object
+	serviceLister corelisters.ServiceLister
+	sliceLister   discoverylisters.EndpointSliceLister
+
+	// synced define the sync for relist
+	serviceSynced cache.InformerSynced
+	sliceSynced   cache.InformerSynced
+
+	// Access that need to be synced
+	queue workqueue.RateLimitingInterface
+
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+
+	// programmed define the frontends programmed for a service, by the key of the service, the
+	// single worker owns it
+	programmed map[string]map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo
+}
+
+// NewController return a controller and add event handler
+func NewController(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	serviceInformer coreinformers.ServiceInformer,
+	sliceInformer discoveryinformers.EndpointSliceInformer) (*Controller, error) {
+	logger := klog.FromContext(ctx)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.V(4).Info("Creating event broadcaster")
+	eventBroadcaster := record.NewBroadcaster()
+	controller := &Controller{
+		kubeClient:       kubeClient,
+		nodeName:         types.NodeName(strings.ToLower(hostname)),
+		serviceLister:    serviceInformer.Lister(),
+		sliceLister:      sliceInformer.Lister(),
+		serviceSynced:    serviceInformer.Informer().HasSynced,
+		sliceSynced:      sliceInformer.Informer().HasSynced,
+		eventBroadcaster: eventBroadcaster,
+		eventRecorder:    eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName}),
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), ControllerName),
+		programmed:       make(map[string]map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo),
+	}
+
+	logger.Info("Setting up event handlers")
+	_, err = serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.enqueue(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.enqueue(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.enqueue(obj)
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
+	_, err = sliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.enqueueSlice(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.enqueueSlice(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.enqueueSlice(obj)
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+// Run worker and sync the queue obj to self logic
+func (c *Controller) Run(ctx context.Context) {
+	defer utilruntime.HandleCrash()
+
+	// Start events processing pipeline.
+	c.eventBroadcaster.StartStructuredLogging(0)
+	c.eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: c.kubeClient.CoreV1().Events(metav1.NamespaceAll)})
+	defer c.eventBroadcaster.Shutdown()
+
+	defer c.queue.ShutDown()
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Starting controller", "controller", ControllerName)
+	defer logger.Info("Shutting down controller", "controller", ControllerName)
+
+	// Wait for the caches to be synced before starting worker
+	logger.Info("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.serviceSynced, c.sliceSynced) {
+		logger.Error(fmt.Errorf("failed to sync informer"), "Informer caches to sync bad")
+		return
+	}
+
+	// the services deleted while the agent was down are still programmed
+	if err := c.garbageCollect(ctx); err != nil {
+		logger.Error(err, "Failed to garbage collect the service maps")
+	}
+
+	logger.Info("Starting worker")
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+	go wait.UntilWithContext(ctx, c.expireConnections, expirePeriod)
+
+	<-ctx.Done()
+}
+
+// runWorker wait obj by queue
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncHandler(ctx, key.(string))
+	c.handleErr(ctx, err, key)
+
+	return true
+}
+
+func (c *Controller) handleErr(ctx context.Context, err error, key interface{}) {
+	logger := klog.FromContext(ctx)
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+	ns, name, keyErr := cache.SplitMetaNamespaceKey(key.(string))
+	if keyErr != nil {
+		logger.Error(err, "Failed to split meta namespace cache key", "cacheKey", key)
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		logger.V(2).Info("Error syncing service", "service", klog.KRef(ns, name), "err", err)
+		c.queue.AddRateLimited(key)
+		return
+	}
+
+	utilruntime.HandleError(err)
+	logger.V(2).Info("Dropping service out of the queue", "service", klog.KRef(ns, name), "err", err)
+	c.queue.Forget(key)
+}
+
+// syncHandler programs the frontends of the service and deletes the frontends it does not have anymore
+func (c *Controller) syncHandler(ctx context.Context, key string) error {
+	logger := klog.FromContext(ctx)
+
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		logger.Error(err, "Failed to split meta namespace cache key", "cacheKey", key)
+		return err
+	}
+
+	startTime := time.Now()
+	logger.V(4).Info("Started syncing service", "service", klog.KRef(ns, name), "startTime", startTime)
+	defer func() {
+		logger.V(4).Info("Finished syncing service", "service", klog.KRef(ns, name), "duration", time.Since(startTime))
+	}()
+
+	svc, err := c.serviceLister.Services(ns).Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	var desired map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo
+	if svc != nil {
+		if desired, err = c.desiredFrontends(svc); err != nil {
+			return err
+		}
+	}
+
+	maps, err := loadMaps()
+	if err != nil {
+		return err
+	}
+	programmed := c.programmed[key]
+	for frontend, backends := range desired {
+		old, ok := programmed[frontend]
+		if ok && reflect.DeepEqual(old, backends) {
+			continue
+		}
+		if err := maps.setFrontend(frontend, backends, ok); err != nil {
+			if bpfmap.IsMapFull(err) {
+				c.eventRecorder.Eventf(svc, v1.EventTypeWarning, "BPFMapFull",
+					"the service is not load balanced: %v, raise the max entries of the service maps of fast-agent", err)
+			}
+			return err
+		}
+	}
+	for frontend := range programmed {
+		if _, ok := desired[frontend]; !ok {
+			if err := maps.deleteFrontend(frontend); err != nil {
+				return err
+			}
+		}
+	}
+	if len(desired) == 0 {
+		delete(c.programmed, key)
+	} else {
+		c.programmed[key] = desired
+	}
+	return nil
+}
+
+// desiredFrontends returns the frontends of the service with their backends
+func (c *Controller) desiredFrontends(svc *v1.Service) (map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo, error) {
+	slices, err := c.sliceLister.EndpointSlices(svc.Namespace).List(labels.SelectorFromSet(labels.Set{
+		discoveryv1.LabelServiceName: svc.Name,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return frontends(svc, slices, c.nodeName), nil
+}
+
+// garbageCollect deletes the frontends of the services that do not exist anymore and the
+// connections to the backends they do not have anymore
+func (c *Controller) garbageCollect(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+
+	svcs, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	desired := make(map[bpfmap.ServiceKey][]bpfmap.ServiceBackendInfo)
+	for _, svc := range svcs {
+		fes, err := c.desiredFrontends(svc)
+		if err != nil {
+			return err
+		}
+		for frontend, backends := range fes {
+			desired[frontend] = backends
+		}
+	}
+
+	maps, err := loadMaps()
+	if err != nil {
+		return err
+	}
+	var (
+		frontend bpfmap.ServiceKey
+		info     bpfmap.ServiceInfo
+		stale    []bpfmap.ServiceKey
+	)
+	iter := maps.services.Iterate()
+	for iter.Next(&frontend, &info) {
+		if _, ok := desired[frontend]; !ok {
+			stale = append(stale, frontend)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, frontend := range stale {
+		logger.V(2).Info("Deleting stale service frontend", "frontend", frontend.String())
+		if err := maps.deleteFrontend(frontend); err != nil {
+			return err
+		}
+	}
+	return maps.purgeConnections(func(frontend bpfmap.ServiceKey, backend bpfmap.ServiceBackendInfo) bool {
+		return !contains(desired[frontend], backend)
+	})
+}
+
+// enqueue the service
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %#v: %w", obj, err))
+		return
+	}
+	c.queue.Add(key)
+}
+
+// enqueueSlice enqueues the service of the slice
+func (c *Controller) enqueueSlice(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("couldn't get endpoint slice from object %#v", obj))
+		return
+	}
+	name, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok || len(name) == 0 {
+		return
+	}
+	c.queue.Add(slice.Namespace + "/" + name)
+}
+
+// serviceMaps are the eBPF maps of the services
+type serviceMaps struct {
+	services      *ebpf.Map
+	backends      *ebpf.Map
+	ct            *ebpf.Map
+	revCt         *ebpf.Map
+	nodeInfo      *ebpf.Map
+	nodePortCt    *ebpf.Map
+	nodePortRevCt *ebpf.Map
+}
+
+func loadMaps() (*serviceMaps, error) {
+	maps := &serviceMaps{
+		services:      bpfmap.GetServicesMap(),
+		backends:      bpfmap.GetServiceBackendsMap(),
+		ct:            bpfmap.GetServiceCtMap(),
+		revCt:         bpfmap.GetServiceRevCtMap(),
+		nodeInfo:      bpfmap.GetNodeInfoMap(),
+		nodePortCt:    bpfmap.GetNodePortCtMap(),
+		nodePortRevCt: bpfmap.GetNodePortRevCtMap(),
+	}
+	if maps.services == nil || maps.backends == nil || maps.ct == nil || maps.revCt == nil ||
+		maps.nodeInfo == nil || maps.nodePortCt == nil || maps.nodePortRevCt == nil {
+		return nil, fmt.Errorf("failed to load eBPF map")
+	}
+	return maps, nil
+}
+
+// setFrontend writes the backends in their slots before the count of the frontend so that the
+// datapath never picks an empty slot, the slots beyond the count are deleted afterwards. The
+// connections to the backends the frontend does not have anymore are deleted when the frontend
+// was programmed.
+func (m *serviceMaps) setFrontend(frontend bpfmap.ServiceKey, backends []bpfmap.ServiceBackendInfo, programmed bool) error {
+	var old bpfmap.ServiceInfo
+	if err := m.services.Lookup(frontend, &old); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	for i, backend := range backends {
+		if err := m.backends.Put(backendKey(frontend, uint32(i+1)), backend); err != nil {
+			if bpfmap.IsMapFull(err) {
+				bpfmap.RecordMapFull(bpfmap.ServiceBackends)
+			}
+			return err
+		}
+	}
+	if err := m.services.Put(frontend, bpfmap.ServiceInfo{Count: uint32(len(backends))}); err != nil {
+		if bpfmap.IsMapFull(err) {
+			bpfmap.RecordMapFull(bpfmap.Services)
+		}
+		return err
+	}
+	if err := m.deleteSlots(frontend, uint32(len(backends))+1, old.Count); err != nil {
+		return err
+	}
+	if !programmed {
+		return nil
+	}
+	return m.purgeConnections(func(f bpfmap.ServiceKey, backend bpfmap.ServiceBackendInfo) bool {
+		return f == frontend && !contains(backends, backend)
+	})
+}
+
+// deleteFrontend deletes the frontend, its backends and its connections
+func (m *serviceMaps) deleteFrontend(frontend bpfmap.ServiceKey) error {
+	var old bpfmap.ServiceInfo
+	if err := m.services.Lookup(frontend, &old); err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := m.services.Delete(frontend); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	if err := m.deleteSlots(frontend, 1, old.Count); err != nil {
+		return err
+	}
+	return m.purgeConnections(func(f bpfmap.ServiceKey, _ bpfmap.ServiceBackendInfo) bool {
+		return f == frontend
+	})
+}
+
+// deleteSlots deletes the slots from..to of the backends of the frontend
+func (m *serviceMaps) deleteSlots(frontend bpfmap.ServiceKey, from, to uint32) error {
+	for slot := from; slot <= to; slot++ {
+		if err := m.backends.Delete(backendKey(frontend, slot)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeConnections deletes the connections matched and their reverse connections
+func (m *serviceMaps) purgeConnections(match func(frontend bpfmap.ServiceKey, backend bpfmap.ServiceBackendInfo) bool) error {
+	var (
+		ctKey   bpfmap.ServiceCtKey
+		backend bpfmap.ServiceBackendInfo
+		stale   []bpfmap.ServiceCtKey
+		revKeys []bpfmap.ServiceCtKey
+	)
+	iter := m.ct.Iterate()
+	for iter.Next(&ctKey, &backend) {
+		frontend := bpfmap.ServiceKey{IP: ctKey.IP, Port: ctKey.Port, Protocol: ctKey.Protocol}
+		if !match(frontend, backend) {
+			continue
+		}
+		stale = append(stale, ctKey)
+		revKeys = append(revKeys, bpfmap.ServiceCtKey{
+			ClientIP:   ctKey.ClientIP,
+			IP:         backend.IP,
+			ClientPort: ctKey.ClientPort,
+			Port:       backend.Port,
+			Protocol:   ctKey.Protocol,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for i := range stale {
+		if err := m.ct.Delete(stale[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+		if err := m.revCt.Delete(revKeys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return m.purgeNodePortConnections(match)
+}
+
+// purgeNodePortConnections deletes the connections to the remote backends matched and their
+// reverse connections, the reverse connections are from the address of the node
+func (m *serviceMaps) purgeNodePortConnections(match func(frontend bpfmap.ServiceKey, backend bpfmap.ServiceBackendInfo) bool) error {
+	var node bpfmap.NodeInfoValue
+	if err := m.nodeInfo.Lookup(bpfmap.NodeInfoKey, &node); err != nil {
+		return err
+	}
+	var (
+		ctKey   bpfmap.ServiceCtKey
+		remote  bpfmap.NodePortCtInfo
+		stale   []bpfmap.ServiceCtKey
+		revKeys []bpfmap.ServiceCtKey
+	)
+	iter := m.nodePortCt.Iterate()
+	for iter.Next(&ctKey, &remote) {
+		frontend := bpfmap.ServiceKey{IP: ctKey.IP, Port: ctKey.Port, Protocol: ctKey.Protocol}
+		if !match(frontend, bpfmap.ServiceBackendInfo{IP: remote.IP, Port: remote.Port}) {
+			continue
+		}
+		stale = append(stale, ctKey)
+		revKeys = append(revKeys, bpfmap.ServiceCtKey{
+			ClientIP:   node.IP,
+			IP:         remote.IP,
+			ClientPort: remote.SnatPort,
+			Port:       remote.Port,
+			Protocol:   ctKey.Protocol,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for i := range stale {
+		if err := m.nodePortCt.Delete(stale[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+		if err := m.nodePortRevCt.Delete(revKeys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func backendKey(frontend bpfmap.ServiceKey, slot uint32) bpfmap.ServiceBackendKey {
+	return bpfmap.ServiceBackendKey{
+		IP:       frontend.IP,
+		Port:     frontend.Port,
+		Protocol: frontend.Protocol,
+		Slot:     slot,
+	}
+}
+
+func contains(backends []bpfmap.ServiceBackendInfo, backend bpfmap.ServiceBackendInfo) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
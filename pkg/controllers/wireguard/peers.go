@@ -0,0 +1,119 @@
+package wireguard
+
+import (
+	"net"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+)
+
+// desiredPeers returns a peer for every other node publishing its public key, the peer is reached
+// at the internal address of the node on port. The packets to the node and to its pods are sent to
+// the peer and the packets from them are accepted from it, the addresses of the pods are those of
+// their status and those the ip endpoints of the node allocate to their interfaces.
+func desiredPeers(self string, port int, nodes []*v1.Node, pods []*v1.Pod, ipeps []*ipsv1alpha1.IpEndpoint) map[wgtypes.Key]wgtypes.PeerConfig {
+	podIPs := make(map[string][]net.IPNet)
+	seen := make(map[string]bool)
+	add := func(node, addr string) {
+		ip := net.ParseIP(addr).To4()
+		if ip == nil || seen[addr] {
+			return
+		}
+		seen[addr] = true
+		podIPs[node] = append(podIPs[node], net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+	}
+	for _, pod := range pods {
+		// the address of a completed pod may be allocated to another pod already
+		if pod.Spec.HostNetwork || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		add(pod.Spec.NodeName, pod.Status.PodIP)
+	}
+	for _, ipep := range ipeps {
+		if len(ipep.Status.Node) == 0 || !ipep.DeletionTimestamp.IsZero() {
+			continue
+		}
+		for _, detail := range ipep.Status.Details() {
+			add(ipep.Status.Node, detail.IPv4)
+		}
+	}
+
+	peers := make(map[wgtypes.Key]wgtypes.PeerConfig)
+	for _, node := range nodes {
+		if node.Name == self {
+			continue
+		}
+		key, err := wgtypes.ParseKey(node.Annotations[PublicKeyAnnotation])
+		if err != nil {
+			continue
+		}
+		ip := nodeInternalIP(node)
+		if ip == nil {
+			continue
+		}
+		allowed := append([]net.IPNet{{IP: ip, Mask: net.CIDRMask(32, 32)}}, podIPs[node.Name]...)
+		peers[key] = wgtypes.PeerConfig{
+			PublicKey:         key,
+			Endpoint:          &net.UDPAddr{IP: ip, Port: port},
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowed,
+		}
+	}
+	return peers
+}
+
+// peerConfigs returns the changes turning the peers of the device into the desired peers, the
+// peers of the device which are unchanged are left alone to keep their sessions
+func peerConfigs(current []wgtypes.Peer, desired map[wgtypes.Key]wgtypes.PeerConfig) []wgtypes.PeerConfig {
+	var configs []wgtypes.PeerConfig
+	existing := make(map[wgtypes.Key]wgtypes.Peer, len(current))
+	for _, peer := range current {
+		existing[peer.PublicKey] = peer
+		if _, ok := desired[peer.PublicKey]; !ok {
+			configs = append(configs, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	for key, want := range desired {
+		if peer, ok := existing[key]; ok && samePeer(peer, want) {
+			continue
+		}
+		configs = append(configs, want)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].PublicKey.String() < configs[j].PublicKey.String()
+	})
+	return configs
+}
+
+// samePeer reports whether the peer of the device has the endpoint and the allowed ips of the config
+func samePeer(peer wgtypes.Peer, want wgtypes.PeerConfig) bool {
+	if peer.Endpoint == nil || peer.Endpoint.String() != want.Endpoint.String() || len(peer.AllowedIPs) != len(want.AllowedIPs) {
+		return false
+	}
+	allowed := make(map[string]bool, len(peer.AllowedIPs))
+	for _, ipNet := range peer.AllowedIPs {
+		allowed[ipNet.String()] = true
+	}
+	for _, ipNet := range want.AllowedIPs {
+		if !allowed[ipNet.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeInternalIP returns the IPv4 internal address of the node
+func nodeInternalIP(node *v1.Node) net.IP {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != v1.NodeInternalIP {
+			continue
+		}
+		if ip := net.ParseIP(addr.Address).To4(); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+)
+
+func newNode(name, ip, publicKey string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if len(publicKey) > 0 {
+		node.Annotations = map[string]string{PublicKeyAnnotation: publicKey}
+	}
+	if len(ip) > 0 {
+		node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}}
+	}
+	return node
+}
+
+func newPod(node, ip string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{
+		Spec:   v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{PodIP: ip, Phase: phase},
+	}
+}
+
+func newIpEndpoint(node, ip, secondaryIP string) *ipsv1alpha1.IpEndpoint {
+	return &ipsv1alpha1.IpEndpoint{Status: ipsv1alpha1.IpEndpointStatus{
+		Node: node,
+		Allocations: []ipsv1alpha1.IPAllocationDetail{
+			{NIC: "eth0", IPv4: ip},
+			{NIC: "net1", IPv4: secondaryIP},
+		},
+	}}
+}
+
+func TestDesiredPeers(t *testing.T) {
+	key1, _ := wgtypes.GeneratePrivateKey()
+	key2, _ := wgtypes.GeneratePrivateKey()
+	pub1, pub2 := key1.PublicKey(), key2.PublicKey()
+
+	tests := []struct {
+		nodes []*v1.Node
+		pods  []*v1.Pod
+		ipeps []*ipsv1alpha1.IpEndpoint
+		want  map[wgtypes.Key][]string
+	}{
+		{
+			nodes: []*v1.Node{newNode("self", "10.0.0.1", pub1.String()), newNode("node2", "10.0.0.2", pub2.String())},
+			pods: []*v1.Pod{
+				newPod("node2", "10.244.1.5", v1.PodRunning),
+				newPod("node2", "10.244.1.6", v1.PodSucceeded),
+				newPod("self", "10.244.0.5", v1.PodRunning),
+			},
+			want: map[wgtypes.Key][]string{pub2: {"10.0.0.2/32", "10.244.1.5/32"}},
+		},
+		{
+			nodes: []*v1.Node{newNode("node2", "10.0.0.2", ""), newNode("node3", "", pub1.String()), newNode("node4", "10.0.0.4", "invalid")},
+			want:  map[wgtypes.Key][]string{},
+		},
+		{
+			// the addresses of the secondary interfaces of the pods
+			nodes: []*v1.Node{newNode("self", "10.0.0.1", pub1.String()), newNode("node2", "10.0.0.2", pub2.String())},
+			pods:  []*v1.Pod{newPod("node2", "10.244.1.5", v1.PodRunning)},
+			ipeps: []*ipsv1alpha1.IpEndpoint{
+				newIpEndpoint("node2", "10.244.1.5", "10.246.10.1"),
+				newIpEndpoint("self", "10.244.0.5", "10.246.10.2"),
+			},
+			want: map[wgtypes.Key][]string{pub2: {"10.0.0.2/32", "10.244.1.5/32", "10.246.10.1/32"}},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			got := desiredPeers("self", 51871, tt.nodes, tt.pods, tt.ipeps)
+			if len(got) != len(tt.want) {
+				t.Fatalf("desiredPeers() = %v, want %v", got, tt.want)
+			}
+			for key, wantIPs := range tt.want {
+				peer, ok := got[key]
+				if !ok {
+					t.Fatalf("desiredPeers() has no peer %s", key)
+				}
+				if len(peer.AllowedIPs) != len(wantIPs) {
+					t.Fatalf("peer %s allowed ips = %v, want %v", key, peer.AllowedIPs, wantIPs)
+				}
+				for j, ipNet := range peer.AllowedIPs {
+					if ipNet.String() != wantIPs[j] {
+						t.Errorf("peer %s allowed ips = %v, want %v", key, peer.AllowedIPs, wantIPs)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPeerConfigs(t *testing.T) {
+	key1, _ := wgtypes.GeneratePrivateKey()
+	key2, _ := wgtypes.GeneratePrivateKey()
+	pub1, pub2 := key1.PublicKey(), key2.PublicKey()
+	endpoint := &net.UDPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 51871}
+	allowed := []net.IPNet{{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)}}
+	want := map[wgtypes.Key]wgtypes.PeerConfig{pub1: {PublicKey: pub1, Endpoint: endpoint, AllowedIPs: allowed}}
+
+	tests := []struct {
+		current    []wgtypes.Peer
+		wantAdd    int
+		wantRemove int
+	}{
+		{current: nil, wantAdd: 1},
+		{current: []wgtypes.Peer{{PublicKey: pub1, Endpoint: endpoint, AllowedIPs: allowed}}},
+		{current: []wgtypes.Peer{{PublicKey: pub1, Endpoint: endpoint}}, wantAdd: 1},
+		{current: []wgtypes.Peer{{PublicKey: pub2, Endpoint: endpoint, AllowedIPs: allowed}}, wantAdd: 1, wantRemove: 1},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			var add, remove int
+			for _, config := range peerConfigs(tt.current, want) {
+				if config.Remove {
+					remove++
+				} else {
+					add++
+				}
+			}
+			if add != tt.wantAdd || remove != tt.wantRemove {
+				t.Errorf("peerConfigs() adds %d and removes %d peers, want %d and %d", add, remove, tt.wantAdd, tt.wantRemove)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package wireguard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	ipsinformers "github.com/fast-io/fast/pkg/generated/informers/externalversions/ips/v1alpha1"
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
+	"github.com/fast-io/fast/pkg/nettools"
+)
+
+const (
+	// maxRetries is the number of times the peers will be retried before they are dropped out of the queue.
+	maxRetries     = 15
+	ControllerName = "wireguard-controller"
+
+	// PublicKeyAnnotation is the annotation of the node publishing the public key of its wireguard device
+	PublicKeyAnnotation = "fast.io/wireguard-public-key"
+
+	// syncKey is the single key of the queue, every change of the nodes and the pods syncs all the peers
+	syncKey = "wireguard-peers"
+
+	// rotationJitter spreads the rotations of the nodes over a fraction of the rotation period, the
+	// packets between two nodes are dropped while one of them rotates its key
+	rotationJitter = 0.2
+)
+
+// deviceClient configures the wireguard device, it is implemented by the wgctrl client
+type deviceClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+// Controller configures the wireguard device of the node: it generates the key of the device and
+// publishes its public key on the node, and adds a peer for every other node publishing its key.
+// The packets of the pods and of the node are sent to the peer of their node.
+type Controller struct {
+	kubeClient     kubernetes.Interface
+	nodeName       string
+	port           int
+	rotationPeriod time.Duration
+	// rotate is set when the key of the device is replaced at the next sync
+	rotate atomic.Bool
+
+	wgClient deviceClient
+
+	// lister define the cache object
+	nodeLister corelisters.NodeLister
+	podLister  corelisters.PodLister
+	ipepLister ipslisters.IpEndpointLister
+
+	// synced define the sync for relist
+	nodeSynced cache.InformerSynced
+	podSynced  cache.InformerSynced
+	ipepSynced cache.InformerSynced
+
+	// Access that need to be synced
+	queue workqueue.RateLimitingInterface
+
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+}
+
+// NewController return a controller and add event handler, the device listens on port and its key is
+// replaced every rotationPeriod, 0 keeps the key.
+func NewController(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	port int,
+	rotationPeriod time.Duration,
+	nodeInformer coreinformers.NodeInformer,
+	podInformer coreinformers.PodInformer,
+	ipepInformer ipsinformers.IpEndpointInformer) (*Controller, error) {
+	logger := klog.FromContext(ctx)
+
+	nodeName, err := hostNodeName()
+	if err != nil {
+		return nil, err
+	}
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wireguard client: %w", err)
+	}
+
+	logger.V(4).Info("Creating event broadcaster")
+	eventBroadcaster := record.NewBroadcaster()
+	controller := &Controller{
+		kubeClient:       kubeClient,
+		nodeName:         nodeName,
+		port:             port,
+		rotationPeriod:   rotationPeriod,
+		wgClient:         wgClient,
+		nodeLister:       nodeInformer.Lister(),
+		podLister:        podInformer.Lister(),
+		ipepLister:       ipepInformer.Lister(),
+		nodeSynced:       nodeInformer.Informer().HasSynced,
+		podSynced:        podInformer.Informer().HasSynced,
+		ipepSynced:       ipepInformer.Informer().HasSynced,
+		eventBroadcaster: eventBroadcaster,
+		eventRecorder:    eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: ControllerName}),
+		queue:            workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), ControllerName),
+	}
+
+	logger.Info("Setting up event handlers")
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.queue.Add(syncKey)
+		},
+	}
+	if _, err := nodeInformer.Informer().AddEventHandler(handler); err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
+	if _, err := podInformer.Informer().AddEventHandler(handler); err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
+	// the ip endpoints hold the addresses of the secondary interfaces of the pods
+	if _, err := ipepInformer.Informer().AddEventHandler(handler); err != nil {
+		logger.Error(err, "Failed to setting up event handlers")
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+// Run worker and sync the queue obj to self logic
+func (c *Controller) Run(ctx context.Context) {
+	defer utilruntime.HandleCrash()
+
+	// Start events processing pipeline.
+	c.eventBroadcaster.StartStructuredLogging(0)
+	c.eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: c.kubeClient.CoreV1().Events(metav1.NamespaceAll)})
+	defer c.eventBroadcaster.Shutdown()
+
+	defer c.queue.ShutDown()
+	defer c.wgClient.Close()
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Starting controller", "controller", ControllerName)
+	defer logger.Info("Shutting down controller", "controller", ControllerName)
+
+	// Wait for the caches to be synced before starting worker
+	logger.Info("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(ctx.Done(), c.nodeSynced, c.podSynced, c.ipepSynced) {
+		logger.Error(fmt.Errorf("failed to sync informer"), "Informer caches to sync bad")
+		return
+	}
+
+	// the device has no key when it was just created
+	c.queue.Add(syncKey)
+	if c.rotationPeriod > 0 {
+		go c.rotateKey(ctx)
+	}
+
+	logger.Info("Starting worker")
+	go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+
+	<-ctx.Done()
+}
+
+// rotateKey replaces the key of the device every rotation period, jittered so that the nodes do
+// not rotate together. The peers keep the old public key of the node until they see the new one,
+// the packets between the node and a peer are dropped meanwhile.
+func (c *Controller) rotateKey(ctx context.Context) {
+	timer := time.NewTimer(wait.Jitter(c.rotationPeriod, rotationJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			c.rotate.Store(true)
+			c.queue.Add(syncKey)
+			timer.Reset(wait.Jitter(c.rotationPeriod, rotationJitter))
+		}
+	}
+}
+
+// runWorker wait obj by queue
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextWorkItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.syncHandler(ctx)
+	c.handleErr(ctx, err, key)
+
+	return true
+}
+
+func (c *Controller) handleErr(ctx context.Context, err error, key interface{}) {
+	logger := klog.FromContext(ctx)
+	if err == nil {
+		c.queue.Forget(key)
+		return
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		logger.V(2).Info("Error syncing wireguard peers", "err", err)
+		c.queue.AddRateLimited(key)
+		return
+	}
+
+	utilruntime.HandleError(err)
+	logger.V(2).Info("Dropping wireguard peers out of the queue", "err", err)
+	c.queue.Forget(key)
+}
+
+// syncHandler configures the key, the port and the peers of the device and publishes its public key
+func (c *Controller) syncHandler(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+
+	startTime := time.Now()
+	logger.V(4).Info("Started syncing wireguard peers", "startTime", startTime)
+	defer func() {
+		logger.V(4).Info("Finished syncing wireguard peers", "duration", time.Since(startTime))
+	}()
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	ipeps, err := c.ipepLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	device, err := c.wgClient.Device(nettools.WireguardDevName)
+	if err != nil {
+		return fmt.Errorf("failed to get wireguard device %s: %w", nettools.WireguardDevName, err)
+	}
+
+	cfg := wgtypes.Config{Peers: peerConfigs(device.Peers, desiredPeers(c.nodeName, c.port, nodes, pods, ipeps))}
+	key := device.PrivateKey
+	rotate := c.rotate.Load()
+	if rotate || key == (wgtypes.Key{}) {
+		if key, err = wgtypes.GeneratePrivateKey(); err != nil {
+			return err
+		}
+		cfg.PrivateKey = &key
+		logger.Info("Generating wireguard key", "device", nettools.WireguardDevName, "rotate", rotate)
+	}
+	if device.ListenPort != c.port {
+		cfg.ListenPort = &c.port
+	}
+	if err := c.wgClient.ConfigureDevice(nettools.WireguardDevName, cfg); err != nil {
+		return fmt.Errorf("failed to configure wireguard device %s: %w", nettools.WireguardDevName, err)
+	}
+	if rotate {
+		c.rotate.Store(false)
+	}
+	return c.publishKey(ctx, key.PublicKey().String())
+}
+
+// publishKey sets the public key of the device on the node unless it is set already
+func (c *Controller) publishKey(ctx context.Context, publicKey string) error {
+	node, err := c.nodeLister.Get(c.nodeName)
+	if err != nil {
+		return err
+	}
+	if node.Annotations[PublicKeyAnnotation] == publicKey {
+		return nil
+	}
+	return patchPublicKey(ctx, c.kubeClient, c.nodeName, &publicKey)
+}
+
+// patchPublicKey sets the public key annotation of the node, it is removed when publicKey is nil
+func patchPublicKey(ctx context.Context, kubeClient kubernetes.Interface, nodeName string, publicKey *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{PublicKeyAnnotation: publicKey},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// Cleanup deletes the wireguard device and the public key of the node when the node does not
+// encrypt, the other nodes remove the peer of the node
+func Cleanup(ctx context.Context, kubeClient kubernetes.Interface) error {
+	nodeName, err := hostNodeName()
+	if err != nil {
+		return err
+	}
+	if err := nettools.DeleteWireguard(nettools.WireguardDevName); err != nil {
+		return err
+	}
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := node.Annotations[PublicKeyAnnotation]; !ok {
+		return nil
+	}
+	return patchPublicKey(ctx, kubeClient, nodeName, nil)
+}
+
+// hostNodeName returns the name of the node of the agent, the lower case host name
+func hostNodeName() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	if len(hostname) == 0 {
+		return "", errors.New("empty host name")
+	}
+	return strings.ToLower(hostname), nil
+}
@@ -0,0 +1,107 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	ipslisters "github.com/fast-io/fast/pkg/generated/listers/ips/v1alpha1"
+)
+
+// fakeDevice is the wireguard device of the tests
+type fakeDevice struct {
+	device       wgtypes.Device
+	configureErr error
+}
+
+func (d *fakeDevice) Device(name string) (*wgtypes.Device, error) {
+	device := d.device
+	return &device, nil
+}
+
+func (d *fakeDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	if d.configureErr != nil {
+		return d.configureErr
+	}
+	if cfg.PrivateKey != nil {
+		d.device.PrivateKey = *cfg.PrivateKey
+	}
+	if cfg.ListenPort != nil {
+		d.device.ListenPort = *cfg.ListenPort
+	}
+	return nil
+}
+
+func (d *fakeDevice) Close() error {
+	return nil
+}
+
+func TestSyncHandler(t *testing.T) {
+	key, _ := wgtypes.GeneratePrivateKey()
+
+	tests := []struct {
+		key          wgtypes.Key
+		published    string
+		rotate       bool
+		configureErr error
+		wantErr      bool
+		wantNewKey   bool
+		wantRotate   bool
+	}{
+		// the key of a new device is generated and published
+		{wantNewKey: true},
+		{key: key, published: key.PublicKey().String()},
+		// the key published by a previous agent is replaced
+		{key: key, published: "old"},
+		{key: key, published: key.PublicKey().String(), rotate: true, wantNewKey: true},
+		// the rotation is retried when the device is not configured
+		{key: key, published: key.PublicKey().String(), rotate: true, configureErr: errors.New("failed"), wantErr: true, wantRotate: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			node := newNode("self", "10.0.0.1", tt.published)
+			kubeClient := fake.NewSimpleClientset(node)
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			_ = indexer.Add(node)
+			device := &fakeDevice{device: wgtypes.Device{PrivateKey: tt.key, ListenPort: 51871}, configureErr: tt.configureErr}
+			c := &Controller{
+				kubeClient: kubeClient,
+				nodeName:   "self",
+				port:       51871,
+				wgClient:   device,
+				nodeLister: corelisters.NewNodeLister(indexer),
+				podLister:  corelisters.NewPodLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+				ipepLister: ipslisters.NewIpEndpointLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+			}
+			c.rotate.Store(tt.rotate)
+
+			err := c.syncHandler(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("syncHandler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := c.rotate.Load(); got != tt.wantRotate {
+				t.Errorf("rotate = %v, want %v", got, tt.wantRotate)
+			}
+			if gotNewKey := device.device.PrivateKey != tt.key; gotNewKey != tt.wantNewKey {
+				t.Errorf("key replaced = %v, want %v", gotNewKey, tt.wantNewKey)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := kubeClient.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := device.device.PrivateKey.PublicKey().String(); got.Annotations[PublicKeyAnnotation] != want {
+				t.Errorf("published key = %q, want %q", got.Annotations[PublicKeyAnnotation], want)
+			}
+		})
+	}
+}
@@ -62,10 +62,10 @@ func (o *listOptions) Run() error {
 
 	table := uitable.New()
 	table.MaxColWidth = 80
-	table.AddRow("CLUSTERIP", "VALUE")
+	table.AddRow("CLUSTERIP", "VALUE", "VNI")
 	iter := o.clusterIpsMap.Iterate()
 	for iter.Next(&key, &value) {
-		table.AddRow(util.InetUint32ToIp(key.IP), util.InetUint32ToIp(value.IP))
+		table.AddRow(util.InetUint32ToIp(key.IP), util.InetUint32ToIp(value.IP), value.Vni)
 	}
 	fmt.Println(table)
 	return nil
@@ -19,6 +19,7 @@ type setOptions struct {
 
 	podIP  string
 	nodeIP string
+	vni    uint32
 }
 
 func newSetOptions(ioStream genericclioptions.IOStreams) *setOptions {
@@ -44,6 +45,7 @@ func NewSetCommand(name string, ioStreaam genericclioptions.IOStreams) *cobra.Co
 	}
 	cmd.Flags().StringVarP(&o.podIP, "pod-ip", "", o.podIP, "The pod-ip define the eBPF map key")
 	cmd.Flags().StringVarP(&o.nodeIP, "node-ip", "", o.nodeIP, "The node-ip define the node ip address")
+	cmd.Flags().Uint32VarP(&o.vni, "vni", "", o.vni, "The vni define the tenant of the pod, 0 is the default tenant")
 
 	return cmd
 }
@@ -71,7 +73,7 @@ func (o *setOptions) Run() error {
 
 	if err := o.clusterIpsMap.Put(
 		bpfmap.ClusterIpsMapKey{IP: podIP},
-		bpfmap.ClusterIpsMapInfo{IP: nodeIP},
+		bpfmap.ClusterIpsMapInfo{IP: nodeIP, Vni: o.vni},
 	); err != nil {
 		return fmt.Errorf("failed to set cluster pod ip %s to map: %w", o.podIP, err)
 	}
@@ -11,6 +11,9 @@ import (
 	"github.com/fast-io/fast/pkg/fastctl/clusterpodips"
 	"github.com/fast-io/fast/pkg/fastctl/localdev"
 	"github.com/fast-io/fast/pkg/fastctl/localpodips"
+	"github.com/fast-io/fast/pkg/fastctl/masquerade"
+	"github.com/fast-io/fast/pkg/fastctl/policy"
+	"github.com/fast-io/fast/pkg/fastctl/services"
 	"github.com/fast-io/fast/pkg/fastctl/version"
 )
 
@@ -31,6 +34,9 @@ func NewFastCtlCommand(rootCmd string) *cobra.Command {
 				clusterpodips.NewClusterPodIpsCommand(rootCmd, ioStreams),
 				localpodips.NewLocalPodIpsCommand(rootCmd, ioStreams),
 				localdev.NewLocalDevCommand(rootCmd, ioStreams),
+				services.NewServicesCommand(rootCmd, ioStreams),
+				policy.NewPolicyCommand(rootCmd, ioStreams),
+				masquerade.NewMasqueradeCommand(rootCmd, ioStreams),
 			},
 		},
 	}
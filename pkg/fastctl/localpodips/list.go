@@ -62,10 +62,10 @@ func (o *listOptions) Run() error {
 
 	table := uitable.New()
 	table.MaxColWidth = 80
-	table.AddRow("LOCALIP", "MAC", "NODEMAC", "IFINDEX", "LXCIFINDEX")
+	table.AddRow("LOCALIP", "MAC", "NODEMAC", "IFINDEX", "LXCIFINDEX", "VNI")
 	iter := o.localIpsMap.Iterate()
 	for iter.Next(&key, &value) {
-		table.AddRow(util.InetUint32ToIp(key.IP), util.Bytes2MacStr(value.MAC), util.Bytes2MacStr(value.NodeMAC), value.IfIndex, value.LxcIfIndex)
+		table.AddRow(util.InetUint32ToIp(key.IP), util.Bytes2MacStr(value.MAC), util.Bytes2MacStr(value.NodeMAC), value.IfIndex, value.LxcIfIndex, value.Vni)
 	}
 	fmt.Println(table)
 	return nil
@@ -22,6 +22,7 @@ type setOptions struct {
 	nsMac     string
 	hostIndex int
 	hostMac   string
+	vni       uint32
 }
 
 func newSetOptions(ioStream genericclioptions.IOStreams) *setOptions {
@@ -50,6 +51,7 @@ func NewSetCommand(name string, ioStreaam genericclioptions.IOStreams) *cobra.Co
 	cmd.Flags().StringVarP(&o.nsMac, "ns-mac", "", o.nsMac, "The ns-mac define the ns veth pair mac")
 	cmd.Flags().IntVarP(&o.hostIndex, "host-index", "", o.hostIndex, "The host-index define the host index")
 	cmd.Flags().StringVarP(&o.hostMac, "host-mac", "", o.hostMac, "The host-mac define the host veth pair mac")
+	cmd.Flags().Uint32VarP(&o.vni, "vni", "", o.vni, "The vni define the tenant of the pod, 0 is the default tenant")
 
 	return cmd
 }
@@ -76,6 +78,7 @@ func (o *setOptions) Run() error {
 			LxcIfIndex: uint32(o.hostIndex),
 			MAC:        util.Stuff8Byte([]byte(o.nsMac)),
 			NodeMAC:    util.Stuff8Byte([]byte(o.hostMac)),
+			Vni:        o.vni,
 		}); err != nil {
 		return fmt.Errorf("failed to set local pod ip %s to map: %w", o.podIP, err)
 	}
@@ -0,0 +1,83 @@
+package masquerade
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/gosuri/uitable"
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+type connectionsOptions struct {
+	genericclioptions.IOStreams
+
+	ctMap       *ebpf.Map
+	nodeInfoMap *ebpf.Map
+}
+
+func newConnectionsOptions(ioStream genericclioptions.IOStreams) *connectionsOptions {
+	return &connectionsOptions{
+		IOStreams:   ioStream,
+		ctMap:       bpfmap.GetMasqCtMap(),
+		nodeInfoMap: bpfmap.GetNodeInfoMap(),
+	}
+}
+
+func NewConnectionsCommand(name string, ioStreaam genericclioptions.IOStreams) *cobra.Command {
+	o := newConnectionsOptions(ioStreaam)
+	cmd := &cobra.Command{
+		Use:     "connections",
+		Aliases: []string{"ct"},
+		Short:   "list the connections of the pods leaving the cluster and the node port they are translated to",
+		Long:    "list the connections of the pods leaving the cluster and the address and port of the node they are translated to",
+		Example: fmt.Sprintf("    %s masquerade ct", name),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(cmd, args))
+			cmdutil.CheckErr(o.Validate(args))
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+	return cmd
+}
+
+func (o *connectionsOptions) Complete(cmd *cobra.Command, args []string) error {
+	return nil
+}
+
+func (o *connectionsOptions) Validate(args []string) error {
+	if o.ctMap == nil || o.nodeInfoMap == nil {
+		return fmt.Errorf("failed to load eBPF map")
+	}
+	return nil
+}
+
+func (o *connectionsOptions) Run() error {
+	var (
+		key   bpfmap.ServiceCtKey
+		value bpfmap.MasqCtInfo
+		node  bpfmap.NodeInfoValue
+	)
+	if err := o.nodeInfoMap.Lookup(bpfmap.NodeInfoKey, &node); err != nil {
+		return err
+	}
+
+	table := uitable.New()
+	table.MaxColWidth = 80
+	table.AddRow("POD", "DESTINATION", "PROTOCOL", "SNAT")
+	iter := o.ctMap.Iterate()
+	for iter.Next(&key, &value) {
+		table.AddRow(fmt.Sprintf("%s:%d", util.InetUint32ToIp(key.ClientIP), key.ClientPort),
+			fmt.Sprintf("%s:%d", util.InetUint32ToIp(key.IP), key.Port), bpfmap.ProtocolName(key.Protocol),
+			fmt.Sprintf("%s:%d", util.InetUint32ToIp(node.IP), value.SnatPort))
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintln(o.Out, table)
+	return nil
+}
@@ -0,0 +1,19 @@
+package masquerade
+
+import (
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+func NewMasqueradeCommand(name string, ioStreams genericclioptions.IOStreams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "masquerade COMMAND",
+		Aliases: []string{"masq"},
+		Short:   "Inspect the masqueraded connections of the pods on the Fast",
+		Long:    "Inspect the masqueraded connections of the pods on the Fast",
+		Run:     cmdutil.DefaultSubCommandRun(ioStreams.ErrOut),
+	}
+	cmd.AddCommand(NewConnectionsCommand(name, ioStreams))
+	return cmd
+}
@@ -0,0 +1,19 @@
+package policy
+
+import (
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+func NewPolicyCommand(name string, ioStreams genericclioptions.IOStreams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "policy COMMAND",
+		Aliases: []string{"netpol"},
+		Short:   "Inspect the network policies enforced on the Fast",
+		Long:    "Inspect the network policies enforced on the Fast",
+		Run:     cmdutil.DefaultSubCommandRun(ioStreams.ErrOut),
+	}
+	cmd.AddCommand(NewShowCommand(name, ioStreams))
+	return cmd
+}
@@ -0,0 +1,227 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/gosuri/uitable"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	policyctrl "github.com/fast-io/fast/pkg/controllers/policy"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+type showOptions struct {
+	genericclioptions.IOStreams
+
+	stateFile string
+	pod       string
+	ip        string
+	state     *policyctrl.State
+
+	endpointsMap *ebpf.Map
+	rulesMap     *ebpf.Map
+	cidrsMap     *ebpf.Map
+	statsMap     *ebpf.Map
+}
+
+func newShowOptions(ioStream genericclioptions.IOStreams) *showOptions {
+	return &showOptions{
+		IOStreams:    ioStream,
+		stateFile:    policyctrl.DefaultStateFile,
+		endpointsMap: bpfmap.GetPolicyEndpointsMap(),
+		rulesMap:     bpfmap.GetPolicyRulesMap(),
+		cidrsMap:     bpfmap.GetPolicyCidrsMap(),
+		statsMap:     bpfmap.GetPolicyStatsMap(),
+	}
+}
+
+func NewShowCommand(name string, ioStreaam genericclioptions.IOStreams) *cobra.Command {
+	o := newShowOptions(ioStreaam)
+	cmd := &cobra.Command{
+		Use:   "show POD",
+		Short: "show the effective network policy of a local pod",
+		Long:  "show the directions a local pod is isolated in, the peers the policies allow it to reach and the counters of the policies, the pod is its address or namespace/name",
+		Example: fmt.Sprintf("    %s policy show 10.244.0.3\n"+
+			"    %s policy show default/busybox-757455cf7-4p9fq", name, name),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(cmd, args))
+			cmdutil.CheckErr(o.Validate(args))
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+	cmd.Flags().StringVar(&o.stateFile, "state-file", o.stateFile, "the file where fast-agent writes the names of the policies and the identities")
+	return cmd
+}
+
+func (o *showOptions) Complete(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("the pod is required")
+	}
+	state, err := policyctrl.ReadState(o.stateFile)
+	if err != nil {
+		return err
+	}
+	o.state = state
+	if ip := net.ParseIP(args[0]); ip != nil {
+		o.ip = ip.String()
+		o.pod = state.Pods[o.ip]
+		return nil
+	}
+	o.pod = args[0]
+	for ip, pod := range state.Pods {
+		if pod == o.pod {
+			o.ip = ip
+		}
+	}
+	return nil
+}
+
+func (o *showOptions) Validate(args []string) error {
+	if o.endpointsMap == nil || o.rulesMap == nil || o.cidrsMap == nil || o.statsMap == nil {
+		return fmt.Errorf("failed to load eBPF map")
+	}
+	if len(o.ip) == 0 || net.ParseIP(o.ip).To4() == nil {
+		return fmt.Errorf("the pod %s is not a local pod", o.pod)
+	}
+	return nil
+}
+
+func (o *showOptions) Run() error {
+	ip := util.InetIpToUInt32(o.ip)
+	policies := make(map[uint32]bool)
+
+	var endpoint bpfmap.PolicyEndpointInfo
+	if err := o.endpointsMap.Lookup(bpfmap.PolicyEndpointKey{IP: ip}, &endpoint); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	isolation := func(policy uint32) string {
+		if policy == 0 {
+			return "not isolated"
+		}
+		policies[policy] = true
+		return "isolated by " + o.policyName(policy)
+	}
+	pod := o.pod
+	if len(pod) == 0 {
+		pod = "<unknown>"
+	}
+	fmt.Fprintf(o.Out, "Pod:      %s (%s)\n", pod, o.ip)
+	fmt.Fprintf(o.Out, "Ingress:  %s\n", isolation(endpoint.IngressPolicy))
+	fmt.Fprintf(o.Out, "Egress:   %s\n\n", isolation(endpoint.EgressPolicy))
+
+	type row struct {
+		direction, peer, protocol, port, policy string
+	}
+	var rows []row
+	var (
+		ruleKey bpfmap.PolicyRuleKey
+		cidrKey bpfmap.PolicyCidrKey
+		rule    bpfmap.PolicyRuleInfo
+	)
+	iter := o.rulesMap.Iterate()
+	for iter.Next(&ruleKey, &rule) {
+		if ruleKey.IP != ip {
+			continue
+		}
+		policies[rule.Policy] = true
+		rows = append(rows, row{direction(ruleKey.Direction), o.identityName(ruleKey.Identity),
+			protocol(ruleKey.Protocol), port(ruleKey.Port, ruleKey.PortPrefix), o.policyName(rule.Policy)})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	iter = o.cidrsMap.Iterate()
+	for iter.Next(&cidrKey, &rule) {
+		if cidrKey.IP != ip {
+			continue
+		}
+		policies[rule.Policy] = true
+		cidr := net.IPNet{IP: net.IP(cidrKey.Peer[:]), Mask: net.CIDRMask(int(cidrKey.Prefixlen)-bpfmap.PolicyCidrPrefix, 32)}
+		rows = append(rows, row{direction(cidrKey.Direction), cidr.String(),
+			protocol(cidrKey.Protocol), port(cidrKey.Port, cidrKey.PortPrefix), o.policyName(rule.Policy)})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].direction != rows[j].direction {
+			return rows[i].direction > rows[j].direction
+		}
+		return rows[i].peer < rows[j].peer
+	})
+	table := uitable.New()
+	table.MaxColWidth = 80
+	table.AddRow("DIRECTION", "PEER", "PROTOCOL", "PORT", "POLICY")
+	for _, r := range rows {
+		table.AddRow(r.direction, r.peer, r.protocol, r.port, r.policy)
+	}
+	fmt.Fprintln(o.Out, table)
+	fmt.Fprintln(o.Out)
+
+	ids := make([]uint32, 0, len(policies))
+	for id := range policies {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return o.policyName(ids[i]) < o.policyName(ids[j]) })
+	table = uitable.New()
+	table.MaxColWidth = 80
+	table.AddRow("POLICY", "ALLOWED", "DENIED")
+	for _, id := range ids {
+		var stats bpfmap.PolicyStatsInfo
+		if err := o.statsMap.Lookup(bpfmap.PolicyStatsKey{Policy: id}, &stats); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+		table.AddRow(o.policyName(id), stats.Allowed, stats.Denied)
+	}
+	fmt.Fprintln(o.Out, table)
+	return nil
+}
+
+func (o *showOptions) policyName(id uint32) string {
+	if name, ok := o.state.Policies[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("<policy %d>", id)
+}
+
+func (o *showOptions) identityName(id uint32) string {
+	identity, ok := o.state.Identities[id]
+	if !ok {
+		return fmt.Sprintf("<identity %d>", id)
+	}
+	return fmt.Sprintf("%s {%s}", identity.Namespace, labels.Set(identity.Labels).String())
+}
+
+func direction(direction uint8) string {
+	if direction == bpfmap.PolicyEgress {
+		return "egress"
+	}
+	return "ingress"
+}
+
+func protocol(protocol uint8) string {
+	if protocol == 0 {
+		return "ANY"
+	}
+	return bpfmap.ProtocolName(protocol)
+}
+
+// port returns the block of the ports whose first prefix bits are those of port
+func port(port uint16, prefix uint8) string {
+	if prefix == 0 {
+		return "ANY"
+	}
+	if prefix >= 16 {
+		return strconv.Itoa(int(port))
+	}
+	return fmt.Sprintf("%d-%d", port, int(port)+1<<(16-prefix)-1)
+}
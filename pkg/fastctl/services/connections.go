@@ -0,0 +1,95 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/gosuri/uitable"
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+type connectionsOptions struct {
+	genericclioptions.IOStreams
+
+	ctMap         *ebpf.Map
+	nodePortCtMap *ebpf.Map
+	nodeInfoMap   *ebpf.Map
+}
+
+func newConnectionsOptions(ioStream genericclioptions.IOStreams) *connectionsOptions {
+	return &connectionsOptions{
+		IOStreams:     ioStream,
+		ctMap:         bpfmap.GetServiceCtMap(),
+		nodePortCtMap: bpfmap.GetNodePortCtMap(),
+		nodeInfoMap:   bpfmap.GetNodeInfoMap(),
+	}
+}
+
+func NewConnectionsCommand(name string, ioStreaam genericclioptions.IOStreams) *cobra.Command {
+	o := newConnectionsOptions(ioStreaam)
+	cmd := &cobra.Command{
+		Use:     "connections",
+		Aliases: []string{"ct"},
+		Short:   "list the connections to the services and the backends they are sent to",
+		Long:    "list the connections to the services and the backends they are sent to, the connections to the remote backends of the node ports and the external ips are translated to the node address and port of the SNAT column",
+		Example: fmt.Sprintf("    %s services ct", name),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(cmd, args))
+			cmdutil.CheckErr(o.Validate(args))
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+	return cmd
+}
+
+func (o *connectionsOptions) Complete(cmd *cobra.Command, args []string) error {
+	return nil
+}
+
+func (o *connectionsOptions) Validate(args []string) error {
+	if o.ctMap == nil || o.nodePortCtMap == nil || o.nodeInfoMap == nil {
+		return fmt.Errorf("failed to load eBPF map")
+	}
+	return nil
+}
+
+func (o *connectionsOptions) Run() error {
+	var (
+		key    bpfmap.ServiceCtKey
+		value  bpfmap.ServiceBackendInfo
+		remote bpfmap.NodePortCtInfo
+		node   bpfmap.NodeInfoValue
+	)
+	if err := o.nodeInfoMap.Lookup(bpfmap.NodeInfoKey, &node); err != nil {
+		return err
+	}
+
+	table := uitable.New()
+	table.MaxColWidth = 80
+	table.AddRow("CLIENT", "SERVICE", "BACKEND", "SNAT")
+	iter := o.ctMap.Iterate()
+	for iter.Next(&key, &value) {
+		service := bpfmap.ServiceKey{IP: key.IP, Port: key.Port, Protocol: key.Protocol}
+		table.AddRow(fmt.Sprintf("%s:%d", util.InetUint32ToIp(key.ClientIP), key.ClientPort), service.String(), value.String(), "<none>")
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	iter = o.nodePortCtMap.Iterate()
+	for iter.Next(&key, &remote) {
+		service := bpfmap.ServiceKey{IP: key.IP, Port: key.Port, Protocol: key.Protocol}
+		backend := bpfmap.ServiceBackendInfo{IP: remote.IP, Port: remote.Port}
+		table.AddRow(fmt.Sprintf("%s:%d", util.InetUint32ToIp(key.ClientIP), key.ClientPort), service.String(), backend.String(),
+			fmt.Sprintf("%s:%d", util.InetUint32ToIp(node.IP), remote.SnatPort))
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintln(o.Out, table)
+	return nil
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/gosuri/uitable"
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+type listOptions struct {
+	genericclioptions.IOStreams
+
+	servicesMap *ebpf.Map
+	backendsMap *ebpf.Map
+}
+
+func newListOptions(ioStream genericclioptions.IOStreams) *listOptions {
+	return &listOptions{
+		IOStreams:   ioStream,
+		servicesMap: bpfmap.GetServicesMap(),
+		backendsMap: bpfmap.GetServiceBackendsMap(),
+	}
+}
+
+func NewListCommand(name string, ioStreaam genericclioptions.IOStreams) *cobra.Command {
+	o := newListOptions(ioStreaam)
+	cmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "list the services and their backends",
+		Long:    "list the services and their backends",
+		Example: fmt.Sprintf("    %s services ls", name),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(cmd, args))
+			cmdutil.CheckErr(o.Validate(args))
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+	return cmd
+}
+
+func (o *listOptions) Complete(cmd *cobra.Command, args []string) error {
+	return nil
+}
+
+func (o *listOptions) Validate(args []string) error {
+	if o.servicesMap == nil || o.backendsMap == nil {
+		return fmt.Errorf("failed to load eBPF map")
+	}
+	return nil
+}
+
+func (o *listOptions) Run() error {
+	var (
+		key   bpfmap.ServiceKey
+		value bpfmap.ServiceInfo
+		rows  [][2]string
+	)
+	iter := o.servicesMap.Iterate()
+	for iter.Next(&key, &value) {
+		backends := make([]string, 0, value.Count)
+		for slot := uint32(1); slot <= value.Count; slot++ {
+			var backend bpfmap.ServiceBackendInfo
+			backendKey := bpfmap.ServiceBackendKey{IP: key.IP, Port: key.Port, Protocol: key.Protocol, Slot: slot}
+			if err := o.backendsMap.Lookup(backendKey, &backend); err != nil {
+				backends = append(backends, fmt.Sprintf("<slot %d missing>", slot))
+				continue
+			}
+			backends = append(backends, backend.String())
+		}
+		rows = append(rows, [2]string{key.String(), strings.Join(backends, ",")})
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+
+	table := uitable.New()
+	table.MaxColWidth = 80
+	table.Wrap = true
+	table.AddRow("SERVICE", "BACKENDS")
+	for _, row := range rows {
+		table.AddRow(row[0], row[1])
+	}
+	fmt.Fprintln(o.Out, table)
+	return nil
+}
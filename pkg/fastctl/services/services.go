@@ -0,0 +1,20 @@
+package services
+
+import (
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+func NewServicesCommand(name string, ioStreams genericclioptions.IOStreams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "services COMMAND",
+		Aliases: []string{"svc"},
+		Short:   "Inspect the load balanced services on the Fast",
+		Long:    "Inspect the load balanced services on the Fast",
+		Run:     cmdutil.DefaultSubCommandRun(ioStreams.ErrOut),
+	}
+	cmd.AddCommand(NewListCommand(name, ioStreams))
+	cmd.AddCommand(NewConnectionsCommand(name, ioStreams))
+	return cmd
+}
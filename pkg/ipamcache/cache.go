@@ -0,0 +1,196 @@
+package ipamcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// Entry is the allocation of a pod on the local node
+type Entry struct {
+	Namespace string                       `json:"namespace"`
+	Name      string                       `json:"name"`
+	Status    ipsv1alpha1.IpEndpointStatus `json:"status"`
+
+	// PendingRelease is set by the agents recording the deferred releases per pod, it releases all
+	// the interfaces of the pod. It is moved to PendingReleases when the cache is loaded.
+	PendingRelease bool `json:"pendingRelease,omitempty"`
+	// PendingReleases are the releases which failed because the apiserver is unreachable, they
+	// are retried by the reconciliation.
+	PendingReleases []Release `json:"pendingReleases,omitempty"`
+}
+
+// Release is a deferred release of an interface of the pod
+type Release struct {
+	// IfName is the interface released, all the interfaces are released when it is empty
+	IfName string `json:"ifName,omitempty"`
+	// Network is the network of the interface
+	Network string `json:"network,omitempty"`
+	// ContainerID is the sandbox releasing the interface
+	ContainerID string `json:"containerID,omitempty"`
+}
+
+// Key returns the namespace/name key of the entry
+func (e *Entry) Key() string {
+	return Key(e.Namespace, e.Name)
+}
+
+// DeepCopy returns a copy of the entry sharing nothing with it
+func (e *Entry) DeepCopy() *Entry {
+	copied := *e
+	e.Status.DeepCopyInto(&copied.Status)
+	copied.PendingReleases = append([]Release(nil), e.PendingReleases...)
+	return &copied
+}
+
+// AddPendingRelease defers the release, a release recorded before is not added twice
+func (e *Entry) AddPendingRelease(release Release) {
+	for _, pending := range e.PendingReleases {
+		if pending == release {
+			return
+		}
+	}
+	e.PendingReleases = append(e.PendingReleases, release)
+}
+
+// Releasing returns true if the release of the interface is deferred
+func (e *Entry) Releasing(nic string) bool {
+	for _, pending := range e.PendingReleases {
+		if len(pending.IfName) == 0 || pending.IfName == nic {
+			return true
+		}
+	}
+	return false
+}
+
+// IpEndpoint returns the ip endpoint described by the entry
+func (e *Entry) IpEndpoint() *ipsv1alpha1.IpEndpoint {
+	ipep := &ipsv1alpha1.IpEndpoint{Status: e.Status}
+	ipep.Namespace = e.Namespace
+	ipep.Name = e.Name
+	return ipep
+}
+
+// Key returns the key of the pod in the cache
+func Key(namespace, name string) string {
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+// Cache keeps the allocations of the local node, so that an allocation can be served
+// while the apiserver is unreachable.
+type Cache interface {
+	Get(namespace, name string) (*Entry, bool)
+	Set(entry *Entry) error
+	Delete(namespace, name string) error
+	List() []*Entry
+}
+
+type fileCache struct {
+	lock    sync.RWMutex
+	path    string
+	entries map[string]*Entry
+}
+
+// NewFileCache returns a cache persisted as json in the file, the entries of the file are loaded
+func NewFileCache(path string) (Cache, error) {
+	c := &fileCache{
+		path:    path,
+		entries: make(map[string]*Entry),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read ipam cache %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return c, nil
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse ipam cache %s: %w", path, err)
+	}
+	legacy := false
+	for _, entry := range c.entries {
+		if entry.PendingRelease {
+			entry.PendingRelease = false
+			entry.AddPendingRelease(Release{})
+			legacy = true
+		}
+	}
+	if legacy {
+		if err := c.persist(); err != nil {
+			return nil, fmt.Errorf("failed to rewrite ipam cache %s: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+func (c *fileCache) Get(namespace, name string) (*Entry, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.entries[Key(namespace, name)]
+	if !ok {
+		return nil, false
+	}
+	return entry.DeepCopy(), true
+}
+
+func (c *fileCache) Set(entry *Entry) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old, ok := c.entries[entry.Key()]
+	c.entries[entry.Key()] = entry.DeepCopy()
+	if err := c.persist(); err != nil {
+		if ok {
+			c.entries[entry.Key()] = old
+		} else {
+			delete(c.entries, entry.Key())
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *fileCache) Delete(namespace, name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := Key(namespace, name)
+	old, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, key)
+	if err := c.persist(); err != nil {
+		c.entries[key] = old
+		return err
+	}
+	return nil
+}
+
+func (c *fileCache) List() []*Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entries := make([]*Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry.DeepCopy())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key() < entries[j].Key()
+	})
+	return entries
+}
+
+// persist writes the entries, the cache file is never left half written.
+func (c *fileCache) persist() error {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(c.path, data, 0600)
+}
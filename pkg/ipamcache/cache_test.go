@@ -0,0 +1,130 @@
+package ipamcache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+)
+
+func TestFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fast", "ipam-cache.json")
+	c, err := NewFileCache(path)
+	if err != nil {
+		t.Fatalf("NewFileCache() error = %v", err)
+	}
+
+	entry := &Entry{
+		Namespace: "default",
+		Name:      "test",
+		Status: ipsv1alpha1.IpEndpointStatus{
+			UID:  "uid",
+			Node: "node1",
+			Allocations: []ipsv1alpha1.IPAllocationDetail{
+				{NIC: "eth0", Network: "fast", IPv4: "10.244.100.1", IPv4Pool: "default-ips"},
+				{NIC: "net1", Network: "fast", IPv4: "10.244.100.2", IPv4Pool: "default-ips"},
+			},
+		},
+	}
+	if err := c.Set(entry); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	// the entries returned do not share the status with the cache
+	cached, _ := c.Get("default", "test")
+	cached.Status.Allocations[0].IPv4 = "10.244.100.3"
+	if got, _ := c.Get("default", "test"); got.Status.Allocations[0].IPv4 != "10.244.100.1" {
+		t.Fatalf("Get() = %s, the cached entry was modified", got.Status.Allocations[0].IPv4)
+	}
+	if err := c.Set(&Entry{Namespace: "default", Name: "deleted"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := c.Delete("default", "deleted"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	// a new cache loads the entries persisted by the previous one
+	reloaded, err := NewFileCache(path)
+	if err != nil {
+		t.Fatalf("NewFileCache() error = %v", err)
+	}
+	got, ok := reloaded.Get("default", "test")
+	if !ok {
+		t.Fatalf("Get() entry not found")
+	}
+	if !reflect.DeepEqual(got.Status, entry.Status) {
+		t.Errorf("Get() = %v, want %v", got.Status, entry.Status)
+	}
+	if _, ok := reloaded.Get("default", "deleted"); ok {
+		t.Errorf("Get() deleted entry found")
+	}
+	if n := len(reloaded.List()); n != 1 {
+		t.Errorf("List() = %d entries, want 1", n)
+	}
+}
+
+func TestFileCacheLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam-cache.json")
+	legacy := `{"default/test":{"namespace":"default","name":"test","status":{"uid":"uid","node":"node1",` +
+		`"ips":{"interface":"eth0","network":"fast","ipv4":"10.244.100.1","ipv4Pool":"default-ips"}},"pendingRelease":true}}`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		// the legacy cache is rewritten when it is loaded the first time
+		c, err := NewFileCache(path)
+		if err != nil {
+			t.Fatalf("NewFileCache() error = %v", err)
+		}
+		got, ok := c.Get("default", "test")
+		if !ok {
+			t.Fatalf("Get() entry not found")
+		}
+		want := []ipsv1alpha1.IPAllocationDetail{{NIC: "eth0", Network: "fast", IPv4: "10.244.100.1", IPv4Pool: "default-ips"}}
+		if details := got.Status.Details(); !reflect.DeepEqual(details, want) {
+			t.Errorf("Details() = %v, want %v", details, want)
+		}
+		if got.PendingRelease || !reflect.DeepEqual(got.PendingReleases, []Release{{}}) {
+			t.Errorf("PendingReleases = %v, want the release of all the interfaces", got.PendingReleases)
+		}
+		if !got.Releasing("net1") {
+			t.Errorf("Releasing() = false, want true")
+		}
+	}
+}
+
+func TestPendingReleases(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pending-releases")
+	if releases, err := ListPendingReleases(dir); err != nil || len(releases) != 0 {
+		t.Fatalf("ListPendingReleases() = %v, %v, want none", releases, err)
+	}
+
+	release := &PendingRelease{Namespace: "default", Name: "test", UID: "uid", Release: Release{IfName: "eth0", ContainerID: "id"}}
+	if err := AddPendingRelease(dir, release); err != nil {
+		t.Fatalf("AddPendingRelease() error = %v", err)
+	}
+	// recording the release again is idempotent
+	if err := AddPendingRelease(dir, release); err != nil {
+		t.Fatalf("AddPendingRelease() error = %v", err)
+	}
+	// the release of another interface of the pod does not overwrite it
+	other := &PendingRelease{Namespace: "default", Name: "test", UID: "uid", Release: Release{IfName: "net1", ContainerID: "id"}}
+	if err := AddPendingRelease(dir, other); err != nil {
+		t.Fatalf("AddPendingRelease() error = %v", err)
+	}
+	releases, err := ListPendingReleases(dir)
+	if err != nil || len(releases) != 2 || *releases[0] != *release || *releases[1] != *other {
+		t.Fatalf("ListPendingReleases() = %v, %v, want %v, %v", releases, err, release, other)
+	}
+
+	for _, r := range []*PendingRelease{release, other, release} {
+		if err := RemovePendingRelease(dir, r); err != nil {
+			t.Fatalf("RemovePendingRelease() error = %v", err)
+		}
+	}
+	if releases, err := ListPendingReleases(dir); err != nil || len(releases) != 0 {
+		t.Errorf("ListPendingReleases() = %v, %v, want none", releases, err)
+	}
+}
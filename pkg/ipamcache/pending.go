@@ -0,0 +1,79 @@
+package ipamcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// DefaultPendingReleaseDir is where the CNI plugin records the releases it could not send to the agent
+const DefaultPendingReleaseDir = "/var/lib/fast/pending-releases"
+
+// PendingRelease is a release the CNI plugin could not send because the agent was unreachable,
+// the agent picks it up on its next reconciliation. The releases recorded before the interfaces
+// have no interface, they release all the interfaces of the pod.
+type PendingRelease struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+	Release   `json:",inline"`
+}
+
+// AddPendingRelease records the release of the pod in the dir
+func AddPendingRelease(dir string, release *PendingRelease) error {
+	data, err := json.Marshal(release)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(dir, pendingReleaseFile(release)), data, 0600)
+}
+
+// ListPendingReleases returns the releases recorded in the dir
+func ListPendingReleases(dir string) ([]*PendingRelease, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var releases []*PendingRelease
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		release := &PendingRelease{}
+		if err := json.Unmarshal(data, release); err != nil {
+			return nil, fmt.Errorf("failed to parse pending release %s: %w", file.Name(), err)
+		}
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+// RemovePendingRelease removes the release from the dir
+func RemovePendingRelease(dir string, release *PendingRelease) error {
+	err := os.Remove(filepath.Join(dir, pendingReleaseFile(release)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pendingReleaseFile returns the file name of the release, namespaces and pod names never contain
+// an underscore. The interface is part of the name so that the releases of the interfaces of a
+// pod do not overwrite each other.
+func pendingReleaseFile(release *PendingRelease) string {
+	if len(release.IfName) == 0 {
+		return fmt.Sprintf("%s_%s.json", release.Namespace, release.Name)
+	}
+	return fmt.Sprintf("%s_%s_%s.json", release.Namespace, release.Name, release.IfName)
+}
@@ -0,0 +1,203 @@
+package ipsmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrAllocateQueueFull is returned when the node already has too many allocations waiting.
+var ErrAllocateQueueFull = errors.New("too many allocations waiting on the node")
+
+// Allocator queues the allocations of the node per ips. The allocations waiting on the
+// same ips are coalesced into a single update of the ips, so that concurrent pods do
+// not conflict with each other, and the number of ips updates running at the same
+// time is bounded by the concurrency.
+type Allocator struct {
+	manager IpsManager
+
+	// sem bounds the number of ips updates running at the same time
+	sem chan struct{}
+	// maxPending bounds the number of allocations waiting on the node, 0 means no limit
+	maxPending int
+
+	lock sync.Mutex
+	// bound is signaled when the binds of an ips running in the background are done
+	bound   *sync.Cond
+	pending int
+	pools   map[string]*poolQueue
+	// warm is the warm pool of the node, it is nil when the warm pool is disabled
+	warm *warmPool
+}
+
+type poolQueue struct {
+	requests []*allocateRequest
+	binds    []*WarmBind
+	// binding are the binds running in the background
+	binding []*WarmBind
+	refill  bool
+	running bool
+}
+
+type allocateRequest struct {
+	ctx      context.Context
+	iface    *PodInterface
+	enqueued time.Time
+	done     chan allocateResponse
+}
+
+type allocateResponse struct {
+	result *AllocateResult
+	err    error
+}
+
+// NewAllocator returns an allocator running at most concurrency ips updates at the same time
+// and admitting at most maxPending waiting allocations.
+func NewAllocator(manager IpsManager, concurrency, maxPending int) *Allocator {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	RegisterMetrics()
+	a := &Allocator{
+		manager:    manager,
+		sem:        make(chan struct{}, concurrency),
+		maxPending: maxPending,
+		pools:      make(map[string]*poolQueue),
+	}
+	a.bound = sync.NewCond(&a.lock)
+	return a
+}
+
+// Allocate queues the allocation of the interface of the pod on the ips and waits for the result.
+// An interface asking for an address is never served by the warm pool.
+func (a *Allocator) Allocate(ctx context.Context, ipsName string, iface *PodInterface) (*AllocateResult, error) {
+	req := &allocateRequest{
+		ctx:      ctx,
+		iface:    iface,
+		enqueued: time.Now(),
+		done:     make(chan allocateResponse, 1),
+	}
+
+	a.lock.Lock()
+	if len(iface.IP) == 0 {
+		if result, ok := a.takeWarm(ipsName, iface); ok {
+			a.lock.Unlock()
+			return result, nil
+		}
+	}
+	if a.maxPending > 0 && a.pending >= a.maxPending {
+		a.lock.Unlock()
+		return nil, ErrAllocateQueueFull
+	}
+	a.pending++
+	queue := a.queue(ipsName)
+	queue.requests = append(queue.requests, req)
+	if a.warm != nil {
+		queue.refill = true
+	}
+	allocateQueueDepth.WithLabelValues(ipsName).Set(float64(len(queue.requests)))
+	a.lock.Unlock()
+
+	select {
+	case resp := <-req.done:
+		return resp.result, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// queue returns the queue of the ips and makes sure its worker is running, the lock must be held.
+func (a *Allocator) queue(ipsName string) *poolQueue {
+	queue, ok := a.pools[ipsName]
+	if !ok {
+		queue = &poolQueue{}
+		a.pools[ipsName] = queue
+	}
+	if !queue.running {
+		queue.running = true
+		go a.run(ipsName, queue)
+	}
+	return queue
+}
+
+// run processes the queue of the ips until it is empty, every round takes all the
+// waiting allocations as one batch, then binds and refills the warm addresses.
+func (a *Allocator) run(ipsName string, queue *poolQueue) {
+	for {
+		a.lock.Lock()
+		batch, binds, refill := queue.requests, queue.binds, queue.refill
+		queue.requests, queue.binds, queue.refill = nil, nil, false
+		queue.binding = binds
+		if len(batch) == 0 && len(binds) == 0 && !refill {
+			queue.running = false
+			delete(a.pools, ipsName)
+			a.lock.Unlock()
+			allocateQueueDepth.WithLabelValues(ipsName).Set(0)
+			return
+		}
+		a.lock.Unlock()
+		allocateQueueDepth.WithLabelValues(ipsName).Set(0)
+
+		a.sem <- struct{}{}
+		if len(batch) > 0 {
+			a.allocate(ipsName, batch)
+		}
+		if len(binds) > 0 {
+			a.bindWarm(ipsName, binds)
+			a.lock.Lock()
+			queue.binding = nil
+			a.bound.Broadcast()
+			a.lock.Unlock()
+		}
+		if refill {
+			a.refillWarm(ipsName)
+		}
+		<-a.sem
+
+		a.lock.Lock()
+		a.pending -= len(batch)
+		a.lock.Unlock()
+	}
+}
+
+func (a *Allocator) allocate(ipsName string, batch []*allocateRequest) {
+	now := time.Now()
+	ifaces := make([]*PodInterface, 0, len(batch))
+	requests := make([]*allocateRequest, 0, len(batch))
+	for _, req := range batch {
+		allocateWaitDuration.WithLabelValues(ipsName).Observe(now.Sub(req.enqueued).Seconds())
+		// the caller gave up, no ip is allocated for it
+		if req.ctx.Err() != nil {
+			req.done <- allocateResponse{err: req.ctx.Err()}
+			continue
+		}
+		ifaces = append(ifaces, req.iface)
+		requests = append(requests, req)
+	}
+	if len(requests) == 0 {
+		return
+	}
+	allocateBatchSize.WithLabelValues(ipsName).Observe(float64(len(requests)))
+
+	// the batch is not bound to the context of a single caller
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results, err := a.manager.AllocateIPs(ctx, ipsName, ifaces)
+	for i, req := range requests {
+		if err != nil {
+			req.done <- allocateResponse{err: err}
+			continue
+		}
+		if results[i] == nil && len(req.iface.IP) > 0 {
+			req.done <- allocateResponse{err: fmt.Errorf("failed to allocate IP %s from ips %s: %w", req.iface.IP, ipsName, ErrIPUnavailable)}
+			continue
+		}
+		if results[i] == nil {
+			req.done <- allocateResponse{err: fmt.Errorf("failed to allocate IP from ips %s: %w", ipsName, ErrIpsExhausted)}
+			continue
+		}
+		req.done <- allocateResponse{result: results[i]}
+	}
+}
@@ -0,0 +1,282 @@
+package ipsmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+	"github.com/fast-io/fast/pkg/generated/clientset/versioned/fake"
+)
+
+func TestAllocatorAllocate(t *testing.T) {
+	ips := &ipsv1alpha1.Ips{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+		Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.8"}},
+		Status:     ipsv1alpha1.IpsStatus{TotalIPCount: 8},
+	}
+	client := fake.NewSimpleClientset(ips)
+	allocator := NewAllocator(NewIpsManager(client), 2, 0)
+
+	const n = 10
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		allocated = make(map[string]string)
+		exhausted int
+	)
+	for i := 0; i < n; i++ {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      fmt.Sprintf("pod-%d", i),
+			UID:       types.UID(fmt.Sprintf("uid-%d", i)),
+		}}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := allocator.Allocate(context.Background(), IpsNameByPod(pod), &PodInterface{Pod: pod, Interface: DefaultInterface})
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				exhausted++
+				return
+			}
+			if other, ok := allocated[result.IP]; ok {
+				t.Errorf("Allocate() ip %s allocated to %s and %s", result.IP, other, pod.Name)
+			}
+			allocated[result.IP] = pod.Name
+		}()
+	}
+	wg.Wait()
+
+	if len(allocated) != 8 || exhausted != n-8 {
+		t.Errorf("Allocate() allocated %d ips, %d exhausted, want 8 and %d", len(allocated), exhausted, n-8)
+	}
+}
+
+func TestAllocatorWarmPool(t *testing.T) {
+	ips := &ipsv1alpha1.Ips{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+		Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.8"}},
+		Status:     ipsv1alpha1.IpsStatus{TotalIPCount: 8},
+	}
+	client := fake.NewSimpleClientset(ips)
+	manager := NewIpsManager(client)
+	allocator := NewAllocator(manager, 2, 0)
+	if err := allocator.EnableWarmPool(context.Background(), "node1", 2, []string{DefaultIpsName}, nil); err != nil {
+		t.Fatalf("EnableWarmPool() error = %v", err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		warm, err := manager.ListWarmIPs(context.Background(), "node1")
+		return len(warm[DefaultIpsName]) == 2, err
+	}); err != nil {
+		t.Fatalf("warm pool is not filled: %v", err)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "uid"},
+		Spec:       corev1.PodSpec{NodeName: "node1"},
+	}
+	result, err := allocator.Allocate(context.Background(), IpsNameByPod(pod), &PodInterface{Pod: pod, Interface: DefaultInterface})
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	// a retried allocation of the pod gets the same address
+	retried, err := allocator.Allocate(context.Background(), IpsNameByPod(pod), &PodInterface{Pod: pod, Interface: DefaultInterface})
+	if err != nil || retried.IP != result.IP {
+		t.Fatalf("Allocate() retried = %v, %v, want %s", retried, err, result.IP)
+	}
+	// another interface of the pod gets another address
+	secondary, err := allocator.Allocate(context.Background(), IpsNameByPod(pod), &PodInterface{Pod: pod, Interface: "net1"})
+	if err != nil || secondary.IP == result.IP {
+		t.Fatalf("Allocate() net1 = %v, %v, want an address other than %s", secondary, err, result.IP)
+	}
+
+	// the address is bound to the pod and the warm pool is refilled
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		got, err := client.SampleV1alpha1().Ipses().Get(context.Background(), DefaultIpsName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		warm := 0
+		for _, allocated := range got.Status.AllocatedIPs {
+			if IsWarm(allocated) {
+				warm++
+			}
+		}
+		return got.Status.AllocatedIPs[result.IP].PodUid == "uid" && warm == 2, nil
+	}); err != nil {
+		t.Fatalf("warm address is not bound: %v", err)
+	}
+
+	if err := manager.ReleaseWarmIPs(context.Background(), DefaultIpsName, "node1"); err != nil {
+		t.Fatalf("ReleaseWarmIPs() error = %v", err)
+	}
+	warm, err := manager.ListWarmIPs(context.Background(), "node1")
+	if err != nil || len(warm) != 0 {
+		t.Errorf("ListWarmIPs() = %v, %v, want none", warm, err)
+	}
+}
+
+func TestAllocatorRequestedIP(t *testing.T) {
+	ips := &ipsv1alpha1.Ips{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+		Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.2"}},
+		Status:     ipsv1alpha1.IpsStatus{TotalIPCount: 2},
+	}
+	allocator := NewAllocator(NewIpsManager(fake.NewSimpleClientset(ips)), 2, 0)
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)}}
+	}
+
+	cases := []struct {
+		pod     *corev1.Pod
+		ip      string
+		want    string
+		wantErr error
+	}{
+		{pod: newPod("pod-1"), ip: "10.244.100.2", want: "10.244.100.2"},
+		// a retry asking for the same address gets it again
+		{pod: newPod("pod-1"), ip: "10.244.100.2", want: "10.244.100.2"},
+		{pod: newPod("pod-1"), ip: "10.244.100.1", wantErr: ErrIPUnavailable},
+		{pod: newPod("pod-2"), ip: "10.244.100.2", wantErr: ErrIPUnavailable},
+		{pod: newPod("pod-2"), ip: "10.244.200.1", wantErr: ErrIPUnavailable},
+		// the requested address is not handed out to another pod
+		{pod: newPod("pod-2"), want: "10.244.100.1"},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			result, err := allocator.Allocate(context.Background(), DefaultIpsName, &PodInterface{Pod: c.pod, Interface: DefaultInterface, IP: c.ip})
+			if c.wantErr != nil {
+				if !errors.Is(err, c.wantErr) {
+					t.Fatalf("Allocate() error = %v, want %v", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil || result.IP != c.want {
+				t.Fatalf("Allocate() = %v, %v, want %s", result, err, c.want)
+			}
+		})
+	}
+}
+
+// blockingManager blocks the binds of the warm addresses until unblock is closed
+type blockingManager struct {
+	IpsManager
+	binding chan struct{}
+	unblock chan struct{}
+}
+
+func (m *blockingManager) BindWarmIPs(ctx context.Context, ipsName, node string, binds []*WarmBind) error {
+	m.binding <- struct{}{}
+	<-m.unblock
+	return m.IpsManager.BindWarmIPs(ctx, ipsName, node, binds)
+}
+
+func TestAllocatorWarmPoolForget(t *testing.T) {
+	ips := &ipsv1alpha1.Ips{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+		Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.8"}},
+		Status:     ipsv1alpha1.IpsStatus{TotalIPCount: 8},
+	}
+	client := fake.NewSimpleClientset(ips)
+	manager := &blockingManager{IpsManager: NewIpsManager(client), binding: make(chan struct{}, 2), unblock: make(chan struct{})}
+	allocator := NewAllocator(manager, 1, 0)
+	if err := allocator.EnableWarmPool(context.Background(), "node1", 2, []string{DefaultIpsName}, nil); err != nil {
+		t.Fatalf("EnableWarmPool() error = %v", err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		allocator.lock.Lock()
+		defer allocator.lock.Unlock()
+		return len(allocator.warm.available[DefaultIpsName]) == 2, nil
+	}); err != nil {
+		t.Fatalf("warm pool is not filled: %v", err)
+	}
+
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)},
+			Spec:       corev1.PodSpec{NodeName: "node1"},
+		}
+	}
+	running, err := allocator.Allocate(context.Background(), DefaultIpsName, &PodInterface{Pod: newPod("pod-1"), Interface: DefaultInterface})
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	<-manager.binding
+	// the bind of pod-2 waits behind the running bind of pod-1
+	queued, err := allocator.Allocate(context.Background(), DefaultIpsName, &PodInterface{Pod: newPod("pod-2"), Interface: DefaultInterface})
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	allocator.Forget("default", "pod-2", DefaultInterface)
+
+	forgotten := make(chan struct{})
+	go func() {
+		allocator.Forget("default", "pod-1", DefaultInterface)
+		close(forgotten)
+	}()
+	select {
+	case <-forgotten:
+		t.Fatalf("Forget() returned before the running bind landed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(manager.unblock)
+	<-forgotten
+
+	got, err := client.SampleV1alpha1().Ipses().Get(context.Background(), DefaultIpsName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if uid := got.Status.AllocatedIPs[running.IP].PodUid; uid != "pod-1" {
+		t.Errorf("ip %s is bound to %q, want pod-1", running.IP, uid)
+	}
+	if uid := got.Status.AllocatedIPs[queued.IP].PodUid; uid != "" {
+		t.Errorf("ip %s of the forgotten pod is bound to %q", queued.IP, uid)
+	}
+}
+
+func TestAllocatorWarmPoolHeld(t *testing.T) {
+	ips := &ipsv1alpha1.Ips{
+		ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+		Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.8"}},
+		Status: ipsv1alpha1.IpsStatus{
+			TotalIPCount: 8,
+			// the address was handed out before the restart, its bind did not land
+			AllocatedIPs: map[string]ipsv1alpha1.AllocatedPod{"10.244.100.1": {Node: "node1"}},
+		},
+	}
+	client := fake.NewSimpleClientset(ips)
+	allocator := NewAllocator(NewIpsManager(client), 1, 0)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "uid"},
+		Spec:       corev1.PodSpec{NodeName: "node1"},
+	}
+	held := map[string]*WarmBind{"10.244.100.1": {IP: "10.244.100.1", Pod: pod, Interface: DefaultInterface}}
+	if err := allocator.EnableWarmPool(context.Background(), "node1", 1, []string{DefaultIpsName}, held); err != nil {
+		t.Fatalf("EnableWarmPool() error = %v", err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		got, err := client.SampleV1alpha1().Ipses().Get(context.Background(), DefaultIpsName, metav1.GetOptions{})
+		return err == nil && got.Status.AllocatedIPs["10.244.100.1"].PodUid == "uid", err
+	}); err != nil {
+		t.Fatalf("held address is not bound: %v", err)
+	}
+
+	other := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other", UID: "other"},
+		Spec:       corev1.PodSpec{NodeName: "node1"},
+	}
+	result, err := allocator.Allocate(context.Background(), DefaultIpsName, &PodInterface{Pod: other, Interface: DefaultInterface})
+	if err != nil || result.IP == "10.244.100.1" {
+		t.Errorf("Allocate() = %v, %v, want an address other than the held one", result, err)
+	}
+}
@@ -2,12 +2,15 @@ package ipsmanager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
@@ -21,12 +24,26 @@ const (
 	IpsPodAnnotation    = "fast.io/ips"
 	DefaultIpsName      = "default-ips"
 	IPsManagerFinalizer = "fast.io/ips-manager"
+
+	// DefaultInterface is the interface of the pod on the default network of the cluster
+	DefaultInterface = ipsv1alpha1.DefaultInterface
 )
 
+// ErrIpsExhausted is returned when the ips has no free address left to allocate.
+var ErrIpsExhausted = errors.New("not enough ip addresses to allocate")
+
+// ErrIPUnavailable is returned when the requested address is out of the ips or held by another interface.
+var ErrIPUnavailable = errors.New("requested ip address is not available")
+
 type IpsManager interface {
 	AllocateIP(ctx context.Context, pod *corev1.Pod) (*AllocateResult, error)
-	ReleaseIP(ctx context.Context, namespace, name string) error
-	NewIpEndpoint(ipsName string, pod *corev1.Pod, ip string) (*ipsv1alpha1.IpEndpoint, error)
+	AllocateIPs(ctx context.Context, ipsName string, ifaces []*PodInterface) ([]*AllocateResult, error)
+	ReleaseIP(ctx context.Context, namespace, name string, release Release) error
+	ClaimWarmIPs(ctx context.Context, ipsName, node string, count int) ([]string, error)
+	BindWarmIPs(ctx context.Context, ipsName, node string, binds []*WarmBind) error
+	ReleaseWarmIPs(ctx context.Context, ipsName, node string) error
+	ListWarmIPs(ctx context.Context, node string) (map[string][]string, error)
+	NewIpEndpoint(pod *corev1.Pod, detail ipsv1alpha1.IPAllocationDetail) (*ipsv1alpha1.IpEndpoint, error)
 	CreateIpEndpoint(ctx context.Context, ipep *ipsv1alpha1.IpEndpoint) error
 }
 
@@ -37,67 +54,154 @@ type ipsManager struct {
 type AllocateResult struct {
 	Namespace string
 	Name      string
+	Interface string
 	IP        string
 	IPsName   string
 }
 
+// PodInterface is an interface of a pod asking for an address
+type PodInterface struct {
+	Pod       *corev1.Pod
+	Interface string
+	// IP is the address the runtime asks for, any free address is allocated when it is empty
+	IP string
+}
+
+// Release selects the allocations of a pod to release
+type Release struct {
+	// Interface is the interface released, all the interfaces are released when it is empty
+	Interface string
+	// Network is the network of the interface, the allocation of the interface on another
+	// network is kept. Any network matches when it is empty.
+	Network string
+	// ContainerID is the sandbox releasing, the allocations set up for another sandbox of
+	// the pod are kept. Any sandbox matches when it is empty.
+	ContainerID string
+}
+
+// Matches returns true if the allocation is released
+func (r Release) Matches(detail ipsv1alpha1.IPAllocationDetail) bool {
+	if len(r.Interface) > 0 && detail.NIC != r.Interface {
+		return false
+	}
+	if len(r.Network) > 0 && len(detail.Network) > 0 && detail.Network != r.Network {
+		return false
+	}
+	return detail.HeldBy(r.ContainerID)
+}
+
+// WarmBind binds a warm address of the node to an interface of a pod
+type WarmBind struct {
+	IP        string
+	Pod       *corev1.Pod
+	Interface string
+}
+
 func NewIpsManager(client ipsversioned.Interface) IpsManager {
 	return &ipsManager{client: client}
 }
 
 func (c *ipsManager) AllocateIP(ctx context.Context, pod *corev1.Pod) (*AllocateResult, error) {
-	ipsName := getIpsNameByPod(pod)
+	ipsName := IpsNameByPod(pod)
+	results, err := c.AllocateIPs(ctx, ipsName, []*PodInterface{{Pod: pod, Interface: DefaultInterface}})
+	if err != nil {
+		return nil, err
+	}
+	if results[0] == nil {
+		return nil, fmt.Errorf("failed to allocate IP from ips %s: %w", ipsName, ErrIpsExhausted)
+	}
+	return results[0], nil
+}
 
-	var res AllocateResult
+// AllocateIPs allocates an ip for every pod interface from the ips in a single update of the ips.
+// The result of an interface is nil when the ips has no address left for it, or when the address
+// it asks for is out of the ips or held by another interface. An interface which already holds an
+// address of the ips gets the same address again.
+func (c *ipsManager) AllocateIPs(ctx context.Context, ipsName string, ifaces []*PodInterface) ([]*AllocateResult, error) {
+	var results []*AllocateResult
 	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		results = make([]*AllocateResult, len(ifaces))
 		ips, err := c.client.SampleV1alpha1().Ipses().Get(ctx, ipsName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
 
-		if ips.Status.AllocatedIPCount >= ips.Status.TotalIPCount {
-			return fmt.Errorf("ips %s/%s not enough ip addresses to allocate", ips.Namespace, ips.Name)
+		if ips.Status.AllocatedIPs == nil {
+			ips.Status.AllocatedIPs = make(map[string]ipsv1alpha1.AllocatedPod)
 		}
-
-		allIps := make([]net.IP, 0)
-		for _, IP := range ips.Spec.IPs {
-			allIps = append(allIps, util.ParseIPRange(IP)...)
+		allocatedByPod := make(map[string]string, len(ips.Status.AllocatedIPs))
+		for ip, allocated := range ips.Status.AllocatedIPs {
+			if len(allocated.PodUid) > 0 {
+				allocatedByPod[interfaceKey(types.UID(allocated.PodUid), allocated.Interface)] = ip
+			}
 		}
 
-		excludeIps := make([]net.IP, 0)
-		for k := range ips.Status.AllocatedIPs {
-			excludeIps = append(excludeIps, net.ParseIP(k))
-		}
+		canAllocateIps := freeIPs(ips)
+		var requestable map[string]struct{}
 
-		canAllocateIps := util.ExcludeIPs(allIps, excludeIps)
-		if len(canAllocateIps) == 0 {
-			return fmt.Errorf("ips %s/%s not enough ip addresses to allocate", ips.Namespace, ips.Name)
-		}
-		ip := canAllocateIps[0]
+		changed := false
+		free := ips.Status.TotalIPCount - ips.Status.AllocatedIPCount
+		for i, iface := range ifaces {
+			pod := iface.Pod
+			if ip, ok := allocatedByPod[interfaceKey(pod.UID, iface.Interface)]; ok {
+				if len(iface.IP) == 0 || iface.IP == ip {
+					results[i] = &AllocateResult{Namespace: pod.Namespace, Name: pod.Name, Interface: iface.Interface, IPsName: ipsName, IP: ip}
+				}
+				continue
+			}
 
-		if ips.Status.AllocatedIPs == nil {
-			ips.Status.AllocatedIPs = make(map[string]ipsv1alpha1.AllocatedPod)
+			var ip string
+			if len(iface.IP) > 0 {
+				if requestable == nil {
+					requestable = make(map[string]struct{}, len(canAllocateIps))
+					for _, free := range canAllocateIps {
+						requestable[free.String()] = struct{}{}
+					}
+				}
+				if _, ok := requestable[iface.IP]; !ok || free <= 0 {
+					continue
+				}
+				delete(requestable, iface.IP)
+				ip = iface.IP
+			} else {
+				// the addresses asked for by the interfaces before are skipped
+				for len(canAllocateIps) > 0 && len(ip) == 0 {
+					if _, taken := ips.Status.AllocatedIPs[canAllocateIps[0].String()]; !taken {
+						ip = canAllocateIps[0].String()
+					}
+					canAllocateIps = canAllocateIps[1:]
+				}
+				if free <= 0 || len(ip) == 0 {
+					continue
+				}
+			}
+			free--
+
+			ips.Status.AllocatedIPs[ip] = allocatedPod(pod, iface.Interface)
+			// the interface may be asked for again in the same batch
+			allocatedByPod[interfaceKey(pod.UID, iface.Interface)] = ip
+			results[i] = &AllocateResult{Namespace: pod.Namespace, Name: pod.Name, Interface: iface.Interface, IPsName: ipsName, IP: ip}
+			changed = true
 		}
-		ips.Status.AllocatedIPs[ip.String()] = ipsv1alpha1.AllocatedPod{
-			Pod:    fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
-			PodUid: string(pod.UID),
+		if !changed {
+			return nil
 		}
 
 		if _, err := c.client.SampleV1alpha1().Ipses().UpdateStatus(ctx, ips, metav1.UpdateOptions{}); err != nil {
 			return err
 		}
-		res = AllocateResult{Namespace: pod.Namespace, Name: pod.Name, IPsName: ipsName, IP: ip.String()}
-
 		return nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to allocate IP from ips %s: %w", ipsName, err)
 	}
 
-	return &res, nil
+	return results, nil
 }
 
-func (c *ipsManager) ReleaseIP(ctx context.Context, namespace, name string) error {
+// ReleaseIP releases the addresses of the interfaces of the pod selected by the release. The ip
+// endpoint keeps the allocations of the other interfaces.
+func (c *ipsManager) ReleaseIP(ctx context.Context, namespace, name string, release Release) error {
 	ipep, err := c.client.SampleV1alpha1().IpEndpoints(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		if apierrors.IsNotFound(err) {
@@ -106,30 +210,182 @@ func (c *ipsManager) ReleaseIP(ctx context.Context, namespace, name string) erro
 		return err
 	}
 
-	releaseIP := ipep.Status.IPs.IPv4
-	ipsName := ipep.Status.IPs.IPv4Pool
-	if len(releaseIP) == 0 || len(ipsName) == 0 {
-		return fmt.Errorf("failed to get release IP(%s) or ips name(%s)", releaseIP, ipsName)
+	details := ipep.Status.Details()
+	var released []ipsv1alpha1.IPAllocationDetail
+	for _, detail := range details {
+		if release.Matches(detail) {
+			released = append(released, detail)
+		}
 	}
-	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+	// the interface was released before or belongs to another network or sandbox
+	if len(released) == 0 && len(details) > 0 {
+		return nil
+	}
+	for _, detail := range released {
+		releaseIP := detail.IPv4
+		ipsName := detail.IPv4Pool
+		if len(releaseIP) == 0 || len(ipsName) == 0 {
+			return fmt.Errorf("failed to get release IP(%s) or ips name(%s) of interface %s", releaseIP, ipsName, detail.NIC)
+		}
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			ips, err := c.client.SampleV1alpha1().Ipses().Get(ctx, ipsName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if _, ok := ips.Status.AllocatedIPs[releaseIP]; !ok {
+				return nil
+			}
+			delete(ips.Status.AllocatedIPs, releaseIP)
+
+			if _, err := c.client.SampleV1alpha1().Ipses().UpdateStatus(ctx, ips, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to release ip for ipe %s; %w", ipsName, err)
+		}
+	}
+
+	if len(released) < len(details) {
+		return c.removeIpEndpointAllocations(ctx, ipep, released)
+	}
+	return c.removeIpEndpointFinalizer(ctx, ipep)
+}
+
+// removeIpEndpointAllocations removes the released allocations from the ip endpoint
+func (c *ipsManager) removeIpEndpointAllocations(ctx context.Context, ipep *ipsv1alpha1.IpEndpoint, released []ipsv1alpha1.IPAllocationDetail) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		got, err := c.client.SampleV1alpha1().IpEndpoints(ipep.Namespace).Get(ctx, ipep.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, detail := range released {
+			got.Status.RemoveAllocation(detail.NIC)
+		}
+		_, err = c.client.SampleV1alpha1().IpEndpoints(ipep.Namespace).UpdateStatus(ctx, got, metav1.UpdateOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove released allocations from ip endpoint: %w", err)
+	}
+	return nil
+}
+
+// ClaimWarmIPs pre-claims up to count free addresses of the ips for the warm pool of the node,
+// the claimed addresses are recorded on the ips so that they are never allocated twice.
+func (c *ipsManager) ClaimWarmIPs(ctx context.Context, ipsName, node string, count int) ([]string, error) {
+	var claimed []string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		claimed = nil
 		ips, err := c.client.SampleV1alpha1().Ipses().Get(ctx, ipsName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
-		if _, ok := ips.Status.AllocatedIPs[releaseIP]; !ok {
+		if ips.Status.AllocatedIPs == nil {
+			ips.Status.AllocatedIPs = make(map[string]ipsv1alpha1.AllocatedPod)
+		}
+		for _, ip := range freeIPs(ips) {
+			if len(claimed) >= count {
+				break
+			}
+			ips.Status.AllocatedIPs[ip.String()] = ipsv1alpha1.AllocatedPod{Node: node}
+			claimed = append(claimed, ip.String())
+		}
+		if len(claimed) == 0 {
 			return nil
 		}
-		delete(ips.Status.AllocatedIPs, releaseIP)
+		_, err = c.client.SampleV1alpha1().Ipses().UpdateStatus(ctx, ips, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim warm IPs from ips %s: %w", ipsName, err)
+	}
+	return claimed, nil
+}
 
-		if _, err := c.client.SampleV1alpha1().Ipses().UpdateStatus(ctx, ips, metav1.UpdateOptions{}); err != nil {
+// BindWarmIPs binds the warm addresses of the node to the pods they were handed out to.
+// An address which was reclaimed in the meantime is bound again if it is still free.
+func (c *ipsManager) BindWarmIPs(ctx context.Context, ipsName, node string, binds []*WarmBind) error {
+	var errs []error
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		errs = nil
+		ips, err := c.client.SampleV1alpha1().Ipses().Get(ctx, ipsName, metav1.GetOptions{})
+		if err != nil {
 			return err
 		}
-		return nil
+		if ips.Status.AllocatedIPs == nil {
+			ips.Status.AllocatedIPs = make(map[string]ipsv1alpha1.AllocatedPod)
+		}
+		changed := false
+		for _, bind := range binds {
+			allocated, ok := ips.Status.AllocatedIPs[bind.IP]
+			if ok && interfaceKey(types.UID(allocated.PodUid), allocated.Interface) == interfaceKey(bind.Pod.UID, bind.Interface) {
+				continue
+			}
+			if ok && (len(allocated.Pod) > 0 || allocated.Node != node) {
+				errs = append(errs, fmt.Errorf("ip %s is already allocated to %s", bind.IP, allocated.Pod))
+				continue
+			}
+			ips.Status.AllocatedIPs[bind.IP] = allocatedPod(bind.Pod, bind.Interface)
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		_, err = c.client.SampleV1alpha1().Ipses().UpdateStatus(ctx, ips, metav1.UpdateOptions{})
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("failed to release ip for ipe %s; %w", ipsName, err)
+		return fmt.Errorf("failed to bind warm IPs of ips %s: %w", ipsName, err)
 	}
-	return c.removeIpEndpointFinalizer(ctx, ipep)
+	return utilerrors.NewAggregate(errs)
+}
+
+// ReleaseWarmIPs releases all the warm addresses of the ips held by the node
+func (c *ipsManager) ReleaseWarmIPs(ctx context.Context, ipsName, node string) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ips, err := c.client.SampleV1alpha1().Ipses().Get(ctx, ipsName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed := false
+		for ip, allocated := range ips.Status.AllocatedIPs {
+			if IsWarm(allocated) && allocated.Node == node {
+				delete(ips.Status.AllocatedIPs, ip)
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = c.client.SampleV1alpha1().Ipses().UpdateStatus(ctx, ips, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release warm IPs of ips %s: %w", ipsName, err)
+	}
+	return nil
+}
+
+// ListWarmIPs returns the warm addresses held by the node keyed by the ips name
+func (c *ipsManager) ListWarmIPs(ctx context.Context, node string) (map[string][]string, error) {
+	list, err := c.client.SampleV1alpha1().Ipses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	warm := make(map[string][]string)
+	for _, ips := range list.Items {
+		for ip, allocated := range ips.Status.AllocatedIPs {
+			if IsWarm(allocated) && allocated.Node == node {
+				warm[ips.Name] = append(warm[ips.Name], ip)
+			}
+		}
+	}
+	return warm, nil
 }
 
 func (c *ipsManager) removeIpEndpointFinalizer(ctx context.Context, ipep *ipsv1alpha1.IpEndpoint) error {
@@ -154,7 +410,7 @@ func (c *ipsManager) removeIpEndpointFinalizer(ctx context.Context, ipep *ipsv1a
 	return nil
 }
 
-func (c *ipsManager) NewIpEndpoint(ipsName string, pod *corev1.Pod, ip string) (*ipsv1alpha1.IpEndpoint, error) {
+func (c *ipsManager) NewIpEndpoint(pod *corev1.Pod, detail ipsv1alpha1.IPAllocationDetail) (*ipsv1alpha1.IpEndpoint, error) {
 	ipep := &ipsv1alpha1.IpEndpoint{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:       pod.Name,
@@ -164,18 +420,17 @@ func (c *ipsManager) NewIpEndpoint(ipsName string, pod *corev1.Pod, ip string) (
 		Status: ipsv1alpha1.IpEndpointStatus{
 			UID:  string(pod.UID),
 			Node: pod.Spec.NodeName,
-			IPs: ipsv1alpha1.IPAllocationDetail{
-				IPv4:     ip,
-				IPv4Pool: ipsName,
-			},
 		},
 	}
+	ipep.Status.SetAllocation(detail)
 	if err := controllerutil.SetOwnerReference(pod, ipep, scheme.Scheme); err != nil {
 		return nil, err
 	}
 	return ipep, nil
 }
 
+// CreateIpEndpoint creates the ip endpoint or adds its allocations to the existing one,
+// the allocations of the other interfaces of the pod are kept.
 func (c *ipsManager) CreateIpEndpoint(ctx context.Context, ipep *ipsv1alpha1.IpEndpoint) error {
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		var (
@@ -190,7 +445,18 @@ func (c *ipsManager) CreateIpEndpoint(ctx context.Context, ipep *ipsv1alpha1.IpE
 		} else if err != nil {
 			return err
 		}
+
+		status := ipep.Status.DeepCopy()
+		// the allocations of an old pod with the same name are dropped
+		if got.Status.UID == ipep.Status.UID {
+			merged := got.Status.DeepCopy()
+			for _, detail := range ipep.Status.Details() {
+				merged.SetAllocation(detail)
+			}
+			status.IPs, status.Allocations = merged.IPs, merged.Allocations
+		}
 		ipep.SetResourceVersion(got.GetResourceVersion())
+		ipep.Status = *status
 		if _, err := c.client.SampleV1alpha1().IpEndpoints(ipep.Namespace).UpdateStatus(ctx, ipep, metav1.UpdateOptions{}); err != nil {
 			return err
 		}
@@ -198,7 +464,45 @@ func (c *ipsManager) CreateIpEndpoint(ctx context.Context, ipep *ipsv1alpha1.IpE
 	})
 }
 
-func getIpsNameByPod(pod *corev1.Pod) string {
+// IsWarm returns true if the address is pre-claimed by the warm pool of a node
+func IsWarm(allocated ipsv1alpha1.AllocatedPod) bool {
+	return len(allocated.Pod) == 0 && len(allocated.Node) > 0
+}
+
+func allocatedPod(pod *corev1.Pod, nic string) ipsv1alpha1.AllocatedPod {
+	return ipsv1alpha1.AllocatedPod{
+		Pod:       fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
+		PodUid:    string(pod.UID),
+		Node:      pod.Spec.NodeName,
+		Interface: nic,
+	}
+}
+
+// interfaceKey returns the key of the interface of the pod, the addresses allocated before
+// the interface was recorded belong to the default interface.
+func interfaceKey(uid types.UID, nic string) string {
+	if len(nic) == 0 {
+		nic = DefaultInterface
+	}
+	return fmt.Sprintf("%s/%s", uid, nic)
+}
+
+// freeIPs returns the addresses of the ips which are neither allocated nor pre-claimed
+func freeIPs(ips *ipsv1alpha1.Ips) []net.IP {
+	allIps := make([]net.IP, 0)
+	for _, IP := range ips.Spec.IPs {
+		allIps = append(allIps, util.ParseIPRange(IP)...)
+	}
+
+	excludeIps := make([]net.IP, 0)
+	for k := range ips.Status.AllocatedIPs {
+		excludeIps = append(excludeIps, net.ParseIP(k))
+	}
+	return util.ExcludeIPs(allIps, excludeIps)
+}
+
+// IpsNameByPod returns the name of the ips the pod allocates from
+func IpsNameByPod(pod *corev1.Pod) string {
 	ipsName := pod.Annotations[IpsPodAnnotation]
 	if len(ipsName) == 0 {
 		ipsName = DefaultIpsName
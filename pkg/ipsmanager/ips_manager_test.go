@@ -0,0 +1,147 @@
+package ipsmanager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+	"github.com/fast-io/fast/pkg/generated/clientset/versioned/fake"
+)
+
+func TestIpsManagerAllocateIPs(t *testing.T) {
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)}}
+	}
+	pod1, pod2 := newPod("pod-1"), newPod("pod-2")
+
+	cases := []struct {
+		ifaces []*PodInterface
+		// want is the address of every interface, empty when the interface gets none
+		want      []string
+		allocated int
+	}{
+		{
+			ifaces:    []*PodInterface{{Pod: pod1, Interface: DefaultInterface}, {Pod: pod2, Interface: DefaultInterface}},
+			want:      []string{"10.244.100.1", "10.244.100.2"},
+			allocated: 2,
+		},
+		// an interface asked for twice in the batch gets one address
+		{
+			ifaces:    []*PodInterface{{Pod: pod1, Interface: DefaultInterface}, {Pod: pod1, Interface: DefaultInterface}},
+			want:      []string{"10.244.100.1", "10.244.100.1"},
+			allocated: 1,
+		},
+		{
+			ifaces:    []*PodInterface{{Pod: pod1, Interface: DefaultInterface}, {Pod: pod1, Interface: "net1"}, {Pod: pod1, Interface: "net1"}},
+			want:      []string{"10.244.100.1", "10.244.100.2", "10.244.100.2"},
+			allocated: 2,
+		},
+		{
+			ifaces:    []*PodInterface{{Pod: pod1, Interface: DefaultInterface, IP: "10.244.100.3"}, {Pod: pod1, Interface: DefaultInterface, IP: "10.244.100.4"}},
+			want:      []string{"10.244.100.3", ""},
+			allocated: 1,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			ips := &ipsv1alpha1.Ips{
+				ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+				Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.4"}},
+				Status:     ipsv1alpha1.IpsStatus{TotalIPCount: 4},
+			}
+			client := fake.NewSimpleClientset(ips)
+			results, err := NewIpsManager(client).AllocateIPs(context.Background(), DefaultIpsName, c.ifaces)
+			if err != nil {
+				t.Fatalf("AllocateIPs() error = %v", err)
+			}
+			for j, result := range results {
+				got := ""
+				if result != nil {
+					got = result.IP
+				}
+				if got != c.want[j] {
+					t.Errorf("AllocateIPs() interface %d = %q, want %q", j, got, c.want[j])
+				}
+			}
+			got, err := client.SampleV1alpha1().Ipses().Get(context.Background(), DefaultIpsName, metav1.GetOptions{})
+			if err != nil || len(got.Status.AllocatedIPs) != c.allocated {
+				t.Errorf("AllocateIPs() allocated %d addresses, %v, want %d", len(got.Status.AllocatedIPs), err, c.allocated)
+			}
+		})
+	}
+}
+
+func TestIpsManagerReleaseIP(t *testing.T) {
+	cases := []struct {
+		release     Release
+		holder      string
+		network     string
+		legacy      bool
+		wantRelease bool
+	}{
+		{release: Release{Interface: DefaultInterface, ContainerID: "sandbox-1"}, holder: "sandbox-1", wantRelease: true},
+		// a late release of an old sandbox keeps the allocation of the new one
+		{release: Release{Interface: DefaultInterface, ContainerID: "sandbox-1"}, holder: "sandbox-2", wantRelease: false},
+		{release: Release{Interface: DefaultInterface}, holder: "sandbox-2", wantRelease: true},
+		{release: Release{Interface: DefaultInterface, ContainerID: "sandbox-1"}, holder: "", wantRelease: true},
+		// the interface moved to another network
+		{release: Release{Interface: DefaultInterface, Network: "fast"}, network: "other", wantRelease: false},
+		{release: Release{Interface: DefaultInterface, Network: "fast"}, network: "fast", wantRelease: true},
+		{release: Release{Interface: DefaultInterface, Network: "fast"}, legacy: true, wantRelease: true},
+		// the release of another interface keeps the allocation of the default interface
+		{release: Release{Interface: "net1"}, wantRelease: false},
+		{release: Release{Interface: "net1"}, legacy: true, wantRelease: false},
+		{release: Release{}, legacy: true, wantRelease: true},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			ips := &ipsv1alpha1.Ips{
+				ObjectMeta: metav1.ObjectMeta{Name: DefaultIpsName},
+				Spec:       ipsv1alpha1.IpsSpec{IPs: []string{"10.244.100.1-10.244.100.4"}},
+				Status: ipsv1alpha1.IpsStatus{
+					TotalIPCount: 4,
+					AllocatedIPs: map[string]ipsv1alpha1.AllocatedPod{
+						"10.244.100.1": {Pod: "default/pod", PodUid: "uid", Interface: DefaultInterface},
+						"10.244.100.2": {Pod: "default/pod", PodUid: "uid", Interface: "net1"},
+					},
+				},
+			}
+			detail := ipsv1alpha1.IPAllocationDetail{NIC: DefaultInterface, Network: c.network, IPv4: "10.244.100.1", IPv4Pool: DefaultIpsName, ContainerID: c.holder}
+			ipep := &ipsv1alpha1.IpEndpoint{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"},
+				Status:     ipsv1alpha1.IpEndpointStatus{UID: "uid", IPs: detail},
+			}
+			if !c.legacy {
+				ipep.Status.SetAllocation(detail)
+				ipep.Status.SetAllocation(ipsv1alpha1.IPAllocationDetail{NIC: "net1", IPv4: "10.244.100.2", IPv4Pool: DefaultIpsName})
+			}
+			client := fake.NewSimpleClientset(ips, ipep)
+			if err := NewIpsManager(client).ReleaseIP(context.Background(), "default", "pod", c.release); err != nil {
+				t.Fatalf("ReleaseIP() error = %v", err)
+			}
+			got, err := client.SampleV1alpha1().Ipses().Get(context.Background(), DefaultIpsName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if _, held := got.Status.AllocatedIPs["10.244.100.1"]; held == c.wantRelease {
+				t.Errorf("ReleaseIP() released = %v, want %v", !held, c.wantRelease)
+			}
+			// the ip endpoint releasing its only allocation is left to its deletion
+			gotIpep, err := client.SampleV1alpha1().IpEndpoints("default").Get(context.Background(), "pod", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if c.legacy {
+				return
+			}
+			if held := gotIpep.Status.Allocation(DefaultInterface, "") != nil; held == c.wantRelease {
+				t.Errorf("ReleaseIP() kept allocation = %v, want %v", held, !c.wantRelease)
+			}
+		})
+	}
+}
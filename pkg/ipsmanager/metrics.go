@@ -0,0 +1,70 @@
+package ipsmanager
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "fast_agent"
+
+var (
+	// allocateQueueDepth is the number of allocations waiting in the queue of an ips
+	allocateQueueDepth = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "allocate_queue_depth",
+			Help:           "Number of allocations waiting in the queue of an ips.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ips"},
+	)
+
+	// allocateWaitDuration is the time an allocation waits in the queue before the ips is updated
+	allocateWaitDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "allocate_wait_duration_seconds",
+			Help:           "Time an allocation waits in the queue of an ips before it is processed.",
+			Buckets:        metrics.ExponentialBuckets(0.001, 2, 15),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ips"},
+	)
+
+	// allocateBatchSize is the number of allocations coalesced into one update of an ips
+	allocateBatchSize = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "allocate_batch_size",
+			Help:           "Number of allocations coalesced into a single update of an ips.",
+			Buckets:        metrics.ExponentialBuckets(1, 2, 8),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ips"},
+	)
+
+	// warmPoolAvailable is the number of warm addresses of an ips ready to be handed out
+	warmPoolAvailable = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "warm_pool_available",
+			Help:           "Number of warm addresses of an ips ready to be handed out.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"ips"},
+	)
+)
+
+var registerMetrics sync.Once
+
+// RegisterMetrics registers the allocation metrics
+func RegisterMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(allocateQueueDepth)
+		legacyregistry.MustRegister(allocateWaitDuration)
+		legacyregistry.MustRegister(allocateBatchSize)
+		legacyregistry.MustRegister(warmPoolAvailable)
+	})
+}
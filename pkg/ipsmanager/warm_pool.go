@@ -0,0 +1,225 @@
+package ipsmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// warmPool keeps addresses pre-claimed by the node on the ips, so that an allocation is
+// served without waiting for the apiserver. It is protected by the lock of the allocator.
+type warmPool struct {
+	node string
+	size int
+
+	// available are the warm addresses ready to be handed out, keyed by the ips name
+	available map[string][]string
+	// handedOut are the warm addresses handed out to pod interfaces keyed by namespace/name/interface,
+	// a retried allocation of the same interface gets the same address.
+	handedOut map[string]*handedOut
+	// unbound are the binds which failed, they are retried on the next refill
+	unbound map[string][]*WarmBind
+}
+
+type handedOut struct {
+	uid    types.UID
+	result *AllocateResult
+}
+
+// EnableWarmPool keeps size warm addresses of every ips used by the node. The warm addresses
+// already recorded for the node on the ips are adopted, the ipsNames are warmed up front.
+// The warm addresses in held, keyed by address, were handed out before the agent restarted
+// and their binds did not land, they are bound again instead of being adopted.
+func (a *Allocator) EnableWarmPool(ctx context.Context, node string, size int, ipsNames []string, held map[string]*WarmBind) error {
+	if size <= 0 {
+		return nil
+	}
+	warm, err := a.manager.ListWarmIPs(ctx, node)
+	if err != nil {
+		return fmt.Errorf("failed to list warm IPs of node %s: %w", node, err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.warm = &warmPool{
+		node:      node,
+		size:      size,
+		available: warm,
+		handedOut: make(map[string]*handedOut),
+		unbound:   make(map[string][]*WarmBind),
+	}
+	for _, ipsName := range ipsNames {
+		if _, ok := a.warm.available[ipsName]; !ok {
+			a.warm.available[ipsName] = nil
+		}
+	}
+	for ipsName, ips := range a.warm.available {
+		available := ips[:0]
+		var binds []*WarmBind
+		for _, ip := range ips {
+			if bind, ok := held[ip]; ok {
+				pod := bind.Pod
+				a.warm.handedOut[fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, bind.Interface)] = &handedOut{
+					uid:    pod.UID,
+					result: &AllocateResult{Namespace: pod.Namespace, Name: pod.Name, Interface: bind.Interface, IPsName: ipsName, IP: ip},
+				}
+				binds = append(binds, bind)
+				continue
+			}
+			available = append(available, ip)
+		}
+		a.warm.available[ipsName] = available
+		queue := a.queue(ipsName)
+		queue.binds = append(queue.binds, binds...)
+		queue.refill = true
+	}
+	return nil
+}
+
+// RefillWarmPools tops up the warm addresses of every ips used by the node and retries
+// the binds which failed.
+func (a *Allocator) RefillWarmPools(context.Context) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.warm == nil {
+		return
+	}
+	for ipsName := range a.warm.available {
+		queue := a.queue(ipsName)
+		queue.refill = true
+		queue.binds = append(queue.binds, a.warm.unbound[ipsName]...)
+		delete(a.warm.unbound, ipsName)
+	}
+}
+
+// Forget drops the warm address handed out to the interface of the pod, it is called before the
+// address is released. The addresses of all the interfaces are dropped when nic is empty. The
+// binds not run yet are dropped, a bind running in the background is waited for so that the
+// release comes after it.
+func (a *Allocator) Forget(namespace, name, nic string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.warm == nil {
+		return
+	}
+	var forgotten []*handedOut
+	for key, h := range a.warm.handedOut {
+		if h.result.Namespace != namespace || h.result.Name != name || (len(nic) > 0 && h.result.Interface != nic) {
+			continue
+		}
+		delete(a.warm.handedOut, key)
+		forgotten = append(forgotten, h)
+	}
+	for _, h := range forgotten {
+		ipsName := h.result.IPsName
+		for queue := a.pools[ipsName]; queue != nil && h.running(queue.binding); queue = a.pools[ipsName] {
+			a.bound.Wait()
+		}
+		if queue := a.pools[ipsName]; queue != nil {
+			queue.binds = h.drop(queue.binds)
+		}
+		a.warm.unbound[ipsName] = h.drop(a.warm.unbound[ipsName])
+	}
+}
+
+// owns returns true if the bind is the one of the handed out address
+func (h *handedOut) owns(bind *WarmBind) bool {
+	return bind.Pod.UID == h.uid && bind.Interface == h.result.Interface
+}
+
+// running returns true if the bind of the handed out address is one of the binds
+func (h *handedOut) running(binds []*WarmBind) bool {
+	for _, bind := range binds {
+		if h.owns(bind) {
+			return true
+		}
+	}
+	return false
+}
+
+// drop returns the binds without the one of the handed out address
+func (h *handedOut) drop(binds []*WarmBind) []*WarmBind {
+	var kept []*WarmBind
+	for _, bind := range binds {
+		if !h.owns(bind) {
+			kept = append(kept, bind)
+		}
+	}
+	return kept
+}
+
+// takeWarm hands out a warm address of the ips to the interface of the pod, the address is
+// bound to the interface on the ips in the background. The lock must be held.
+func (a *Allocator) takeWarm(ipsName string, iface *PodInterface) (*AllocateResult, bool) {
+	if a.warm == nil {
+		return nil, false
+	}
+	pod := iface.Pod
+	key := fmt.Sprintf("%s/%s/%s", pod.Namespace, pod.Name, iface.Interface)
+	if h, ok := a.warm.handedOut[key]; ok && h.uid == pod.UID {
+		return h.result, true
+	}
+
+	available, ok := a.warm.available[ipsName]
+	if !ok {
+		// the ips is warmed from now on
+		a.warm.available[ipsName] = nil
+	}
+	if len(available) == 0 {
+		return nil, false
+	}
+	ip := available[0]
+	a.warm.available[ipsName] = available[1:]
+	warmPoolAvailable.WithLabelValues(ipsName).Set(float64(len(available) - 1))
+
+	result := &AllocateResult{Namespace: pod.Namespace, Name: pod.Name, Interface: iface.Interface, IPsName: ipsName, IP: ip}
+	a.warm.handedOut[key] = &handedOut{uid: pod.UID, result: result}
+	queue := a.queue(ipsName)
+	queue.binds = append(queue.binds, &WarmBind{IP: ip, Pod: pod, Interface: iface.Interface})
+	queue.refill = true
+	return result, true
+}
+
+// bindWarm records the pods of the warm addresses handed out on the ips
+func (a *Allocator) bindWarm(ipsName string, binds []*WarmBind) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.manager.BindWarmIPs(ctx, ipsName, a.warm.node, binds); err != nil {
+		utilruntime.HandleError(err)
+		a.lock.Lock()
+		a.warm.unbound[ipsName] = append(a.warm.unbound[ipsName], binds...)
+		a.lock.Unlock()
+	}
+}
+
+// refillWarm claims addresses of the ips until the warm pool of the ips is full
+func (a *Allocator) refillWarm(ipsName string) {
+	a.lock.Lock()
+	need := a.warm.size - len(a.warm.available[ipsName])
+	a.lock.Unlock()
+	if need <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	claimed, err := a.manager.ClaimWarmIPs(ctx, ipsName, a.warm.node, need)
+	if err != nil {
+		utilruntime.HandleError(err)
+		if apierrors.IsNotFound(err) {
+			a.lock.Lock()
+			delete(a.warm.available, ipsName)
+			a.lock.Unlock()
+		}
+		return
+	}
+
+	a.lock.Lock()
+	a.warm.available[ipsName] = append(a.warm.available[ipsName], claimed...)
+	warmPoolAvailable.WithLabelValues(ipsName).Set(float64(len(a.warm.available[ipsName])))
+	a.lock.Unlock()
+}
@@ -0,0 +1,120 @@
+package nettools
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// latencyInMillis is the latency of the tbf qdisc, it is the one of the CNI bandwidth plugin
+const latencyInMillis = 25
+
+// LimitEgress limits the traffic sent by the link with a root tbf qdisc, the rate and burst are in bits.
+func LimitEgress(link netlink.Link, rateInBits, burstInBits uint64) error {
+	rate, burst := rateInBits/8, burstInBits/8
+	if rate == 0 || burst == 0 {
+		return fmt.Errorf("invalid egress rate %d and burst %d", rateInBits, burstInBits)
+	}
+	buffer := time2Tick(uint32(float64(burst) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rate)))
+	latency := float64(netlink.TIME_UNITS_PER_SEC) * (latencyInMillis / 1000.0)
+	limit := uint32(float64(rate)*latency/float64(netlink.TIME_UNITS_PER_SEC)) + buffer
+
+	return netlink.QdiscReplace(&netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Limit:  limit,
+		Rate:   rate,
+		Buffer: buffer,
+	})
+}
+
+// LimitIngress polices the traffic received by the link, the packets over the rate are dropped.
+// The rate and burst are in bits. The packets redirected to the peer of a veth by eBPF skip the
+// qdiscs of the veth, so the ingress of the pod interface is policed instead of shaping the veth.
+func LimitIngress(link netlink.Link, rateInBits, burstInBits uint64) error {
+	rate, burst := rateInBits/8, burstInBits/8
+	if rate == 0 || burst == 0 {
+		return fmt.Errorf("invalid ingress rate %d and burst %d", rateInBits, burstInBits)
+	}
+	if err := netlink.QdiscReplace(&netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}); err != nil {
+		return err
+	}
+
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(rate)
+	police.Burst = uint32(burst)
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	return netlink.FilterReplace(&netlink.MatchAll{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Handle:    1,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{police},
+	})
+}
+
+// EgressRate returns the rate in bytes of the root tbf qdisc of the link, 0 when the link is not shaped.
+func EgressRate(link netlink.Link) (uint64, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return 0, err
+	}
+	for _, qdisc := range qdiscs {
+		if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+			return tbf.Rate, nil
+		}
+	}
+	return 0, nil
+}
+
+// IngressRate returns the rate in bytes of the police action of the ingress of the link, 0 when
+// the link is not policed.
+func IngressRate(link netlink.Link) (uint64, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return 0, err
+	}
+	ingress := false
+	for _, qdisc := range qdiscs {
+		if _, ok := qdisc.(*netlink.Ingress); ok {
+			ingress = true
+			break
+		}
+	}
+	if !ingress {
+		return 0, nil
+	}
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return 0, err
+	}
+	for _, filter := range filters {
+		matchAll, ok := filter.(*netlink.MatchAll)
+		if !ok {
+			continue
+		}
+		for _, action := range matchAll.Actions {
+			if police, ok := action.(*netlink.PoliceAction); ok {
+				return uint64(police.Rate), nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+func time2Tick(time uint32) uint32 {
+	return uint32(float64(time) * netlink.TickInUsec())
+}
@@ -0,0 +1,72 @@
+package nettools
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// GeneveOverhead is the size of the outer ethernet, IPv4, UDP and Geneve headers and of the
+// option carrying the identity of the source pod
+const GeneveOverhead = 58
+
+// CreateGeneveAndUp creates the geneve device in external mode, the tunnel and the options of every packet are set
+// by the eBPF programs. The device listens on port, 0 is the default port of the kernel and accepts the port of an
+// existing device.
+func CreateGeneveAndUp(name string, port int) (*netlink.Geneve, error) {
+	l, _ := netlink.LinkByName(name)
+
+	geneve, ok := l.(*netlink.Geneve)
+	if ok && geneve != nil {
+		if port == 0 || int(geneve.Dport) == port {
+			return geneve, netlink.LinkSetUp(geneve)
+		}
+		// the port of a geneve device can not be changed
+		if err := netlink.LinkDel(geneve); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := addExternalGeneve(name, port); err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, err
+	}
+
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	geneve, ok = l.(*netlink.Geneve)
+	if !ok {
+		return nil, fmt.Errorf("found the device %q but it's not a geneve", name)
+	}
+	if err = netlink.LinkSetUp(geneve); err != nil {
+		return nil, fmt.Errorf("set up geneve %q error, err: %w", name, err)
+	}
+	return geneve, nil
+}
+
+// addExternalGeneve adds the geneve device in external mode, netlink ignores the port of a flow based geneve device
+// and sends the external flag out of the data of the link
+func addExternalGeneve(name string, port int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(name)))
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated("geneve"))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(nl.IFLA_GENEVE_COLLECT_METADATA, []byte{})
+	if port > 0 {
+		dport := make([]byte, 2)
+		binary.BigEndian.PutUint16(dport, uint16(port))
+		data.AddRtAttr(nl.IFLA_GENEVE_PORT, dport)
+	}
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
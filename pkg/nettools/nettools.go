@@ -2,13 +2,14 @@ package nettools
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 func RandomVethName() (string, error) {
@@ -65,36 +66,93 @@ func CreateVethPair(ifname string, mtu int, hostname ...string) (*netlink.Veth,
 }
 
 func CreateArpEntry(ip, mac, dev string) error {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("arp -s %s %s -i %s", ip, mac, dev),
-	)
-	_, err := processInfo.Output()
-	return err
+	neigh, err := arpEntry(ip, mac, dev)
+	if err != nil {
+		return err
+	}
+	return netlink.NeighSet(neigh)
 }
 
 func DeleteArpEntry(ip, dev string) error {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("arp -d %s -i %s", ip, dev),
-	)
-	_, err := processInfo.Output()
-	return err
+	neigh, err := arpEntry(ip, "", dev)
+	if err != nil {
+		return err
+	}
+	if err := netlink.NeighDel(neigh); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
 }
 
-func CreateVxlanAndUp(name string) (*netlink.Vxlan, error) {
+// ExistArpEntry returns true if the dev has a permanent arp entry of the ip with the mac
+func ExistArpEntry(ip, mac, dev string) bool {
+	want, err := arpEntry(ip, mac, dev)
+	if err != nil {
+		return false
+	}
+	neighs, err := netlink.NeighList(want.LinkIndex, netlink.FAMILY_V4)
+	if err != nil {
+		return false
+	}
+	for _, neigh := range neighs {
+		if neigh.IP.Equal(want.IP) && neigh.HardwareAddr.String() == want.HardwareAddr.String() &&
+			neigh.State&netlink.NUD_PERMANENT != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func arpEntry(ip, mac, dev string) (*netlink.Neigh, error) {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	neighIP := net.ParseIP(ip)
+	if neighIP == nil {
+		return nil, fmt.Errorf("invalid ip %q", ip)
+	}
+	neigh := &netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    netlink.FAMILY_V4,
+		State:     netlink.NUD_PERMANENT,
+		IP:        neighIP,
+	}
+	if len(mac) > 0 {
+		if neigh.HardwareAddr, err = net.ParseMAC(mac); err != nil {
+			return nil, err
+		}
+	}
+	return neigh, nil
+}
+
+const (
+	// VxlanDevName and GeneveDevName are the tunnel devices to the pods of the other nodes
+	VxlanDevName  = "fast_vxlan"
+	GeneveDevName = "fast_geneve"
+)
+
+// CreateVxlanAndUp creates the vxlan device in external mode, the tunnel of every packet is set by the eBPF programs.
+// The device listens on port, 0 is the default port of the kernel and accepts the port of an existing device.
+func CreateVxlanAndUp(name string, port int) (*netlink.Vxlan, error) {
 	l, _ := netlink.LinkByName(name)
 
 	vxlan, ok := l.(*netlink.Vxlan)
 	if ok && vxlan != nil {
-		return vxlan, nil
+		if port == 0 || vxlan.Port == port {
+			return vxlan, nil
+		}
+		// the port of a vxlan device can not be changed
+		if err := netlink.LinkDel(vxlan); err != nil {
+			return nil, err
+		}
 	}
 
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("ip link add name %s type vxlan external", name),
-	)
-	if _, err := processInfo.Output(); err != nil {
+	if err := netlink.LinkAdd(&netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		FlowBased: true,
+		Port:      port,
+	}); err != nil && !errors.Is(err, unix.EEXIST) {
 		return nil, err
 	}
 
@@ -127,3 +185,38 @@ func DeviceExistIp(link netlink.Link) (string, error) {
 	}
 	return "", nil
 }
+
+// VxlanOverhead is the size of the outer ethernet, IPv4, UDP and VXLAN headers
+const VxlanOverhead = 50
+
+// UnderlayMTU returns the MTU of the interface of the IPv4 default route
+func UnderlayMTU() (int, error) {
+	link, err := UnderlayLink()
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+// UnderlayLink returns the interface of the IPv4 default route
+func UnderlayLink() (netlink.Link, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.String() != "0.0.0.0/0" {
+			continue
+		}
+		return netlink.LinkByIndex(route.LinkIndex)
+	}
+	return nil, fmt.Errorf("no default route found")
+}
+
+// EnsureMTU sets the MTU of the link if it differs
+func EnsureMTU(link netlink.Link, mtu int) error {
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+	return netlink.LinkSetMTU(link, mtu)
+}
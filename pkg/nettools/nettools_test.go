@@ -0,0 +1,160 @@
+package nettools
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// withVeth runs f in a new netns with the veth dev, the test is skipped without the privileges
+// to create them or when the kernel does not support a device f creates
+func withVeth(t *testing.T, dev string, f func() error) {
+	t.Helper()
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skipf("failed to create netns: %v", err)
+	}
+	defer func() {
+		netns.Close()
+		_ = testutils.UnmountNS(netns)
+	}()
+	err = netns.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: dev}, PeerName: dev + "-peer"}); err != nil {
+			return err
+		}
+		return f()
+	})
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skipf("the kernel does not support the device: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArpEntry(t *testing.T) {
+	tests := []struct {
+		ip      string
+		macs    []string
+		wantErr bool
+	}{
+		{ip: "10.244.1.5", macs: []string{"02:00:00:00:00:01"}},
+		// the entry set again is replaced
+		{ip: "10.244.1.5", macs: []string{"02:00:00:00:00:01", "02:00:00:00:00:02"}},
+		{ip: "invalid", macs: []string{"02:00:00:00:00:01"}, wantErr: true},
+		{ip: "10.244.1.5", macs: []string{"invalid"}, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			withVeth(t, "veth0", func() error {
+				var mac string
+				for _, mac = range tt.macs {
+					err := CreateArpEntry(tt.ip, mac, "veth0")
+					if (err != nil) != tt.wantErr {
+						return fmt.Errorf("CreateArpEntry() error = %v, wantErr %v", err, tt.wantErr)
+					}
+					if err != nil {
+						return nil
+					}
+				}
+				if !ExistArpEntry(tt.ip, mac, "veth0") {
+					return fmt.Errorf("ExistArpEntry(%s, %s) = false, want true", tt.ip, mac)
+				}
+				if ExistArpEntry(tt.ip, "02:00:00:00:00:ff", "veth0") {
+					return fmt.Errorf("ExistArpEntry() of another mac = true, want false")
+				}
+				if err := DeleteArpEntry(tt.ip, "veth0"); err != nil {
+					return err
+				}
+				if ExistArpEntry(tt.ip, mac, "veth0") {
+					return fmt.Errorf("ExistArpEntry() after delete = true, want false")
+				}
+				// the entry deleted twice is not an error
+				return DeleteArpEntry(tt.ip, "veth0")
+			})
+		})
+	}
+}
+
+func TestCreateVxlanAndUp(t *testing.T) {
+	tests := []struct {
+		ports    []int
+		wantPort int
+	}{
+		{ports: []int{4789}, wantPort: 4789},
+		// the default port keeps the port of the device
+		{ports: []int{4789, 0}, wantPort: 4789},
+		// the device is recreated on another port
+		{ports: []int{4789, 8472}, wantPort: 8472},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			withVeth(t, "veth0", func() error {
+				var vxlan *netlink.Vxlan
+				for _, port := range tt.ports {
+					var err error
+					if vxlan, err = CreateVxlanAndUp(VxlanDevName, port); err != nil {
+						return fmt.Errorf("CreateVxlanAndUp() error = %w", err)
+					}
+				}
+				link, err := netlink.LinkByName(VxlanDevName)
+				if err != nil {
+					return err
+				}
+				got, ok := link.(*netlink.Vxlan)
+				if !ok || !got.FlowBased || got.Port != tt.wantPort || vxlan.Port != tt.wantPort {
+					return fmt.Errorf("vxlan device = %+v, want a flow based device on port %d", link, tt.wantPort)
+				}
+				if got.Attrs().Flags&net.FlagUp == 0 {
+					return fmt.Errorf("vxlan device is down")
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestCreateGeneveAndUp(t *testing.T) {
+	tests := []struct {
+		ports    []int
+		wantPort uint16
+	}{
+		{ports: []int{0}, wantPort: 6081},
+		{ports: []int{6081}, wantPort: 6081},
+		// the default port keeps the port of the device
+		{ports: []int{6082, 0}, wantPort: 6082},
+		// the device is recreated on another port
+		{ports: []int{6081, 6082}, wantPort: 6082},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			withVeth(t, "veth0", func() error {
+				var geneve *netlink.Geneve
+				for _, port := range tt.ports {
+					var err error
+					if geneve, err = CreateGeneveAndUp(GeneveDevName, port); err != nil {
+						return fmt.Errorf("CreateGeneveAndUp() error = %w", err)
+					}
+				}
+				link, err := netlink.LinkByName(GeneveDevName)
+				if err != nil {
+					return err
+				}
+				got, ok := link.(*netlink.Geneve)
+				if !ok || !got.FlowBased || got.Dport != tt.wantPort || geneve.Dport != tt.wantPort {
+					return fmt.Errorf("geneve device = %+v, want a flow based device on port %d", link, tt.wantPort)
+				}
+				if got.Attrs().Flags&net.FlagUp == 0 {
+					return fmt.Errorf("geneve device is down")
+				}
+				return nil
+			})
+		})
+	}
+}
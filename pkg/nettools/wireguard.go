@@ -0,0 +1,51 @@
+package nettools
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// WireguardDevName is the device the packets to the pods of the other nodes are encrypted by
+const WireguardDevName = "fast_wg"
+
+// WireguardOverhead is the size of the outer IPv4, UDP and WireGuard headers and of the
+// authentication tag, the device carries the packets without ethernet header
+const WireguardOverhead = 60
+
+// CreateWireguardAndUp creates the wireguard device, its key, port and peers are configured by the agent
+func CreateWireguardAndUp(name string) (*netlink.Wireguard, error) {
+	if err := netlink.LinkAdd(&netlink.Wireguard{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+	}); err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, err
+	}
+
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	wg, ok := l.(*netlink.Wireguard)
+	if !ok {
+		return nil, fmt.Errorf("found the device %q but it's not a wireguard", name)
+	}
+	if err = netlink.LinkSetUp(wg); err != nil {
+		return nil, fmt.Errorf("set up wireguard %q error, err: %w", name, err)
+	}
+	return wg, nil
+}
+
+// DeleteWireguard deletes the wireguard device unless it does not exist
+func DeleteWireguard(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(l)
+}
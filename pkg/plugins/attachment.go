@@ -0,0 +1,75 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// attachmentDir is where the plugin records the attachments it set up, GC compares
+// them with the attachments the runtime still knows about.
+const attachmentDir = "/var/lib/fast/attachments"
+
+// attachment is a pod interface set up by ADD
+type attachment struct {
+	ContainerID string   `json:"containerID"`
+	IfName      string   `json:"ifName"`
+	Namespace   string   `json:"namespace"`
+	Name        string   `json:"name"`
+	UID         string   `json:"uid,omitempty"`
+	Network     string   `json:"network,omitempty"`
+	Netns       string   `json:"netns,omitempty"`
+	HostVeth    string   `json:"hostVeth"`
+	IPs         []string `json:"ips,omitempty"`
+}
+
+func attachmentFile(containerID, ifName string) string {
+	return filepath.Join(attachmentDir, fmt.Sprintf("%s_%s.json", containerID, ifName))
+}
+
+func saveAttachment(a *attachment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(attachmentFile(a.ContainerID, a.IfName), data, 0600)
+}
+
+func listAttachments() ([]*attachment, error) {
+	files, err := os.ReadDir(attachmentDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var attachments []*attachment
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(attachmentDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		a := &attachment{}
+		if err := json.Unmarshal(data, a); err != nil {
+			logger.WithError(err).WithField("file", file.Name()).Warn("skip invalid attachment")
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+func removeAttachment(containerID, ifName string) error {
+	err := os.Remove(attachmentFile(containerID, ifName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
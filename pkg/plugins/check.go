@@ -0,0 +1,227 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/bpf/tc"
+	"github.com/fast-io/fast/pkg/nettools"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// checkPrevResult checks the addresses of the previous result are the addresses allocated to the pod
+func checkPrevResult(prevIPs []*current.IPConfig, ipamConf *ipamConfig) error {
+	for _, prev := range prevIPs {
+		found := false
+		for _, ipc := range ipamConf.IPs {
+			if prev.Address.IP.Equal(ipc.Address.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("address %s of the previous result is not allocated to the pod", prev.Address.String())
+		}
+	}
+	return nil
+}
+
+// checkNsInterface checks the interface of the pod netns has the allocated addresses, MAC and routes,
+// it returns the interface.
+func checkNsInterface(ifName string, ipamConf *ipamConfig) (*netlink.Veth, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s not found in netns: %w", ifName, err)
+	}
+	veth, ok := link.(*netlink.Veth)
+	if !ok {
+		return nil, fmt.Errorf("interface %s is a %s, want veth", ifName, link.Type())
+	}
+	if veth.Attrs().Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", ifName)
+	}
+	if veth.Attrs().MTU != ipamConf.MTU {
+		return nil, fmt.Errorf("interface %s has mtu %d, want %d", ifName, veth.Attrs().MTU, ipamConf.MTU)
+	}
+	if len(ipamConf.MAC) > 0 && veth.Attrs().HardwareAddr.String() != ipamConf.MAC.String() {
+		return nil, fmt.Errorf("interface %s has mac %s, want %s", ifName, veth.Attrs().HardwareAddr, ipamConf.MAC)
+	}
+
+	addrs, err := netlink.AddrList(veth, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface %s: %w", ifName, err)
+	}
+	for _, ipc := range ipamConf.IPs {
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == ipc.Address.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("interface %s has no address %s", ifName, ipc.Address.String())
+		}
+	}
+
+	routes, err := netlink.RouteList(veth, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes of interface %s: %w", ifName, err)
+	}
+	gwNet := &net.IPNet{IP: ipamConf.Gateway, Mask: net.CIDRMask(32, 32)}
+	if !hasRoute(routes, gwNet, nil) {
+		return nil, fmt.Errorf("interface %s has no route to gateway %s", ifName, ipamConf.Gateway)
+	}
+	for _, route := range ipamConf.Routes {
+		// the routes which are not IPv4 are skipped by ADD
+		if route.Dst.IP.To4() == nil || route.GW.To4() == nil {
+			continue
+		}
+		dst := route.Dst
+		if !hasRoute(routes, &dst, route.GW) {
+			return nil, fmt.Errorf("interface %s has no route to %s via %s", ifName, dst.String(), route.GW)
+		}
+	}
+	return veth, nil
+}
+
+// hasRoute returns true if a route to the dst via the gw exists, a nil gw matches a link route
+func hasRoute(routes []netlink.Route, dst *net.IPNet, gw net.IP) bool {
+	for _, route := range routes {
+		routeDst := route.Dst
+		if routeDst == nil {
+			routeDst = &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+		}
+		if routeDst.String() != dst.String() {
+			continue
+		}
+		if gw == nil || gw.Equal(route.Gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHostVeth checks the host side of the pod veth is the peer of the netns interface,
+// is up and has the veth_ingress program attached, it returns the host veth.
+func checkHostVeth(hostNs ns.NetNS, vethName string, nsVeth *netlink.Veth) (*netlink.Veth, error) {
+	peerIndex, err := netlink.VethPeerIndex(nsVeth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peer of interface %s: %w", nsVeth.Attrs().Name, err)
+	}
+
+	var hostVeth *netlink.Veth
+	err = hostNs.Do(func(ns.NetNS) error {
+		link, err := netlink.LinkByName(vethName)
+		if err != nil {
+			return fmt.Errorf("host veth %s not found: %w", vethName, err)
+		}
+		veth, ok := link.(*netlink.Veth)
+		if !ok {
+			return fmt.Errorf("host veth %s is a %s, want veth", vethName, link.Type())
+		}
+		if veth.Attrs().Index != peerIndex {
+			return fmt.Errorf("host veth %s has ifindex %d, the peer of interface %s is %d", vethName, veth.Attrs().Index, nsVeth.Attrs().Name, peerIndex)
+		}
+		if veth.Attrs().Flags&net.FlagUp == 0 {
+			return fmt.Errorf("host veth %s is down", vethName)
+		}
+		if !tc.ExistIngressBPF(vethName, tc.GetVethIngressPath()) {
+			return fmt.Errorf("host veth %s has no %s program attached to tc ingress", vethName, tc.GetVethIngressPath())
+		}
+		if !tc.ExistBPF(vethName, tc.EgressType, tc.GetVethEgressPath()) {
+			return fmt.Errorf("host veth %s has no %s program attached to tc egress", vethName, tc.GetVethEgressPath())
+		}
+		hostVeth = veth
+		return nil
+	})
+	return hostVeth, err
+}
+
+// checkLocalIPsMap checks the local_pod_ips entry of the pod matches the current ifindexes, MACs and tenant
+func checkLocalIPsMap(ip net.IP, vni uint32, hostVeth, nsVeth *netlink.Veth) error {
+	localIpsMap := bpfmap.GetLocalPodIpsMap()
+	if localIpsMap == nil {
+		return errors.New("failed to load eBPF map local_pod_ips")
+	}
+	var info bpfmap.LocalIpsMapInfo
+	if err := localIpsMap.Lookup(bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(ip.String())}, &info); err != nil {
+		return fmt.Errorf("local_pod_ips has no entry for %s: %w", ip, err)
+	}
+	want := bpfmap.LocalIpsMapInfo{
+		IfIndex:    uint32(nsVeth.Attrs().Index),
+		LxcIfIndex: uint32(hostVeth.Attrs().Index),
+		MAC:        util.Stuff8Byte(nsVeth.Attrs().HardwareAddr),
+		NodeMAC:    util.Stuff8Byte(hostVeth.Attrs().HardwareAddr),
+		Vni:        vni,
+	}
+	if info != want {
+		return fmt.Errorf("local_pod_ips entry of %s is {ifindex %d, lxc ifindex %d, mac %s, node mac %s, vni %d}, want {ifindex %d, lxc ifindex %d, mac %s, node mac %s, vni %d}",
+			ip, info.IfIndex, info.LxcIfIndex, util.Bytes2MacStr(info.MAC), util.Bytes2MacStr(info.NodeMAC), info.Vni,
+			want.IfIndex, want.LxcIfIndex, util.Bytes2MacStr(want.MAC), util.Bytes2MacStr(want.NodeMAC), want.Vni)
+	}
+	return nil
+}
+
+// checkBandwidth checks the interface of the pod is shaped and policed at the rates of the bandwidth
+// capability, the rates of the qdiscs are in bytes.
+func checkBandwidth(nsVeth *netlink.Veth, bandwidth *BandwidthEntry) error {
+	var wantEgress, wantIngress uint64
+	if bandwidth != nil {
+		wantEgress, wantIngress = bandwidth.EgressRate/8, bandwidth.IngressRate/8
+	}
+	name := nsVeth.Attrs().Name
+	egress, err := nettools.EgressRate(nsVeth)
+	if err != nil {
+		return fmt.Errorf("failed to get egress rate of interface %s: %w", name, err)
+	}
+	if egress != wantEgress {
+		return fmt.Errorf("interface %s has egress rate %d bits, want %d", name, egress*8, wantEgress*8)
+	}
+	ingress, err := nettools.IngressRate(nsVeth)
+	if err != nil {
+		return fmt.Errorf("failed to get ingress rate of interface %s: %w", name, err)
+	}
+	if ingress != wantIngress {
+		return fmt.Errorf("interface %s has ingress rate %d bits, want %d", name, ingress*8, wantIngress*8)
+	}
+	return nil
+}
+
+// checkHostPorts checks the host_ports entries of the port mappings translate to the pod
+func checkHostPorts(mappings []PortMapping, podIP net.IP) error {
+	if len(mappings) == 0 || podIP.To4() == nil {
+		return nil
+	}
+	hostPortsMap := bpfmap.GetHostPortsMap()
+	if hostPortsMap == nil {
+		return errors.New("failed to load eBPF map host_ports")
+	}
+	ip := util.InetIpToUInt32(podIP.String())
+	for _, m := range mappings {
+		protocol, err := portMappingProtocol(m.Protocol)
+		if err != nil {
+			return err
+		}
+		key := bpfmap.HostPortsMapKey{Port: uint16(m.HostPort), Protocol: protocol}
+		if len(m.HostIP) > 0 {
+			key.IP = util.InetIpToUInt32(net.ParseIP(m.HostIP).String())
+		}
+		var info bpfmap.HostPortsMapInfo
+		if err := hostPortsMap.Lookup(key, &info); err != nil {
+			return fmt.Errorf("host_ports has no entry for host port %s/%d: %w", m.Protocol, m.HostPort, err)
+		}
+		want := bpfmap.HostPortsMapInfo{IP: ip, Port: uint16(m.ContainerPort)}
+		if info != want {
+			return fmt.Errorf("host port %s/%d translates to %s:%d, want %s:%d", m.Protocol, m.HostPort,
+				util.InetUint32ToIp(info.IP), info.Port, podIP, m.ContainerPort)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package plugins
+
+import (
+	"net"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/vishvananda/netlink"
+)
+
+func TestHasRoute(t *testing.T) {
+	_, gwNet, _ := net.ParseCIDR("10.244.0.1/32")
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/16")
+	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+	gw := net.ParseIP("10.244.0.1")
+	routes := []netlink.Route{
+		{Dst: gwNet},
+		{Dst: subnet, Gw: gw},
+		// the default route has no dst
+		{Gw: gw},
+	}
+
+	tests := []struct {
+		name string
+		dst  *net.IPNet
+		gw   net.IP
+		want bool
+	}{
+		{name: "case 1", dst: gwNet, gw: nil, want: true},
+		{name: "case 2", dst: subnet, gw: gw, want: true},
+		{name: "case 3", dst: subnet, gw: net.ParseIP("10.244.0.2"), want: false},
+		{name: "case 4", dst: defNet, gw: gw, want: true},
+		{name: "case 5", dst: &net.IPNet{IP: net.ParseIP("172.16.0.0").To4(), Mask: net.CIDRMask(12, 32)}, gw: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasRoute(routes, tt.dst, tt.gw); got != tt.want {
+				t.Errorf("hasRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPrevResult(t *testing.T) {
+	ipConfig := func(cidr string) *current.IPConfig {
+		ip, ipNet, _ := net.ParseCIDR(cidr)
+		ipNet.IP = ip
+		return &current.IPConfig{Address: *ipNet}
+	}
+	ipamConf := &ipamConfig{IPs: []*current.IPConfig{ipConfig("10.244.0.10/16"), ipConfig("fd00::10/64")}}
+
+	tests := []struct {
+		name    string
+		prevIPs []*current.IPConfig
+		wantErr bool
+	}{
+		{name: "case 1", prevIPs: nil},
+		{name: "case 2", prevIPs: []*current.IPConfig{ipConfig("10.244.0.10/16")}},
+		{name: "case 3", prevIPs: []*current.IPConfig{ipConfig("10.244.0.10/16"), ipConfig("fd00::10/64")}},
+		{name: "case 4", prevIPs: []*current.IPConfig{ipConfig("10.244.0.11/16")}, wantErr: true},
+		{name: "case 5", prevIPs: []*current.IPConfig{ipConfig("10.244.0.10/16"), ipConfig("fd00::11/64")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPrevResult(tt.prevIPs, ipamConf); (err != nil) != tt.wantErr {
+				t.Errorf("checkPrevResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -15,3 +15,29 @@ type K8sArgs struct {
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString //revive:disable-line
 	K8S_POD_UID                types.UnmarshallableString //revive:disable-line
 }
+
+// RuntimeConfig is the runtime config of the capabilities fast advertises, the runtime
+// passes the values of the pod.
+type RuntimeConfig struct {
+	PortMappings []PortMapping   `json:"portMappings,omitempty"`
+	Bandwidth    *BandwidthEntry `json:"bandwidth,omitempty"`
+	// IPs are the addresses asked for the interface, with or without prefix
+	IPs []string `json:"ips,omitempty"`
+	Mac string   `json:"mac,omitempty"`
+}
+
+// PortMapping is a host port of the pod
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// BandwidthEntry is the rate limit of the pod, the rates and bursts are in bits
+type BandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
+}
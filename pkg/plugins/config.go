@@ -0,0 +1,97 @@
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAgentEndpoint  = "127.0.0.1:50051"
+	defaultDialTimeout    = 2 * time.Second
+	defaultRequestTimeout = 5 * time.Second
+)
+
+// the environment variables override the plugin config, they are meant for debugging
+const (
+	envAgentEndpoint  = "FAST_AGENT_ENDPOINT"
+	envDialTimeout    = "FAST_DIAL_TIMEOUT"
+	envRequestTimeout = "FAST_REQUEST_TIMEOUT"
+	envLogFile        = "FAST_LOG_FILE"
+	envLogLevel       = "FAST_LOG_LEVEL"
+)
+
+// complete applies the environment overrides and the defaults to the plugin config
+func (c *PluginConf) complete() error {
+	for env, field := range map[string]*string{
+		envAgentEndpoint:  &c.AgentEndpoint,
+		envDialTimeout:    &c.DialTimeout,
+		envRequestTimeout: &c.RequestTimeout,
+		envLogFile:        &c.LogFile,
+		envLogLevel:       &c.LogLevel,
+	} {
+		if val, ok := os.LookupEnv(env); ok && len(val) > 0 {
+			*field = val
+		}
+	}
+
+	if len(c.AgentEndpoint) == 0 {
+		c.AgentEndpoint = defaultAgentEndpoint
+	}
+	var err error
+	if c.dialTimeout, err = parseTimeout("dialTimeout", c.DialTimeout, defaultDialTimeout); err != nil {
+		return err
+	}
+	if c.requestTimeout, err = parseTimeout("requestTimeout", c.RequestTimeout, defaultRequestTimeout); err != nil {
+		return err
+	}
+	if err := c.completeRuntimeConfig(); err != nil {
+		return err
+	}
+	return setUpLogger(c.LogFile, c.LogLevel)
+}
+
+// agentTarget returns the grpc target of the agent endpoint, a path is a unix socket
+func (c *PluginConf) agentTarget() string {
+	if strings.HasPrefix(c.AgentEndpoint, "/") {
+		return "unix://" + c.AgentEndpoint
+	}
+	return c.AgentEndpoint
+}
+
+func parseTimeout(name, val string, def time.Duration) (time.Duration, error) {
+	if len(val) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", name, val)
+	}
+	return d, nil
+}
+
+// setUpLogger redirects the logger to the log file and sets the log level when they are configured
+func setUpLogger(logFile, logLevel string) error {
+	if len(logLevel) > 0 {
+		level, err := logrus.ParseLevel(logLevel)
+		if err != nil {
+			return fmt.Errorf("invalid logLevel %q: %w", logLevel, err)
+		}
+		logger.SetLevel(level)
+	}
+	if len(logFile) > 0 {
+		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.WithError(err).Warnf("failed to open log file %s, keep the current output", logFile)
+			return nil
+		}
+		logger.SetOutput(file)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package plugins
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPluginConfComplete(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        PluginConf
+		env         map[string]string
+		wantTarget  string
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "case 1", conf: PluginConf{}, wantTarget: "127.0.0.1:50051", wantTimeout: 5 * time.Second},
+		{name: "case 2", conf: PluginConf{AgentEndpoint: "/var/run/fast/agent.sock", RequestTimeout: "10s"}, wantTarget: "unix:///var/run/fast/agent.sock", wantTimeout: 10 * time.Second},
+		{name: "case 3", conf: PluginConf{AgentEndpoint: "127.0.0.1:50051"}, env: map[string]string{envAgentEndpoint: "127.0.0.1:50052", envRequestTimeout: "1s"}, wantTarget: "127.0.0.1:50052", wantTimeout: time.Second},
+		{name: "case 4", conf: PluginConf{DialTimeout: "-1s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			err := tt.conf.complete()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("complete() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := tt.conf.agentTarget(); got != tt.wantTarget {
+				t.Errorf("agentTarget() = %v, want %v", got, tt.wantTarget)
+			}
+			if tt.conf.requestTimeout != tt.wantTimeout {
+				t.Errorf("requestTimeout = %v, want %v", tt.conf.requestTimeout, tt.wantTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+)
+
+// allocateBackoff is used to retry transient agent errors, the whole retry
+// is still bounded by the context timeout of the CNI command.
+var allocateBackoff = wait.Backoff{
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+	Cap:      2 * time.Second,
+}
+
+// isTransient returns true if the agent error may succeed on retry
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// toCNIError converts an agent error to a CNI error, the agent message is kept
+// verbatim so that kubelet reports the real cause of the failure.
+func toCNIError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	code := types.ErrInternal
+	if isTransient(err) {
+		code = types.ErrTryAgainLater
+	}
+	return types.NewError(code, st.Message(), st.Code().String())
+}
+
+// allocateWithRetry checks the agent health and allocates an ip for the pod,
+// transient errors are retried with backoff until the context is done.
+func allocateWithRetry(ctx context.Context, client ipamapiv2.IpServiceClient, req *ipamapiv2.AllocateRequest) (*ipamapiv2.AllocateResponse, error) {
+	var (
+		resp    *ipamapiv2.AllocateResponse
+		lastErr error
+	)
+	err := wait.ExponentialBackoffWithContext(ctx, allocateBackoff, func(ctx context.Context) (bool, error) {
+		hresp, err := client.Health(ctx, &ipamapiv2.HealthRequest{})
+		if err == nil && !isHealthy(hresp.Health) {
+			err = status.Error(codes.Unavailable, "ipam service is unhealthy")
+		}
+		if err == nil {
+			resp, err = client.Allocate(ctx, req)
+		}
+		if err == nil {
+			return true, nil
+		}
+		lastErr = err
+		if isTransient(err) {
+			logger.WithError(err).WithFields(logrus.Fields{
+				"namespace": req.Namespace,
+				"name":      req.Name,
+			}).Warn("transient error to allocate ip, retrying")
+			return false, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		if lastErr != nil {
+			return nil, toCNIError(lastErr)
+		}
+		return nil, fmt.Errorf("failed to allocate ip: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,192 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/bpf/tc"
+)
+
+// errPluginNotAvailable is the well known error code of STATUS when the plugin can not serve ADD
+const errPluginNotAvailable uint = 50
+
+// cmdGC removes the attachments the runtime no longer knows about: their veth pair,
+// local_pod_ips entries and ip endpoint. The local_pod_ips entries pointing to a
+// deleted host veth are removed as well.
+func cmdGC(args *skel.CmdArgs) error {
+	pluginConfig, err := loadConfig(args.StdinData)
+	if err != nil {
+		logger.WithError(err).Error("failed to load plugin config")
+		return err
+	}
+
+	attachments, err := listAttachments()
+	if err != nil {
+		logger.WithError(err).Error("failed to list attachments")
+		return err
+	}
+	stale, superseded := staleAttachments(attachments, pluginConfig.ValidAttachments)
+	unlock, err := bpfmap.LockMaps()
+	if err != nil {
+		logger.WithError(err).Error("failed to lock eBPF maps")
+		return err
+	}
+	defer unlock()
+	var errs []error
+	for _, a := range superseded {
+		// the pod has a valid attachment of a newer sandbox sharing the host veth
+		logger.WithFields(logrus.Fields{
+			"ContainerID":  a.ContainerID,
+			"IfName":       a.IfName,
+			"PodNamespace": a.Namespace,
+			"PodName":      a.Name,
+		}).Info("drop stale attachment superseded by a valid one")
+		if err := removeAttachment(a.ContainerID, a.IfName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, a := range stale {
+		logger.WithFields(logrus.Fields{
+			"ContainerID":  a.ContainerID,
+			"IfName":       a.IfName,
+			"PodNamespace": a.Namespace,
+			"PodName":      a.Name,
+		}).Info("GC stale attachment")
+
+		var ips []net.IP
+		for _, ip := range a.IPs {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				ips = append(ips, parsed)
+			}
+		}
+		// the veth pair of a netns which is gone went away with it
+		if err := teardownPod(a.Netns, a.IfName, ips); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := releaseOrDefer(pluginConfig, &ipamapiv2.AllocateRequest{
+			Command:   "GC",
+			Id:        a.ContainerID,
+			IfName:    a.IfName,
+			Namespace: a.Namespace,
+			Name:      a.Name,
+			Uid:       a.UID,
+			Network:   a.Network,
+		}); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := removeAttachment(a.ContainerID, a.IfName); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := deleteOrphanLocalIPsMapEntries(); err != nil {
+		logger.WithError(err).Error("failed to delete orphan local ips map entries")
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// staleAttachments returns the attachments which are not valid. The stale attachments sharing the
+// host veth of a valid attachment are superseded, they must be neither torn down nor released. The
+// other stale attachments of an older sandbox of the pod are torn down and released, the agent
+// keeps the allocations held by the newer sandbox.
+func staleAttachments(attachments []*attachment, valid []types.GCAttachment) (stale, superseded []*attachment) {
+	validFiles := make(map[string]struct{}, len(valid))
+	for _, a := range valid {
+		validFiles[attachmentFile(a.ContainerID, a.IfName)] = struct{}{}
+	}
+	veths := make(map[string]struct{})
+	for _, a := range attachments {
+		if _, ok := validFiles[attachmentFile(a.ContainerID, a.IfName)]; ok {
+			veths[a.HostVeth] = struct{}{}
+		}
+	}
+	for _, a := range attachments {
+		if _, ok := validFiles[attachmentFile(a.ContainerID, a.IfName)]; ok {
+			continue
+		}
+		if _, sameVeth := veths[a.HostVeth]; sameVeth {
+			superseded = append(superseded, a)
+			continue
+		}
+		stale = append(stale, a)
+	}
+	return stale, superseded
+}
+
+// deleteOrphanLocalIPsMapEntries deletes the local_pod_ips entries whose host veth no longer exists
+func deleteOrphanLocalIPsMapEntries() error {
+	localIpsMap := bpfmap.GetLocalPodIpsMap()
+	if localIpsMap == nil {
+		return fmt.Errorf("failed to load eBPF map local_pod_ips")
+	}
+	var (
+		key    bpfmap.LocalIpsMapKey
+		info   bpfmap.LocalIpsMapInfo
+		orphan []bpfmap.LocalIpsMapKey
+	)
+	iter := localIpsMap.Iterate()
+	for iter.Next(&key, &info) {
+		if _, err := netlink.LinkByIndex(int(info.LxcIfIndex)); err != nil && isLinkNotFound(err) {
+			orphan = append(orphan, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range orphan {
+		if err := localIpsMap.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmdStatus reports whether the plugin can serve ADD: the agent is healthy and the eBPF maps and
+// programs are loaded
+func cmdStatus(args *skel.CmdArgs) error {
+	pluginConfig, err := loadConfig(args.StdinData)
+	if err != nil {
+		logger.WithError(err).Error("failed to load plugin config")
+		return err
+	}
+
+	if bpfmap.GetLocalPodIpsMap() == nil || bpfmap.GetClusterPodIpsMap() == nil || bpfmap.GetLocalDevMap() == nil {
+		return types.NewError(errPluginNotAvailable, "eBPF maps are not available", "the agent has not pinned the maps yet")
+	}
+	for _, program := range []string{tc.GetVethIngressPath(), tc.GetVethEgressPath(), tc.GetVxlanIngressPath(), tc.GetVxlanEgressPath(), tc.GetHostIngressPath(),
+		tc.GetGeneveIngressPath(), tc.GetGeneveEgressPath(), tc.GetWireguardIngressPath()} {
+		if _, err := os.Stat(program); err != nil {
+			return types.NewError(errPluginNotAvailable, "eBPF programs are not available", err.Error())
+		}
+	}
+
+	agentClient, conn, err := newAgentClient(pluginConfig)
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "agent is not available", err.Error())
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginConfig.requestTimeout)
+	defer cancel()
+	hresp, err := agentClient.Health(ctx, &ipamapiv2.HealthRequest{})
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "agent is not available", err.Error())
+	}
+	if !isHealthy(hresp.Health) {
+		return types.NewError(errPluginNotAvailable, "agent is unhealthy", hresp.Health.String())
+	}
+	return nil
+}
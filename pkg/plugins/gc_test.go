@@ -0,0 +1,49 @@
+package plugins
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestStaleAttachments(t *testing.T) {
+	live := &attachment{ContainerID: "new", IfName: "eth0", Namespace: "default", Name: "pod", HostVeth: "fast1"}
+	oldSandbox := &attachment{ContainerID: "old", IfName: "eth0", Namespace: "default", Name: "pod", HostVeth: "fast1"}
+	oldSecondary := &attachment{ContainerID: "old", IfName: "net1", Namespace: "default", Name: "pod", HostVeth: "fast2"}
+	liveSecondary := &attachment{ContainerID: "new", IfName: "net1", Namespace: "default", Name: "pod", HostVeth: "fast2"}
+	other := &attachment{ContainerID: "other", IfName: "eth0", Namespace: "default", Name: "other", HostVeth: "fast3"}
+	valid := []types.GCAttachment{{ContainerID: "new", IfName: "eth0"}}
+
+	tests := []struct {
+		name           string
+		attachments    []*attachment
+		valid          []types.GCAttachment
+		wantStale      []*attachment
+		wantSuperseded []*attachment
+	}{
+		{name: "case 1", attachments: []*attachment{live}, valid: valid},
+		{name: "case 2", attachments: []*attachment{live, other}, valid: valid, wantStale: []*attachment{other}},
+		{name: "case 3", attachments: []*attachment{live, oldSandbox}, valid: valid, wantSuperseded: []*attachment{oldSandbox}},
+		{name: "case 4", attachments: []*attachment{oldSandbox, other}, valid: nil, wantStale: []*attachment{oldSandbox, other}},
+		// the secondary interface the new sandbox did not add again is released
+		{name: "case 5", attachments: []*attachment{live, oldSandbox, oldSecondary}, valid: valid, wantStale: []*attachment{oldSecondary}, wantSuperseded: []*attachment{oldSandbox}},
+		{
+			name:           "case 6",
+			attachments:    []*attachment{live, liveSecondary, oldSandbox, oldSecondary},
+			valid:          append(valid, types.GCAttachment{ContainerID: "new", IfName: "net1"}),
+			wantSuperseded: []*attachment{oldSandbox, oldSecondary},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stale, superseded := staleAttachments(tt.attachments, tt.valid)
+			if !reflect.DeepEqual(stale, tt.wantStale) {
+				t.Errorf("staleAttachments() stale = %v, want %v", stale, tt.wantStale)
+			}
+			if !reflect.DeepEqual(superseded, tt.wantSuperseded) {
+				t.Errorf("staleAttachments() superseded = %v, want %v", superseded, tt.wantSuperseded)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/bpf/tc"
+	"github.com/fast-io/fast/pkg/nettools"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// setHostPorts saves the port mappings of the pod into the host_ports map and attaches host_ingress
+// to the underlay interface. The connections to the host ports coming from outside the node are
+// translated to the pod and back by the eBPF programs, no iptables rule is involved.
+func setHostPorts(mappings []PortMapping, podIP net.IP) error {
+	if len(mappings) == 0 || podIP.To4() == nil {
+		return nil
+	}
+	hostPortsMap := bpfmap.GetHostPortsMap()
+	localIpsMap := bpfmap.GetLocalPodIpsMap()
+	if hostPortsMap == nil || localIpsMap == nil {
+		return errors.New("failed to load eBPF map host_ports")
+	}
+
+	info := bpfmap.HostPortsMapInfo{IP: util.InetIpToUInt32(podIP.String())}
+	for _, m := range mappings {
+		protocol, err := portMappingProtocol(m.Protocol)
+		if err != nil {
+			return err
+		}
+		key := bpfmap.HostPortsMapKey{Port: uint16(m.HostPort), Protocol: protocol}
+		if len(m.HostIP) > 0 {
+			key.IP = util.InetIpToUInt32(net.ParseIP(m.HostIP).String())
+		}
+
+		// the host port may still point to a deleted pod, it is taken over then
+		var exist bpfmap.HostPortsMapInfo
+		if err := hostPortsMap.Lookup(key, &exist); err == nil && exist.IP != info.IP {
+			var ep bpfmap.LocalIpsMapInfo
+			if err := localIpsMap.Lookup(bpfmap.LocalIpsMapKey{IP: exist.IP}, &ep); err == nil {
+				return fmt.Errorf("host port %s/%d is used by pod %s", m.Protocol, m.HostPort, util.InetUint32ToIp(exist.IP))
+			}
+		}
+		info.Port = uint16(m.ContainerPort)
+		if err := hostPortsMap.Put(key, info); err != nil {
+			if bpfmap.IsMapFull(err) {
+				return fmt.Errorf("host_ports is full, raise --bpf-map-host-ports-max-entries of fast-agent: %w", err)
+			}
+			return err
+		}
+	}
+
+	link, err := nettools.UnderlayLink()
+	if err != nil {
+		return err
+	}
+	return tc.TryAttachBPF(link.Attrs().Name, tc.IngressType, tc.GetHostIngressPath())
+}
+
+// deleteHostPorts deletes the host ports of the pod addresses and their connections
+func deleteHostPorts(podIPs []net.IP) error {
+	ips := make(map[uint32]struct{}, len(podIPs))
+	for _, ip := range podIPs {
+		if ip.To4() != nil {
+			ips[util.InetIpToUInt32(ip.String())] = struct{}{}
+		}
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	hostPortsMap := bpfmap.GetHostPortsMap()
+	hostPortsCtMap := bpfmap.GetHostPortsCtMap()
+	if hostPortsMap == nil || hostPortsCtMap == nil {
+		return errors.New("failed to load eBPF map host_ports")
+	}
+
+	var (
+		key   bpfmap.HostPortsMapKey
+		info  bpfmap.HostPortsMapInfo
+		stale []bpfmap.HostPortsMapKey
+	)
+	iter := hostPortsMap.Iterate()
+	for iter.Next(&key, &info) {
+		if _, ok := ips[info.IP]; ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := hostPortsMap.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	var (
+		ctKey   bpfmap.HostPortsCtKey
+		staleCt []bpfmap.HostPortsCtKey
+	)
+	ctIter := hostPortsCtMap.Iterate()
+	for ctIter.Next(&ctKey, &info) {
+		if _, ok := ips[ctKey.PodIP]; ok {
+			staleCt = append(staleCt, ctKey)
+		}
+	}
+	if err := ctIter.Err(); err != nil {
+		return err
+	}
+	for _, key := range staleCt {
+		// the entry may be evicted meanwhile
+		_ = hostPortsCtMap.Delete(key)
+	}
+	return nil
+}
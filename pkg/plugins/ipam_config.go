@@ -0,0 +1,155 @@
+package plugins
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
+)
+
+// defaultPodMTU is used when the MTU of the underlay can not be detected
+const defaultPodMTU = 1450
+
+// ipamConfig is the interface configuration of the pod built from the Allocate response
+type ipamConfig struct {
+	IPs    []*current.IPConfig
+	Routes []*types.Route
+	DNS    types.DNS
+	MAC    net.HardwareAddr
+	// Vni is the tenant of the pod
+	Vni uint32
+
+	// MTU is the MTU of the pod interface, NodeMTU is the MTU of the fast devices of the node
+	MTU     int
+	NodeMTU int
+
+	// PodIP and Gateway are the IPv4 address and gateway used by the eBPF datapath
+	PodIP   net.IP
+	Gateway net.IP
+}
+
+// newIpamConfig parses the Allocate response, the gateway of the plugin config is used
+// when the ips does not define one. Only the default interface gets the default route.
+// The pod interface is a veth routed by eBPF, an ips with a VLAN is rejected as the
+// frames of the pod can not be tagged. The reserved vni would put the pod in the default tenant.
+func newIpamConfig(resp *ipamapiv2.AllocateResponse, conf *PluginConf, defaultRoute bool) (*ipamConfig, error) {
+	if resp.Vlan != 0 {
+		return nil, fmt.Errorf("vlan %d is not supported, the pod interface is a veth routed by eBPF", resp.Vlan)
+	}
+	if resp.Vni == ipsv1alpha1.ReservedVni {
+		return nil, fmt.Errorf("vni %d is reserved for the default tenant", resp.Vni)
+	}
+	c := &ipamConfig{
+		Vni:     resp.Vni,
+		NodeMTU: nodeMTU(conf),
+	}
+	c.MTU = podMTU(int(resp.Mtu), c.NodeMTU)
+	if len(resp.Mac) > 0 {
+		mac, err := net.ParseMAC(resp.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse mac %q: %w", resp.Mac, err)
+		}
+		c.MAC = mac
+	}
+
+	for _, ipc := range resp.Ips {
+		ip, ipNet, err := net.ParseCIDR(ipc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse address %q: %w", ipc.Address, err)
+		}
+		ipNet.IP = ip
+
+		gw := net.ParseIP(ipc.Gateway)
+		if ipc.Family == ipamapiv2.IPFamily_IPv4 {
+			if gw == nil {
+				gw = net.ParseIP(conf.Gateway)
+			}
+			if gw == nil {
+				return nil, fmt.Errorf("failed to get gateway ip, please setting for node")
+			}
+			c.PodIP = ip
+			c.Gateway = gw
+		}
+		c.IPs = append(c.IPs, &current.IPConfig{Address: *ipNet, Gateway: gw})
+	}
+	if c.PodIP == nil {
+		return nil, fmt.Errorf("no ipv4 address is allocated")
+	}
+
+	if defaultRoute {
+		_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+		c.Routes = append(c.Routes, &types.Route{Dst: *defNet, GW: c.Gateway})
+	}
+	for _, r := range resp.Routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse route %q: %w", r.Dst, err)
+		}
+		gw := net.ParseIP(r.Gateway)
+		if gw == nil {
+			gw = c.Gateway
+		}
+		c.Routes = append(c.Routes, &types.Route{Dst: *dst, GW: gw})
+	}
+
+	if resp.Dns != nil {
+		c.DNS = types.DNS{
+			Nameservers: resp.Dns.Nameservers,
+			Domain:      resp.Dns.Domain,
+			Search:      resp.Dns.Search,
+			Options:     resp.Dns.Options,
+		}
+	}
+	return c, nil
+}
+
+// result returns the CNI result of the pod, the interfaces and addresses of fast are appended
+// to the previous result when fast is chained after another plugin.
+func (c *ipamConfig) result(cniVersion string, prevResult *current.Result, interfaces ...*current.Interface) *current.Result {
+	result := &current.Result{CNIVersion: cniVersion}
+	if prevResult != nil {
+		result.Interfaces = append(result.Interfaces, prevResult.Interfaces...)
+		result.IPs = append(result.IPs, prevResult.IPs...)
+		result.Routes = append(result.Routes, prevResult.Routes...)
+		result.DNS = prevResult.DNS
+	}
+
+	// the pod interface is the last one
+	podIndex := len(result.Interfaces) + len(interfaces) - 1
+	result.Interfaces = append(result.Interfaces, interfaces...)
+	for _, ipc := range c.IPs {
+		copied := *ipc
+		copied.Interface = current.Int(podIndex)
+		result.IPs = append(result.IPs, &copied)
+	}
+	result.Routes = append(result.Routes, c.Routes...)
+	if len(result.DNS.Nameservers) == 0 {
+		result.DNS = c.DNS
+	}
+	return result
+}
+
+// interfaceIPs returns the addresses of the result on the interface of the sandbox, the
+// addresses without an interface index are kept as results of older versions have none.
+func interfaceIPs(result *current.Result, ifName, sandbox string) []*current.IPConfig {
+	var ips []*current.IPConfig
+	for _, ipc := range result.IPs {
+		if ipc.Interface == nil {
+			ips = append(ips, ipc)
+			continue
+		}
+		idx := *ipc.Interface
+		if idx < 0 || idx >= len(result.Interfaces) {
+			continue
+		}
+		iface := result.Interfaces[idx]
+		if iface.Name == ifName && (len(iface.Sandbox) == 0 || iface.Sandbox == sandbox) {
+			ips = append(ips, ipc)
+		}
+	}
+	return ips
+}
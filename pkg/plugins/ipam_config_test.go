@@ -0,0 +1,88 @@
+package plugins
+
+import (
+	"net"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+)
+
+func TestIpamConfigResult(t *testing.T) {
+	fastIP := &current.IPConfig{Address: net.IPNet{IP: net.ParseIP("10.244.0.10"), Mask: net.CIDRMask(32, 32)}}
+	prevIP := &current.IPConfig{
+		Interface: current.Int(0),
+		Address:   net.IPNet{IP: net.ParseIP("192.168.0.10"), Mask: net.CIDRMask(24, 32)},
+	}
+	c := &ipamConfig{IPs: []*current.IPConfig{fastIP}}
+	hostVeth := &current.Interface{Name: "veth1"}
+	podIface := &current.Interface{Name: "eth0", Sandbox: "/var/run/netns/pod"}
+
+	tests := []struct {
+		name       string
+		prevResult *current.Result
+		wantIfaces int
+		wantIndex  int
+	}{
+		{name: "case 1", prevResult: nil, wantIfaces: 2, wantIndex: 1},
+		{
+			name: "case 2",
+			prevResult: &current.Result{
+				Interfaces: []*current.Interface{{Name: "net1", Sandbox: "/var/run/netns/pod"}},
+				IPs:        []*current.IPConfig{prevIP},
+			},
+			wantIfaces: 3,
+			wantIndex:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.result("1.1.0", tt.prevResult, hostVeth, podIface)
+			if len(got.Interfaces) != tt.wantIfaces {
+				t.Fatalf("result() has %d interfaces, want %d", len(got.Interfaces), tt.wantIfaces)
+			}
+			ips := interfaceIPs(got, "eth0", "/var/run/netns/pod")
+			if len(ips) != 1 || !ips[0].Address.IP.Equal(fastIP.Address.IP) || *ips[0].Interface != tt.wantIndex {
+				t.Errorf("interfaceIPs() = %v, want %s on interface %d", ips, fastIP.Address.IP, tt.wantIndex)
+			}
+			if fastIP.Interface != nil {
+				t.Errorf("result() modified the ips of the ipam config")
+			}
+		})
+	}
+}
+
+func TestNewIpamConfig(t *testing.T) {
+	conf := &PluginConf{MTU: 1500}
+	ips := []*ipamapiv2.IPConfig{{Family: ipamapiv2.IPFamily_IPv4, Address: "10.244.0.10/16", Gateway: "10.244.0.1"}}
+
+	tests := []struct {
+		name       string
+		resp       *ipamapiv2.AllocateResponse
+		wantErr    bool
+		wantRoutes int
+	}{
+		{name: "case 1", resp: &ipamapiv2.AllocateResponse{Ips: ips}, wantRoutes: 1},
+		{name: "case 2", resp: &ipamapiv2.AllocateResponse{Ips: ips, Vlan: 100}, wantErr: true},
+		{
+			name:       "case 3",
+			resp:       &ipamapiv2.AllocateResponse{Ips: ips, Routes: []*ipamapiv2.Route{{Dst: "192.168.0.0/16"}}},
+			wantRoutes: 2,
+		},
+		{name: "case 4", resp: &ipamapiv2.AllocateResponse{}, wantErr: true},
+		{name: "case 5", resp: &ipamapiv2.AllocateResponse{Ips: ips, Vni: 13190}, wantErr: true},
+		{name: "case 6", resp: &ipamapiv2.AllocateResponse{Ips: ips, Vni: 100}, wantRoutes: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newIpamConfig(tt.resp, conf, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newIpamConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(got.Routes) != tt.wantRoutes {
+				t.Errorf("newIpamConfig() has %d routes, want %d", len(got.Routes), tt.wantRoutes)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package plugins
+
+import (
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/nettools"
+)
+
+// nodeMTU returns the MTU of the fast devices of the node: the MTU of the plugin config wins,
+// otherwise it is the MTU of the underlay minus the overhead of the tunnel.
+func nodeMTU(conf *PluginConf) int {
+	if conf.MTU > 0 {
+		return conf.MTU
+	}
+	underlay, err := nettools.UnderlayMTU()
+	if err != nil {
+		logger.WithError(err).Warnf("failed to detect underlay mtu, use %d", defaultPodMTU)
+		return defaultPodMTU
+	}
+	return tunnelMTU(underlay, nodeInfo())
+}
+
+// tunnelMTU returns the MTU of the underlay minus the overhead of the tunnel of the node. A node
+// encrypting sends the packets of its pods through wireguard whatever the routing. A node routing
+// natively tunnels the packets it has no route to the node of, so its devices leave room for the
+// overhead of the tunnel too rather than the tunnel dropping those packets.
+func tunnelMTU(underlay int, node bpfmap.NodeInfoValue) int {
+	if node.Encryption == bpfmap.EncryptionWireguard {
+		return underlay - nettools.WireguardOverhead
+	}
+	if node.Tunnel == bpfmap.TunnelGeneve {
+		return underlay - nettools.GeneveOverhead
+	}
+	return underlay - nettools.VxlanOverhead
+}
+
+// nodeInfo returns the routing mode, the tunnel and the encryption the agent recorded in node_info,
+// the zero value routes through vxlan in clear when the agent did not record them
+func nodeInfo() bpfmap.NodeInfoValue {
+	var node bpfmap.NodeInfoValue
+	nodeInfoMap := bpfmap.GetNodeInfoMap()
+	if nodeInfoMap == nil {
+		return node
+	}
+	if err := nodeInfoMap.Lookup(bpfmap.NodeInfoKey, &node); err != nil {
+		return bpfmap.NodeInfoValue{}
+	}
+	return node
+}
+
+// podMTU returns the MTU of the pod interface, the MTU of the ips may only lower the MTU
+// of the node as larger packets would be dropped by the tunnel.
+func podMTU(ipsMTU, nodeMTU int) int {
+	if ipsMTU <= 0 {
+		return nodeMTU
+	}
+	if ipsMTU > nodeMTU {
+		logger.Warnf("mtu %d of the ips exceeds the mtu %d of the node, use %d", ipsMTU, nodeMTU, nodeMTU)
+		return nodeMTU
+	}
+	return ipsMTU
+}
@@ -0,0 +1,49 @@
+package plugins
+
+import (
+	"fmt"
+	"testing"
+
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+)
+
+func TestTunnelMTU(t *testing.T) {
+	tests := []struct {
+		node bpfmap.NodeInfoValue
+		want int
+	}{
+		{node: bpfmap.NodeInfoValue{}, want: 1450},
+		{node: bpfmap.NodeInfoValue{Tunnel: bpfmap.TunnelGeneve}, want: 1442},
+		// the packets without a route to their node are tunneled
+		{node: bpfmap.NodeInfoValue{Routing: bpfmap.RoutingNative}, want: 1450},
+		{node: bpfmap.NodeInfoValue{Routing: bpfmap.RoutingNative, Tunnel: bpfmap.TunnelGeneve}, want: 1442},
+		{node: bpfmap.NodeInfoValue{Routing: bpfmap.RoutingNative, Encryption: bpfmap.EncryptionWireguard}, want: 1440},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			if got := tunnelMTU(1500, tt.node); got != tt.want {
+				t.Errorf("tunnelMTU() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodMTU(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipsMTU  int
+		nodeMTU int
+		want    int
+	}{
+		{name: "case 1", ipsMTU: 0, nodeMTU: 8950, want: 8950},
+		{name: "case 2", ipsMTU: 1400, nodeMTU: 1450, want: 1400},
+		{name: "case 3", ipsMTU: 1500, nodeMTU: 1450, want: 1450},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podMTU(tt.ipsMTU, tt.nodeMTU); got != tt.want {
+				t.Errorf("podMTU() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
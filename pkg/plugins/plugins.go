@@ -15,10 +15,14 @@ import (
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
-	ipamapiv1 "github.com/fast-io/fast/pkg/api/proto/v1"
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+	ipsv1alpha1 "github.com/fast-io/fast/pkg/apis/ips/v1alpha1"
 	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
 	"github.com/fast-io/fast/pkg/bpf/tc"
 	"github.com/fast-io/fast/pkg/nettools"
@@ -38,11 +42,28 @@ func init() {
 
 type PluginConf struct {
 	types.NetConf
-	RuntimeConfig *struct {
-		TestConfig map[string]interface{} `json:"testConfig"`
-	} `json:"runtimeConfig"`
+	// RuntimeConfig is the runtime config of the capabilities the plugin advertises
+	RuntimeConfig RuntimeConfig `json:"runtimeConfig,omitempty"`
+
 	Gateway string `json:"gateway"`
 	MTU     int    `json:"mtu"`
+	// Ips is the ips the addresses of the network are allocated from, the ips of the pod
+	// annotation is used when it is empty
+	Ips string `json:"ips,omitempty"`
+
+	// AgentEndpoint is the address of the agent, host:port or the path of a unix socket
+	AgentEndpoint string `json:"agentEndpoint,omitempty"`
+	// DialTimeout and RequestTimeout are durations such as "2s"
+	DialTimeout    string `json:"dialTimeout,omitempty"`
+	RequestTimeout string `json:"requestTimeout,omitempty"`
+	LogFile        string `json:"logFile,omitempty"`
+	LogLevel       string `json:"logLevel,omitempty"`
+
+	dialTimeout    time.Duration
+	requestTimeout time.Duration
+	// requestedIP and mac are parsed from the runtime config
+	requestedIP string
+	mac         net.HardwareAddr
 }
 
 func loadConfig(bytes []byte) (*PluginConf, error) {
@@ -50,28 +71,42 @@ func loadConfig(bytes []byte) (*PluginConf, error) {
 	if err := json.Unmarshal(bytes, &conf); err != nil {
 		return nil, err
 	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, err
+	}
+	if err := conf.complete(); err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
 
-func newAgentClient() (ipamapiv1.IpServiceClient, *grpc.ClientConn, error) {
-	conn, err := grpc.Dial(":50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+// newAgentClient dials the agent, an agent not reachable within the dial timeout is Unavailable
+func newAgentClient(conf *PluginConf) (ipamapiv2.IpServiceClient, *grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.dialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, conf.agentTarget(), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, status.Errorf(codes.Unavailable, "failed to dial agent %s: %v", conf.AgentEndpoint, err)
 	}
-	return ipamapiv1.NewIpServiceClient(conn), conn, nil
+	return ipamapiv2.NewIpServiceClient(conn), conn, nil
 }
 
-func isHealthy(health ipamapiv1.HealthyType) bool {
-	return health == ipamapiv1.HealthyType_Healthy
+func isHealthy(health ipamapiv2.HealthyType) bool {
+	return health == ipamapiv2.HealthyType_Healthy
 }
 
-func createHostVethPair() (*netlink.Veth, *netlink.Veth, error) {
+func createHostVethPair(mtu int) (*netlink.Veth, *netlink.Veth, error) {
 	hostVeth, _ := netlink.LinkByName(VethHostName)
 	netVeth, _ := netlink.LinkByName(VethNetName)
 	if hostVeth != nil && netVeth != nil {
+		for _, veth := range []netlink.Link{hostVeth, netVeth} {
+			if err := nettools.EnsureMTU(veth, mtu); err != nil {
+				return nil, nil, err
+			}
+		}
 		return hostVeth.(*netlink.Veth), netVeth.(*netlink.Veth), nil
 	}
-	return nettools.CreateVethPair(VethHostName, 1500, VethNetName)
+	return nettools.CreateVethPair(VethHostName, mtu, VethNetName)
 }
 
 func setUpVethPair(veth ...*netlink.Veth) error {
@@ -83,18 +118,33 @@ func setUpVethPair(veth ...*netlink.Veth) error {
 	return nil
 }
 
-func setIPForNsPair(nsPair *netlink.Veth, ip string) error {
-	ip32 := fmt.Sprintf("%s/%s", ip, "32")
-	ipAddr, ipNet, err := net.ParseCIDR(ip32)
+func setIPForNsPair(nsPair *netlink.Veth, ips []*current.IPConfig) error {
+	link, err := netlink.LinkByName(nsPair.Name)
 	if err != nil {
 		return err
 	}
-	ipNet.IP = ipAddr
+	for _, ipc := range ips {
+		// all traffic goes through the gateway, so no prefix route is added for the subnet
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ipc.Address.IP, Mask: ipc.Address.Mask}, Flags: unix.IFA_F_NOPREFIXROUTE}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setMacForNsPair(nsPair *netlink.Veth, mac net.HardwareAddr) (*netlink.Veth, error) {
+	if len(mac) == 0 {
+		return nsPair, nil
+	}
+	if err := netlink.LinkSetHardwareAddr(nsPair, mac); err != nil {
+		return nil, err
+	}
 	link, err := netlink.LinkByName(nsPair.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet})
+	return link.(*netlink.Veth), nil
 }
 
 func setIPForHostPair(gwPair *netlink.Veth, ip string) error {
@@ -123,12 +173,12 @@ func setHostPairIntoHost(veth *netlink.Veth, netNs ns.NetNS) error {
 	return netlink.LinkSetNsFd(veth, int(netNs.Fd()))
 }
 
-func setFibTableIntoNs(veth *netlink.Veth, gw string) error {
-	gwIp, gwNet, err := net.ParseCIDR(fmt.Sprintf("%s/32", gw))
+func setFibTableIntoNs(veth *netlink.Veth, gw net.IP, routes []*types.Route) error {
+	_, gwNet, err := net.ParseCIDR(fmt.Sprintf("%s/32", gw))
 	if err != nil {
 		return err
 	}
-	defIp, defNet, err := net.ParseCIDR("0.0.0.0/0")
+	defIp, _, err := net.ParseCIDR("0.0.0.0/0")
 	if err != nil {
 		return err
 	}
@@ -142,12 +192,23 @@ func setFibTableIntoNs(veth *netlink.Veth, gw string) error {
 		return err
 	}
 
-	return netlink.RouteAdd(&netlink.Route{
-		LinkIndex: veth.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       defNet,
-		Gw:        gwIp,
-	})
+	for _, route := range routes {
+		// the eBPF datapath routes IPv4 only
+		if route.Dst.IP.To4() == nil || route.GW.To4() == nil {
+			logger.WithField("route", route.String()).Warn("skip the route which is not IPv4")
+			continue
+		}
+		dst := route.Dst
+		if err := netlink.RouteAdd(&netlink.Route{
+			LinkIndex: veth.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       &dst,
+			Gw:        route.GW,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func setArp(gwIP string, hostNs ns.NetNS, veth *netlink.Veth, dev string) error {
@@ -176,7 +237,7 @@ func setUpHostPair(hostNs ns.NetNS, veth *netlink.Veth) error {
 	})
 }
 
-func setVethPairInfoToLocalIPsMap(hostNs ns.NetNS, podIP string, hostVeth, nsVeth *netlink.Veth) error {
+func setVethPairInfoToLocalIPsMap(hostNs ns.NetNS, ip net.IP, vni uint32, hostVeth, nsVeth *netlink.Veth) error {
 	err := hostNs.Do(func(nn ns.NetNS) error {
 		v, err := netlink.LinkByName(hostVeth.Attrs().Name)
 		if err != nil {
@@ -189,8 +250,8 @@ func setVethPairInfoToLocalIPsMap(hostNs ns.NetNS, podIP string, hostVeth, nsVet
 		return err
 	}
 
-	podIP = net.ParseIP(podIP).String()
-	if len(podIP) == 0 {
+	podIP := ip.String()
+	if ip.To4() == nil {
 		return nil
 	}
 
@@ -207,49 +268,104 @@ func setVethPairInfoToLocalIPsMap(hostNs ns.NetNS, podIP string, hostVeth, nsVet
 			LxcIfIndex: uint32(hostVeth.Attrs().Index),
 			MAC:        util.Stuff8Byte(([]byte)(nsVeth.Attrs().HardwareAddr)),
 			NodeMAC:    util.Stuff8Byte(([]byte)(hostVeth.Attrs().HardwareAddr)),
+			Vni:        vni,
 		}); err != nil {
 		logger.WithError(err).Error("failed set local pod ips to local_pod_ips eBPF map")
+		if bpfmap.IsMapFull(err) {
+			return fmt.Errorf("local_pod_ips is full, raise --bpf-map-local-pod-ips-max-entries of fast-agent: %w", err)
+		}
 		return err
 	}
 	return nil
 }
 
+// setBandwidth limits the traffic of the pod on its interface: the egress of the pod is shaped and
+// the ingress of the pod is policed.
+func setBandwidth(nsPair *netlink.Veth, bandwidth *BandwidthEntry) error {
+	if bandwidth == nil {
+		return nil
+	}
+	if bandwidth.EgressRate > 0 {
+		if err := nettools.LimitEgress(nsPair, bandwidth.EgressRate, bandwidth.EgressBurst); err != nil {
+			return err
+		}
+	}
+	if bandwidth.IngressRate > 0 {
+		if err := nettools.LimitIngress(nsPair, bandwidth.IngressRate, bandwidth.IngressBurst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func attachTcBPFIntoVeth(veth *netlink.Veth) error {
 	name := veth.Attrs().Name
 	vethIngressBPFPath := tc.GetVethIngressPath()
-	return tc.TryAttachBPF(name, tc.IngressType, vethIngressBPFPath)
+	if err := tc.TryAttachBPF(name, tc.IngressType, vethIngressBPFPath); err != nil {
+		return err
+	}
+	vethEgressBPFPath := tc.GetVethEgressPath()
+	return tc.TryAttachBPF(name, tc.EgressType, vethEgressBPFPath)
+}
+
+// tunnel is the tunnel device of the node and the programs attached to it
+type tunnel struct {
+	link    netlink.Link
+	devType bpfmap.LocalDevType
+	ingress string
+	egress  string
+}
+
+// tunnelDevice returns the device of the tunnel type, the vxlan device is created when the agent
+// did not create it
+func tunnelDevice(tunnelType bpfmap.TunnelType) (*tunnel, error) {
+	if tunnelType == bpfmap.TunnelGeneve {
+		link, err := netlink.LinkByName(nettools.GeneveDevName)
+		if err != nil {
+			return nil, fmt.Errorf("the geneve device %s is created by the agent: %w", nettools.GeneveDevName, err)
+		}
+		return &tunnel{link: link, devType: bpfmap.GeneveDevType, ingress: tc.GetGeneveIngressPath(), egress: tc.GetGeneveEgressPath()}, nil
+	}
+	vxlan, err := nettools.CreateVxlanAndUp(nettools.VxlanDevName, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &tunnel{link: vxlan, devType: bpfmap.VxlanDevType, ingress: tc.GetVxlanIngressPath(), egress: tc.GetVxlanEgressPath()}, nil
 }
 
-func setVxlanInfoToLocalDevMap(vxlan *netlink.Vxlan) error {
+func setTunnelInfoToLocalDevMap(t *tunnel) error {
 	localDevMap := bpfmap.GetLocalDevMap()
 	if localDevMap == nil {
 		return fmt.Errorf("failed to load eBPF map")
 	}
-	return localDevMap.Put(bpfmap.LocalDevMapKey{Type: bpfmap.VxlanDevType}, bpfmap.LocalDevMapValue{IfIndex: uint32(vxlan.Attrs().Index)})
+	return localDevMap.Put(bpfmap.LocalDevMapKey{Type: t.devType}, bpfmap.LocalDevMapValue{IfIndex: uint32(t.link.Attrs().Index)})
 }
 
-func attachTcBPFIntoVxlan(vxlan *netlink.Vxlan) error {
-	name := vxlan.Attrs().Name
-	vxlanIngressBPFPath := tc.GetVxlanIngressPath()
-	err := tc.TryAttachBPF(name, tc.IngressType, vxlanIngressBPFPath)
-	if err != nil {
+func attachTcBPFIntoTunnel(t *tunnel) error {
+	name := t.link.Attrs().Name
+	if err := tc.TryAttachBPF(name, tc.IngressType, t.ingress); err != nil {
 		return err
 	}
-	vxlanEgressBPFPath := tc.GetVxlanEgressPath()
-	return tc.TryAttachBPF(name, tc.EgressType, vxlanEgressBPFPath)
+	return tc.TryAttachBPF(name, tc.EgressType, t.egress)
 }
 
 /*
  * tc qdisc add dev ${pod veth name} clsact
  * tc qdisc add dev fast_vxlan clsact
- * clang -g  -O2 -emit-llvm -c vxlan_egress.c -o - | llc -march=bpf -filetype=obj -o vxlan_egress.o
- * clang -g  -O2 -emit-llvm -c vxlan_ingress.c -o - | llc -march=bpf -filetype=obj -o vxlan_ingress.o
- * clang -g  -O2 -emit-llvm -c veth_ingress.c -o - | llc -march=bpf -filetype=obj -o veth_ingress.o
- * tc filter add dev fast_vxlan egress bpf direct-action obj vxlan_egress.o
- * tc filter add dev fast_vxlan ingress bpf direct-action obj vxlan_ingress.o
- * tc filter add dev ${pod veth name} ingress bpf direct-action obj veth_ingress.o
+ * tc filter add dev fast_vxlan egress bpf direct-action pinned /sys/fs/bpf/fast/vxlan_egress
+ * tc filter add dev fast_vxlan ingress bpf direct-action pinned /sys/fs/bpf/fast/vxlan_ingress
+ *   (fast_geneve with geneve_egress and geneve_ingress when the tunnel type of the agent is geneve)
+ * tc filter add dev ${pod veth name} ingress bpf direct-action pinned /sys/fs/bpf/fast/veth_ingress
+ * tc filter add dev ${pod veth name} egress bpf direct-action pinned /sys/fs/bpf/fast/veth_egress
+ * tc filter add dev ${underlay dev} ingress bpf direct-action pinned /sys/fs/bpf/fast/host_ingress (pods with host ports)
+ * tc filter add dev fast_wg ingress bpf direct-action pinned /sys/fs/bpf/fast/wireguard_ingress (nodes encrypting)
+ *
+ * The programs are pinned by the agent, the agent also attaches host_ingress when it starts.
+ *
+ * Every step registers its undo, they are run when a later step fails. A retry of ADD
+ * for the same pod removes what an interrupted ADD left and sets the pod up again.
  */
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	pluginConfig, err := loadConfig(args.StdinData)
 	if err != nil {
 		logger.WithError(err).Error("failed to load plugin config")
@@ -274,48 +390,89 @@ func cmdAdd(args *skel.CmdArgs) error {
 		"PodUid":       string(k8sArgs.K8S_POD_UID),
 	}).Info("ADD")
 
-	agentClient, conn, err := newAgentClient()
+	// fast may be chained after another plugin, its interface must not be taken yet
+	var prevResult *current.Result
+	if pluginConfig.PrevResult != nil {
+		prevResult, err = current.NewResultFromResult(pluginConfig.PrevResult)
+		if err != nil {
+			logger.WithError(err).Error("failed to convert previous result")
+			return err
+		}
+		for _, iface := range prevResult.Interfaces {
+			if iface.Name == args.IfName && iface.Sandbox == args.Netns {
+				return fmt.Errorf("interface %s is already set up by a previous plugin", args.IfName)
+			}
+		}
+	}
+
+	agentClient, conn, err := newAgentClient(pluginConfig)
 	if err != nil {
 		logger.WithError(err).Error("failed to new agent client")
-		return err
+		return toCNIError(err)
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), pluginConfig.requestTimeout)
 	defer cancel()
 
-	hresp, err := agentClient.Health(ctx, &ipamapiv1.HealthRequest{})
-	if err != nil {
-		return err
-	}
-	if !isHealthy(hresp.Health) {
-		return fmt.Errorf("ipam svervice is unhealthy")
-	}
+	rb := &rollback{}
+	unlock := func() {}
+	defer func() {
+		if err != nil {
+			rb.run()
+		}
+		unlock()
+	}()
 
-	resp, err := agentClient.Allocate(ctx, &ipamapiv1.AllocateRequest{
+	allocateReq := &ipamapiv2.AllocateRequest{
 		Command:   "ADD",
 		Id:        args.ContainerID,
 		IfName:    args.IfName,
 		Namespace: string(k8sArgs.K8S_POD_NAMESPACE),
 		Name:      string(k8sArgs.K8S_POD_NAME),
 		Uid:       string(k8sArgs.K8S_POD_UID),
+		Network:   pluginConfig.Name,
+		Ips:       pluginConfig.Ips,
+		Ip:        pluginConfig.requestedIP,
+	}
+	resp, err := allocateWithRetry(ctx, agentClient, allocateReq)
+	if err != nil {
+		logger.WithError(err).Error("failed to allocate ip")
+		return err
+	}
+	rb.add("allocate ip", func() error {
+		return releaseOrDefer(pluginConfig, allocateReq)
 	})
+
+	// the maps are not written while the agent replaces them, the lock is held by the rollback too
+	if unlock, err = bpfmap.LockMaps(); err != nil {
+		logger.WithError(err).Error("failed to lock eBPF maps")
+		return err
+	}
+
+	ipamConf, err := newIpamConfig(resp, pluginConfig, args.IfName == ipsv1alpha1.DefaultInterface)
 	if err != nil {
+		logger.WithError(err).Error("failed to parse allocate response")
 		return err
 	}
+	// the mac asked for by the runtime wins over the one of the agent
+	if len(pluginConfig.mac) > 0 {
+		ipamConf.MAC = pluginConfig.mac
+	}
 	logger.WithFields(logrus.Fields{
 		"namespace": string(k8sArgs.K8S_POD_NAMESPACE),
 		"name":      string(k8sArgs.K8S_POD_NAME),
-		"ip":        resp.Ip,
+		"ip":        ipamConf.PodIP.String(),
 	}).Info("allocate ip successfully")
 
-	gwIP := pluginConfig.Gateway
-	if len(gwIP) == 0 {
-		return fmt.Errorf("failed to get gatewa ip, please setting for node")
+	gwIP := ipamConf.Gateway.String()
+	hostGwIP := pluginConfig.Gateway
+	if len(hostGwIP) == 0 {
+		hostGwIP = gwIP
 	}
 
 	// create or get veth_host and veth_net
-	gwPair, netPair, err := createHostVethPair()
+	gwPair, netPair, err := createHostVethPair(ipamConf.NodeMTU)
 	if err != nil {
 		logger.WithError(err).Error("failed to create host veth pair")
 		return err
@@ -328,7 +485,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	// set ip for host pair
-	if err := setIPForHostPair(gwPair, gwIP); err != nil {
+	if err := setIPForHostPair(gwPair, hostGwIP); err != nil {
 		logger.WithError(err).Error("failed to set ip for host pair")
 		return err
 	}
@@ -338,18 +495,36 @@ func cmdAdd(args *skel.CmdArgs) error {
 		logger.WithError(err).Error("failed to get netns")
 		return err
 	}
+	defer netNs.Close()
+
+	// remove the veth pair and local_pod_ips entries left by an interrupted ADD of the pod
+	vethName := podVethName(k8sArgs, args.IfName)
+	if err := teardownPod(args.Netns, args.IfName, []net.IP{ipamConf.PodIP}); err != nil {
+		logger.WithError(err).Error("failed to clean up previous attempt")
+		return err
+	}
 
 	var nsPair, hostPair *netlink.Veth
 	err = netNs.Do(func(hostNs ns.NetNS) error {
 		// create veth pair for netns
-		vethName := util.GenerateVethName(
-			"fast",
-			fmt.Sprintf("%s/%s", string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME)))
-		nsPair, hostPair, err = createNsVethPair(args.IfName, 1450, vethName)
+		var err error
+		nsPair, hostPair, err = createNsVethPair(args.IfName, ipamConf.MTU, vethName)
 		if err != nil {
 			logger.WithError(err).Error("failed to create veth pair")
 			return err
 		}
+		// the host veth and the clsact qdisc with its programs go away with the pair
+		rb.add("create veth pair", func() error {
+			_, _, err := deletePodVeth(args.Netns, args.IfName)
+			return err
+		})
+
+		// set the desired mac for ns pair
+		nsPair, err = setMacForNsPair(nsPair, ipamConf.MAC)
+		if err != nil {
+			logger.WithError(err).Error("failed to set mac for ns pair")
+			return err
+		}
 
 		// host pair connect to host
 		if err := setHostPairIntoHost(hostPair, hostNs); err != nil {
@@ -358,7 +533,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 
 		// set ip for ns pair
-		if err := setIPForNsPair(nsPair, resp.Ip); err != nil {
+		if err := setIPForNsPair(nsPair, ipamConf.IPs); err != nil {
 			logger.WithError(err).Error("failed to set ip for ns pair")
 			return err
 		}
@@ -369,8 +544,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
+		// the rate limits live on the ns pair and go away with it
+		if err := setBandwidth(nsPair, pluginConfig.RuntimeConfig.Bandwidth); err != nil {
+			logger.WithError(err).Error("failed to set bandwidth for ns pair")
+			return err
+		}
+
 		// add arp table for ns pair
-		if err := setFibTableIntoNs(nsPair, gwIP); err != nil {
+		if err := setFibTableIntoNs(nsPair, ipamConf.Gateway, ipamConf.Routes); err != nil {
 			logger.WithError(err).Error("failed to set arp table into ns")
 			return err
 		}
@@ -385,10 +566,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return err
 		}
 
-		if err := setVethPairInfoToLocalIPsMap(hostNs, resp.Ip, hostPair, nsPair); err != nil {
+		if err := setVethPairInfoToLocalIPsMap(hostNs, ipamConf.PodIP, ipamConf.Vni, hostPair, nsPair); err != nil {
 			logger.WithError(err).Error("failed to save pod information for local ips map")
 			return err
 		}
+		hostIfIndex := hostPair.Attrs().Index
+		rb.add("save local ips map", func() error {
+			_, err := deleteLocalIPsMapEntries([]net.IP{ipamConf.PodIP}, hostIfIndex)
+			return err
+		})
 		return nil
 	})
 	if err != nil {
@@ -397,42 +583,99 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// attach bpf for veth ingress
 	if err := attachTcBPFIntoVeth(hostPair); err != nil {
-		logger.WithError(err).Error("failed to attach eBPF program to tc ingress")
+		logger.WithError(err).Error("failed to attach eBPF programs to tc")
+		return err
+	}
+
+	if err := setHostPorts(pluginConfig.RuntimeConfig.PortMappings, ipamConf.PodIP); err != nil {
+		logger.WithError(err).Error("failed to set host ports")
 		return err
 	}
+	rb.add("set host ports", func() error {
+		return deleteHostPorts([]net.IP{ipamConf.PodIP})
+	})
 
-	// crate vxlan
-	vxlan, err := nettools.CreateVxlanAndUp("fast_vxlan")
+	// create the tunnel device, the geneve device is created by the agent with its port
+	tunnel, err := tunnelDevice(nodeInfo().Tunnel)
 	if err != nil {
-		logger.WithError(err).Error("failed to create vxlan and up")
+		logger.WithError(err).Error("failed to create tunnel and up")
+		return err
+	}
+	if err := nettools.EnsureMTU(tunnel.link, ipamConf.NodeMTU); err != nil {
+		logger.WithError(err).Error("failed to set mtu of tunnel")
 		return err
 	}
+	// the wireguard device is created by the agent when the node encrypts
+	if nodeInfo().Encryption == bpfmap.EncryptionWireguard {
+		wg, err := netlink.LinkByName(nettools.WireguardDevName)
+		if err != nil {
+			logger.WithError(err).Error("failed to get wireguard device")
+			return err
+		}
+		if err := nettools.EnsureMTU(wg, ipamConf.NodeMTU); err != nil {
+			logger.WithError(err).Error("failed to set mtu of wireguard")
+			return err
+		}
+	}
 
-	// save vxlan information to local map
-	if err := setVxlanInfoToLocalDevMap(vxlan); err != nil {
-		logger.WithError(err).Error("failed to save vxlan information to local map")
+	// save tunnel information to local map
+	if err := setTunnelInfoToLocalDevMap(tunnel); err != nil {
+		logger.WithError(err).Error("failed to save tunnel information to local map")
 		return err
 	}
 
-	if err := attachTcBPFIntoVxlan(vxlan); err != nil {
-		logger.WithError(err).Error("failed to attach eBPF program to vxlan")
+	if err := attachTcBPFIntoTunnel(tunnel); err != nil {
+		logger.WithError(err).Error("failed to attach eBPF program to tunnel")
 		return err
 	}
 
-	_, podIP, _ := net.ParseCIDR(fmt.Sprintf("%s/32", resp.Ip))
-	result := &current.Result{
-		CNIVersion: pluginConfig.CNIVersion,
-		IPs: []*current.IPConfig{
-			{
-				Address: *podIP,
-				Gateway: net.ParseIP(gwIP),
-			},
-		},
+	// record the attachment for GC
+	attached := &attachment{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Namespace:   string(k8sArgs.K8S_POD_NAMESPACE),
+		Name:        string(k8sArgs.K8S_POD_NAME),
+		UID:         string(k8sArgs.K8S_POD_UID),
+		Network:     pluginConfig.Name,
+		Netns:       args.Netns,
+		HostVeth:    vethName,
+	}
+	for _, ipc := range ipamConf.IPs {
+		attached.IPs = append(attached.IPs, ipc.Address.IP.String())
 	}
+	if err := saveAttachment(attached); err != nil {
+		logger.WithError(err).Error("failed to record attachment")
+		return err
+	}
+	rb.add("record attachment", func() error {
+		return removeAttachment(args.ContainerID, args.IfName)
+	})
+
+	result := ipamConf.result(pluginConfig.CNIVersion, prevResult,
+		&current.Interface{
+			Name: hostPair.Attrs().Name,
+			Mac:  hostPair.Attrs().HardwareAddr.String(),
+			Mtu:  ipamConf.MTU,
+		},
+		&current.Interface{
+			Name:    args.IfName,
+			Mac:     nsPair.Attrs().HardwareAddr.String(),
+			Mtu:     ipamConf.MTU,
+			Sandbox: args.Netns,
+		})
 	return types.PrintResult(result, pluginConfig.CNIVersion)
 }
 
+// cmdDel tears down the pod idempotently: the veth pair, the local_pod_ips entries and the ip.
+// It succeeds when the netns or the veth are already gone, and the release is deferred to the
+// reconciliation of the agent when the agent is unreachable.
 func cmdDel(args *skel.CmdArgs) error {
+	pluginConfig, err := loadConfig(args.StdinData)
+	if err != nil {
+		logger.WithError(err).Error("failed to load plugin config")
+		return err
+	}
+
 	k8sArgs := K8sArgs{}
 	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
 		err := fmt.Errorf("failed to load CNI ENV args: %w", err)
@@ -440,62 +683,168 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
-	//logger.WithFields(logrus.Fields{
-	//	"ContainerID":  args.ContainerID,
-	//	"NetNs":        args.Netns,
-	//	"IfName":       args.IfName,
-	//	"Args":         args.Args,
-	//	"Path":         args.Path,
-	//	"PodNamespace": string(k8sArgs.K8S_POD_NAMESPACE),
-	//	"PodName":      string(k8sArgs.K8S_POD_NAME),
-	//	"PodUid":       string(k8sArgs.K8S_POD_UID),
-	//}).Info("DEL")
-
-	agentClient, conn, err := newAgentClient()
+	logger.WithFields(logrus.Fields{
+		"ContainerID":  args.ContainerID,
+		"NetNs":        args.Netns,
+		"IfName":       args.IfName,
+		"PodNamespace": string(k8sArgs.K8S_POD_NAMESPACE),
+		"PodName":      string(k8sArgs.K8S_POD_NAME),
+		"PodUid":       string(k8sArgs.K8S_POD_UID),
+	}).Info("DEL")
+
+	var prevIPs []net.IP
+	if pluginConfig.PrevResult != nil {
+		if prevResult, err := current.GetResult(pluginConfig.PrevResult); err == nil {
+			for _, ipc := range interfaceIPs(prevResult, args.IfName, args.Netns) {
+				prevIPs = append(prevIPs, ipc.Address.IP)
+			}
+		}
+	}
+	unlock, err := bpfmap.LockMaps()
+	if err != nil {
+		logger.WithError(err).Error("failed to lock eBPF maps")
+		return err
+	}
+	err = teardownPod(args.Netns, args.IfName, prevIPs)
+	unlock()
 	if err != nil {
-		logger.WithError(err).Error("failed to new agent client")
 		return err
 	}
-	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if len(k8sArgs.K8S_POD_NAMESPACE) > 0 && len(k8sArgs.K8S_POD_NAME) > 0 {
+		if err := releaseOrDefer(pluginConfig, &ipamapiv2.AllocateRequest{
+			Command:   "DEL",
+			Id:        args.ContainerID,
+			IfName:    args.IfName,
+			Namespace: string(k8sArgs.K8S_POD_NAMESPACE),
+			Name:      string(k8sArgs.K8S_POD_NAME),
+			Uid:       string(k8sArgs.K8S_POD_UID),
+			Network:   pluginConfig.Name,
+		}); err != nil {
+			return err
+		}
+	}
+	return removeAttachment(args.ContainerID, args.IfName)
+}
 
-	hresp, err := agentClient.Health(ctx, &ipamapiv1.HealthRequest{})
+// cmdCheck verifies the whole setup of the pod: the netns interface with its addresses, routes and
+// bandwidth, the host veth with the veth_ingress program, the local_pod_ips and host_ports entries
+// and the ip endpoint.
+func cmdCheck(args *skel.CmdArgs) error {
+	pluginConfig, err := loadConfig(args.StdinData)
 	if err != nil {
+		logger.WithError(err).Error("failed to load plugin config")
 		return err
 	}
 
-	if !isHealthy(hresp.Health) {
-		return fmt.Errorf("ipam svervice is unhealthy")
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		err := fmt.Errorf("failed to load CNI ENV args: %w", err)
+		logger.WithError(err).Error("get k8s arg error")
+		return err
 	}
 
-	_, err = agentClient.Release(ctx, &ipamapiv1.AllocateRequest{
-		Command:   "DEL",
+	logger.WithFields(logrus.Fields{
+		"ContainerID":  args.ContainerID,
+		"NetNs":        args.Netns,
+		"IfName":       args.IfName,
+		"PodNamespace": string(k8sArgs.K8S_POD_NAMESPACE),
+		"PodName":      string(k8sArgs.K8S_POD_NAME),
+		"PodUid":       string(k8sArgs.K8S_POD_UID),
+	}).Info("CHECK")
+
+	agentClient, conn, err := newAgentClient(pluginConfig)
+	if err != nil {
+		logger.WithError(err).Error("failed to new agent client")
+		return toCNIError(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginConfig.requestTimeout)
+	defer cancel()
+
+	resp, err := agentClient.Check(ctx, &ipamapiv2.AllocateRequest{
+		Command:   "CHECK",
 		Id:        args.ContainerID,
 		IfName:    args.IfName,
 		Namespace: string(k8sArgs.K8S_POD_NAMESPACE),
 		Name:      string(k8sArgs.K8S_POD_NAME),
+		Uid:       string(k8sArgs.K8S_POD_UID),
+		Network:   pluginConfig.Name,
 	})
 	if err != nil {
-		logger.WithError(err).Error("failed to release ip")
+		logger.WithError(err).Error("failed to check ip endpoint")
+		return toCNIError(err)
+	}
+	ipamConf, err := newIpamConfig(resp, pluginConfig, args.IfName == ipsv1alpha1.DefaultInterface)
+	if err != nil {
+		logger.WithError(err).Error("failed to parse check response")
+		return err
+	}
+
+	if pluginConfig.PrevResult != nil {
+		prevResult, err := current.GetResult(pluginConfig.PrevResult)
+		if err != nil {
+			return fmt.Errorf("failed to convert previous result: %w", err)
+		}
+		if err := checkPrevResult(interfaceIPs(prevResult, args.IfName, args.Netns), ipamConf); err != nil {
+			logger.WithError(err).Error("previous result drift")
+			return err
+		}
 	}
 
+	netNs, err := ns.GetNS(args.Netns)
+	if err != nil {
+		logger.WithError(err).Error("failed to get netns")
+		return err
+	}
+	defer netNs.Close()
+
+	err = netNs.Do(func(hostNs ns.NetNS) error {
+		nsVeth, err := checkNsInterface(args.IfName, ipamConf)
+		if err != nil {
+			return err
+		}
+		hostVeth, err := checkHostVeth(hostNs, podVethName(k8sArgs, args.IfName), nsVeth)
+		if err != nil {
+			return err
+		}
+		// the gateway resolves to the host veth
+		gwMAC := hostVeth.Attrs().HardwareAddr.String()
+		if !nettools.ExistArpEntry(ipamConf.Gateway.String(), gwMAC, args.IfName) {
+			return fmt.Errorf("interface %s has no arp entry of gateway %s at %s", args.IfName, ipamConf.Gateway, gwMAC)
+		}
+		if err := checkBandwidth(nsVeth, pluginConfig.RuntimeConfig.Bandwidth); err != nil {
+			return err
+		}
+		return checkLocalIPsMap(ipamConf.PodIP, ipamConf.Vni, hostVeth, nsVeth)
+	})
+	if err == nil {
+		err = checkHostPorts(pluginConfig.RuntimeConfig.PortMappings, ipamConf.PodIP)
+	}
+	if err != nil {
+		logger.WithError(err).Error("pod network drift")
+		return err
+	}
 	return nil
 }
 
-func cmdCheck(args *skel.CmdArgs) error {
-	logger.WithFields(logrus.Fields{
-		"ContainerID": args.ContainerID,
-		"NetNs":       args.Netns,
-		"IfName":      args.IfName,
-		"Args":        args.Args,
-		"Path":        args.Path,
-		"StdinData":   string(args.StdinData),
-	}).Info("CHECK")
-	return nil
+// podVethName returns the name of the host side veth of the interface of the pod, the
+// default interface keeps the name derived from the pod only.
+func podVethName(k8sArgs K8sArgs, ifName string) string {
+	nsAndName := fmt.Sprintf("%s/%s", string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
+	if ifName != ipsv1alpha1.DefaultInterface {
+		nsAndName = fmt.Sprintf("%s/%s", nsAndName, ifName)
+	}
+	return util.GenerateVethName("fast", nsAndName)
 }
 
 func Main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("fast"))
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("fast"))
 }
@@ -0,0 +1,32 @@
+package plugins
+
+// undo reverts a step of ADD
+type undo struct {
+	step string
+	fn   func() error
+}
+
+// rollback records the undo of every step done by ADD, they are run in reverse
+// order when a later step fails so that a retry of ADD starts from a clean node.
+type rollback struct {
+	undos []undo
+}
+
+// add registers the undo of a step which succeeded
+func (r *rollback) add(step string, fn func() error) {
+	r.undos = append(r.undos, undo{step: step, fn: fn})
+}
+
+// run runs the registered undos in reverse order, a failed undo is logged and
+// the others still run.
+func (r *rollback) run() {
+	for i := len(r.undos) - 1; i >= 0; i-- {
+		u := r.undos[i]
+		if err := u.fn(); err != nil {
+			logger.WithError(err).WithField("step", u.step).Error("failed to roll back")
+			continue
+		}
+		logger.WithField("step", u.step).Info("rolled back")
+	}
+	r.undos = nil
+}
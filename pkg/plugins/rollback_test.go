@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRollbackRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		fail  string
+		want  []string
+	}{
+		{name: "case 1", steps: nil, want: nil},
+		{name: "case 2", steps: []string{"allocate ip", "create veth pair", "save local ips map"}, want: []string{"save local ips map", "create veth pair", "allocate ip"}},
+		{name: "case 3", steps: []string{"allocate ip", "create veth pair"}, fail: "create veth pair", want: []string{"create veth pair", "allocate ip"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			rb := &rollback{}
+			for _, step := range tt.steps {
+				step := step
+				rb.add(step, func() error {
+					got = append(got, step)
+					if step == tt.fail {
+						return errors.New("failed")
+					}
+					return nil
+				})
+			}
+			rb.run()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("run() = %v, want %v", got, tt.want)
+			}
+			if len(rb.undos) != 0 {
+				t.Errorf("run() kept %d undos", len(rb.undos))
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package plugins
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// completeRuntimeConfig validates the runtime config and parses the address and mac asked for
+func (c *PluginConf) completeRuntimeConfig() error {
+	rc := &c.RuntimeConfig
+	for _, ip := range rc.IPs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			var err error
+			if parsed, _, err = net.ParseCIDR(ip); err != nil {
+				return fmt.Errorf("invalid runtimeConfig ips %q", ip)
+			}
+		}
+		if parsed.To4() == nil {
+			return fmt.Errorf("invalid runtimeConfig ips %q: only IPv4 is supported", ip)
+		}
+		if len(c.requestedIP) > 0 {
+			return fmt.Errorf("invalid runtimeConfig ips %v: only one address is supported", rc.IPs)
+		}
+		c.requestedIP = parsed.String()
+	}
+
+	if len(rc.Mac) > 0 {
+		mac, err := net.ParseMAC(rc.Mac)
+		if err != nil {
+			return fmt.Errorf("invalid runtimeConfig mac %q: %w", rc.Mac, err)
+		}
+		c.mac = mac
+	}
+
+	for _, m := range rc.PortMappings {
+		if _, err := portMappingProtocol(m.Protocol); err != nil {
+			return err
+		}
+		if m.HostPort <= 0 || m.HostPort > 65535 || m.ContainerPort <= 0 || m.ContainerPort > 65535 {
+			return fmt.Errorf("invalid runtimeConfig portMappings %d:%d: port out of range", m.HostPort, m.ContainerPort)
+		}
+		if len(m.HostIP) > 0 {
+			if ip := net.ParseIP(m.HostIP); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid runtimeConfig portMappings hostIP %q: only IPv4 is supported", m.HostIP)
+			}
+		}
+	}
+
+	if bw := rc.Bandwidth; bw != nil {
+		if (bw.IngressRate > 0) != (bw.IngressBurst > 0) || (bw.EgressRate > 0) != (bw.EgressBurst > 0) {
+			return fmt.Errorf("invalid runtimeConfig bandwidth: a rate and its burst must be set together")
+		}
+	}
+	return nil
+}
+
+// portMappingProtocol returns the ip protocol of the port mapping, it is tcp when empty
+func portMappingProtocol(protocol string) (uint8, error) {
+	switch strings.ToLower(protocol) {
+	case "", "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	}
+	return 0, fmt.Errorf("invalid runtimeConfig portMappings protocol %q: only tcp and udp are supported", protocol)
+}
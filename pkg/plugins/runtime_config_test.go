@@ -0,0 +1,40 @@
+package plugins
+
+import "testing"
+
+func TestPluginConfCompleteRuntimeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		rc      RuntimeConfig
+		wantIP  string
+		wantMac string
+		wantErr bool
+	}{
+		{name: "case 1", rc: RuntimeConfig{}},
+		{name: "case 2", rc: RuntimeConfig{IPs: []string{"10.244.100.10/24"}, Mac: "c2:b0:57:49:47:f1"}, wantIP: "10.244.100.10", wantMac: "c2:b0:57:49:47:f1"},
+		{name: "case 3", rc: RuntimeConfig{IPs: []string{"10.244.100.10", "10.244.100.11"}}, wantErr: true},
+		{name: "case 4", rc: RuntimeConfig{IPs: []string{"fd00::10"}}, wantErr: true},
+		{name: "case 5", rc: RuntimeConfig{Mac: "invalid"}, wantErr: true},
+		{name: "case 6", rc: RuntimeConfig{PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "sctp"}}}, wantErr: true},
+		{name: "case 7", rc: RuntimeConfig{PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "udp", HostIP: "192.168.1.10"}}}},
+		{name: "case 8", rc: RuntimeConfig{Bandwidth: &BandwidthEntry{IngressRate: 1000000}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &PluginConf{RuntimeConfig: tt.rc}
+			err := conf.completeRuntimeConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("completeRuntimeConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if conf.requestedIP != tt.wantIP {
+				t.Errorf("requestedIP = %v, want %v", conf.requestedIP, tt.wantIP)
+			}
+			if conf.mac.String() != tt.wantMac {
+				t.Errorf("mac = %v, want %v", conf.mac, tt.wantMac)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	ipamapiv2 "github.com/fast-io/fast/pkg/api/proto/v2"
+	bpfmap "github.com/fast-io/fast/pkg/bpf/map"
+	"github.com/fast-io/fast/pkg/ipamcache"
+	"github.com/fast-io/fast/pkg/util"
+)
+
+// teardownPod deletes the veth pair of the pod, its local_pod_ips entries and its host ports, the
+// addresses of the pod interface are removed from the maps together with the given addresses.
+// The entries of an address held by the live veth of another sandbox of the pod are kept.
+func teardownPod(netnsPath, ifName string, ips []net.IP) error {
+	podIPs, hostIfIndex, err := deletePodVeth(netnsPath, ifName)
+	if err != nil {
+		logger.WithError(err).Error("failed to delete veth pair")
+		return err
+	}
+	podIPs = append(podIPs, ips...)
+	released, err := deleteLocalIPsMapEntries(podIPs, hostIfIndex)
+	if err != nil {
+		logger.WithError(err).Error("failed to delete pod from local ips map")
+		return err
+	}
+	if err := deleteHostPorts(released); err != nil {
+		logger.WithError(err).Error("failed to delete host ports of pod")
+		return err
+	}
+	return nil
+}
+
+// releaseOrDefer releases the ip of the interface of the pod through the agent, the release
+// is recorded for the reconciliation of the agent when the agent is unreachable.
+func releaseOrDefer(conf *PluginConf, req *ipamapiv2.AllocateRequest) error {
+	err := releaseIP(conf, req)
+	if err == nil {
+		return nil
+	}
+	if !isTransient(err) && status.Code(err) != codes.DeadlineExceeded {
+		logger.WithError(err).Error("failed to release ip")
+		return nil
+	}
+	logger.WithError(err).Warn("failed to release ip, defer it")
+	if err := ipamcache.AddPendingRelease(ipamcache.DefaultPendingReleaseDir, &ipamcache.PendingRelease{
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		UID:       req.Uid,
+		Release: ipamcache.Release{
+			IfName:      req.IfName,
+			Network:     req.Network,
+			ContainerID: req.Id,
+		},
+	}); err != nil {
+		logger.WithError(err).Error("failed to record pending release")
+		return err
+	}
+	return nil
+}
+
+// releaseIP releases the ip of the pod through the agent
+func releaseIP(conf *PluginConf, req *ipamapiv2.AllocateRequest) error {
+	agentClient, conn, err := newAgentClient(conf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.requestTimeout)
+	defer cancel()
+
+	hresp, err := agentClient.Health(ctx, &ipamapiv2.HealthRequest{})
+	if err != nil {
+		return err
+	}
+	if !isHealthy(hresp.Health) {
+		return status.Error(codes.Unavailable, "ipam service is unhealthy")
+	}
+	_, err = agentClient.Release(ctx, req)
+	return err
+}
+
+// deletePodVeth deletes the veth pair of the pod from the netns and returns the ipv4 addresses the
+// pod interface had and the ifindex of its host veth. The host veth, with the clsact qdisc and its
+// programs, goes away with its peer. It is never looked up by name: the name is derived from the
+// pod, it may be the veth of a newer sandbox of the pod, and the pair of a netns which is gone was
+// already removed by the kernel.
+func deletePodVeth(netnsPath, ifName string) ([]net.IP, int, error) {
+	var (
+		podIPs      []net.IP
+		hostIfIndex int
+	)
+	if len(netnsPath) == 0 {
+		return nil, 0, nil
+	}
+	err := ns.WithNetNSPath(netnsPath, func(ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if isLinkNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		if veth, ok := link.(*netlink.Veth); ok {
+			if hostIfIndex, err = netlink.VethPeerIndex(veth); err != nil {
+				return err
+			}
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			podIPs = append(podIPs, addr.IP)
+		}
+		return netlink.LinkDel(link)
+	})
+	if err != nil {
+		var nsErr ns.NSPathNotExistErr
+		if !errors.As(err, &nsErr) {
+			return podIPs, hostIfIndex, err
+		}
+	}
+	return podIPs, hostIfIndex, nil
+}
+
+// deleteLocalIPsMapEntries deletes the local_pod_ips entries of the pod addresses and the
+// entries pointing to the host veth of the pod, it returns the addresses it deleted or which
+// had no entry. The entry of an address pointing to another veth which still exists belongs
+// to another pod and is kept.
+func deleteLocalIPsMapEntries(podIPs []net.IP, hostIfIndex int) ([]net.IP, error) {
+	localIpsMap := bpfmap.GetLocalPodIpsMap()
+	if localIpsMap == nil {
+		return nil, errors.New("failed to load eBPF map local_pod_ips")
+	}
+
+	keys := make(map[bpfmap.LocalIpsMapKey]struct{})
+	for _, ip := range podIPs {
+		if ip.To4() != nil {
+			keys[bpfmap.LocalIpsMapKey{IP: util.InetIpToUInt32(ip.String())}] = struct{}{}
+		}
+	}
+	if hostIfIndex > 0 {
+		var (
+			key  bpfmap.LocalIpsMapKey
+			info bpfmap.LocalIpsMapInfo
+		)
+		iter := localIpsMap.Iterate()
+		for iter.Next(&key, &info) {
+			if info.LxcIfIndex == uint32(hostIfIndex) {
+				keys[key] = struct{}{}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var released []net.IP
+	for key := range keys {
+		ip := net.ParseIP(util.InetUint32ToIp(key.IP))
+		var info bpfmap.LocalIpsMapInfo
+		if err := localIpsMap.Lookup(key, &info); err != nil {
+			released = append(released, ip)
+			continue
+		}
+		// the address may already belong to a new pod on another veth
+		if info.LxcIfIndex != uint32(hostIfIndex) {
+			if _, err := netlink.LinkByIndex(int(info.LxcIfIndex)); err == nil {
+				continue
+			}
+		}
+		if err := localIpsMap.Delete(key); err != nil {
+			return released, err
+		}
+		released = append(released, ip)
+	}
+	return released, nil
+}
+
+func isLinkNotFound(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound)
+}
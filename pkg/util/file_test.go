@@ -0,0 +1,56 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		existing string
+		data     string
+	}{
+		{data: "new"},
+		{existing: "old content", data: "new"},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("case %d", i+1), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "sub", "state.json")
+			if len(tt.existing) > 0 {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := WriteFileAtomic(path, []byte(tt.data), 0600); err != nil {
+				t.Fatalf("WriteFileAtomic() error = %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.data {
+				t.Errorf("WriteFileAtomic() wrote %q, want %q", got, tt.data)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("WriteFileAtomic() mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+			}
+			files, err := os.ReadDir(filepath.Dir(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Errorf("WriteFileAtomic() left %d files, want 1", len(files))
+			}
+		})
+	}
+}
@@ -88,3 +88,13 @@ func ExcludeIPs(allIps []net.IP, excludeIps []net.IP) []net.IP {
 	}
 	return resIps
 }
+
+// GenerateMacByIP returns a locally administered unicast MAC address derived
+// from the IPv4 address, the same IP always gets the same MAC.
+func GenerateMacByIP(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	return net.HardwareAddr{0x0a, 0x58, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
@@ -1,6 +1,9 @@
 package util
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestInetIpToUInt32(t *testing.T) {
 	tests := []struct {
@@ -53,3 +56,29 @@ func TestInetUint32ToIp(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateMacByIP(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{
+			name: "case 1",
+			ip:   "10.244.10.23",
+			want: "0a:58:0a:f4:0a:17",
+		},
+		{
+			name: "ipv6",
+			ip:   "fd00::1",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GenerateMacByIP(net.ParseIP(tt.ip)).String(); got != tt.want {
+				t.Errorf("GenerateMacByIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}